@@ -0,0 +1,169 @@
+// Package authtest runs identity providers for tests: an OpenID provider with discovery, JWKS
+// and a token endpoint, and a SAML IdP that signs responses with a generated certificate.
+package authtest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// OIDCProvider is an OpenID provider on a local test server. It signs ID tokens with Key;
+// codes handed out by IssueCode are redeemed once at its token endpoint, with PKCE.
+type OIDCProvider struct {
+	*httptest.Server
+	Key      *rsa.PrivateKey
+	KeyID    string
+	ClientID string
+
+	mu    sync.Mutex
+	codes map[string]issuedCode
+}
+
+type issuedCode struct {
+	challenge string
+	idToken   string
+}
+
+// NewOIDCProvider starts a provider for one client. Close it when done.
+func NewOIDCProvider(clientID string) *OIDCProvider {
+	p := &OIDCProvider{
+		Key:      NewKey(),
+		KeyID:    "test-key",
+		ClientID: clientID,
+		codes:    map[string]issuedCode{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("/jwks", p.handleJWKS)
+	mux.HandleFunc("/token", p.handleToken)
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// Issuer is the issuer identifier, the server's URL
+func (p *OIDCProvider) Issuer() string {
+	return p.URL
+}
+
+// IDToken signs claims as an ID token for the client, adding iss, aud, iat and exp unless set
+func (p *OIDCProvider) IDToken(claims map[string]any) string {
+	full := map[string]any{
+		"iss": p.Issuer(),
+		"aud": p.ClientID,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range claims {
+		full[k] = v
+	}
+	return SignJWT(p.Key, p.KeyID, full)
+}
+
+// IssueCode returns an authorization code the token endpoint exchanges for idToken, given
+// the verifier of codeChallenge (S256)
+func (p *OIDCProvider) IssueCode(codeChallenge, idToken string) string {
+	code := randomString()
+	p.mu.Lock()
+	p.codes[code] = issuedCode{challenge: codeChallenge, idToken: idToken}
+	p.mu.Unlock()
+	return code
+}
+
+func (p *OIDCProvider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                           p.Issuer(),
+		"authorization_endpoint":           p.URL + "/authorize",
+		"token_endpoint":                   p.URL + "/token",
+		"jwks_uri":                         p.URL + "/jwks",
+		"code_challenge_methods_supported": []string{"S256"},
+	})
+}
+
+func (p *OIDCProvider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	pub := p.Key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": p.KeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *OIDCProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	clientID, _, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+	}
+	if clientID != p.ClientID {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	issued, found := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !found || base64.RawURLEncoding.EncodeToString(sum[:]) != issued.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"id_token":     issued.idToken,
+		"expires_in":   3600,
+	})
+}
+
+// NewKey generates an RSA signing key
+func NewKey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// SignJWT returns claims as a compact RS256 JWS with the key id kid
+func SignJWT(key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
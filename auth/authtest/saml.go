@@ -0,0 +1,193 @@
+package authtest
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+// SAMLIdP is a SAML identity provider with a generated key and self-signed certificate. It
+// serves no HTTP: tests give Metadata to the service provider and post the responses it builds.
+type SAMLIdP struct {
+	EntityID    string
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+
+	idp *saml.IdentityProvider
+}
+
+// NewSAMLIdP creates an IdP whose entity ID is entityID, an absolute URL
+func NewSAMLIdP(entityID string) *SAMLIdP {
+	key := NewKey()
+	cert := NewCertificate(key, "sachi-test-idp")
+	metadataURL, err := url.Parse(entityID)
+	if err != nil {
+		panic(err)
+	}
+	return &SAMLIdP{
+		EntityID:    entityID,
+		Key:         key,
+		Certificate: cert,
+		idp: &saml.IdentityProvider{
+			Key:             key,
+			Certificate:     cert,
+			MetadataURL:     *metadataURL,
+			SSOURL:          *metadataURL.JoinPath("sso"),
+			SignatureMethod: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+		},
+	}
+}
+
+// NewCertificate returns a self-signed certificate for key, valid for a day
+func NewCertificate(key *rsa.PrivateKey, commonName string) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return cert
+}
+
+// SSOURL is where service providers send AuthnRequests
+func (p *SAMLIdP) SSOURL() string {
+	return p.idp.SSOURL.String()
+}
+
+// Metadata returns the IdP's EntityDescriptor
+func (p *SAMLIdP) Metadata() []byte {
+	out, err := xml.Marshal(p.idp.Metadata())
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// ReadAuthnRequest decodes the AuthnRequest of an HTTP-Redirect binding URL and returns it
+// with the RelayState
+func (p *SAMLIdP) ReadAuthnRequest(redirectURL string) (*saml.AuthnRequest, string, error) {
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		return nil, "", err
+	}
+	compressed, err := base64.StdEncoding.DecodeString(u.Query().Get("SAMLRequest"))
+	if err != nil {
+		return nil, "", fmt.Errorf("SAMLRequest is not base64: %v", err)
+	}
+	raw, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		return nil, "", fmt.Errorf("SAMLRequest is not deflated: %v", err)
+	}
+	req := &saml.AuthnRequest{}
+	if err := xml.Unmarshal(raw, req); err != nil {
+		return nil, "", err
+	}
+	return req, u.Query().Get("RelayState"), nil
+}
+
+// SAMLLogin is what a SAML response asserts, and how. The zero values of the optional
+// fields give a valid response.
+type SAMLLogin struct {
+	SPEntityID   string // audience of the assertion
+	ACSURL       string // destination and recipient
+	InResponseTo string // AuthnRequest ID; empty for an IdP-initiated response
+	NameID       string
+	Attributes   map[string]string
+
+	Audience     string    // overrides SPEntityID as the audience
+	Recipient    string    // overrides ACSURL as the recipient
+	NotOnOrAfter time.Time // overrides the end of the validity window
+	Unsigned     bool      // sign neither the response nor the assertion
+}
+
+// Response builds a SAMLResponse for the HTTP-POST binding, base64-encoded as it is posted
+func (p *SAMLIdP) Response(login *SAMLLogin) string {
+	acs := saml.IndexedEndpoint{Binding: saml.HTTPPostBinding, Location: login.ACSURL, Index: 1}
+	sp := &saml.EntityDescriptor{
+		EntityID: login.SPEntityID,
+		SPSSODescriptors: []saml.SPSSODescriptor{{
+			AssertionConsumerServices: []saml.IndexedEndpoint{acs},
+		}},
+	}
+	req := &saml.IdpAuthnRequest{
+		IDP:                     p.idp,
+		HTTPRequest:             httptest.NewRequest("POST", p.SSOURL(), nil),
+		Request:                 saml.AuthnRequest{ID: login.InResponseTo},
+		ServiceProviderMetadata: sp,
+		SPSSODescriptor:         &sp.SPSSODescriptors[0],
+		ACSEndpoint:             &acs,
+		Now:                     saml.TimeNow(),
+	}
+	err := saml.DefaultAssertionMaker{}.MakeAssertion(req, &saml.Session{
+		NameID:       login.NameID,
+		NameIDFormat: "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent",
+		CreateTime:   req.Now,
+		Index:        "1",
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	a := req.Assertion
+	for name, value := range login.Attributes {
+		a.AttributeStatements[0].Attributes = append(a.AttributeStatements[0].Attributes, saml.Attribute{
+			Name:       name,
+			NameFormat: "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
+			Values:     []saml.AttributeValue{{Type: "xs:string", Value: value}},
+		})
+	}
+	if login.Audience != "" {
+		a.Conditions.AudienceRestrictions[0].Audience.Value = login.Audience
+	}
+	if login.Recipient != "" {
+		a.Subject.SubjectConfirmations[0].SubjectConfirmationData.Recipient = login.Recipient
+	}
+	if !login.NotOnOrAfter.IsZero() {
+		a.Conditions.NotOnOrAfter = login.NotOnOrAfter
+		a.Subject.SubjectConfirmations[0].SubjectConfirmationData.NotOnOrAfter = login.NotOnOrAfter
+	}
+
+	if login.Unsigned {
+		response := &saml.Response{
+			Destination:  login.ACSURL,
+			ID:           "id-" + randomString(),
+			InResponseTo: login.InResponseTo,
+			IssueInstant: req.Now,
+			Version:      "2.0",
+			Issuer:       &saml.Issuer{Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity", Value: p.EntityID},
+			Status:       saml.Status{StatusCode: saml.StatusCode{Value: saml.StatusSuccess}},
+		}
+		req.ResponseEl = response.Element()
+		req.ResponseEl.AddChild(a.Element())
+	} else if err := req.MakeResponse(); err != nil {
+		panic(err)
+	}
+
+	form, err := req.PostBinding()
+	if err != nil {
+		panic(err)
+	}
+	return form.SAMLResponse
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// breachedSHA1 lists the SHA-1 of common passwords (the zxcvbn frequency list plus recent
+// top entries), one uppercase hex digest per line, sorted
+//
+//go:embed breached-sha1.txt
+var breachedSHA1 []byte
+
+// sha1HexLen is the length of a hex-encoded SHA-1 digest
+const sha1HexLen = 40
+
+// BreachedPasswords looks passwords up in a sorted list of SHA-1 digests without loading it.
+// The format is the one of the Have I Been Pwned "ordered by hash" download: one
+// "HEX[:COUNT]" entry per line, sorted by digest, so the full multi-gigabyte file can be
+// used directly as an offline replacement for the bundled list.
+type BreachedPasswords struct {
+	r    io.ReaderAt
+	size int64
+}
+
+// DefaultBreachedPasswords returns the bundled list
+func DefaultBreachedPasswords() *BreachedPasswords {
+	return &BreachedPasswords{r: bytes.NewReader(breachedSHA1), size: int64(len(breachedSHA1))}
+}
+
+// OpenBreachedPasswords opens a list file. The file stays open for the life of the process.
+func OpenBreachedPasswords(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	b := &BreachedPasswords{r: f, size: info.Size()}
+	// Catch files in the wrong format at startup rather than on the first registration
+	if b.size > 0 {
+		line, _, err := b.lineAt(0)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, err := hex.DecodeString(digestOf(line)); err != nil || len(digestOf(line)) != sha1HexLen {
+			f.Close()
+			return nil, fmt.Errorf("%s: expected SHA-1 hex digests, one per line", path)
+		}
+	}
+	return b, nil
+}
+
+// Contains reports whether the password appears in the list
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	return b.containsDigest(strings.ToUpper(hex.EncodeToString(sum[:])))
+}
+
+// containsDigest reports whether the uppercase hex digest is listed
+func (b *BreachedPasswords) containsDigest(want string) (bool, error) {
+	// Binary search over byte offsets: each probe reads the first complete line at or
+	// after the midpoint, so lines of any length (with or without counts) work.
+	lo, hi := int64(0), b.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, err := b.lineStart(mid)
+		if err != nil {
+			return false, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+		line, next, err := b.lineAt(start)
+		if err != nil {
+			return false, err
+		}
+		switch got := strings.ToUpper(digestOf(line)); {
+		case got == want:
+			return true, nil
+		case got < want:
+			lo = next
+		default:
+			hi = start
+		}
+	}
+	return false, nil
+}
+
+// lineStart returns the offset of the first line beginning at or after off
+func (b *BreachedPasswords) lineStart(off int64) (int64, error) {
+	if off == 0 {
+		return 0, nil
+	}
+	buf := make([]byte, 128)
+	for pos := off - 1; pos < b.size; pos += int64(len(buf)) {
+		n, err := b.r.ReadAt(buf, pos)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return pos + int64(i) + 1, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+	return b.size, nil
+}
+
+// lineAt reads the line starting at off and returns it with the offset of the next line
+func (b *BreachedPasswords) lineAt(off int64) (string, int64, error) {
+	buf := make([]byte, 128)
+	n, err := b.r.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		return "", 0, err
+	}
+	buf = buf[:n]
+	if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+		return strings.TrimSpace(string(buf[:i])), off + int64(i) + 1, nil
+	}
+	return strings.TrimSpace(string(buf)), off + int64(n), nil
+}
+
+// digestOf strips the optional ":COUNT" suffix of a list entry
+func digestOf(line string) string {
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
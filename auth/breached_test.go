@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeBreachedList writes the SHA-1 of each password as a sorted list file. format turns a
+// digest and its index into a line, for the bare and the "HEX:COUNT" layouts.
+func writeBreachedList(t *testing.T, passwords []string, format func(digest string, i int) string, trailingNewline bool) string {
+	t.Helper()
+	var digests []string
+	for _, pw := range passwords {
+		sum := sha1.Sum([]byte(pw))
+		digests = append(digests, strings.ToUpper(hex.EncodeToString(sum[:])))
+	}
+	sort.Strings(digests)
+	var b strings.Builder
+	for i, d := range digests {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(format(d, i))
+	}
+	if trailingNewline {
+		b.WriteString("\n")
+	}
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBreachedPasswordsFile(t *testing.T) {
+	var listed []string
+	for i := range 500 {
+		listed = append(listed, fmt.Sprintf("listed-%d", i))
+	}
+	formats := map[string]func(string, int) string{
+		"bare":        func(d string, _ int) string { return d },
+		"lowercase":   func(d string, _ int) string { return strings.ToLower(d) },
+		"with counts": func(d string, i int) string { return fmt.Sprintf("%s:%d", d, i*i*7919%100003) }, // lines of varying length
+		"CRLF":        func(d string, i int) string { return d + ":" + fmt.Sprint(i) + "\r" },
+	}
+	for name, format := range formats {
+		for _, trailing := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s, trailing newline %v", name, trailing), func(t *testing.T) {
+				list, err := OpenBreachedPasswords(writeBreachedList(t, listed, format, trailing))
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Every entry is found, which includes the first and the last line
+				for _, pw := range listed {
+					if ok, err := list.Contains(pw); !ok || err != nil {
+						t.Fatalf("%s not found: %v", pw, err)
+					}
+				}
+				for i := range 500 {
+					pw := fmt.Sprintf("unlisted-%d", i)
+					if ok, err := list.Contains(pw); ok || err != nil {
+						t.Fatalf("%s found: %v", pw, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestBreachedPasswordsEdges(t *testing.T) {
+	// The digests of "a" and "b" sort after and before that of "c"
+	one := writeBreachedList(t, []string{"c"}, func(d string, _ int) string { return d }, false)
+	list, err := OpenBreachedPasswords(one)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pw, want := range map[string]bool{"c": true, "a": false, "b": false, "": false} {
+		if ok, err := list.Contains(pw); ok != want || err != nil {
+			t.Errorf("one-entry list: Contains(%q) = %v, %v", pw, ok, err)
+		}
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.txt")
+	os.WriteFile(empty, nil, 0o644)
+	list, err = OpenBreachedPasswords(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := list.Contains("password"); ok || err != nil {
+		t.Errorf("empty list: got %v, %v", ok, err)
+	}
+}
+
+func TestOpenBreachedPasswordsRejects(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"plaintext.txt": "password\n123456\n",
+		"sha256.txt":    strings.Repeat("A", 64) + "\n",
+		"short.txt":     "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD\n",
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0o644)
+		if _, err := OpenBreachedPasswords(path); err == nil {
+			t.Errorf("%s was accepted", name)
+		}
+	}
+	if _, err := OpenBreachedPasswords(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Error("a missing file was accepted")
+	}
+}
+
+func TestDefaultBreachedPasswords(t *testing.T) {
+	lines := bytes.Split(bytes.TrimSpace(breachedSHA1), []byte("\n"))
+	if !sort.SliceIsSorted(lines, func(i, j int) bool { return bytes.Compare(lines[i], lines[j]) < 0 }) {
+		t.Fatal("the bundled list is not sorted")
+	}
+	for i, line := range lines {
+		if len(line) != sha1HexLen || strings.ToUpper(string(line)) != string(line) {
+			t.Fatalf("line %d is %q", i+1, line)
+		}
+	}
+
+	list := DefaultBreachedPasswords()
+	for pw, want := range map[string]bool{"password": true, "123456": true, "qwerty": true, "P@ssw0rd": true, "Tr0ub4dor&3xyz": false} {
+		if ok, err := list.Contains(pw); ok != want || err != nil {
+			t.Errorf("Contains(%q) = %v, %v", pw, ok, err)
+		}
+	}
+
+	// The first and last entries, whose passwords are not known
+	for _, line := range [][]byte{lines[0], lines[len(lines)-1]} {
+		if ok, err := list.containsDigest(string(line)); !ok || err != nil {
+			t.Errorf("%s not found: %v", line, err)
+		}
+	}
+}
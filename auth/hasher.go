@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms
+const (
+	HasherBcrypt   = "bcrypt"
+	HasherArgon2id = "argon2id"
+)
+
+// ErrUnknownHashFormat is returned for stored hashes no configured hasher recognizes
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+// Hasher is one password hashing algorithm. Hashes are self-describing modular crypt strings
+// ("$2a$12$..." for bcrypt, "$argon2id$v=19$m=...,t=...,p=...$salt$key" in the PHC format), so
+// the algorithm, its version and its parameters can be read back from any stored hash.
+type Hasher interface {
+	// Name returns the algorithm identifier
+	Name() string
+	// Hash derives a new encoded hash with a random salt
+	Hash(password string) (string, error)
+	// Identify reports whether the encoded hash belongs to this algorithm
+	Identify(encoded string) bool
+	// Verify checks a password against an encoded hash of this algorithm
+	Verify(encoded, password string) (bool, error)
+	// NeedsRehash reports whether the encoded hash uses weaker parameters than the hasher
+	NeedsRehash(encoded string) bool
+	// MaxPasswordBytes is the longest password the algorithm fully takes into account
+	MaxPasswordBytes() int
+}
+
+// BcryptHasher hashes with bcrypt at a fixed cost
+type BcryptHasher struct {
+	Cost int
+}
+
+// bcryptMaxBytes is the longest input bcrypt hashes
+const bcryptMaxBytes = 72
+
+func (h *BcryptHasher) Name() string { return HasherBcrypt }
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(b), err
+}
+
+func (h *BcryptHasher) Identify(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h *BcryptHasher) Verify(encoded, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < h.Cost
+}
+
+func (h *BcryptHasher) MaxPasswordBytes() int { return bcryptMaxBytes }
+
+// Argon2idHasher hashes with Argon2id (RFC 9106)
+type Argon2idHasher struct {
+	Memory  uint32 // KiB
+	Time    uint32 // passes
+	Threads uint8
+}
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+	// Stored hashes with a shorter salt or key are refused: an empty key would match any password
+	argon2MinSaltLen = 8
+	argon2MinKeyLen  = 16
+	// argon2MaxBytes bounds the work an oversized password can cause; Argon2 itself has no limit
+	argon2MaxBytes = 1024
+)
+
+func (h *Argon2idHasher) Name() string { return HasherArgon2id }
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) Identify(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+// argon2Params is the decoded form of a PHC argon2id string
+type argon2Params struct {
+	version      int
+	memory, time uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+func parseArgon2id(encoded string) (*argon2Params, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != HasherArgon2id {
+		return nil, ErrUnknownHashFormat
+	}
+	p := &argon2Params{}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &p.version); err != nil {
+		return nil, fmt.Errorf("invalid argon2id version: %v", err)
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads)
+	// argon2.IDKey panics on parameters outside these bounds
+	if err != nil || parts[3] != fmt.Sprintf("m=%d,t=%d,p=%d", p.memory, p.time, p.threads) ||
+		p.time < 1 || p.threads < 1 || p.memory < 8*uint32(p.threads) {
+		return nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(p.salt) < argon2MinSaltLen {
+		return nil, errors.New("invalid argon2id salt")
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(p.key) < argon2MinKeyLen {
+		return nil, errors.New("invalid argon2id key")
+	}
+	return p, nil
+}
+
+func (h *Argon2idHasher) Verify(encoded, password string) (bool, error) {
+	p, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	if p.version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2id version %d", p.version)
+	}
+	key := argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	return subtle.ConstantTimeCompare(key, p.key) == 1, nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	p, err := parseArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return p.version != argon2.Version || p.memory < h.Memory || p.time < h.Time || p.threads < h.Threads ||
+		len(p.salt) < argon2SaltLen || len(p.key) < argon2KeyLen
+}
+
+func (h *Argon2idHasher) MaxPasswordBytes() int { return argon2MaxBytes }
+
+// PasswordHashing hashes new passwords with the preferred hasher and verifies stored hashes
+// of any supported algorithm, so the algorithm or its cost can change without a migration:
+// hashes are upgraded as users sign in.
+type PasswordHashing struct {
+	Preferred Hasher
+	Others    []Hasher // algorithms still accepted for existing hashes
+}
+
+// NewPasswordHashing prefers the named algorithm and keeps accepting the others
+func NewPasswordHashing(name string, bcryptCost int, argon *Argon2idHasher) (*PasswordHashing, error) {
+	b := &BcryptHasher{Cost: bcryptCost}
+	switch name {
+	case HasherBcrypt:
+		return &PasswordHashing{Preferred: b, Others: []Hasher{argon}}, nil
+	case HasherArgon2id:
+		return &PasswordHashing{Preferred: argon, Others: []Hasher{b}}, nil
+	}
+	return nil, fmt.Errorf("unknown password hasher %q (want %s or %s)", name, HasherBcrypt, HasherArgon2id)
+}
+
+// Hash hashes a new password with the preferred algorithm
+func (p *PasswordHashing) Hash(password string) (string, error) {
+	return p.Preferred.Hash(password)
+}
+
+// Verify checks a password against a stored hash. rehash is set when the password matched
+// but the hash should be replaced by one from Hash. Accounts without a password never match.
+func (p *PasswordHashing) Verify(encoded, password string) (ok, rehash bool, err error) {
+	if encoded == "" {
+		return false, false, nil
+	}
+	if p.Preferred.Identify(encoded) {
+		ok, err = p.Preferred.Verify(encoded, password)
+		return ok, ok && p.Preferred.NeedsRehash(encoded), err
+	}
+	for _, h := range p.Others {
+		if h.Identify(encoded) {
+			ok, err = h.Verify(encoded, password)
+			return ok, ok, err
+		}
+	}
+	return false, false, ErrUnknownHashFormat
+}
+
+// MaxPasswordBytes is the password length limit of the preferred algorithm
+func (p *PasswordHashing) MaxPasswordBytes() int {
+	return p.Preferred.MaxPasswordBytes()
+}
@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2id is cheap enough for tests
+var testArgon2id = &Argon2idHasher{Memory: 64, Time: 1, Threads: 1}
+
+// argon2idHash encodes a hash of password with the given parameters, salt and key length
+func argon2idHash(password string, m, t uint32, p uint8, salt []byte, keyLen uint32) string {
+	key := argon2.IDKey([]byte(password), salt, t, m, p, keyLen)
+	return fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s", m, t, p,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestArgon2idEncoding(t *testing.T) {
+	encoded, err := testArgon2id.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != "v=19" || parts[3] != "m=64,t=1,p=1" {
+		t.Fatalf("Hash = %s", encoded)
+	}
+	p, err := parseArgon2id(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.salt) != argon2SaltLen || len(p.key) != argon2KeyLen || p.memory != 64 || p.time != 1 || p.threads != 1 {
+		t.Errorf("parsed %+v", p)
+	}
+	// The key is Argon2id over the encoded salt, so the parameters round-trip
+	if want := argon2idHash("correct horse", 64, 1, 1, p.salt, argon2KeyLen); encoded != want {
+		t.Errorf("Hash = %s, want %s", encoded, want)
+	}
+	if other, _ := testArgon2id.Hash("correct horse"); other == encoded {
+		t.Error("two hashes share a salt")
+	}
+
+	for password, want := range map[string]bool{"correct horse": true, "correct horse ": false, "": false, "Correct horse": false} {
+		if ok, err := testArgon2id.Verify(encoded, password); ok != want || err != nil {
+			t.Errorf("Verify(%q) = %v, %v", password, ok, err)
+		}
+	}
+
+	// Hashes made with other parameters verify with their own
+	salt := []byte("0123456789abcdef")
+	for _, encoded := range []string{
+		argon2idHash("pw", 32, 3, 2, salt, 32),
+		argon2idHash("pw", 128, 1, 4, salt, 64),
+		argon2idHash("pw", 64, 1, 1, salt[:8], 16), // the shortest salt and key accepted
+	} {
+		if ok, err := testArgon2id.Verify(encoded, "pw"); !ok || err != nil {
+			t.Errorf("Verify(%s) = %v, %v", encoded, ok, err)
+		}
+	}
+}
+
+func TestArgon2idMalformed(t *testing.T) {
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	key := base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+	tests := map[string]string{
+		"not argon2id":        "$argon2i$v=19$m=64,t=1,p=1$" + salt + "$" + key,
+		"missing key":         "$argon2id$v=19$m=64,t=1,p=1$" + salt,
+		"extra field":         "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + key + "$x",
+		"bad version":         "$argon2id$v=x$m=64,t=1,p=1$" + salt + "$" + key,
+		"other version":       "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key,
+		"params out of order": "$argon2id$v=19$t=1,m=64,p=1$" + salt + "$" + key,
+		"missing param":       "$argon2id$v=19$m=64,t=1$" + salt + "$" + key,
+		"trailing param":      "$argon2id$v=19$m=64,t=1,p=1,k=2$" + salt + "$" + key,
+		"negative memory":     "$argon2id$v=19$m=-64,t=1,p=1$" + salt + "$" + key,
+		"zero passes":         "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key,
+		"zero threads":        "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key,
+		"memory below 8p":     "$argon2id$v=19$m=15,t=1,p=2$" + salt + "$" + key,
+		"threads overflow":    "$argon2id$v=19$m=64,t=1,p=256$" + salt + "$" + key,
+		"salt not base64":     "$argon2id$v=19$m=64,t=1,p=1$!!$" + key,
+		"padded salt":         "$argon2id$v=19$m=64,t=1,p=1$" + salt + "==$" + key,
+		"short salt":          "$argon2id$v=19$m=64,t=1,p=1$" + base64.RawStdEncoding.EncodeToString([]byte("1234567")) + "$" + key,
+		"empty salt":          "$argon2id$v=19$m=64,t=1,p=1$$" + key,
+		"empty key":           "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$",
+		"short key":           "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + base64.RawStdEncoding.EncodeToString(make([]byte, 15)),
+	}
+	for name, encoded := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Never a match, and never a panic inside argon2
+			if ok, err := testArgon2id.Verify(encoded, ""); ok || err == nil {
+				t.Errorf("Verify = %v, %v; want an error", ok, err)
+			}
+			if !testArgon2id.NeedsRehash(encoded) {
+				t.Error("NeedsRehash = false")
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	argon := &Argon2idHasher{Memory: 64, Time: 2, Threads: 2}
+	tests := []struct {
+		encoded string
+		want    bool
+	}{
+		{argon2idHash("pw", 64, 2, 2, salt, 32), false},
+		{argon2idHash("pw", 128, 3, 4, salt, 64), false}, // stronger than configured
+		{argon2idHash("pw", 32, 2, 2, salt, 32), true},
+		{argon2idHash("pw", 64, 1, 2, salt, 32), true},
+		{argon2idHash("pw", 64, 2, 1, salt, 32), true},
+		{argon2idHash("pw", 64, 2, 2, salt[:8], 32), true},
+		{argon2idHash("pw", 64, 2, 2, salt, 16), true},
+	}
+	for _, tt := range tests {
+		if got := argon.NeedsRehash(tt.encoded); got != tt.want {
+			t.Errorf("NeedsRehash(%s) = %v, want %v", tt.encoded, got, tt.want)
+		}
+	}
+
+	b := &BcryptHasher{Cost: 5}
+	for cost, want := range map[int]bool{4: true, 5: false, 6: false} {
+		encoded, _ := bcrypt.GenerateFromPassword([]byte("pw"), cost)
+		if got := b.NeedsRehash(string(encoded)); got != want {
+			t.Errorf("bcrypt cost %d: NeedsRehash = %v, want %v", cost, got, want)
+		}
+	}
+	if !b.NeedsRehash("$2a$xx$garbage") {
+		t.Error("a malformed bcrypt hash does not need a rehash")
+	}
+}
+
+func TestPasswordHashing(t *testing.T) {
+	bcryptOld, _ := (&BcryptHasher{Cost: 4}).Hash("pw")
+	bcryptCurrent, _ := (&BcryptHasher{Cost: 5}).Hash("pw")
+	argonOld := argon2idHash("pw", 32, 1, 1, []byte("0123456789abcdef"), 32)
+	argonCurrent, _ := testArgon2id.Hash("pw")
+
+	preferBcrypt, err := NewPasswordHashing(HasherBcrypt, 5, testArgon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preferArgon, err := NewPasswordHashing(HasherArgon2id, 5, testArgon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		hashing  *PasswordHashing
+		encoded  string
+		password string
+		ok       bool
+		rehash   bool
+	}{
+		{"bcrypt, current cost", preferBcrypt, bcryptCurrent, "pw", true, false},
+		{"bcrypt, lower cost", preferBcrypt, bcryptOld, "pw", true, true},
+		{"bcrypt, wrong password", preferBcrypt, bcryptOld, "wrong", false, false},
+		{"argon2id while preferring bcrypt", preferBcrypt, argonCurrent, "pw", true, true},
+		{"argon2id while preferring bcrypt, wrong password", preferBcrypt, argonCurrent, "wrong", false, false},
+		{"argon2id, current parameters", preferArgon, argonCurrent, "pw", true, false},
+		{"argon2id, weaker parameters", preferArgon, argonOld, "pw", true, true},
+		{"argon2id, wrong password", preferArgon, argonOld, "wrong", false, false},
+		{"bcrypt while preferring argon2id", preferArgon, bcryptCurrent, "pw", true, true},
+		{"bcrypt while preferring argon2id, wrong password", preferArgon, bcryptCurrent, "wrong", false, false},
+		{"no password", preferArgon, "", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash, err := tt.hashing.Verify(tt.encoded, tt.password)
+			if ok != tt.ok || rehash != tt.rehash || err != nil {
+				t.Errorf("Verify = %v, %v, %v; want %v, %v", ok, rehash, err, tt.ok, tt.rehash)
+			}
+		})
+	}
+
+	if _, _, err := preferArgon.Verify("$1$md5crypt$", "pw"); !errors.Is(err, ErrUnknownHashFormat) {
+		t.Errorf("unknown format: got %v", err)
+	}
+	for _, h := range []*PasswordHashing{preferBcrypt, preferArgon} {
+		encoded, err := h.Hash("pw")
+		if err != nil || !h.Preferred.Identify(encoded) {
+			t.Errorf("%s: Hash = %s, %v", h.Preferred.Name(), encoded, err)
+		}
+	}
+	if preferBcrypt.MaxPasswordBytes() != 72 || preferArgon.MaxPasswordBytes() != 1024 {
+		t.Error("MaxPasswordBytes is not the preferred algorithm's")
+	}
+	if _, err := NewPasswordHashing("scrypt", 5, testArgon2id); err == nil {
+		t.Error("an unknown algorithm was accepted")
+	}
+}
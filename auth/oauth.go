@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// HashToken returns the hex SHA-256 of a high-entropy secret (tokens, codes, client
+// secrets) so only digests are stored at rest
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenHashEqual compares a secret against a stored digest in constant time
+func TokenHashEqual(token, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(hash)) == 1
+}
+
+// ParseScope splits a space-delimited scope string into a sorted, de-duplicated list
+func ParseScope(scope string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, s := range strings.Fields(scope) {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ScopeSubset reports whether every scope in requested is present in granted
+func ScopeSubset(requested, granted string) bool {
+	have := map[string]bool{}
+	for _, s := range strings.Fields(granted) {
+		have[s] = true
+	}
+	for _, s := range strings.Fields(requested) {
+		if !have[s] {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidRedirectURI accepts absolute https URIs, or http on loopback hosts for native
+// apps (RFC 8252), without fragments
+func ValidRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		h := u.Hostname()
+		return h == "localhost" || h == "127.0.0.1" || h == "::1"
+	}
+	return false
+}
+
+// CheckPKCE verifies an S256 code verifier against the challenge sent with the authorization request
+func CheckPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(S256Challenge(verifier)), []byte(challenge)) == 1
+}
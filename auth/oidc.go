@@ -0,0 +1,309 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isymbo/sachi/tracing"
+)
+
+// httpClient is used for all calls to identity providers. Its requests are traced under the
+// sign-in that made them and carry the trace context to the provider.
+var httpClient = &http.Client{Timeout: 10 * time.Second, Transport: tracing.Transport(nil)}
+
+const (
+	discoveryTTL   = time.Hour
+	jwksMinRefresh = time.Minute
+	maxIdPResponse = 1 << 20
+)
+
+// OIDCDiscovery is the subset of the provider metadata document we rely on
+type OIDCDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	UserinfoEndpoint      string   `json:"userinfo_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+}
+
+type cachedDiscovery struct {
+	doc     *OIDCDiscovery
+	fetched time.Time
+}
+
+type cachedJWKS struct {
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+var (
+	cacheMu        sync.Mutex
+	discoveryCache = map[string]cachedDiscovery{}
+	jwksCache      = map[string]cachedJWKS{}
+)
+
+// Discover fetches (and caches) the OpenID provider configuration of an issuer
+func Discover(ctx context.Context, issuer string) (*OIDCDiscovery, error) {
+	issuer = strings.TrimRight(issuer, "/")
+	cacheMu.Lock()
+	cached, ok := discoveryCache[issuer]
+	cacheMu.Unlock()
+	if ok && time.Since(cached.fetched) < discoveryTTL {
+		return cached.doc, nil
+	}
+
+	doc := &OIDCDiscovery{}
+	if err := getJSON(ctx, issuer+"/.well-known/openid-configuration", "", doc); err != nil {
+		return nil, fmt.Errorf("discovery failed: %v", err)
+	}
+	if strings.TrimRight(doc.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery issuer mismatch: got %q, want %q", doc.Issuer, issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document for %s is incomplete", issuer)
+	}
+
+	cacheMu.Lock()
+	discoveryCache[issuer] = cachedDiscovery{doc: doc, fetched: time.Now()}
+	cacheMu.Unlock()
+	return doc, nil
+}
+
+// jwksKey returns the key with the given id, refetching the key set when the id is unknown
+// (the IdP rotated keys) but no more often than jwksMinRefresh
+func jwksKey(ctx context.Context, jwksURI, kid string) (crypto.PublicKey, error) {
+	cacheMu.Lock()
+	cached, ok := jwksCache[jwksURI]
+	cacheMu.Unlock()
+
+	if ok {
+		if key, found := pickKey(cached.keys, kid); found {
+			return key, nil
+		}
+		if time.Since(cached.fetched) < jwksMinRefresh {
+			return nil, ErrUnknownKey
+		}
+	}
+
+	var set JWKS
+	if err := getJSON(ctx, jwksURI, "", &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for i := range set.Keys {
+		k := &set.Keys[i]
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	cacheMu.Lock()
+	jwksCache[jwksURI] = cachedJWKS{keys: keys, fetched: time.Now()}
+	cacheMu.Unlock()
+
+	if key, found := pickKey(keys, kid); found {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// pickKey finds a key by id; tokens without kid are accepted only when the set has a single key
+func pickKey(keys map[string]crypto.PublicKey, kid string) (crypto.PublicKey, bool) {
+	if key, ok := keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// OIDCClient is a relying-party configuration for one identity provider
+type OIDCClient struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RedirectURI  string
+}
+
+// AuthCodeURL builds the authorization request for the code flow with PKCE (S256)
+func (c *OIDCClient) AuthCodeURL(d *OIDCDiscovery, state, nonce, codeChallenge string) string {
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.ClientID},
+		"redirect_uri":          {c.RedirectURI},
+		"scope":                 {strings.Join(c.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode()
+}
+
+// OIDCTokens is the token endpoint response
+type OIDCTokens struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Exchange redeems an authorization code at the token endpoint
+func (c *OIDCClient) Exchange(ctx context.Context, d *OIDCDiscovery, code, codeVerifier string) (*OIDCTokens, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.RedirectURI},
+		"code_verifier": {codeVerifier},
+	}
+	if c.ClientSecret == "" {
+		// public client
+		form.Set("client_id", c.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxIdPResponse))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	tokens := &OIDCTokens{}
+	if err := json.Unmarshal(body, tokens); err != nil {
+		return nil, fmt.Errorf("invalid token response: %v", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("token response has no id_token")
+	}
+	return tokens, nil
+}
+
+// VerifyIDToken validates the ID token signature against the IdP's JWKS and checks
+// iss, aud, azp, exp and nonce as required by OpenID Connect Core 3.1.3.7
+func (c *OIDCClient) VerifyIDToken(ctx context.Context, d *OIDCDiscovery, rawIDToken, nonce string) (Claims, error) {
+	claims, err := VerifyJWT(rawIDToken, func(h *JWTHeader) (crypto.PublicKey, error) {
+		return jwksKey(ctx, d.JWKSURI, h.Kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimRight(claims.String("iss"), "/") != strings.TrimRight(c.Issuer, "/") {
+		return nil, fmt.Errorf("id_token issuer mismatch")
+	}
+	aud := claims.Audience()
+	found := false
+	for _, a := range aud {
+		if a == c.ClientID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("id_token audience mismatch")
+	}
+	if len(aud) > 1 && claims.String("azp") != c.ClientID {
+		return nil, fmt.Errorf("id_token authorized party mismatch")
+	}
+	if claims.String("nonce") != nonce {
+		return nil, fmt.Errorf("id_token nonce mismatch")
+	}
+	if claims.String("sub") == "" {
+		return nil, fmt.Errorf("id_token has no subject")
+	}
+	return claims, nil
+}
+
+// UserInfo fetches claims from the userinfo endpoint
+func UserInfo(ctx context.Context, d *OIDCDiscovery, accessToken string) (Claims, error) {
+	if d.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("provider has no userinfo endpoint")
+	}
+	var claims Claims
+	if err := getJSON(ctx, d.UserinfoEndpoint, accessToken, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// NewPKCE returns a random code verifier and its S256 code challenge
+func NewPKCE() (verifier, challenge string) {
+	verifier = RandomToken(32)
+	return verifier, S256Challenge(verifier)
+}
+
+// S256Challenge derives the PKCE S256 code challenge of a verifier
+func S256Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// RandomToken returns n random bytes encoded as unpadded base64url
+func RandomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func getJSON(ctx context.Context, u, bearer string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxIdPResponse)).Decode(v)
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isymbo/sachi/auth/authtest"
+)
+
+func testOIDCClient(p *authtest.OIDCProvider) *OIDCClient {
+	return &OIDCClient{
+		Issuer:       p.Issuer(),
+		ClientID:     p.ClientID,
+		ClientSecret: "secret",
+		Scopes:       []string{"openid", "email"},
+		RedirectURI:  "https://sachi.example.com/api/sso/oidc/callback",
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	p := authtest.NewOIDCProvider("sachi")
+	defer p.Close()
+
+	d, err := Discover(context.Background(), p.Issuer()+"/")
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	if d.TokenEndpoint != p.URL+"/token" || d.JWKSURI != p.URL+"/jwks" {
+		t.Errorf("unexpected endpoints: %+v", d)
+	}
+
+	// A document for another issuer must not be trusted
+	impostor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"issuer":"` + p.Issuer() + `","authorization_endpoint":"x","token_endpoint":"x","jwks_uri":"x"}`))
+	}))
+	defer impostor.Close()
+	if _, err := Discover(context.Background(), impostor.URL); err == nil || !strings.Contains(err.Error(), "issuer mismatch") {
+		t.Errorf("Discover of a mismatched issuer: got %v", err)
+	}
+}
+
+func TestOIDCCodeFlow(t *testing.T) {
+	p := authtest.NewOIDCProvider("sachi")
+	defer p.Close()
+	ctx := context.Background()
+	client := testOIDCClient(p)
+	d, err := Discover(ctx, p.Issuer())
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+
+	verifier, challenge := NewPKCE()
+	u, err := url.Parse(client.AuthCodeURL(d, "state-1", "nonce-1", challenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge") != challenge || q.Get("code_challenge_method") != "S256" || q.Get("nonce") != "nonce-1" || q.Get("state") != "state-1" {
+		t.Errorf("authorization request is missing parameters: %s", u)
+	}
+
+	code := p.IssueCode(challenge, p.IDToken(map[string]any{"sub": "user-1", "nonce": "nonce-1", "email": "ann@example.com"}))
+	tokens, err := client.Exchange(ctx, d, code, verifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	claims, err := client.VerifyIDToken(ctx, d, tokens.IDToken, "nonce-1")
+	if err != nil {
+		t.Fatalf("VerifyIDToken: %v", err)
+	}
+	if claims.String("sub") != "user-1" || claims.String("email") != "ann@example.com" {
+		t.Errorf("unexpected claims: %v", claims)
+	}
+
+	// Codes are single use
+	if _, err := client.Exchange(ctx, d, code, verifier); err == nil {
+		t.Error("a redeemed code was accepted again")
+	}
+}
+
+func TestOIDCExchangeRequiresVerifier(t *testing.T) {
+	p := authtest.NewOIDCProvider("sachi")
+	defer p.Close()
+	ctx := context.Background()
+	client := testOIDCClient(p)
+	d, err := Discover(ctx, p.Issuer())
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+
+	_, challenge := NewPKCE()
+	otherVerifier, _ := NewPKCE()
+	code := p.IssueCode(challenge, p.IDToken(map[string]any{"sub": "user-1", "nonce": "n"}))
+	if _, err := client.Exchange(ctx, d, code, otherVerifier); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("Exchange with the wrong code verifier: got %v", err)
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	p := authtest.NewOIDCProvider("sachi")
+	defer p.Close()
+	ctx := context.Background()
+	client := testOIDCClient(p)
+	d, err := Discover(ctx, p.Issuer())
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+
+	valid := map[string]any{"sub": "user-1", "nonce": "nonce-1"}
+	with := func(k string, v any) map[string]any {
+		m := map[string]any{"sub": "user-1", "nonce": "nonce-1"}
+		m[k] = v
+		return m
+	}
+	unsigned := func(claims map[string]any) string {
+		parts := strings.Split(p.IDToken(claims), ".")
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"` + p.KeyID + `"}`))
+		return header + "." + parts[1] + "."
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"wrong nonce", p.IDToken(with("nonce", "other")), nil},
+		{"wrong audience", p.IDToken(with("aud", "another-client")), nil},
+		{"wrong issuer", p.IDToken(with("iss", "https://idp.example.com")), nil},
+		{"no subject", p.IDToken(with("sub", "")), nil},
+		{"expired", p.IDToken(with("exp", time.Now().Add(-10*time.Minute).Unix())), ErrTokenExpired},
+		{"not yet valid", p.IDToken(with("nbf", time.Now().Add(10*time.Minute).Unix())), ErrTokenNotYetValid},
+		{"signed by another key", authtest.SignJWT(authtest.NewKey(), p.KeyID, valid), ErrInvalidSignature},
+		{"unknown kid", authtest.SignJWT(p.Key, "rotated-away", valid), ErrUnknownKey},
+		{"tampered payload", tamper(p.IDToken(valid)), ErrInvalidSignature},
+		{"alg none", unsigned(valid), ErrUnsupportedAlg},
+		{"malformed", "not-a-jwt", ErrMalformedToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.VerifyIDToken(ctx, d, tt.token, "nonce-1")
+			if err == nil {
+				t.Fatal("token was accepted")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := client.VerifyIDToken(ctx, d, p.IDToken(valid), "nonce-1"); err != nil {
+		t.Errorf("valid token rejected: %v", err)
+	}
+}
+
+// tamper swaps the claims of a signed token for different ones, keeping the signature
+func tamper(token string) string {
+	parts := strings.Split(token, ".")
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","nonce":"nonce-1","exp":9999999999}`))
+	return parts[0] + "." + payload + "." + parts[2]
+}
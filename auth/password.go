@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Password policy rules, reported to clients so forms can point at the failing requirement
+const (
+	RuleMinLength    = "min_length"
+	RuleMaxLength    = "max_length"
+	RuleCharClasses  = "char_classes"
+	RulePersonalInfo = "personal_info"
+	RuleBreached     = "breached"
+	RuleReused       = "reused"
+)
+
+// minPersonalToken is the shortest name or email fragment rejected inside a password
+const minPersonalToken = 3
+
+// PasswordViolation is one unmet policy rule
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicy describes the requirements for new passwords
+type PasswordPolicy struct {
+	MinLength  int                // minimum length in characters
+	MaxLength  int                // maximum length in bytes, usually the hasher's limit; 0 means none
+	MinClasses int                // required number of lowercase, uppercase, digit and symbol classes
+	History    int                // number of previous passwords that may not be reused
+	Breached   *BreachedPasswords // nil disables the breached-password check
+}
+
+// Check validates a new password. personal holds the user's email, name and similar values
+// that must not appear in the password. The error reports a failed breached-list lookup;
+// the violations found so far are still returned.
+func (p *PasswordPolicy) Check(password string, personal ...string) ([]PasswordViolation, error) {
+	var violations []PasswordViolation
+
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		violations = append(violations, PasswordViolation{RuleMinLength,
+			fmt.Sprintf("Must be at least %d characters long", p.MinLength)})
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		violations = append(violations, PasswordViolation{RuleMaxLength,
+			fmt.Sprintf("Must be at most %d bytes long", p.MaxLength)})
+	}
+	if p.MinClasses > 0 && charClasses(password) < p.MinClasses {
+		violations = append(violations, PasswordViolation{RuleCharClasses,
+			fmt.Sprintf("Must mix at least %d of: lowercase letters, uppercase letters, digits, symbols", p.MinClasses)})
+	}
+	if containsPersonalInfo(password, personal) {
+		violations = append(violations, PasswordViolation{RulePersonalInfo,
+			"Must not contain your name or email address"})
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return violations, err
+		}
+		if breached {
+			violations = append(violations, PasswordViolation{RuleBreached,
+				"This password appears in a list of commonly used or breached passwords"})
+		}
+	}
+	return violations, nil
+}
+
+// ReusedViolation is reported by callers that find the password among the user's previous ones
+func (p *PasswordPolicy) ReusedViolation() PasswordViolation {
+	return PasswordViolation{RuleReused,
+		fmt.Sprintf("Must differ from your last %d passwords", p.History)}
+}
+
+// Describe lists the configured requirements for display next to password fields
+func (p *PasswordPolicy) Describe() map[string]any {
+	return map[string]any{
+		"min_length":     p.MinLength,
+		"max_length":     p.MaxLength,
+		"min_classes":    p.MinClasses,
+		"history":        p.History,
+		"breached_check": p.Breached != nil,
+	}
+}
+
+func charClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	n := 0
+	for _, b := range []bool{lower, upper, digit, symbol} {
+		if b {
+			n++
+		}
+	}
+	return n
+}
+
+// containsPersonalInfo checks the password against the words of each value; an email
+// contributes its local part, e.g. "jane.doe@example.com" yields "jane" and "doe"
+func containsPersonalInfo(password string, personal []string) bool {
+	lower := strings.ToLower(password)
+	for _, value := range personal {
+		value = strings.ToLower(value)
+		if at := strings.IndexByte(value, '@'); at >= 0 {
+			if local := value[:at]; len(local) >= minPersonalToken && strings.Contains(lower, local) {
+				return true
+			}
+			value = value[:at]
+		}
+		words := strings.FieldsFunc(value, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, w := range words {
+			if utf8.RuneCountInString(w) >= minPersonalToken && strings.Contains(lower, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// temporaryAlphabet leaves out characters that are easy to misread (0/O, 1/l/I)
+const temporaryAlphabet = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// TemporaryPassword returns a random password for an admin to hand over, such as
+// "Kq7mT-x9PwR-3nHvZ-b8Ld2": groups of five separated by dashes, at least minLength long and
+// containing all four character classes so any policy's class requirement is met
+func TemporaryPassword(minLength int) string {
+	groups := max(4, (minLength+6)/6)
+	for {
+		var b strings.Builder
+		for g := 0; g < groups; g++ {
+			if g > 0 {
+				b.WriteByte('-')
+			}
+			for i := 0; i < 5; i++ {
+				n, err := rand.Int(rand.Reader, big.NewInt(int64(len(temporaryAlphabet))))
+				if err != nil {
+					panic(fmt.Sprintf("crypto/rand failed: %v", err))
+				}
+				b.WriteByte(temporaryAlphabet[n.Int64()])
+			}
+		}
+		if pw := b.String(); charClasses(pw) == 4 {
+			return pw
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// rules returns the rules of the violations, in order
+func rules(violations []PasswordViolation) []string {
+	var out []string
+	for _, v := range violations {
+		out = append(out, v.Rule)
+	}
+	return out
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 10, MaxLength: 72, MinClasses: 3, Breached: DefaultBreachedPasswords()}
+	tests := []struct {
+		password string
+		personal []string
+		want     []string
+	}{
+		{"Tr0ub4dor&3xyz", nil, nil},
+		{"correct horse battery staple", nil, []string{RuleCharClasses}},
+		{"Sh0rt!", nil, []string{RuleMinLength}},
+		{"Sh0rt!abcd", nil, nil}, // exactly the minimum
+		{"Sh0rt!abc", nil, []string{RuleMinLength}},
+		{"Ünïcødé-Ümläut", nil, nil}, // length counts characters, classes include non-ASCII letters
+		{"ÄÖÜäöü12", nil, []string{RuleMinLength}},
+		{strings.Repeat("Ab1", 24), nil, nil}, // 72 bytes
+		{strings.Repeat("Ab1", 24) + "x", nil, []string{RuleMaxLength}},
+		{strings.Repeat("é", 37) + "A1", nil, []string{RuleMaxLength}}, // 76 bytes in 39 characters
+		{"alllowercaseletters", nil, []string{RuleCharClasses}},
+		{"lowercase and 123", nil, nil}, // space is a symbol
+		{"UPPER lower", nil, nil},
+		{"1234567890123", nil, []string{RuleCharClasses}},
+
+		// Personal information: email local part and its words, name words of 3+ characters
+		{"Jane.Doe#2024", []string{"jane.doe@example.com", "Jane Doe"}, []string{RulePersonalInfo}},
+		{"Xx-DOE-2024-xx", []string{"jane.doe@example.com"}, []string{RulePersonalInfo}},
+		{"Xx-example-2024", []string{"jane.doe@example.com"}, nil},  // the domain is not personal
+		{"Al!ce-Wonder9", []string{"al@example.com", "Al Bo"}, nil}, // too short to count
+		{"Ohsmith!Rocks9", []string{"x@example.com", "Anna Smith-Jones"}, []string{RulePersonalInfo}},
+
+		// The bundled breached list
+		{"password", nil, []string{RuleMinLength, RuleCharClasses, RuleBreached}},
+		{"Password123", nil, []string{RuleBreached}},
+		{"Password1234", nil, nil},
+		{"", nil, []string{RuleMinLength, RuleCharClasses}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			violations, err := policy.Check(tt.password, tt.personal...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rules(violations); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyDisabledRules(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 1}
+	for _, pw := range []string{"a", "password", strings.Repeat("a", 1000)} {
+		if violations, err := policy.Check(pw, "a@example.com"); err != nil || len(violations) != 0 {
+			t.Errorf("%.20q: got %v, %v", pw, violations, err)
+		}
+	}
+}
+
+func TestCharClasses(t *testing.T) {
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"", 0},
+		{"abc", 1},
+		{"aB", 2},
+		{"aB3", 3},
+		{"aB3!", 4},
+		{"ß", 1},
+		{"Σ", 1},
+		{"٣", 1}, // Arabic-Indic digit
+		{"漢字", 1},
+		{" \t", 1},
+	}
+	for _, tt := range tests {
+		if got := charClasses(tt.password); got != tt.want {
+			t.Errorf("charClasses(%q) = %d, want %d", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestTemporaryPassword(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 30, MinClasses: 4}
+	for _, minLength := range []int{0, 8, 23, 24, 30, 64} {
+		pw := TemporaryPassword(minLength)
+		if utf8.RuneCountInString(pw) < minLength || len(pw) < 23 {
+			t.Errorf("TemporaryPassword(%d) = %q is too short", minLength, pw)
+		}
+		if strings.ContainsAny(pw, "0O1lI") {
+			t.Errorf("TemporaryPassword(%d) = %q has easily misread characters", minLength, pw)
+		}
+		policy.MinLength = minLength
+		if violations, _ := policy.Check(pw); len(violations) > 0 {
+			t.Errorf("TemporaryPassword(%d) = %q violates %v", minLength, pw, rules(violations))
+		}
+	}
+	if TemporaryPassword(8) == TemporaryPassword(8) {
+		t.Error("two temporary passwords are the same")
+	}
+}
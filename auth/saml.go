@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+// SAML name identifier format for email addresses
+const SAMLEmailNameIDFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+
+// SAMLServiceProvider describes Sachi as a SAML 2.0 service provider for one identity provider
+type SAMLServiceProvider struct {
+	EntityID    string
+	ACSURL      string
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+	IDPMetadata []byte // IdP EntityDescriptor XML; may be empty when only SP metadata is needed
+}
+
+// SAMLAssertion is the verified content of an IdP assertion
+type SAMLAssertion struct {
+	ID           string
+	Issuer       string
+	NameID       string
+	NameIDFormat string
+	Attributes   map[string][]string // keyed by both Name and FriendlyName
+	NotOnOrAfter time.Time
+	InResponseTo string // the AuthnRequest answered; empty for unsolicited responses
+}
+
+// Attr returns the first value of the first attribute found under any of the given names
+func (a *SAMLAssertion) Attr(names ...string) string {
+	for _, n := range names {
+		for k, v := range a.Attributes {
+			if strings.EqualFold(k, n) && len(v) > 0 && v[0] != "" {
+				return v[0]
+			}
+		}
+	}
+	return ""
+}
+
+// ParseSAMLMetadata parses IdP metadata (an EntityDescriptor, or the first IdP in an
+// EntitiesDescriptor) and checks it has a single sign-on service and a signing certificate
+func ParseSAMLMetadata(data []byte) (*saml.EntityDescriptor, error) {
+	entity := &saml.EntityDescriptor{}
+	if err := xml.Unmarshal(data, entity); err != nil {
+		entities := &saml.EntitiesDescriptor{}
+		if err2 := xml.Unmarshal(data, entities); err2 != nil {
+			return nil, fmt.Errorf("invalid metadata: %v", err)
+		}
+		entity = nil
+		for i := range entities.EntityDescriptors {
+			if len(entities.EntityDescriptors[i].IDPSSODescriptors) > 0 {
+				entity = &entities.EntityDescriptors[i]
+				break
+			}
+		}
+		if entity == nil {
+			return nil, errors.New("metadata contains no identity provider")
+		}
+	}
+
+	if len(entity.IDPSSODescriptors) == 0 {
+		return nil, errors.New("metadata contains no IDPSSODescriptor")
+	}
+	hasCert := false
+	for _, d := range entity.IDPSSODescriptors {
+		for _, k := range d.KeyDescriptors {
+			if k.Use != "encryption" && len(k.KeyInfo.X509Data.X509Certificates) > 0 {
+				hasCert = true
+			}
+		}
+	}
+	if !hasCert {
+		return nil, errors.New("metadata contains no signing certificate")
+	}
+	return entity, nil
+}
+
+// FetchSAMLMetadata downloads IdP metadata
+func FetchSAMLMetadata(ctx context.Context, metadataURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %d", metadataURL, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxIdPResponse))
+}
+
+func (p *SAMLServiceProvider) build(allowIDPInitiated bool) (*saml.ServiceProvider, error) {
+	acs, err := url.Parse(p.ACSURL)
+	if err != nil {
+		return nil, err
+	}
+	metadataURL, err := url.Parse(p.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	sp := &saml.ServiceProvider{
+		EntityID:          p.EntityID,
+		Key:               p.Key,
+		Certificate:       p.Certificate,
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acs,
+		AuthnNameIDFormat: saml.UnspecifiedNameIDFormat,
+		AllowIDPInitiated: allowIDPInitiated,
+	}
+	if len(p.IDPMetadata) > 0 {
+		if sp.IDPMetadata, err = ParseSAMLMetadata(p.IDPMetadata); err != nil {
+			return nil, err
+		}
+	}
+	return sp, nil
+}
+
+// Metadata returns the SP metadata document to hand to the IdP administrator
+func (p *SAMLServiceProvider) Metadata() ([]byte, error) {
+	sp, err := p.build(false)
+	if err != nil {
+		return nil, err
+	}
+	out, err := xml.MarshalIndent(sp.Metadata(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+// AuthnRequestURL builds an HTTP-Redirect binding AuthnRequest and returns its ID, which
+// must be remembered to validate InResponseTo in the response
+func (p *SAMLServiceProvider) AuthnRequestURL(relayState string) (string, string, error) {
+	sp, err := p.build(false)
+	if err != nil {
+		return "", "", err
+	}
+	if sp.IDPMetadata == nil {
+		return "", "", errors.New("identity provider metadata is not configured")
+	}
+	location := sp.GetSSOBindingLocation(saml.HTTPRedirectBinding)
+	if location == "" {
+		return "", "", errors.New("identity provider has no HTTP-Redirect single sign-on service")
+	}
+	req, err := sp.MakeAuthenticationRequest(location, saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", "", err
+	}
+	u, err := req.Redirect(url.QueryEscape(relayState), sp)
+	if err != nil {
+		return "", "", err
+	}
+	return u.String(), req.ID, nil
+}
+
+// ParseResponse verifies a base64 SAMLResponse from the POST binding: signatures against
+// the IdP certificates, destination, audience, validity window and, for SP-initiated logins,
+// that it answers one of requestIDs. An empty requestIDs accepts IdP-initiated responses.
+func (p *SAMLServiceProvider) ParseResponse(samlResponse string, requestIDs []string) (*SAMLAssertion, error) {
+	sp, err := p.build(len(requestIDs) == 0)
+	if err != nil {
+		return nil, err
+	}
+	if sp.IDPMetadata == nil {
+		return nil, errors.New("identity provider metadata is not configured")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		return nil, fmt.Errorf("SAMLResponse is not valid base64: %v", err)
+	}
+	assertion, err := sp.ParseXMLResponse(raw, requestIDs, sp.AcsURL)
+	if err != nil {
+		var ire *saml.InvalidResponseError
+		if errors.As(err, &ire) && ire.PrivateErr != nil {
+			return nil, ire.PrivateErr
+		}
+		return nil, err
+	}
+
+	out := &SAMLAssertion{
+		ID:         assertion.ID,
+		Issuer:     assertion.Issuer.Value,
+		Attributes: map[string][]string{},
+	}
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		out.NameID = strings.TrimSpace(assertion.Subject.NameID.Value)
+		out.NameIDFormat = assertion.Subject.NameID.Format
+	}
+	if assertion.Subject != nil {
+		for _, sc := range assertion.Subject.SubjectConfirmations {
+			if sc.SubjectConfirmationData != nil && sc.SubjectConfirmationData.InResponseTo != "" {
+				out.InResponseTo = sc.SubjectConfirmationData.InResponseTo
+				break
+			}
+		}
+	}
+	if assertion.Conditions != nil {
+		out.NotOnOrAfter = assertion.Conditions.NotOnOrAfter
+	}
+	for _, st := range assertion.AttributeStatements {
+		for _, attr := range st.Attributes {
+			var values []string
+			for _, v := range attr.Values {
+				values = append(values, strings.TrimSpace(v.Value))
+			}
+			for _, key := range []string{attr.Name, attr.FriendlyName} {
+				if key != "" {
+					out.Attributes[key] = append(out.Attributes[key], values...)
+				}
+			}
+		}
+	}
+	if out.NameID == "" {
+		return nil, errors.New("assertion has no NameID")
+	}
+	return out, nil
+}
+
+// LoadSAMLKeyPair reads the SP certificate and RSA key from PEM files
+func LoadSAMLKeyPair(certPath, keyPath string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("SAML service provider key must be RSA")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cert, nil
+}
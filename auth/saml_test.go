@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isymbo/sachi/auth/authtest"
+)
+
+const (
+	testSPEntityID = "https://sachi.example.com/api/sso/saml/acme/metadata"
+	testACSURL     = "https://sachi.example.com/api/sso/saml/acme/acs"
+)
+
+func newTestSAMLSP(t *testing.T, idp *authtest.SAMLIdP) *SAMLServiceProvider {
+	t.Helper()
+	key := authtest.NewKey()
+	return &SAMLServiceProvider{
+		EntityID:    testSPEntityID,
+		ACSURL:      testACSURL,
+		Key:         key,
+		Certificate: authtest.NewCertificate(key, "sachi-test-sp"),
+		IDPMetadata: idp.Metadata(),
+	}
+}
+
+func TestParseSAMLMetadata(t *testing.T) {
+	idp := authtest.NewSAMLIdP("https://idp.example.com/metadata")
+	entity, err := ParseSAMLMetadata(idp.Metadata())
+	if err != nil {
+		t.Fatalf("ParseSAMLMetadata: %v", err)
+	}
+	if entity.EntityID != idp.EntityID {
+		t.Errorf("entity ID %q, want %q", entity.EntityID, idp.EntityID)
+	}
+
+	noCert := strings.NewReplacer("<X509Certificate>", "<X509Certificate-not>", "</X509Certificate>", "</X509Certificate-not>").Replace(string(idp.Metadata()))
+	if _, err := ParseSAMLMetadata([]byte(noCert)); err == nil {
+		t.Error("metadata without a signing certificate was accepted")
+	}
+	if _, err := ParseSAMLMetadata([]byte(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="sp"></EntityDescriptor>`)); err == nil {
+		t.Error("metadata without an IdP was accepted")
+	}
+}
+
+// spInitiatedLogin starts a login at the SP and returns the AuthnRequest ID the IdP answers
+func spInitiatedLogin(t *testing.T, sp *SAMLServiceProvider, idp *authtest.SAMLIdP) string {
+	t.Helper()
+	target, requestID, err := sp.AuthnRequestURL("relay-1")
+	if err != nil {
+		t.Fatalf("AuthnRequestURL: %v", err)
+	}
+	if !strings.HasPrefix(target, idp.SSOURL()+"?") {
+		t.Fatalf("AuthnRequest sent to %s, want %s", target, idp.SSOURL())
+	}
+	req, relayState, err := idp.ReadAuthnRequest(target)
+	if err != nil {
+		t.Fatalf("ReadAuthnRequest: %v", err)
+	}
+	if req.ID != requestID || relayState != "relay-1" || req.AssertionConsumerServiceURL != testACSURL {
+		t.Fatalf("unexpected AuthnRequest %+v with RelayState %q", req, relayState)
+	}
+	return requestID
+}
+
+func TestSAMLParseResponse(t *testing.T) {
+	idp := authtest.NewSAMLIdP("https://idp.example.com/metadata")
+	sp := newTestSAMLSP(t, idp)
+	requestID := spInitiatedLogin(t, sp, idp)
+
+	assertion, err := sp.ParseResponse(idp.Response(&authtest.SAMLLogin{
+		SPEntityID:   testSPEntityID,
+		ACSURL:       testACSURL,
+		InResponseTo: requestID,
+		NameID:       "ann@example.com",
+		Attributes:   map[string]string{"email": "ann@example.com", "displayName": "Ann Example"},
+	}), []string{requestID})
+	if err != nil {
+		t.Fatalf("ParseResponse: %v", err)
+	}
+	if assertion.NameID != "ann@example.com" || assertion.Issuer != idp.EntityID || assertion.ID == "" {
+		t.Errorf("unexpected assertion %+v", assertion)
+	}
+	if assertion.Attr("mail", "email") != "ann@example.com" || assertion.Attr("displayName") != "Ann Example" {
+		t.Errorf("unexpected attributes %v", assertion.Attributes)
+	}
+	if !assertion.NotOnOrAfter.After(time.Now()) {
+		t.Errorf("NotOnOrAfter %v is not in the future", assertion.NotOnOrAfter)
+	}
+}
+
+func TestSAMLParseResponseRejects(t *testing.T) {
+	idp := authtest.NewSAMLIdP("https://idp.example.com/metadata")
+	sp := newTestSAMLSP(t, idp)
+	requestID := spInitiatedLogin(t, sp, idp)
+	login := func(change func(l *authtest.SAMLLogin)) string {
+		l := &authtest.SAMLLogin{
+			SPEntityID:   testSPEntityID,
+			ACSURL:       testACSURL,
+			InResponseTo: requestID,
+			NameID:       "ann@example.com",
+		}
+		if change != nil {
+			change(l)
+		}
+		return idp.Response(l)
+	}
+	other := authtest.NewSAMLIdP("https://idp.example.com/metadata")
+
+	tests := []struct {
+		name     string
+		response string
+	}{
+		{"unsigned", login(func(l *authtest.SAMLLogin) { l.Unsigned = true })},
+		{"tampered", tamperSAML(t, login(nil), "ann@example.com", "admin@example.com")},
+		{"signed by another key", other.Response(&authtest.SAMLLogin{
+			SPEntityID: testSPEntityID, ACSURL: testACSURL, InResponseTo: requestID, NameID: "ann@example.com",
+		})},
+		{"wrong audience", login(func(l *authtest.SAMLLogin) { l.Audience = "https://other.example.com/metadata" })},
+		{"wrong recipient", login(func(l *authtest.SAMLLogin) { l.Recipient = "https://other.example.com/acs" })},
+		{"wrong destination", login(func(l *authtest.SAMLLogin) { l.ACSURL = "https://other.example.com/acs" })},
+		{"expired", login(func(l *authtest.SAMLLogin) { l.NotOnOrAfter = time.Now().Add(-10 * time.Minute) })},
+		{"answers another request", login(func(l *authtest.SAMLLogin) { l.InResponseTo = "id-other-request" })},
+		{"unsolicited", login(func(l *authtest.SAMLLogin) { l.InResponseTo = "" })},
+		{"not base64", "<Response/>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if a, err := sp.ParseResponse(tt.response, []string{requestID}); err == nil {
+				t.Errorf("response was accepted: %+v", a)
+			}
+		})
+	}
+}
+
+func TestSAMLParseResponseIdPInitiated(t *testing.T) {
+	idp := authtest.NewSAMLIdP("https://idp.example.com/metadata")
+	sp := newTestSAMLSP(t, idp)
+
+	// Without request IDs the SP accepts unsolicited responses; the caller decides whether
+	// the organization allows them
+	assertion, err := sp.ParseResponse(idp.Response(&authtest.SAMLLogin{
+		SPEntityID: testSPEntityID,
+		ACSURL:     testACSURL,
+		NameID:     "ann@example.com",
+	}), nil)
+	if err != nil {
+		t.Fatalf("ParseResponse: %v", err)
+	}
+	if assertion.NameID != "ann@example.com" {
+		t.Errorf("unexpected assertion %+v", assertion)
+	}
+}
+
+// tamperSAML replaces old with new in the XML of a base64 SAMLResponse
+func tamperSAML(t *testing.T, response, old, new string) string {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), old) {
+		t.Fatalf("response does not contain %q", old)
+	}
+	return base64.StdEncoding.EncodeToString([]byte(strings.ReplaceAll(string(raw), old, new)))
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInitDefaults(t *testing.T) {
+	dir := t.TempDir()
+	a := &CmdArgs{DataDir: dir, DBFile: "sachi.db", BasePath: "analytics/", PublicURL: "https://sachi.example.com/", TraceExporter: "file"}
+	if err := Init(a); err != nil {
+		t.Fatal(err)
+	}
+	checks := []struct {
+		name      string
+		got, want any
+	}{
+		{"database file", a.DBFile, filepath.Join(dir, "sachi.db")},
+		{"base path", a.BasePath, "/analytics"},
+		{"public URL", a.PublicURL, "https://sachi.example.com"},
+		{"trace file", a.TraceFile, filepath.Join(dir, "traces.jsonl")},
+		{"mail sender", a.MailFrom, DefaultMailFrom},
+		{"password length", a.PasswordMinLength, DefaultPasswordMinLength},
+		{"password hasher", a.PasswordHasher, DefaultPasswordHasher},
+		{"bcrypt cost", a.BcryptCost, DefaultBcryptCost},
+		{"argon2id memory", a.Argon2Memory, DefaultArgon2Memory},
+		{"argon2id time", a.Argon2Time, DefaultArgon2Time},
+		{"argon2id threads", a.Argon2Threads, DefaultArgon2Threads},
+		{"mode", a.Mode(), "development"},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+
+	abs := filepath.Join(t.TempDir(), "other.db")
+	a = &CmdArgs{DataDir: dir, DBFile: abs, BasePath: "/", Production: true}
+	if err := Init(a); err != nil {
+		t.Fatal(err)
+	}
+	if a.DBFile != abs || a.BasePath != "" || a.Mode() != "production" {
+		t.Errorf("got database %q, base path %q, mode %s", a.DBFile, a.BasePath, a.Mode())
+	}
+}
+
+func TestInitValidation(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "")
+	tests := []struct {
+		name    string
+		args    CmdArgs
+		wantErr string // empty when the settings are accepted
+	}{
+		// CORS
+		{"development allows any origin", CmdArgs{CORSOrigins: "*"}, ""},
+		{"production refuses any origin", CmdArgs{Production: true, CORSOrigins: "*"}, "wildcard --cors-origins"},
+		{"production refuses a wildcard in the list", CmdArgs{Production: true, CORSOrigins: "https://a.example,*"}, "wildcard --cors-origins"},
+		{"production with listed origins", CmdArgs{Production: true, CORSOrigins: "https://a.example", CORSCredentials: true}, ""},
+		{"credentials with any origin", CmdArgs{CORSOrigins: "*", CORSCredentials: true}, "--cors-credentials requires"},
+
+		// Listeners
+		{"negative body limit", CmdArgs{BodyLimit: -1}, "must not be negative"},
+		{"negative idle timeout", CmdArgs{IdleTimeout: -1}, "must not be negative"},
+		{"certificate without key", CmdArgs{TLSCert: "c.pem"}, "--tls-cert and --tls-key must be given together"},
+		{"key without certificate", CmdArgs{TLSKey: "k.pem"}, "--tls-cert and --tls-key must be given together"},
+		{"redirect without TLS", CmdArgs{HTTPRedirectPort: 8080}, "--http-redirect-port requires"},
+		{"redirect with TLS", CmdArgs{TLSCert: "c.pem", TLSKey: "k.pem", HTTPRedirectPort: 8080}, ""},
+		{"prefork", CmdArgs{Production: true, Prefork: true}, ""},
+		{"prefork with TLS", CmdArgs{Production: true, Prefork: true, TLSCert: "c.pem", TLSKey: "k.pem"}, "--prefork cannot be combined with --tls-cert"},
+		{"prefork with a metrics port", CmdArgs{Production: true, Prefork: true, MetricsAddr: "127.0.0.1:9090"}, "--metrics-addr cannot be combined with --prefork"},
+		{"prefork with a metrics token", CmdArgs{Production: true, Prefork: true, MetricsToken: "secret"}, ""},
+		{"metrics port", CmdArgs{MetricsAddr: ":9090"}, ""},
+		{"metrics address without a port", CmdArgs{MetricsAddr: "127.0.0.1"}, "invalid --metrics-addr"},
+
+		// Tracing
+		{"sample ratio above 1", CmdArgs{TraceSampleRatio: 1.5}, "--trace-sample-ratio"},
+		{"negative sample ratio", CmdArgs{TraceSampleRatio: -0.1}, "--trace-sample-ratio"},
+		{"unknown exporter", CmdArgs{TraceExporter: "jaeger"}, "--trace-exporter"},
+
+		// Proxies and URLs
+		{"trusted proxies", CmdArgs{TrustedProxies: "10.0.0.1, 192.168.0.0/16, ::1"}, ""},
+		{"invalid trusted proxy", CmdArgs{TrustedProxies: "10.0.0.300"}, "invalid trusted proxy IP"},
+		{"invalid trusted CIDR", CmdArgs{TrustedProxies: "10.0.0.0/33"}, "invalid trusted proxy CIDR"},
+		{"relative public URL", CmdArgs{PublicURL: "sachi.example.com"}, "invalid --public-url"},
+		{"public URL with another scheme", CmdArgs{PublicURL: "ftp://sachi.example.com"}, "invalid --public-url"},
+		{"assets directory that does not exist", CmdArgs{AssetsDir: "/nonexistent/assets"}, "--assets-dir"},
+
+		// Passwords and accounts
+		{"negative password length", CmdArgs{PasswordMinLength: -1}, "--password-min-length"},
+		{"five character classes", CmdArgs{PasswordMinClasses: 5}, "--password-min-classes"},
+		{"negative password history", CmdArgs{PasswordHistory: -1}, "--password-history"},
+		{"negative deletion grace", CmdArgs{AccountDeletionGraceDays: -1}, "--account-deletion-grace"},
+		{"unknown hasher", CmdArgs{PasswordHasher: "scrypt"}, "--password-hasher"},
+		{"bcrypt cost too low", CmdArgs{BcryptCost: 3}, "--bcrypt-cost"},
+		{"bcrypt cost too high", CmdArgs{BcryptCost: 32}, "--bcrypt-cost"},
+		{"argon2id", CmdArgs{PasswordHasher: "argon2id", Argon2Memory: 64 * 1024, Argon2Time: 3, Argon2Threads: 4}, ""},
+		{"argon2id memory below 8 KiB per thread", CmdArgs{Argon2Memory: 31, Argon2Threads: 4}, "invalid argon2id parameters"},
+		{"argon2id with too many threads", CmdArgs{Argon2Memory: 64 * 1024, Argon2Threads: 256}, "invalid argon2id parameters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := tt.args
+			a.DataDir = t.TempDir()
+			err := Init(&a)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("refused: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("accepted, want an error containing %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package entry
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/isymbo/sachi/core"
+	"github.com/isymbo/sachi/health"
+)
+
+// defaultHealthcheckURL is the readiness probe of a server started with the default port
+const defaultHealthcheckURL = "http://127.0.0.1:8000/readyz"
+
+// runHealthcheck asks a running server whether it is ready and exits 0 if it is, ok or
+// degraded, and 1 if not. It is the Docker HEALTHCHECK, as the alpine image has no curl.
+func runHealthcheck(args []string) {
+	var url string
+	var timeout time.Duration
+	var insecure bool
+	var f = flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	defaultURL := os.Getenv("SACHI_HEALTHCHECK_URL")
+	if defaultURL == "" {
+		defaultURL = defaultHealthcheckURL
+	}
+	f.StringVar(&url, "url", defaultURL, "probe to query, /readyz or /healthz (default $SACHI_HEALTHCHECK_URL or "+defaultHealthcheckURL+")")
+	f.DurationVar(&timeout, "timeout", 5*time.Second, "give up after this long")
+	f.BoolVar(&insecure, "insecure", false, "skip TLS certificate verification, e.g. for a dev-cert server")
+
+	err := f.Parse(args)
+	if err != nil {
+		fmt.Printf("Error parsing flags: %v\n", err)
+		return
+	}
+
+	if err := healthcheck(url, timeout, insecure); err != nil {
+		fmt.Fprintf(os.Stderr, "unhealthy: %v\n", err)
+		core.RunExitCalls()
+		os.Exit(1)
+	}
+}
+
+// healthcheck queries the probe and prints the overall status and any check that is not ok
+func healthcheck(url string, timeout time.Duration, insecure bool) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	client := &http.Client{Timeout: timeout, Transport: transport}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+
+	var report health.Report
+	if err := json.Unmarshal(body, &report); err != nil || report.Status == "" {
+		return fmt.Errorf("%s: unexpected response from %s", resp.Status, url)
+	}
+	names := make([]string, 0, len(report.Checks))
+	for name := range report.Checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Println(report.Status)
+	for _, name := range names {
+		if r := report.Checks[name]; r.Status != health.StatusOK {
+			fmt.Printf("  %s: %s %s\n", name, r.Status, r.Message)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package entry
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isymbo/sachi/config"
+)
+
+// parseServerFlags parses args the way "sachi web" or "sachi serve" would and runs config.Init
+func parseServerFlags(t *testing.T, production bool, args ...string) (*config.CmdArgs, error) {
+	t.Helper()
+	name := "web"
+	if production {
+		name = "serve"
+	}
+	f, cmdArgs := serverFlags(name, production, flag.ContinueOnError)
+	f.SetOutput(&strings.Builder{})
+	if err := f.Parse(append(args, "--datadir", t.TempDir())); err != nil {
+		return nil, err
+	}
+	return cmdArgs, config.Init(cmdArgs)
+}
+
+func TestServerDefaults(t *testing.T) {
+	t.Setenv("SACHI_METRICS_TOKEN", "")
+	tests := []struct {
+		name       string
+		production bool
+		cors       string
+		timeouts   [3]time.Duration
+		secure     bool
+	}{
+		{"web", false, "*", [3]time.Duration{}, false},
+		{"serve", true, "", [3]time.Duration{15 * time.Second, 30 * time.Second, 2 * time.Minute}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseServerFlags(t, tt.production)
+			if err != nil {
+				t.Fatalf("defaults are refused: %v", err)
+			}
+			if a.Production != tt.production || a.CORSOrigins != tt.cors || a.SecureCookies != tt.secure {
+				t.Errorf("got production %v, CORS origins %q, Secure cookies %v; want %v, %q, %v",
+					a.Production, a.CORSOrigins, a.SecureCookies, tt.production, tt.cors, tt.secure)
+			}
+			if got := [3]time.Duration{a.ReadTimeout, a.WriteTimeout, a.IdleTimeout}; got != tt.timeouts {
+				t.Errorf("got timeouts %v, want %v", got, tt.timeouts)
+			}
+			if a.Prefork || a.MetricsEnabled() || a.BodyLimit != 4<<20 {
+				t.Errorf("got prefork %v, metrics %v, body limit %d", a.Prefork, a.MetricsEnabled(), a.BodyLimit)
+			}
+		})
+	}
+}
+
+func TestServerFlags(t *testing.T) {
+	t.Setenv("SACHI_METRICS_TOKEN", "")
+	tests := []struct {
+		name       string
+		production bool
+		args       []string
+		wantErr    string // empty when the flags are accepted
+	}{
+		{"web allows any origin", false, []string{"--cors-origins", "*"}, ""},
+		{"serve refuses any origin", true, []string{"--cors-origins", "*"}, "wildcard --cors-origins"},
+		{"serve refuses a wildcard in the list", true, []string{"--cors-origins", "https://a.example,*"}, "wildcard --cors-origins"},
+		{"serve accepts listed origins", true, []string{"--cors-origins", "https://a.example"}, ""},
+		{"web has no prefork", false, []string{"--prefork"}, "flag provided but not defined: -prefork"},
+		{"serve prefork", true, []string{"--prefork"}, ""},
+		{"prefork with TLS", true, []string{"--prefork", "--tls-cert", "c.pem", "--tls-key", "k.pem"}, "--prefork cannot be combined with --tls-cert"},
+		{"prefork with a metrics port", true, []string{"--prefork", "--metrics-addr", "127.0.0.1:9090"}, "--metrics-addr cannot be combined with --prefork"},
+		{"prefork with a metrics token", true, []string{"--prefork", "--metrics-token", "secret"}, ""},
+		{"timeouts can be turned off", true, []string{"--read-timeout", "0", "--write-timeout", "0", "--idle-timeout", "0"}, ""},
+		{"negative timeout", true, []string{"--write-timeout", "-1s"}, "must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseServerFlags(t, tt.production, tt.args...)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("refused: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("accepted, want an error containing %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
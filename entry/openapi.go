@@ -0,0 +1,57 @@
+package entry
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/isymbo/sachi/core"
+	"github.com/isymbo/sachi/web"
+)
+
+func printOpenAPIHelp() {
+	fmt.Print(`
+Print or verify the OpenAPI 3 document of the API, which a running server also
+serves at /api/openapi.json and renders at /docs.
+
+Usage:
+  sachi openapi [command]
+
+Commands:
+  print  Write the document to stdout (default)
+  check  Compare the routes the server registers with the document and list every
+         route that is not documented and every operation that is not served;
+         exits 1 when they differ
+`)
+}
+
+func runOpenAPI(args []string) {
+	command := "print"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "print":
+		os.Stdout.Write(web.OpenAPISpec())
+	case "check":
+		problems, err := web.CheckOpenAPI()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			core.RunExitCalls()
+			os.Exit(1)
+		}
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) > 0 {
+			fmt.Fprintf(os.Stderr, "openapi.json does not match the routes: %d problems\n", len(problems))
+			core.RunExitCalls()
+			os.Exit(1)
+		}
+		fmt.Println("openapi.json matches the routes")
+	case "-h", "--help", "help":
+		printOpenAPIHelp()
+	default:
+		fmt.Printf("Unknown openapi command: %s\n", command)
+		printOpenAPIHelp()
+	}
+}
@@ -0,0 +1,646 @@
+package entry
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/isymbo/sachi/auth"
+	"github.com/isymbo/sachi/config"
+	"github.com/isymbo/sachi/core"
+	"github.com/isymbo/sachi/orm"
+	"github.com/isymbo/sachi/storage"
+	"golang.org/x/term"
+)
+
+// Audit actions for changes made from the command line; the names match the admin API
+// and the events carry {"via": "cli"} instead of an actor
+const (
+	auditCLIUserCreate        = "admin.user_create"
+	auditCLIUserDisable       = "admin.user_disable"
+	auditCLIUserEnable        = "admin.user_enable"
+	auditCLIUserPasswordReset = "admin.user_password_reset"
+	auditCLIUserRoleChange    = "admin.user_role_change"
+	auditCLIUserDelete        = "admin.user_delete"
+)
+
+func printUserHelp() {
+	fmt.Print(`
+Manage user accounts directly in the database, e.g. to create the first admin or
+recover a locked-out account. The server does not need to be stopped.
+
+Usage:
+  sachi user <command> [user] [flags]
+
+Commands:
+  create          Create an account (--email, --name, --company, --role, --org)
+  list            List accounts (--q, --role, --status, --org, --sort, --limit, --offset)
+  show            Show one account with its identities and sessions
+  disable         Disable an account and sign it out everywhere
+  enable          Re-enable a disabled account
+  reset-password  Set a new password and sign the user out everywhere
+  set-role        Change the role: sachi user set-role <user> admin|user
+  delete          Delete an account and everything attached to it
+
+<user> is an email address or a numeric id. Every command accepts --datadir, --db
+and --json. Passwords are prompted for on a terminal; otherwise pass
+--password-stdin, or --generate for a temporary password the user must change at
+the next sign-in.
+`)
+}
+
+func runUser(args []string) {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		printUserHelp()
+		return
+	}
+
+	commands := map[string]func([]string) error{
+		"create":         userCreate,
+		"list":           userList,
+		"show":           userShow,
+		"disable":        func(args []string) error { return userSetDisabled("disable", args, true) },
+		"enable":         func(args []string) error { return userSetDisabled("enable", args, false) },
+		"reset-password": userResetPassword,
+		"set-role":       userSetRole,
+		"delete":         userDelete,
+	}
+	run, ok := commands[args[0]]
+	if !ok {
+		fmt.Printf("Unknown user command: %s\n", args[0])
+		printUserHelp()
+		core.RunExitCalls()
+		os.Exit(2)
+	}
+	if err := run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		core.RunExitCalls()
+		os.Exit(1)
+	}
+}
+
+// userCommand holds the flags every user subcommand shares
+type userCommand struct {
+	f       *flag.FlagSet
+	cmdArgs *config.CmdArgs
+	json    bool
+	args    []string // positional arguments
+}
+
+func newUserCommand(name string) *userCommand {
+	u := &userCommand{
+		f:       flag.NewFlagSet("user "+name, flag.ExitOnError),
+		cmdArgs: &config.CmdArgs{},
+	}
+	u.f.StringVar(&u.cmdArgs.DataDir, "datadir", "", "Path to data dir.")
+	u.f.StringVar(&u.cmdArgs.DBFile, "db", "sachi.db", "db file path")
+	u.f.BoolVar(&u.json, "json", false, "print JSON instead of text")
+	return u
+}
+
+// parse reads flags and positional arguments in any order, checks the number of positional
+// arguments and opens the database
+func (u *userCommand) parse(args []string, usage string, positional int) error {
+	for {
+		if err := u.f.Parse(args); err != nil {
+			return err
+		}
+		if u.f.NArg() == 0 {
+			break
+		}
+		u.args = append(u.args, u.f.Arg(0))
+		args = u.f.Args()[1:]
+	}
+	if len(u.args) != positional {
+		return fmt.Errorf("usage: sachi user %s", usage)
+	}
+
+	if err := config.Init(u.cmdArgs); err != nil {
+		return fmt.Errorf("failed to initialize config: %v", err)
+	}
+	if err := orm.Init(u.cmdArgs.DBFile); err != nil {
+		return fmt.Errorf("failed to initialize database: %v", err)
+	}
+	core.AddExitCallback(func() { orm.Close() })
+	return nil
+}
+
+// print writes v as indented JSON when --json is set, otherwise calls text
+func (u *userCommand) print(v any, text func()) error {
+	if !u.json {
+		text()
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// lookupUser finds a user by email or numeric id
+func lookupUser(ref string) (*orm.User, error) {
+	var user *orm.User
+	var err error
+	if id, perr := strconv.ParseInt(ref, 10, 64); perr == nil {
+		user, err = orm.GetUserByID(core.Ctx, id)
+	} else {
+		user, err = orm.GetUserByEmail(core.Ctx, ref)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no user %q", ref)
+	}
+	return user, err
+}
+
+func userStatus(u *orm.User) string {
+	switch {
+	case u.Disabled:
+		return orm.UserStatusDisabled
+	case !u.DeleteAt.IsZero():
+		return orm.UserStatusDeleting
+	}
+	return orm.UserStatusActive
+}
+
+func userJSON(u *orm.User) map[string]any {
+	m := map[string]any{
+		"id":                   u.ID,
+		"name":                 u.Name,
+		"email":                u.Email,
+		"company":              u.Company,
+		"role":                 u.Role,
+		"status":               userStatus(u),
+		"has_password":         u.PasswordHash != "",
+		"must_change_password": u.MustChangePassword,
+		"created_at":           u.CreatedAt,
+		"updated_at":           u.UpdatedAt,
+	}
+	if u.OrgID != 0 {
+		m["org_id"] = u.OrgID
+	}
+	if !u.DeleteAt.IsZero() {
+		m["delete_at"] = u.DeleteAt.UTC()
+	}
+	return m
+}
+
+// recordCLIAudit logs a change made from the command line
+func recordCLIAudit(action, target string, meta map[string]any) {
+	if meta == nil {
+		meta = map[string]any{}
+	}
+	meta["via"] = "cli"
+	if err := orm.InsertAuditEvent(core.Ctx, &orm.AuditEvent{Action: action, Target: target, Metadata: meta}); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write audit event %s: %v\n", action, err)
+	}
+}
+
+// checkLastAdmin refuses to disable, demote or delete the only enabled admin
+func checkLastAdmin(u *orm.User) error {
+	if u.Role != orm.RoleAdmin || u.Disabled || !u.DeleteAt.IsZero() {
+		return nil
+	}
+	n, err := orm.CountAdmins(core.Ctx)
+	if err != nil {
+		return err
+	}
+	if n <= 1 {
+		return fmt.Errorf("%s is the only administrator; make someone else an administrator first", u.Email)
+	}
+	return nil
+}
+
+// passwordSource holds the flags that choose where a new password comes from
+type passwordSource struct {
+	stdin    bool
+	generate bool
+}
+
+func (p *passwordSource) register(u *userCommand) {
+	u.f.BoolVar(&p.stdin, "password-stdin", false, "read the password from the first line of standard input")
+	u.f.BoolVar(&p.generate, "generate", false, "generate a temporary password the user must change at the next sign-in")
+	addPasswordFlags(u.f, u.cmdArgs)
+}
+
+// read returns the new password for a user with the given name and email, checked against the
+// password policy, and its hash. Prompted and piped passwords are the user's own; generated ones
+// are temporary. For an existing user (nil when creating one) the password must also differ from
+// the current and remembered ones, as when the user changes it.
+func (p *passwordSource) read(u *userCommand, user *orm.User, name, email string) (password, hash string, temporary bool, err error) {
+	if p.stdin && p.generate {
+		return "", "", false, errors.New("--password-stdin and --generate cannot be combined")
+	}
+	hashing, err := u.cmdArgs.NewPasswordHashing()
+	if err != nil {
+		return "", "", false, err
+	}
+	policy, err := u.cmdArgs.NewPasswordPolicy(hashing.MaxPasswordBytes())
+	if err != nil {
+		return "", "", false, err
+	}
+	if p.generate {
+		password = auth.TemporaryPassword(policy.MinLength)
+		hash, err = hashing.Hash(password)
+		return password, hash, true, err
+	}
+
+	switch {
+	case p.stdin:
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", "", false, fmt.Errorf("failed to read password: %v", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	case term.IsTerminal(int(os.Stdin.Fd())):
+		password, err = promptPassword("New password: ")
+		if err != nil {
+			return "", "", false, err
+		}
+		again, err := promptPassword("Repeat password: ")
+		if err != nil {
+			return "", "", false, err
+		}
+		if again != password {
+			return "", "", false, errors.New("passwords do not match")
+		}
+	default:
+		return "", "", false, errors.New("no terminal to prompt for a password; use --password-stdin or --generate")
+	}
+
+	violations, err := policy.Check(password, email, name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: breached password lookup failed: %v\n", err)
+	}
+	if user != nil && policy.History > 0 {
+		previous, err := orm.PasswordHistory(core.Ctx, user.ID, policy.History)
+		if err != nil {
+			return "", "", false, err
+		}
+		for _, h := range append([]string{user.PasswordHash}, previous...) {
+			if ok, _, _ := hashing.Verify(h, password); ok {
+				violations = append(violations, policy.ReusedViolation())
+				break
+			}
+		}
+	}
+	if len(violations) > 0 {
+		msgs := make([]string, len(violations))
+		for i, v := range violations {
+			msgs[i] = v.Message
+		}
+		return "", "", false, fmt.Errorf("password does not meet the requirements:\n  %s", strings.Join(msgs, "\n  "))
+	}
+	hash, err = hashing.Hash(password)
+	return password, hash, false, err
+}
+
+func promptPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	b, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %v", err)
+	}
+	return string(b), nil
+}
+
+func userCreate(args []string) error {
+	u := newUserCommand("create")
+	var email, name, company, role, orgSlug string
+	var noPassword bool
+	var source passwordSource
+	u.f.StringVar(&email, "email", "", "email address (required)")
+	u.f.StringVar(&name, "name", "", "full name; defaults to the part of the email before @")
+	u.f.StringVar(&company, "company", "", "company")
+	u.f.StringVar(&role, "role", orm.RoleUser, "role: user or admin")
+	u.f.StringVar(&orgSlug, "org", "", "organization slug")
+	u.f.BoolVar(&noPassword, "no-password", false, "create the account without a password, for single sign-on only")
+	source.register(u)
+	if err := u.parse(args, "create --email EMAIL [--name NAME] [--role admin]", 0); err != nil {
+		return err
+	}
+
+	email = strings.TrimSpace(email)
+	if email == "" || !strings.Contains(email, "@") {
+		return errors.New("--email is required")
+	}
+	if name == "" {
+		name = email[:strings.Index(email, "@")]
+	}
+	if role != orm.RoleUser && role != orm.RoleAdmin {
+		return errors.New("--role must be user or admin")
+	}
+	if _, err := orm.GetUserByEmail(core.Ctx, email); err == nil {
+		return fmt.Errorf("a user with email %s already exists", email)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	var org *orm.Organization
+	if orgSlug != "" {
+		var err error
+		if org, err = orm.GetOrganizationBySlug(core.Ctx, orgSlug); err != nil {
+			return fmt.Errorf("unknown organization %q", orgSlug)
+		}
+	}
+
+	var password, hash string
+	var temporary bool
+	if !noPassword {
+		var err error
+		if password, hash, temporary, err = source.read(u, nil, name, email); err != nil {
+			return err
+		}
+	}
+
+	id, err := orm.CreateUser(core.Ctx, name, email, company, "")
+	if err != nil {
+		return fmt.Errorf("failed to create user: %v", err)
+	}
+	if hash != "" {
+		if temporary {
+			err = orm.ResetUserPassword(core.Ctx, id, hash, 0)
+		} else {
+			err = orm.UpdateUserPassword(core.Ctx, id, hash, 0)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set password: %v", err)
+		}
+	}
+	if role != orm.RoleUser {
+		if err := orm.SetUserRole(core.Ctx, id, role); err != nil {
+			return fmt.Errorf("failed to set role: %v", err)
+		}
+	}
+	if org != nil {
+		if err := orm.SetUserOrganization(core.Ctx, id, org.ID); err != nil {
+			return fmt.Errorf("failed to set organization: %v", err)
+		}
+	}
+	recordCLIAudit(auditCLIUserCreate, email, map[string]any{"user_id": id, "role": role})
+
+	user, err := orm.GetUserByID(core.Ctx, id)
+	if err != nil {
+		return err
+	}
+	out := userJSON(user)
+	if temporary {
+		out["temporary_password"] = password
+	}
+	return u.print(out, func() {
+		fmt.Printf("Created %s %s (id %d)\n", role, email, id)
+		if temporary {
+			fmt.Printf("Temporary password: %s\n", password)
+		}
+	})
+}
+
+func userList(args []string) error {
+	u := newUserCommand("list")
+	var f orm.UserFilter
+	var orgSlug string
+	u.f.StringVar(&f.Query, "q", "", "search name and email")
+	u.f.StringVar(&f.Role, "role", "", "only users with this role")
+	u.f.StringVar(&f.Status, "status", "", "active, disabled or deleting")
+	u.f.StringVar(&orgSlug, "org", "", "only members of this organization")
+	u.f.StringVar(&f.Sort, "sort", "", "name, email, or newest first")
+	u.f.IntVar(&f.Limit, "limit", 0, "show at most this many users, 0 for all")
+	u.f.IntVar(&f.Offset, "offset", 0, "skip this many users")
+	if err := u.parse(args, "list [--q TEXT] [--role ROLE] [--status STATUS]", 0); err != nil {
+		return err
+	}
+	if orgSlug != "" {
+		org, err := orm.GetOrganizationBySlug(core.Ctx, orgSlug)
+		if err != nil {
+			return fmt.Errorf("unknown organization %q", orgSlug)
+		}
+		f.OrgID = org.ID
+	}
+
+	users, total, err := orm.ListUsers(core.Ctx, f)
+	if err != nil {
+		return err
+	}
+	list := make([]map[string]any, 0, len(users))
+	for _, user := range users {
+		list = append(list, userJSON(user))
+	}
+	return u.print(map[string]any{"users": list, "total": total}, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tEMAIL\tNAME\tROLE\tSTATUS\tCREATED")
+		for _, user := range users {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", user.ID, user.Email, user.Name, user.Role, userStatus(user), user.CreatedAt.Format(time.DateOnly))
+		}
+		w.Flush()
+		if len(users) < total {
+			fmt.Printf("%d of %d users\n", len(users), total)
+		}
+	})
+}
+
+func userShow(args []string) error {
+	u := newUserCommand("show")
+	if err := u.parse(args, "show <user>", 1); err != nil {
+		return err
+	}
+	user, err := lookupUser(u.args[0])
+	if err != nil {
+		return err
+	}
+	identities, err := orm.ListUserIdentities(core.Ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	sessions, err := orm.CountUserSessions(core.Ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	var org *orm.Organization
+	if user.OrgID != 0 {
+		org, _ = orm.GetOrganizationByID(core.Ctx, user.OrgID)
+	}
+
+	out := userJSON(user)
+	out["identities"] = identities
+	out["active_sessions"] = sessions
+	if org != nil {
+		out["org"] = org.Slug
+	}
+	return u.print(out, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "ID\t%d\n", user.ID)
+		fmt.Fprintf(w, "Email\t%s\n", user.Email)
+		fmt.Fprintf(w, "Name\t%s\n", user.Name)
+		fmt.Fprintf(w, "Company\t%s\n", user.Company)
+		if org != nil {
+			fmt.Fprintf(w, "Organization\t%s (%s)\n", org.Name, org.Slug)
+		}
+		fmt.Fprintf(w, "Role\t%s\n", user.Role)
+		fmt.Fprintf(w, "Status\t%s\n", userStatus(user))
+		if !user.DeleteAt.IsZero() {
+			fmt.Fprintf(w, "Deletion on\t%s\n", user.DeleteAt.UTC().Format(time.DateOnly))
+		}
+		password := "set"
+		switch {
+		case user.PasswordHash == "":
+			password = "none (single sign-on only)"
+		case user.MustChangePassword:
+			password = "temporary, must be changed at next sign-in"
+		}
+		fmt.Fprintf(w, "Password\t%s\n", password)
+		fmt.Fprintf(w, "Active sessions\t%d\n", sessions)
+		fmt.Fprintf(w, "Created\t%s\n", user.CreatedAt.UTC().Format(time.RFC3339))
+		for _, id := range identities {
+			fmt.Fprintf(w, "Identity\t%s %s %s\n", id.Provider, id.Issuer, id.Email)
+		}
+		w.Flush()
+	})
+}
+
+func userSetDisabled(name string, args []string, disabled bool) error {
+	u := newUserCommand(name)
+	if err := u.parse(args, name+" <user>", 1); err != nil {
+		return err
+	}
+	user, err := lookupUser(u.args[0])
+	if err != nil {
+		return err
+	}
+	if disabled {
+		if err := checkLastAdmin(user); err != nil {
+			return err
+		}
+	}
+	if err := orm.SetUserDisabled(core.Ctx, user.ID, disabled); err != nil {
+		return err
+	}
+	action := auditCLIUserEnable
+	if disabled {
+		action = auditCLIUserDisable
+	}
+	recordCLIAudit(action, user.Email, map[string]any{"user_id": user.ID})
+
+	user.Disabled = disabled
+	return u.print(userJSON(user), func() {
+		fmt.Printf("%s is now %s\n", user.Email, userStatus(user))
+	})
+}
+
+func userResetPassword(args []string) error {
+	u := newUserCommand("reset-password")
+	var source passwordSource
+	source.register(u)
+	if err := u.parse(args, "reset-password <user> [--generate | --password-stdin]", 1); err != nil {
+		return err
+	}
+	user, err := lookupUser(u.args[0])
+	if err != nil {
+		return err
+	}
+	password, hash, temporary, err := source.read(u, user, user.Name, user.Email)
+	if err != nil {
+		return err
+	}
+	if temporary {
+		err = orm.ResetUserPassword(core.Ctx, user.ID, hash, u.cmdArgs.PasswordHistory)
+	} else if err = orm.UpdateUserPassword(core.Ctx, user.ID, hash, u.cmdArgs.PasswordHistory); err == nil {
+		err = orm.SignOutUser(core.Ctx, user.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reset password: %v", err)
+	}
+	recordCLIAudit(auditCLIUserPasswordReset, user.Email, map[string]any{"user_id": user.ID})
+
+	out := map[string]any{"id": user.ID, "email": user.Email}
+	if temporary {
+		out["temporary_password"] = password
+	}
+	return u.print(out, func() {
+		fmt.Printf("Password of %s reset; all sessions were signed out\n", user.Email)
+		if temporary {
+			fmt.Printf("Temporary password: %s\n", password)
+		}
+	})
+}
+
+func userSetRole(args []string) error {
+	u := newUserCommand("set-role")
+	if err := u.parse(args, "set-role <user> admin|user", 2); err != nil {
+		return err
+	}
+	role := u.args[1]
+	if role != orm.RoleUser && role != orm.RoleAdmin {
+		return errors.New("role must be admin or user")
+	}
+	user, err := lookupUser(u.args[0])
+	if err != nil {
+		return err
+	}
+	if user.Role != role {
+		if role != orm.RoleAdmin {
+			if err := checkLastAdmin(user); err != nil {
+				return err
+			}
+		}
+		if err := orm.SetUserRole(core.Ctx, user.ID, role); err != nil {
+			return err
+		}
+		recordCLIAudit(auditCLIUserRoleChange, user.Email, map[string]any{"user_id": user.ID, "from": user.Role, "to": role})
+		user.Role = role
+	}
+	return u.print(userJSON(user), func() {
+		fmt.Printf("%s is now %s\n", user.Email, role)
+	})
+}
+
+func userDelete(args []string) error {
+	u := newUserCommand("delete")
+	var yes bool
+	u.f.BoolVar(&yes, "yes", false, "do not ask for confirmation")
+	u.f.StringVar(&u.cmdArgs.StorageURL, "storage-url", "", "where uploads are kept, as for sachi web; the profile picture is deleted from there")
+	if err := u.parse(args, "delete <user> [--yes]", 1); err != nil {
+		return err
+	}
+	user, err := lookupUser(u.args[0])
+	if err != nil {
+		return err
+	}
+	if err := checkLastAdmin(user); err != nil {
+		return err
+	}
+	if !yes {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return errors.New("confirm with --yes")
+		}
+		fmt.Fprintf(os.Stderr, "This permanently deletes %s and everything attached to the account.\nType the email address to confirm: ", user.Email)
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(line) != user.Email {
+			return errors.New("not confirmed")
+		}
+	}
+
+	if err := orm.DeleteUser(core.Ctx, user.ID); err != nil {
+		return fmt.Errorf("failed to delete user: %v", err)
+	}
+	if user.AvatarKey != "" {
+		blobs, err := storage.New(u.cmdArgs.StorageURL, filepath.Join(u.cmdArgs.DataDir, "blobs"))
+		if err == nil {
+			err = blobs.Delete(user.AvatarKey)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to delete profile picture %s: %v\n", user.AvatarKey, err)
+		}
+	}
+	recordCLIAudit(auditCLIUserDelete, user.Email, map[string]any{"user_id": user.ID})
+
+	return u.print(map[string]any{"id": user.ID, "email": user.Email, "deleted": true}, func() {
+		fmt.Printf("Deleted %s\n", user.Email)
+	})
+}
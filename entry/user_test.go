@@ -0,0 +1,235 @@
+package entry
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/isymbo/sachi/auth"
+	"github.com/isymbo/sachi/orm"
+)
+
+// userCLI runs sachi user commands against one data directory
+type userCLI struct {
+	dir string
+}
+
+func newUserCLI(t *testing.T) *userCLI {
+	t.Cleanup(func() { orm.Close() })
+	return &userCLI{dir: t.TempDir()}
+}
+
+// run runs a user command with stdin as its standard input and returns what it printed.
+// The database stays open afterwards so the test can look at it.
+func (u *userCLI) run(t *testing.T, stdin string, args ...string) (string, error) {
+	t.Helper()
+	orm.Close()
+	commands := map[string]func([]string) error{
+		"create":         userCreate,
+		"list":           userList,
+		"show":           userShow,
+		"disable":        func(args []string) error { return userSetDisabled("disable", args, true) },
+		"enable":         func(args []string) error { return userSetDisabled("enable", args, false) },
+		"reset-password": userResetPassword,
+		"set-role":       userSetRole,
+		"delete":         userDelete,
+	}
+
+	in := filepath.Join(u.dir, "stdin")
+	if err := os.WriteFile(in, []byte(stdin), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stdinFile, err := os.Open(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdinFile.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedIn, savedOut := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdinFile, w
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+
+	err = commands[args[0]](append(args[1:], "--datadir", u.dir))
+	os.Stdin, os.Stdout = savedIn, savedOut
+	w.Close()
+	return <-out, err
+}
+
+// runJSON runs a command with --json and decodes its output
+func (u *userCLI) runJSON(t *testing.T, stdin string, args ...string) map[string]any {
+	t.Helper()
+	out, err := u.run(t, stdin, append(args, "--json")...)
+	if err != nil {
+		t.Fatalf("sachi user %s: %v", strings.Join(args, " "), err)
+	}
+	var m map[string]any
+	if err := json.Unmarshal([]byte(out), &m); err != nil {
+		t.Fatalf("sachi user %s printed %q: %v", strings.Join(args, " "), out, err)
+	}
+	return m
+}
+
+// mustFail checks that a command fails with an error mentioning want
+func (u *userCLI) mustFail(t *testing.T, stdin, want string, args ...string) {
+	t.Helper()
+	if _, err := u.run(t, stdin, args...); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("sachi user %s: got %v, want an error about %q", strings.Join(args, " "), err, want)
+	}
+}
+
+func getUser(t *testing.T, email string) *orm.User {
+	t.Helper()
+	user, err := orm.GetUserByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatalf("%s: %v", email, err)
+	}
+	return user
+}
+
+func checkPassword(t *testing.T, user *orm.User, password string) bool {
+	t.Helper()
+	h := &auth.PasswordHashing{Preferred: &auth.BcryptHasher{Cost: 4}, Others: []auth.Hasher{&auth.Argon2idHasher{}}}
+	ok, _, err := h.Verify(user.PasswordHash, password)
+	return ok && err == nil
+}
+
+func TestUserCreate(t *testing.T) {
+	cli := newUserCLI(t)
+
+	out := cli.runJSON(t, "first admin passphrase\n", "create", "--email", "root@cli.example", "--role", "admin", "--password-stdin", "--bcrypt-cost", "4")
+	if out["role"] != orm.RoleAdmin || out["name"] != "root" || out["has_password"] != true || out["must_change_password"] != false {
+		t.Errorf("created %v", out)
+	}
+	if root := getUser(t, "root@cli.example"); !checkPassword(t, root, "first admin passphrase") {
+		t.Error("the piped password does not verify")
+	}
+	event, _, err := orm.ListAuditEvents(context.Background(), orm.AuditFilter{Action: auditCLIUserCreate, Target: "root@cli.example"})
+	if err != nil || len(event) != 1 || event[0].Metadata["via"] != "cli" || event[0].ActorID != 0 {
+		t.Errorf("audit events %v, %v", event, err)
+	}
+
+	// A generated password is temporary and printed once
+	out = cli.runJSON(t, "", "create", "--email", "temp@cli.example", "--name", "Tem Porary", "--generate", "--bcrypt-cost", "4")
+	password, _ := out["temporary_password"].(string)
+	if password == "" || out["must_change_password"] != true || out["name"] != "Tem Porary" {
+		t.Errorf("created %v", out)
+	}
+	if !checkPassword(t, getUser(t, "temp@cli.example"), password) {
+		t.Error("the temporary password does not verify")
+	}
+
+	out = cli.runJSON(t, "", "create", "--email", "sso@cli.example", "--no-password")
+	if out["has_password"] != false {
+		t.Errorf("created %v", out)
+	}
+
+	cli.mustFail(t, "another passphrase\n", "already exists", "create", "--email", "root@cli.example", "--password-stdin")
+	cli.mustFail(t, "", "--email is required", "create", "--generate")
+	cli.mustFail(t, "", "--role must be", "create", "--email", "x@cli.example", "--role", "owner", "--generate")
+	cli.mustFail(t, "", "unknown organization", "create", "--email", "x@cli.example", "--org", "nope", "--generate")
+	cli.mustFail(t, "short\n", "requirements", "create", "--email", "x@cli.example", "--password-stdin")
+	cli.mustFail(t, "", "cannot be combined", "create", "--email", "x@cli.example", "--password-stdin", "--generate")
+	cli.mustFail(t, "", "no terminal", "create", "--email", "x@cli.example")
+	if _, err := orm.GetUserByEmail(context.Background(), "x@cli.example"); err == nil {
+		t.Error("a failed create left an account behind")
+	}
+}
+
+func TestUserCommands(t *testing.T) {
+	cli := newUserCLI(t)
+	cli.runJSON(t, "", "create", "--email", "admin@cli.example", "--role", "admin", "--generate", "--bcrypt-cost", "4")
+	cli.runJSON(t, "", "create", "--email", "ann@cli.example", "--name", "Ann", "--generate", "--bcrypt-cost", "4")
+	ann := getUser(t, "ann@cli.example")
+
+	if out := cli.runJSON(t, "", "list", "--role", "admin"); out["total"] != float64(1) {
+		t.Errorf("list --role admin: %v", out)
+	}
+	if out := cli.runJSON(t, "", "list", "--q", "ann"); out["total"] != float64(1) {
+		t.Errorf("list --q ann: %v", out)
+	}
+	// Users are found by email or id
+	for _, ref := range []string{"ann@cli.example", "2"} {
+		if out := cli.runJSON(t, "", "show", ref); out["email"] != "ann@cli.example" || out["active_sessions"] != float64(0) {
+			t.Errorf("show %s: %v", ref, out)
+		}
+	}
+	cli.mustFail(t, "", `no user "nobody@cli.example"`, "show", "nobody@cli.example")
+	cli.mustFail(t, "", "usage: sachi user show", "show")
+
+	// The only admin cannot be locked out
+	cli.mustFail(t, "", "only administrator", "set-role", "admin@cli.example", "user")
+	cli.mustFail(t, "", "only administrator", "disable", "admin@cli.example")
+	cli.mustFail(t, "", "only administrator", "delete", "admin@cli.example", "--yes")
+	cli.mustFail(t, "", "role must be", "set-role", "ann@cli.example", "owner")
+
+	if out := cli.runJSON(t, "", "set-role", "ann@cli.example", "admin"); out["role"] != orm.RoleAdmin {
+		t.Errorf("set-role: %v", out)
+	}
+	if out := cli.runJSON(t, "", "set-role", "admin@cli.example", "user"); out["role"] != orm.RoleUser {
+		t.Errorf("set-role with another admin: %v", out)
+	}
+
+	// Disabling signs the user out everywhere
+	ctx := context.Background()
+	if _, err := orm.CreateSession(ctx, ann.ID); err != nil {
+		t.Fatal(err)
+	}
+	cli.runJSON(t, "", "set-role", "admin@cli.example", "admin")
+	if out := cli.runJSON(t, "", "disable", "ann@cli.example"); out["status"] != orm.UserStatusDisabled {
+		t.Errorf("disable: %v", out)
+	}
+	if n, _ := orm.CountUserSessions(ctx, ann.ID); n != 0 {
+		t.Errorf("%d sessions left after disable", n)
+	}
+	if out := cli.runJSON(t, "", "enable", "ann@cli.example"); out["status"] != orm.UserStatusActive {
+		t.Errorf("enable: %v", out)
+	}
+
+	// A reset password is the user's own, and signs them out
+	if _, err := orm.CreateSession(ctx, ann.ID); err != nil {
+		t.Fatal(err)
+	}
+	cli.runJSON(t, "a brand new passphrase\n", "reset-password", "ann@cli.example", "--password-stdin", "--bcrypt-cost", "4")
+	ann = getUser(t, "ann@cli.example")
+	if !checkPassword(t, ann, "a brand new passphrase") || ann.MustChangePassword {
+		t.Error("reset password does not verify, or is marked temporary")
+	}
+	if n, _ := orm.CountUserSessions(ctx, ann.ID); n != 0 {
+		t.Errorf("%d sessions left after the reset", n)
+	}
+	cli.mustFail(t, "a brand new passphrase\n", "requirements", "reset-password", "ann@cli.example", "--password-stdin")
+
+	// Deleting needs confirmation
+	cli.mustFail(t, "", "confirm with --yes", "delete", "ann@cli.example")
+	if out := cli.runJSON(t, "", "delete", "ann@cli.example", "--yes"); out["deleted"] != true {
+		t.Errorf("delete: %v", out)
+	}
+	if _, err := orm.GetUserByID(ctx, ann.ID); err == nil {
+		t.Error("deleted account still exists")
+	}
+
+	events, _, err := orm.ListAuditEvents(ctx, orm.AuditFilter{Action: "admin.user_*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for i := len(events) - 1; i >= 0; i-- {
+		actions = append(actions, events[i].Action)
+	}
+	want := []string{auditCLIUserCreate, auditCLIUserCreate, auditCLIUserRoleChange, auditCLIUserRoleChange, auditCLIUserRoleChange,
+		auditCLIUserDisable, auditCLIUserEnable, auditCLIUserPasswordReset, auditCLIUserDelete}
+	if strings.Join(actions, " ") != strings.Join(want, " ") {
+		t.Errorf("audit events\n got %v\nwant %v", actions, want)
+	}
+}
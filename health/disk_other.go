@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package health
+
+// DiskSpace is not implemented on this platform
+func DiskSpace(path string) (free, total uint64, err error) {
+	return 0, 0, ErrDiskSpaceUnsupported
+}
@@ -0,0 +1,104 @@
+// Package health runs readiness checks concurrently, each with a deadline, and combines
+// their results into one report for probes and the healthcheck command.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Status of a check or of the whole report
+type Status string
+
+const (
+	StatusOK       Status = "ok"
+	StatusDegraded Status = "degraded" // still serving, but someone should look
+	StatusDown     Status = "down"     // not able to serve; the instance should get no traffic
+)
+
+// worse reports whether a is a worse status than b
+func worse(a, b Status) bool {
+	rank := map[Status]int{StatusOK: 0, StatusDegraded: 1, StatusDown: 2}
+	return rank[a] > rank[b]
+}
+
+// ErrDiskSpaceUnsupported is returned by DiskSpace where free space cannot be read
+var ErrDiskSpaceUnsupported = errors.New("disk space is not available on this platform")
+
+// Result is the outcome of one check
+type Result struct {
+	Status    Status         `json:"status"`
+	Message   string         `json:"message,omitempty"`
+	LatencyMS float64        `json:"latency_ms"`
+	Details   map[string]any `json:"details,omitempty"`
+}
+
+// OK, Degraded and Down build results for check functions
+func OK() Result { return Result{Status: StatusOK} }
+
+func Degraded(format string, args ...any) Result {
+	return Result{Status: StatusDegraded, Message: fmt.Sprintf(format, args...)}
+}
+
+func Down(format string, args ...any) Result {
+	return Result{Status: StatusDown, Message: fmt.Sprintf(format, args...)}
+}
+
+// With adds a detail to the result, e.g. the free disk space
+func (r Result) With(key string, value any) Result {
+	if r.Details == nil {
+		r.Details = map[string]any{}
+	}
+	r.Details[key] = value
+	return r
+}
+
+// Check is one named readiness condition. Run must return once ctx is done.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) Result
+}
+
+// Report is the combined result: the worst status of any check
+type Report struct {
+	Status Status            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Run runs the checks concurrently. A check still busy after timeout is reported down.
+func Run(ctx context.Context, timeout time.Duration, checks []Check) Report {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(checks))}
+	for _, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			done := make(chan Result, 1)
+			go func() { done <- c.Run(ctx) }()
+			var r Result
+			select {
+			case r = <-done:
+			case <-ctx.Done():
+				r = Down("timed out after %s", timeout)
+			}
+			r.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[c.Name] = r
+			if worse(r.Status, report.Status) {
+				report.Status = r.Status
+			}
+		}()
+	}
+	wg.Wait()
+	return report
+}
@@ -0,0 +1,191 @@
+// Package jobs runs periodic background work, such as purging expired rows, on one
+// goroutine and reports each run to the metrics registry and as the root span of a trace.
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/isymbo/sachi/metrics"
+	"github.com/isymbo/sachi/tracing"
+)
+
+// tick is the longest the scheduler sleeps, so its heartbeat stays fresh between long intervals
+const tick = 30 * time.Second
+
+// StaleAfter is how old the heartbeat of a working scheduler can get while it is idle
+const StaleAfter = 3 * tick
+
+var (
+	jobRuns = metrics.NewCounter("sachi_job_runs_total",
+		"Background job runs by job and result (success or error).", "job", "result")
+	jobDuration = metrics.NewHistogram("sachi_job_duration_seconds",
+		"Background job run time.", []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300}, "job")
+	jobLastSuccess = metrics.NewGauge("sachi_job_last_success_timestamp_seconds",
+		"Unix time of the last successful run of each background job.", "job")
+	schedulerHeartbeat = metrics.NewGauge("sachi_job_scheduler_heartbeat_timestamp_seconds",
+		"Unix time the job scheduler last woke up.")
+)
+
+// job is a registered function and the state of its last run
+type job struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+	next     time.Time
+
+	lastRun     time.Time
+	lastSuccess time.Time
+	lastErr     error
+}
+
+// Scheduler runs registered jobs one after another, each first when the scheduler starts
+// and then every interval. A run that is still busy delays the others rather than overlapping.
+type Scheduler struct {
+	mu        sync.Mutex
+	jobs      []*job
+	heartbeat time.Time
+	running   *job
+	runStart  time.Time
+}
+
+// JobStatus is how a job last went
+type JobStatus struct {
+	Name        string
+	LastRun     time.Time // zero until the first run has finished
+	LastSuccess time.Time
+	LastError   string // of the last run, "" when it succeeded
+}
+
+// Status is a snapshot of the scheduler for health checks
+type Status struct {
+	Heartbeat    time.Time // when the scheduler last woke up; zero before Start
+	Running      string    // job running now, if any
+	RunningSince time.Time
+	Jobs         []JobStatus
+}
+
+// New returns an empty scheduler
+func New() *Scheduler {
+	return &Scheduler{}
+}
+
+// Add registers fn to run every interval under name, which labels its logs and metrics
+func (s *Scheduler) Add(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, &job{name: name, interval: interval, run: fn})
+}
+
+// Status reports when the scheduler last woke up and how every job last went
+func (s *Scheduler) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := Status{Heartbeat: s.heartbeat, Jobs: make([]JobStatus, 0, len(s.jobs))}
+	if s.running != nil {
+		st.Running, st.RunningSince = s.running.name, s.runStart
+	}
+	for _, j := range s.jobs {
+		js := JobStatus{Name: j.name, LastRun: j.lastRun, LastSuccess: j.lastSuccess}
+		if j.lastErr != nil {
+			js.LastError = j.lastErr.Error()
+		}
+		st.Jobs = append(st.Jobs, js)
+	}
+	return st
+}
+
+// Start runs the jobs in the background until ctx is done
+func (s *Scheduler) Start(ctx context.Context) {
+	go s.loop(ctx)
+}
+
+func (s *Scheduler) loop(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		s.mu.Lock()
+		s.heartbeat = now
+		due := []*job{}
+		for _, j := range s.jobs {
+			if !j.next.After(now) {
+				due = append(due, j)
+			}
+		}
+		s.mu.Unlock()
+		schedulerHeartbeat.Set(float64(now.Unix()))
+
+		for _, j := range due {
+			if ctx.Err() != nil {
+				return
+			}
+			s.runJob(ctx, j)
+		}
+		timer.Reset(s.sleep())
+	}
+}
+
+// sleep returns how long until the next job is due, at most tick
+func (s *Scheduler) sleep() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := tick
+	for _, j := range s.jobs {
+		if until := time.Until(j.next); until < d {
+			d = until
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// runJob runs one job, turning a panic into an error so the scheduler keeps going
+func (s *Scheduler) runJob(ctx context.Context, j *job) {
+	start := time.Now()
+	s.mu.Lock()
+	s.running, s.runStart = j, start
+	s.mu.Unlock()
+
+	ctx, span := tracing.Start(ctx, "job "+j.name, tracing.KindInternal, tracing.String("job.name", j.name))
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return j.run(ctx)
+	}()
+	span.RecordError(err)
+	span.End()
+	elapsed := time.Since(start)
+
+	s.mu.Lock()
+	s.running = nil
+	j.next = start.Add(j.interval)
+	j.lastRun, j.lastErr = time.Now(), err
+	if err == nil {
+		j.lastSuccess = j.lastRun
+	}
+	s.mu.Unlock()
+
+	jobDuration.Observe(elapsed.Seconds(), j.name)
+	if err != nil {
+		jobRuns.Inc(j.name, "error")
+		log.Printf("job %s failed after %s: %v%s", j.name, elapsed.Round(time.Millisecond), err, tracing.LogSuffix(ctx))
+		return
+	}
+	jobRuns.Inc(j.name, "success")
+	jobLastSuccess.Set(float64(time.Now().Unix()), j.name)
+}
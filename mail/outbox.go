@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Outbox writes each message to a .eml file instead of sending it, for development and
+// tests: links can be read from the files or opened with any mail client.
+type Outbox struct {
+	dir  string
+	from *mail.Address
+}
+
+// NewOutbox creates the outbox directory
+func NewOutbox(dir string, from *mail.Address) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create mail outbox: %v", err)
+	}
+	return &Outbox{dir: dir, from: from}, nil
+}
+
+// Dir returns the outbox directory
+func (o *Outbox) Dir() string {
+	return o.dir
+}
+
+// Send stores the message as <timestamp>-<recipient>.eml
+func (o *Outbox) Send(msg *Message) error {
+	data, err := encode(o.from, msg)
+	if err != nil {
+		return err
+	}
+	to, _ := mail.ParseAddress(msg.To)
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000Z"), to.Address)
+	// Messages contain sign-in links; keep them private to the server user
+	return os.WriteFile(filepath.Join(o.dir, filepath.Base(name)), data, 0600)
+}
@@ -0,0 +1,107 @@
+package mail
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"time"
+)
+
+// smtpTimeout bounds a whole delivery so a stuck relay cannot pile up goroutines
+const smtpTimeout = 30 * time.Second
+
+// SMTP delivers through a relay. Credentials are only sent over TLS.
+type SMTP struct {
+	addr     string // host:port
+	host     string
+	implicit bool // TLS from the first byte (smtps) rather than STARTTLS
+	auth     smtp.Auth
+	from     *mail.Address
+}
+
+// NewSMTP configures a relay from an smtp:// or smtps:// URL
+func NewSMTP(u *url.URL, from *mail.Address) (*SMTP, error) {
+	s := &SMTP{host: u.Hostname(), from: from}
+	port := u.Port()
+	switch u.Scheme {
+	case "smtp":
+		if port == "" {
+			port = "587"
+		}
+	case "smtps":
+		s.implicit = true
+		if port == "" {
+			port = "465"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported SMTP URL scheme %q (want smtp or smtps)", u.Scheme)
+	}
+	if s.host == "" {
+		return nil, fmt.Errorf("SMTP URL has no host")
+	}
+	s.addr = net.JoinHostPort(s.host, port)
+	if u.User != nil {
+		password, _ := u.User.Password()
+		s.auth = smtp.PlainAuth("", u.User.Username(), password, s.host)
+	}
+	return s, nil
+}
+
+// Send delivers one message
+func (s *SMTP) Send(msg *Message) error {
+	data, err := encode(s.from, msg)
+	if err != nil {
+		return err
+	}
+	to, _ := mail.ParseAddress(msg.To)
+
+	conn, err := net.DialTimeout("tcp", s.addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	tlsConfig := &tls.Config{ServerName: s.host}
+	if s.implicit {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if !s.implicit {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if s.auth != nil {
+		// smtp.PlainAuth refuses to send credentials over plaintext except to localhost
+		if err := c.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,279 @@
+// Package metrics keeps counters, gauges and histograms in memory and writes them in the
+// Prometheus text exposition format. Metrics register themselves in one process-wide
+// registry when they are created, normally in package-level vars.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the exposition format written by Write
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are histogram upper bounds in seconds suited to request latencies
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector writes one or more metric families
+type collector interface {
+	collect(w *bufio.Writer)
+}
+
+var registry struct {
+	mu         sync.Mutex
+	names      map[string]bool
+	collectors []collector
+}
+
+func register(c collector, names ...string) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.names == nil {
+		registry.names = map[string]bool{}
+	}
+	for _, name := range names {
+		if registry.names[name] {
+			panic("metrics: duplicate metric " + name)
+		}
+		registry.names[name] = true
+	}
+	registry.collectors = append(registry.collectors, c)
+}
+
+// Write writes every registered metric to w
+func Write(w io.Writer) error {
+	registry.mu.Lock()
+	collectors := append([]collector(nil), registry.collectors...)
+	registry.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.collect(bw)
+	}
+	return bw.Flush()
+}
+
+// family is a metric and its series, one per combination of label values
+type family struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64 // histograms only
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // counters and gauges
+	counts      []uint64 // histogram bucket counts, not cumulative
+	count       uint64
+	sum         float64
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	f := &family{name: name, help: help, kind: kind, labels: labels, series: map[string]*series{}}
+	register(f, name)
+	return f
+}
+
+// get returns the series for the label values, creating it on first use
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		// Label values may point into reused request buffers
+		s = &series{labelValues: make([]string, len(labelValues))}
+		for i, v := range labelValues {
+			s.labelValues[i] = strings.Clone(v)
+		}
+		key = strings.Clone(key)
+		if f.buckets != nil {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) collect(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	writeHeader(w, f.name, f.help, f.kind)
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		if f.kind != "histogram" {
+			writeSample(w, f.name, f.labels, s.labelValues, s.value)
+			continue
+		}
+		labels := append(append([]string(nil), f.labels...), "le")
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			writeSample(w, f.name+"_bucket", labels, append(append([]string(nil), s.labelValues...), formatFloat(bound)), float64(cumulative))
+		}
+		writeSample(w, f.name+"_bucket", labels, append(append([]string(nil), s.labelValues...), "+Inf"), float64(s.count))
+		writeSample(w, f.name+"_sum", f.labels, s.labelValues, s.sum)
+		writeSample(w, f.name+"_count", f.labels, s.labelValues, float64(s.count))
+	}
+}
+
+// Counter is a value that only goes up, such as a number of requests
+type Counter struct{ f *family }
+
+// NewCounter registers a counter with the given label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newFamily(name, help, "counter", labels)}
+	if len(labels) == 0 {
+		c.f.get(nil)
+	}
+	return c
+}
+
+// Inc adds one to the series with the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the series with the given label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counter " + c.f.name + " cannot decrease")
+	}
+	c.f.mu.Lock()
+	c.f.get(labelValues).value += v
+	c.f.mu.Unlock()
+}
+
+// Gauge is a value that goes up and down, such as requests in flight
+type Gauge struct{ f *family }
+
+// NewGauge registers a gauge with the given label names
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newFamily(name, help, "gauge", labels)}
+	if len(labels) == 0 {
+		g.f.get(nil)
+	}
+	return g
+}
+
+// Set sets the series with the given label values to v
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.mu.Lock()
+	g.f.get(labelValues).value = v
+	g.f.mu.Unlock()
+}
+
+// Add adds v, which may be negative, to the series with the given label values
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.f.mu.Lock()
+	g.f.get(labelValues).value += v
+	g.f.mu.Unlock()
+}
+
+// Inc adds one to the series with the given label values
+func (g *Gauge) Inc(labelValues ...string) { g.Add(1, labelValues...) }
+
+// Dec subtracts one from the series with the given label values
+func (g *Gauge) Dec(labelValues ...string) { g.Add(-1, labelValues...) }
+
+// Histogram counts observations, such as durations, into buckets
+type Histogram struct{ f *family }
+
+// NewHistogram registers a histogram with ascending bucket upper bounds and the given label names
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) || len(buckets) == 0 {
+		panic("metrics: histogram " + name + " needs ascending buckets")
+	}
+	f := &family{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets, series: map[string]*series{}}
+	register(f, name)
+	return &Histogram{f}
+}
+
+// Observe records v in the series with the given label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	s := h.f.get(labelValues)
+	if i := sort.SearchFloat64s(h.f.buckets, v); i < len(h.f.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+// funcMetric is an unlabelled value read when metrics are written
+type funcMetric struct {
+	name, help, kind string
+	fn               func() float64
+}
+
+func (m *funcMetric) collect(w *bufio.Writer) {
+	writeHeader(w, m.name, m.help, m.kind)
+	writeSample(w, m.name, nil, nil, m.fn())
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by fn on every scrape
+func NewGaugeFunc(name, help string, fn func() float64) {
+	register(&funcMetric{name, help, "gauge", fn}, name)
+}
+
+// NewCounterFunc registers a counter whose value is computed by fn on every scrape, for
+// totals kept elsewhere such as database/sql statistics
+func NewCounterFunc(name, help string, fn func() float64) {
+	register(&funcMetric{name, help, "counter", fn}, name)
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l)
+			w.WriteString(`="`)
+			w.WriteString(labelValueEscaper.Replace(values[i]))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
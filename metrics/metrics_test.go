@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"bytes"
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// emptyRegistry lets a test register metrics of its own, leaving out the runtime ones, and
+// restores the process-wide registry when it ends
+func emptyRegistry(t *testing.T) {
+	registry.mu.Lock()
+	names, collectors := registry.names, registry.collectors
+	registry.names, registry.collectors = nil, nil
+	registry.mu.Unlock()
+	t.Cleanup(func() {
+		registry.mu.Lock()
+		registry.names, registry.collectors = names, collectors
+		registry.mu.Unlock()
+	})
+}
+
+// TestExposition compares the text of each kind of metric with testdata/exposition.txt.
+// Run with -update after an intended format change and review the diff.
+func TestExposition(t *testing.T) {
+	emptyRegistry(t)
+	requests := NewCounter("test_http_requests_total", "Requests handled.", "method", "status")
+	requests.Inc("GET", "200")
+	requests.Add(2, "GET", "200")
+	requests.Inc("POST", "500")
+
+	logins := NewCounter("test_logins_total", "Sign-ins.\nLine two with a \\ backslash.")
+	logins.Add(0.5)
+
+	inFlight := NewGauge("test_in_flight", "Requests in flight.")
+	inFlight.Inc()
+	inFlight.Inc()
+	inFlight.Dec()
+
+	temperature := NewGauge("test_temperature_celsius", "Special values.", "sensor")
+	temperature.Set(-12.25, "outside")
+	temperature.Set(math.Inf(1), "sun")
+	temperature.Set(math.NaN(), "broken")
+
+	escaping := NewCounter("test_escaping_total", "Label values needing escapes.", "path")
+	escaping.Inc(`/a"quoted"`)
+	escaping.Inc(`C:\dir`)
+	escaping.Inc("two\nlines")
+
+	latency := NewHistogram("test_request_duration_seconds", "Request latency.", []float64{.1, .5, 1}, "route")
+	for _, v := range []float64{.05, .1, .3, .7, 2, 30} {
+		latency.Observe(v, "/api/me")
+	}
+	latency.Observe(.2, "/api/health")
+
+	unlabelled := NewHistogram("test_job_seconds", "No labels.", []float64{1e-3, 1e6})
+	unlabelled.Observe(1e-4)
+
+	NewGaugeFunc("test_queue_length", "Computed on scrape.", func() float64 { return 42 })
+	NewCounterFunc("test_bytes_total", "Computed on scrape.", func() float64 { return 1.5e9 })
+
+	var buf bytes.Buffer
+	if err := Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+
+	golden := filepath.Join("testdata", "exposition.txt")
+	if *update {
+		if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("exposition differs from %s:\n%s", golden, got)
+	}
+}
+
+// sampleLine is a sample as the Prometheus text format defines it
+var sampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{([a-zA-Z_][a-zA-Z0-9_]*="([^"\\\n]|\\[\\"n])*",?)*\})? (-?[0-9.e+-]+|[+-]Inf|NaN)$`)
+
+// TestWrite checks that the full output, including the runtime metrics, parses: every
+// sample belongs to the family announced before it, and no family appears twice.
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]bool{}
+	family, kind := "", ""
+	for i, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			family = strings.Fields(line)[2]
+			if seen[family] {
+				t.Errorf("line %d: family %s repeated", i+1, family)
+			}
+			seen[family] = true
+			kind = ""
+		case strings.HasPrefix(line, "# TYPE "):
+			f := strings.Fields(line)
+			if len(f) != 4 || f[2] != family {
+				t.Errorf("line %d: TYPE does not follow the HELP of %s: %q", i+1, family, line)
+				continue
+			}
+			kind = f[3]
+		default:
+			m := sampleLine.FindStringSubmatch(line)
+			if m == nil {
+				t.Errorf("line %d: not a sample: %q", i+1, line)
+				continue
+			}
+			name := m[1]
+			if kind == "histogram" {
+				name = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_sum"), "_count")
+			}
+			if name != family || kind == "" {
+				t.Errorf("line %d: sample of %s in family %s", i+1, m[1], family)
+			}
+		}
+	}
+	for _, name := range []string{"go_goroutines", "go_memstats_alloc_bytes", "process_start_time_seconds"} {
+		if !seen[name] {
+			t.Errorf("no %s", name)
+		}
+	}
+}
+
+func TestDuplicateMetricPanics(t *testing.T) {
+	emptyRegistry(t)
+	NewGauge("test_duplicate", "First.")
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice did not panic")
+		}
+	}()
+	NewCounter("test_duplicate", "Second.")
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"bufio"
+	"runtime"
+	"runtime/pprof"
+	"time"
+)
+
+// runtimeCollector reports the Go runtime under the names the official Prometheus client
+// uses, so existing Go dashboards work unchanged. Memory statistics are read once per scrape.
+type runtimeCollector struct {
+	start time.Time
+}
+
+func init() {
+	register(&runtimeCollector{start: time.Now()},
+		"go_info", "go_goroutines", "go_threads",
+		"go_memstats_alloc_bytes", "go_memstats_heap_inuse_bytes", "go_memstats_heap_objects",
+		"go_memstats_sys_bytes", "go_memstats_next_gc_bytes",
+		"go_memstats_mallocs_total", "go_memstats_frees_total",
+		"go_gc_cycles_total", "go_gc_pause_seconds_total",
+		"process_start_time_seconds")
+}
+
+func (r *runtimeCollector) collect(w *bufio.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	gauge := func(name, help string, v float64) {
+		writeHeader(w, name, help, "gauge")
+		writeSample(w, name, nil, nil, v)
+	}
+	counter := func(name, help string, v float64) {
+		writeHeader(w, name, help, "counter")
+		writeSample(w, name, nil, nil, v)
+	}
+
+	writeHeader(w, "go_info", "Information about the Go environment.", "gauge")
+	writeSample(w, "go_info", []string{"version"}, []string{runtime.Version()}, 1)
+	gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	gauge("go_threads", "Number of OS threads created.", float64(pprof.Lookup("threadcreate").Count()))
+	gauge("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(ms.Alloc))
+	gauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(ms.HeapInuse))
+	gauge("go_memstats_heap_objects", "Number of allocated objects.", float64(ms.HeapObjects))
+	gauge("go_memstats_sys_bytes", "Number of bytes obtained from system.", float64(ms.Sys))
+	gauge("go_memstats_next_gc_bytes", "Number of heap bytes when next garbage collection will take place.", float64(ms.NextGC))
+	counter("go_memstats_mallocs_total", "Total number of mallocs.", float64(ms.Mallocs))
+	counter("go_memstats_frees_total", "Total number of frees.", float64(ms.Frees))
+	counter("go_gc_cycles_total", "Number of completed GC cycles.", float64(ms.NumGC))
+	counter("go_gc_pause_seconds_total", "Total time the world was stopped for garbage collection.", float64(ms.PauseTotalNs)/1e9)
+	gauge("process_start_time_seconds", "Start time of the process since unix epoch in seconds.", float64(r.start.UnixNano())/1e9)
+}
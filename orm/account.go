@@ -0,0 +1,258 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// DeletedUserPseudonym replaces a purged user's email in the audit trail. It is stable per
+// account so events of the same former user can still be correlated.
+func DeletedUserPseudonym(userID int64) string {
+	return "deleted-user-" + strconv.FormatInt(userID, 10)
+}
+
+// ScheduleUserDeletion marks an account for deletion and signs it out everywhere
+func ScheduleUserDeletion(ctx context.Context, userID int64, at time.Time) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET deletion_scheduled_at = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", at.UTC(), userID); err != nil {
+		return err
+	}
+	if err := revokeUserCredentials(tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CancelUserDeletion keeps an account that was scheduled for deletion
+func CancelUserDeletion(ctx context.Context, userID int64) error {
+	_, err := DB.ExecContext(ctx, "UPDATE users SET deletion_scheduled_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?", userID)
+	return err
+}
+
+// UsersDueForDeletion returns accounts whose deletion grace period has ended
+func UsersDueForDeletion(ctx context.Context, now time.Time) ([]*User, error) {
+	rows, err := DB.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM users WHERE deletion_scheduled_at IS NOT NULL AND deletion_scheduled_at <= ?", userSelectCols("")), now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// PurgeUser deletes an account and anonymises what must outlive it. Audit events keep
+// their action and time, but every address the account has had becomes a pseudonym (see
+// formerAddresses) and the IP address, user agent and metadata of the user's own events are
+// erased.
+func PurgeUser(ctx context.Context, user *User) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	addresses, err := formerAddresses(tx, user)
+	if err != nil {
+		return fmt.Errorf("failed to find the addresses of user %d: %v", user.ID, err)
+	}
+	pseudonym := DeletedUserPseudonym(user.ID)
+	quotedPseudonym, _ := json.Marshal(pseudonym)
+	type redaction struct {
+		query string
+		args  []any
+	}
+	redactions := []redaction{
+		{"UPDATE audit_events SET actor_email = ?, ip = NULL, user_agent = NULL, metadata = NULL WHERE actor_id = ?", []any{pseudonym, user.ID}},
+	}
+	for _, addr := range addresses {
+		// Metadata is JSON, so match the address as a whole string value
+		quoted, _ := json.Marshal(addr)
+		redactions = append(redactions,
+			redaction{"UPDATE audit_events SET target = ? WHERE target = ?", []any{pseudonym, addr}},
+			redaction{"UPDATE audit_events SET actor_email = ? WHERE actor_email = ?", []any{pseudonym, addr}},
+			redaction{"UPDATE audit_events SET metadata = REPLACE(metadata, ?, ?) WHERE instr(metadata, ?) > 0", []any{string(quoted), string(quotedPseudonym), string(quoted)}},
+			// Sign-in link requests for the address are not tied to the user row
+			redaction{"DELETE FROM magic_links WHERE email = ?", []any{addr}},
+		)
+	}
+	for _, r := range redactions {
+		if _, err := tx.Exec(r.query, r.args...); err != nil {
+			return fmt.Errorf("failed to anonymise user %d: %v", user.ID, err)
+		}
+	}
+	if err := deleteUser(tx, user.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// formerAddresses returns the email addresses an account has had: the current one, those
+// it acted under, those its identities and sign-in links used, and those SCIM updates
+// replaced. Addresses that now belong to another account are left out, since audit events
+// naming them may be about that account.
+func formerAddresses(tx *Tx, user *User) ([]string, error) {
+	seen := map[string]bool{}
+	queue := []string{user.Email}
+	for _, q := range []string{
+		"SELECT DISTINCT actor_email FROM audit_events WHERE actor_id = ? AND actor_email IS NOT NULL",
+		"SELECT DISTINCT email FROM user_identities WHERE user_id = ? AND email IS NOT NULL",
+		"SELECT DISTINCT email FROM magic_links WHERE user_id = ?",
+	} {
+		found, err := queryStrings(tx, q, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, found...)
+	}
+
+	var addresses []string
+	for len(queue) > 0 {
+		addr := queue[0]
+		queue = queue[1:]
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		var other int
+		err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE email = ? AND id != ?", addr, user.ID).Scan(&other)
+		if err != nil {
+			return nil, err
+		}
+		if other > 0 {
+			continue
+		}
+		addresses = append(addresses, addr)
+		// A SCIM update names the new address and records the one it replaced
+		previous, err := queryStrings(tx, `SELECT DISTINCT json_extract(metadata, '$.previous_email') FROM audit_events
+			WHERE target = ? AND json_extract(metadata, '$.previous_email') IS NOT NULL`, addr)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, previous...)
+	}
+	return addresses, nil
+}
+
+// queryStrings returns the first column of each row
+func queryStrings(tx *Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// userDataQueries select the rows of each table that belong to a user, for data export.
+// Secrets (session tokens, password and token hashes) are deliberately left out.
+var userDataQueries = []struct{ name, query string }{
+	{"sessions", "SELECT id, created_at, expires_at FROM sessions WHERE user_id = ? ORDER BY id"},
+	{"identities", "SELECT provider, issuer, subject, email, created_at, last_login_at FROM user_identities WHERE user_id = ? ORDER BY id"},
+	{"oauth_consents", "SELECT client_id, scope, updated_at FROM oauth_consents WHERE user_id = ? ORDER BY client_id"},
+	{"oauth_tokens", "SELECT kind, client_id, scope, created_at, expires_at, revoked FROM oauth_tokens WHERE user_id = ? ORDER BY created_at"},
+	{"oauth_clients_created", "SELECT client_id, name, redirect_uris, scopes, created_at FROM oauth_clients WHERE created_by = ? ORDER BY id"},
+	{"scim_tokens_created", "SELECT o.slug AS organization, t.description, t.created_at, t.last_used_at FROM scim_tokens t JOIN organizations o ON o.id = t.org_id WHERE t.created_by = ? ORDER BY t.id"},
+	{"groups", "SELECT g.display_name, g.external_id, g.role FROM scim_groups g JOIN scim_group_members m ON m.group_id = g.id WHERE m.user_id = ? ORDER BY g.display_name"},
+	{"password_changes", "SELECT created_at FROM password_history WHERE user_id = ? ORDER BY id"},
+	{"sign_in_links", "SELECT email, ip, created_at, expires_at, used_at FROM magic_links WHERE user_id = ? ORDER BY id"},
+}
+
+// ExportUserData returns every stored record about a user except audit events (see
+// EachAuditEvent), keyed by dataset name
+func ExportUserData(ctx context.Context, userID int64) (map[string][]map[string]any, error) {
+	out := make(map[string][]map[string]any, len(userDataQueries))
+	for _, q := range userDataQueries {
+		rows, err := queryMaps(ctx, q.query, userID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export %s: %v", q.name, err)
+		}
+		out[q.name] = rows
+	}
+	return out, nil
+}
+
+// queryMaps returns rows as column-name maps
+func queryMaps(ctx context.Context, query string, args ...any) ([]map[string]any, error) {
+	rows, err := DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]map[string]any, 0)
+	for rows.Next() {
+		values := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		m := make(map[string]any, len(cols))
+		for i, c := range cols {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			m[c] = values[i]
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// CountAdmins returns the number of enabled admin accounts not scheduled for deletion
+func CountAdmins(ctx context.Context) (int, error) {
+	var n int
+	err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE role = ? AND disabled = 0 AND deletion_scheduled_at IS NULL", RoleAdmin).Scan(&n)
+	return n, err
+}
+
+// SetUserAvatar stores the blob key of a user's profile picture ("" removes it) and
+// returns the previous key so the caller can delete that blob
+func SetUserAvatar(ctx context.Context, userID int64, key string) (string, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var previous sql.NullString
+	if err := tx.QueryRow("SELECT avatar_key FROM users WHERE id = ?", userID).Scan(&previous); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("UPDATE users SET avatar_key = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", nullString(key), userID); err != nil {
+		return "", err
+	}
+	return previous.String, tx.Commit()
+}
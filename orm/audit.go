@@ -0,0 +1,201 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditEvent represents a row in the append-only audit_events table
+type AuditEvent struct {
+	ID         int64          `json:"id"`
+	ActorID    int64          `json:"actor_id,omitempty"`
+	ActorEmail string         `json:"actor_email,omitempty"`
+	Action     string         `json:"action"`
+	Target     string         `json:"target,omitempty"`
+	IP         string         `json:"ip,omitempty"`
+	UserAgent  string         `json:"user_agent,omitempty"`
+	Metadata   map[string]any `json:"metadata,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+}
+
+// AuditFilter narrows down audit event queries. Zero values are ignored.
+type AuditFilter struct {
+	ActorID    int64
+	ActorEmail string
+	Action     string // exact match, or prefix match when ending with "*"
+	Target     string
+	IP         string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+	Offset     int
+}
+
+// where builds the WHERE clause and args for the filter
+func (f *AuditFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if f.ActorID > 0 {
+		conds = append(conds, "actor_id = ?")
+		args = append(args, f.ActorID)
+	}
+	if f.ActorEmail != "" {
+		conds = append(conds, "actor_email = ?")
+		args = append(args, f.ActorEmail)
+	}
+	if f.Action != "" {
+		if strings.HasSuffix(f.Action, "*") {
+			conds = append(conds, "action LIKE ? ESCAPE '\\'")
+			args = append(args, escapeLike(strings.TrimSuffix(f.Action, "*"))+"%")
+		} else {
+			conds = append(conds, "action = ?")
+			args = append(args, f.Action)
+		}
+	}
+	if f.Target != "" {
+		conds = append(conds, "target = ?")
+		args = append(args, f.Target)
+	}
+	if f.IP != "" {
+		conds = append(conds, "ip = ?")
+		args = append(args, f.IP)
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, f.Until.UTC())
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func escapeLike(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(s)
+}
+
+const auditSelectCols = "id, actor_id, actor_email, action, target, ip, user_agent, metadata, created_at"
+
+// InsertAuditEvent appends an event to the audit log
+func InsertAuditEvent(ctx context.Context, e *AuditEvent) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	var meta sql.NullString
+	if len(e.Metadata) > 0 {
+		data, err := json.Marshal(e.Metadata)
+		if err != nil {
+			return fmt.Errorf("failed to encode audit metadata: %v", err)
+		}
+		meta = sql.NullString{String: string(data), Valid: true}
+	}
+	var actorID sql.NullInt64
+	if e.ActorID > 0 {
+		actorID = sql.NullInt64{Int64: e.ActorID, Valid: true}
+	}
+
+	res, err := DB.ExecContext(ctx, `INSERT INTO audit_events(actor_id, actor_email, action, target, ip, user_agent, metadata, created_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+		actorID, nullString(e.ActorEmail), e.Action, nullString(e.Target), nullString(e.IP),
+		nullString(e.UserAgent), meta, e.CreatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	e.ID, _ = res.LastInsertId()
+	return nil
+}
+
+// ListAuditEvents returns a page of events matching the filter, newest first, and the total match count
+func ListAuditEvents(ctx context.Context, f AuditFilter) ([]*AuditEvent, int, error) {
+	where, args := f.where()
+
+	var total int
+	if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM audit_events"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := "SELECT " + auditSelectCols + " FROM audit_events" + where + " ORDER BY id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, f.Limit, f.Offset)
+	}
+	rows, err := DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	events := make([]*AuditEvent, 0)
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		events = append(events, e)
+	}
+	return events, total, rows.Err()
+}
+
+// EachAuditEvent streams events matching the filter in chronological order.
+// Limit and Offset are ignored. Iteration stops at the first error returned by fn.
+func EachAuditEvent(ctx context.Context, f AuditFilter, fn func(e *AuditEvent) error) error {
+	where, args := f.where()
+	rows, err := DB.QueryContext(ctx, "SELECT "+auditSelectCols+" FROM audit_events"+where+" ORDER BY id ASC", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			return err
+		}
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// PurgeAuditEvents deletes events older than the given time and returns how many were removed
+func PurgeAuditEvents(ctx context.Context, before time.Time) (int64, error) {
+	res, err := DB.ExecContext(ctx, "DELETE FROM audit_events WHERE created_at < ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func scanAuditEvent(row rowScanner) (*AuditEvent, error) {
+	e := &AuditEvent{}
+	var actorID sql.NullInt64
+	var actorEmail, target, ip, ua, meta sql.NullString
+	if err := row.Scan(&e.ID, &actorID, &actorEmail, &e.Action, &target, &ip, &ua, &meta, &e.CreatedAt); err != nil {
+		return nil, err
+	}
+	e.ActorID = actorID.Int64
+	e.ActorEmail = actorEmail.String
+	e.Target = target.String
+	e.IP = ip.String
+	e.UserAgent = ua.String
+	if meta.Valid && meta.String != "" {
+		if err := json.Unmarshal([]byte(meta.String), &e.Metadata); err != nil {
+			return nil, fmt.Errorf("invalid audit metadata for event %d: %v", e.ID, err)
+		}
+	}
+	return e, nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
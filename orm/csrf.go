@@ -0,0 +1,49 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// GetCSRFToken returns the stored value of a CSRF token, or nil when it is unknown or expired
+func GetCSRFToken(ctx context.Context, token string) ([]byte, error) {
+	var value []byte
+	err := DB.QueryRowContext(ctx, "SELECT value FROM csrf_tokens WHERE token = ? AND (expires_at IS NULL OR expires_at > ?)",
+		token, time.Now()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return value, err
+}
+
+// SetCSRFToken stores or extends a CSRF token; a zero ttl never expires
+func SetCSRFToken(ctx context.Context, token string, value []byte, ttl time.Duration) error {
+	var expiresAt any
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+	_, err := DB.ExecContext(ctx, `INSERT INTO csrf_tokens(token, value, expires_at) VALUES(?, ?, ?)
+		ON CONFLICT(token) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at`,
+		token, value, expiresAt)
+	return err
+}
+
+// DeleteCSRFToken removes a CSRF token
+func DeleteCSRFToken(ctx context.Context, token string) error {
+	_, err := DB.ExecContext(ctx, "DELETE FROM csrf_tokens WHERE token = ?", token)
+	return err
+}
+
+// DeleteAllCSRFTokens removes every CSRF token
+func DeleteAllCSRFTokens(ctx context.Context) error {
+	_, err := DB.ExecContext(ctx, "DELETE FROM csrf_tokens")
+	return err
+}
+
+// CleanupExpiredCSRFTokens removes expired CSRF tokens
+func CleanupExpiredCSRFTokens(ctx context.Context) error {
+	_, err := DB.ExecContext(ctx, "DELETE FROM csrf_tokens WHERE expires_at <= ?", time.Now())
+	return err
+}
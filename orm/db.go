@@ -1,9 +1,11 @@
 package orm
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"regexp"
 	"strings"
 	"time"
 
@@ -11,35 +13,58 @@ import (
 	_ "modernc.org/sqlite"
 )
 
-var DB *sql.DB
+var DB *Database
+
+// dbFile is the path Init opened, watched by Ping
+var dbFile string
+
+// SchemaVersion is stored in PRAGMA user_version once Init has brought the schema up to date.
+// Raise it whenever createTables or addedUserColumns change.
+const SchemaVersion = 1
+
+// schemaTables lists the tables createTables makes, for CheckSchema
+var schemaTables []string
 
 // schema feature flags (detected at runtime)
 var usersNameColumn = "name" // either "name" or legacy "username"
 var hasCompanyColumn = true  // some legacy DBs may miss company
 
+// addedUserColumns were introduced after the first release; detectUsersSchema adds
+// any that are missing so older databases keep working
+var addedUserColumns = []struct{ name, ddl string }{
+	{"role", "role TEXT NOT NULL DEFAULT 'user'"},
+	{"role_from_scim", "role_from_scim INTEGER NOT NULL DEFAULT 0"},
+	{"org_id", "org_id INTEGER REFERENCES organizations (id) ON DELETE SET NULL"},
+	{"disabled", "disabled INTEGER NOT NULL DEFAULT 0"},
+	{"deletion_scheduled_at", "deletion_scheduled_at DATETIME"},
+	{"avatar_key", "avatar_key TEXT"},
+	{"password_must_change", "password_must_change INTEGER NOT NULL DEFAULT 0"},
+}
+
+// User roles
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// connPragmas are applied by the driver to every pooled connection, not just the first one:
+// WAL and NORMAL sync for concurrency, foreign keys for the ON DELETE clauses, and a busy
+// timeout so writers from several processes (prefork) wait for the lock instead of failing.
+const connPragmas = "_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)"
+
 // Init initializes the database connection
 func Init(dbPath string) error {
-	var err error
-	DB, err = sql.Open("sqlite", dbPath)
+	db, err := sql.Open("sqlite", dbPath+"?"+connPragmas)
 	if err != nil {
 		return fmt.Errorf("failed to open database: %v", err)
 	}
+	DB = &Database{db}
+	dbFile = dbPath
 
 	if err = DB.Ping(); err != nil {
 		return fmt.Errorf("failed to ping database: %v", err)
 	}
 
-	// Improve SQLite performance and concurrency
-	if _, err := DB.Exec(`PRAGMA journal_mode = WAL;`); err != nil {
-		log.Printf("warning: failed to set journal_mode=WAL: %v", err)
-	}
-	if _, err := DB.Exec(`PRAGMA synchronous = NORMAL;`); err != nil {
-		log.Printf("warning: failed to set synchronous=NORMAL: %v", err)
-	}
-	if _, err := DB.Exec(`PRAGMA foreign_keys = ON;`); err != nil {
-		log.Printf("warning: failed to enable foreign_keys: %v", err)
-	}
-
 	// Create tables (no-op if they exist)
 	if err = createTables(); err != nil {
 		return fmt.Errorf("failed to create tables: %v", err)
@@ -50,10 +75,23 @@ func Init(dbPath string) error {
 		return fmt.Errorf("failed to detect users schema: %v", err)
 	}
 
+	// A database already migrated by a newer build keeps its version
+	var version int
+	if err = DB.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+	if version < SchemaVersion {
+		if _, err = DB.Exec(fmt.Sprintf("PRAGMA user_version = %d", SchemaVersion)); err != nil {
+			return fmt.Errorf("failed to record schema version: %v", err)
+		}
+	}
+
 	log.Printf("Database initialized successfully at %s", dbPath)
 	return nil
 }
 
+var createTableName = regexp.MustCompile(`CREATE TABLE IF NOT EXISTS (\w+)`)
+
 // createTables creates the necessary database tables
 func createTables() error {
 	// Users table for basic user management (modern schema)
@@ -64,6 +102,13 @@ func createTables() error {
 		email TEXT NOT NULL UNIQUE,
 		company TEXT,
 		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'user',
+		role_from_scim INTEGER NOT NULL DEFAULT 0,
+		org_id INTEGER REFERENCES organizations (id) ON DELETE SET NULL,
+		disabled INTEGER NOT NULL DEFAULT 0,
+		deletion_scheduled_at DATETIME,
+		avatar_key TEXT,
+		password_must_change INTEGER NOT NULL DEFAULT 0,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);`
@@ -89,12 +134,251 @@ func createTables() error {
 		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);`
 
-	tables := []string{createUsersTable, createSessionsTable, createSettingsTable}
+	// Append-only audit trail for authentication and account events
+	createAuditEventsTable := `
+	CREATE TABLE IF NOT EXISTS audit_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		actor_id INTEGER,
+		actor_email TEXT,
+		action TEXT NOT NULL,
+		target TEXT,
+		ip TEXT,
+		user_agent TEXT,
+		metadata TEXT,
+		created_at DATETIME NOT NULL
+	);`
+
+	// Organizations group users and carry per-organization identity provider settings
+	createOrganizationsTable := `
+	CREATE TABLE IF NOT EXISTS organizations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		slug TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// OpenID Connect identity provider per organization
+	createOIDCProvidersTable := `
+	CREATE TABLE IF NOT EXISTS oidc_providers (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL UNIQUE,
+		issuer TEXT NOT NULL,
+		client_id TEXT NOT NULL,
+		client_secret TEXT,
+		scopes TEXT NOT NULL DEFAULT 'openid email profile',
+		email_domains TEXT,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (org_id) REFERENCES organizations (id) ON DELETE CASCADE
+	);`
+
+	// External identities (SSO subjects) linked to local users
+	createUserIdentitiesTable := `
+	CREATE TABLE IF NOT EXISTS user_identities (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		provider TEXT NOT NULL,
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		email TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_login_at DATETIME,
+		UNIQUE (provider, issuer, subject),
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);`
+
+	// Pending SSO logins (state, nonce, PKCE verifier); single use and short-lived
+	createSSOStatesTable := `
+	CREATE TABLE IF NOT EXISTS sso_states (
+		state TEXT PRIMARY KEY,
+		org_id INTEGER NOT NULL,
+		nonce TEXT NOT NULL,
+		code_verifier TEXT NOT NULL,
+		redirect_uri TEXT NOT NULL,
+		next_path TEXT,
+		expires_at DATETIME NOT NULL,
+		FOREIGN KEY (org_id) REFERENCES organizations (id) ON DELETE CASCADE
+	);`
+
+	// SAML 2.0 identity provider per organization
+	createSAMLProvidersTable := `
+	CREATE TABLE IF NOT EXISTS saml_providers (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL UNIQUE,
+		idp_entity_id TEXT NOT NULL,
+		idp_metadata TEXT NOT NULL,
+		metadata_url TEXT,
+		attr_email TEXT,
+		attr_name TEXT,
+		attr_company TEXT,
+		email_domains TEXT,
+		allow_idp_initiated INTEGER NOT NULL DEFAULT 0,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (org_id) REFERENCES organizations (id) ON DELETE CASCADE
+	);`
+
+	// IDs of consumed SAML assertions, kept until they expire to reject replays
+	createSAMLAssertionsTable := `
+	CREATE TABLE IF NOT EXISTS saml_assertions (
+		id TEXT PRIMARY KEY,
+		expires_at DATETIME NOT NULL
+	);`
+
+	// Third-party applications registered with the OAuth2 authorization server
+	createOAuthClientsTable := `
+	CREATE TABLE IF NOT EXISTS oauth_clients (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		client_id TEXT NOT NULL UNIQUE,
+		secret_hash TEXT,
+		name TEXT NOT NULL,
+		redirect_uris TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		created_by INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (created_by) REFERENCES users (id) ON DELETE SET NULL
+	);`
+
+	// Authorization codes awaiting redemption; stored hashed, single use
+	createOAuthCodesTable := `
+	CREATE TABLE IF NOT EXISTS oauth_codes (
+		code_hash TEXT PRIMARY KEY,
+		client_id TEXT NOT NULL,
+		user_id INTEGER NOT NULL,
+		redirect_uri TEXT NOT NULL,
+		scope TEXT NOT NULL,
+		code_challenge TEXT NOT NULL,
+		expires_at DATETIME NOT NULL,
+		FOREIGN KEY (client_id) REFERENCES oauth_clients (client_id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);`
+
+	// Issued access and refresh tokens; stored hashed. family_id ties every token
+	// descending from one authorization so refresh token reuse can revoke them all.
+	createOAuthTokensTable := `
+	CREATE TABLE IF NOT EXISTS oauth_tokens (
+		token_hash TEXT PRIMARY KEY,
+		kind TEXT NOT NULL,
+		family_id TEXT NOT NULL,
+		client_id TEXT NOT NULL,
+		user_id INTEGER NOT NULL,
+		scope TEXT NOT NULL,
+		expires_at DATETIME NOT NULL,
+		revoked INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (client_id) REFERENCES oauth_clients (client_id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);`
+
+	// Scopes a user has approved per client, so consent is only asked once
+	createOAuthConsentsTable := `
+	CREATE TABLE IF NOT EXISTS oauth_consents (
+		user_id INTEGER NOT NULL,
+		client_id TEXT NOT NULL,
+		scope TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, client_id),
+		FOREIGN KEY (client_id) REFERENCES oauth_clients (client_id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);`
+
+	// SCIM provisioning: org-scoped bearer tokens, pushed groups and their members.
+	// A group role is set by a Sachi administrator, never by the identity provider.
+	createSCIMTokensTable := `
+	CREATE TABLE IF NOT EXISTS scim_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		description TEXT,
+		created_by INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME,
+		FOREIGN KEY (org_id) REFERENCES organizations (id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users (id) ON DELETE SET NULL
+	);`
+
+	createSCIMGroupsTable := `
+	CREATE TABLE IF NOT EXISTS scim_groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL,
+		display_name TEXT NOT NULL,
+		external_id TEXT,
+		role TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (org_id, display_name),
+		FOREIGN KEY (org_id) REFERENCES organizations (id) ON DELETE CASCADE
+	);`
 
+	createSCIMGroupMembersTable := `
+	CREATE TABLE IF NOT EXISTS scim_group_members (
+		group_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		PRIMARY KEY (group_id, user_id),
+		FOREIGN KEY (group_id) REFERENCES scim_groups (id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);`
+
+	// Previous password hashes of each user, newest first, for the reuse check
+	createPasswordHistoryTable := `
+	CREATE TABLE IF NOT EXISTS password_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		password_hash TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);`
+
+	// Passwordless sign-in links. Requests for unknown emails are stored too (without a user)
+	// so the per-email and per-IP limits behave the same whether or not an account exists.
+	createMagicLinksTable := `
+	CREATE TABLE IF NOT EXISTS magic_links (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT NOT NULL UNIQUE,
+		browser_hash TEXT NOT NULL,
+		user_id INTEGER,
+		email TEXT NOT NULL,
+		ip TEXT,
+		next_path TEXT,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		used_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);`
+
+	// Sessions an admin opened as another user; the row lives as long as the session
+	createImpersonationsTable := `
+	CREATE TABLE IF NOT EXISTS impersonations (
+		session_token TEXT PRIMARY KEY,
+		admin_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		reason TEXT,
+		created_at DATETIME NOT NULL
+	);`
+
+	// CSRF tokens shared between prefork processes
+	createCSRFTokensTable := `
+	CREATE TABLE IF NOT EXISTS csrf_tokens (
+		token TEXT PRIMARY KEY,
+		value BLOB NOT NULL,
+		expires_at DATETIME
+	);`
+
+	tables := []string{createUsersTable, createSessionsTable, createSettingsTable, createAuditEventsTable,
+		createOrganizationsTable, createOIDCProvidersTable, createUserIdentitiesTable, createSSOStatesTable,
+		createSAMLProvidersTable, createSAMLAssertionsTable,
+		createOAuthClientsTable, createOAuthCodesTable, createOAuthTokensTable, createOAuthConsentsTable,
+		createSCIMTokensTable, createSCIMGroupsTable, createSCIMGroupMembersTable,
+		createPasswordHistoryTable, createMagicLinksTable, createImpersonationsTable, createCSRFTokensTable}
+
+	schemaTables = schemaTables[:0]
 	for _, table := range tables {
 		if _, err := DB.Exec(table); err != nil {
 			return fmt.Errorf("failed to create table: %v", err)
 		}
+		schemaTables = append(schemaTables, createTableName.FindStringSubmatch(table)[1])
 	}
 
 	// Indexes to speed up common queries
@@ -103,6 +387,17 @@ func createTables() error {
 		`CREATE INDEX IF NOT EXISTS idx_sessions_token ON sessions(session_token);`,
 		`CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);`,
 		`CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events(created_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events(actor_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events(action);`,
+		`CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_sso_states_expires_at ON sso_states(expires_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_oauth_tokens_family_id ON oauth_tokens(family_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_oauth_tokens_expires_at ON oauth_tokens(expires_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_scim_group_members_user_id ON scim_group_members(user_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_password_history_user_id ON password_history(user_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_magic_links_email ON magic_links(email, created_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_magic_links_ip ON magic_links(ip, created_at);`,
 	}
 	for _, idx := range indexes {
 		if _, err := DB.Exec(idx); err != nil {
@@ -110,6 +405,27 @@ func createTables() error {
 		}
 	}
 
+	// Audit events may be purged by retention but never rewritten. The one exception is
+	// erasing personal data of deleted accounts: actor_email and target may only become NULL
+	// or a "deleted-user-" pseudonym, ip and user_agent only NULL, and metadata may be redacted.
+	if _, err := DB.Exec(`DROP TRIGGER IF EXISTS audit_events_no_update`); err != nil {
+		return fmt.Errorf("failed to drop trigger: %v", err)
+	}
+	if _, err := DB.Exec(`
+	CREATE TRIGGER IF NOT EXISTS audit_events_redact_only
+	BEFORE UPDATE ON audit_events
+	WHEN NEW.id IS NOT OLD.id OR NEW.actor_id IS NOT OLD.actor_id OR NEW.action IS NOT OLD.action
+		OR NEW.created_at IS NOT OLD.created_at
+		OR (NEW.actor_email IS NOT OLD.actor_email AND NEW.actor_email IS NOT NULL AND NEW.actor_email NOT LIKE 'deleted-user-%')
+		OR (NEW.target IS NOT OLD.target AND NEW.target IS NOT NULL AND NEW.target NOT LIKE 'deleted-user-%')
+		OR (NEW.ip IS NOT OLD.ip AND NEW.ip IS NOT NULL)
+		OR (NEW.user_agent IS NOT OLD.user_agent AND NEW.user_agent IS NOT NULL)
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_events is append-only; only personal data may be redacted');
+	END;`); err != nil {
+		return fmt.Errorf("failed to create trigger: %v", err)
+	}
+
 	return nil
 }
 
@@ -137,6 +453,7 @@ func detectUsersSchema() error {
 	hasName := false
 	hasUsername := false
 	hasCompany := false
+	present := map[string]bool{}
 	for cols.Next() {
 		var cid int
 		var name string
@@ -146,6 +463,7 @@ func detectUsersSchema() error {
 		if err := cols.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
 			return err
 		}
+		present[name] = true
 		switch name {
 		case "name":
 			hasName = true
@@ -167,12 +485,61 @@ func detectUsersSchema() error {
 	}
 	hasCompanyColumn = hasCompany
 
+	for _, col := range addedUserColumns {
+		if present[col.name] {
+			continue
+		}
+		if _, err := DB.Exec("ALTER TABLE users ADD COLUMN " + col.ddl); err != nil {
+			return fmt.Errorf("failed to add users.%s column: %v", col.name, err)
+		}
+	}
+
 	log.Printf("users schema detected: nameColumn=%s, hasCompany=%v", usersNameColumn, hasCompanyColumn)
 	return nil
 }
 
 func joinCols(cols []string) string { return strings.Join(cols, ", ") }
 
+// userSelectCols returns the users columns read by scanUser, optionally qualified by a table alias
+func userSelectCols(alias string) string {
+	p := ""
+	if alias != "" {
+		p = alias + "."
+	}
+	cols := []string{p + "id", p + usersNameColumn, p + "email"}
+	if hasCompanyColumn {
+		cols = append(cols, p+"company")
+	}
+	cols = append(cols, p+"password_hash", p+"role", p+"org_id", p+"disabled", p+"deletion_scheduled_at", p+"avatar_key", p+"password_must_change", p+"created_at", p+"updated_at")
+	return joinCols(cols)
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanUser scans a row selected with userSelectCols
+func scanUser(row rowScanner) (*User, error) {
+	user := &User{}
+	dest := []any{&user.ID, &user.Name, &user.Email}
+	var company sql.NullString
+	var orgID sql.NullInt64
+	var deletionAt sql.NullTime
+	var avatarKey sql.NullString
+	if hasCompanyColumn {
+		dest = append(dest, &company)
+	}
+	dest = append(dest, &user.PasswordHash, &user.Role, &orgID, &user.Disabled, &deletionAt, &avatarKey, &user.MustChangePassword, &user.CreatedAt, &user.UpdatedAt)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	user.Company = company.String
+	user.OrgID = orgID.Int64
+	user.DeleteAt = deletionAt.Time
+	user.AvatarKey = avatarKey.String
+	return user, nil
+}
+
 // Close closes the database connection
 func Close() error {
 	if DB != nil {
@@ -183,17 +550,23 @@ func Close() error {
 
 // User represents a user in the database
 type User struct {
-	ID           int64
-	Name         string
-	Email        string
-	Company      string
-	PasswordHash string
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+	ID                 int64
+	Name               string
+	Email              string
+	Company            string
+	PasswordHash       string
+	Role               string
+	OrgID              int64     // 0 when the user does not belong to an organization
+	Disabled           bool      // deactivated accounts cannot sign in and have no sessions
+	DeleteAt           time.Time // when a self-deleted account will be purged; zero otherwise
+	AvatarKey          string    // blob storage key of the profile picture; empty when there is none
+	MustChangePassword bool      // set by an admin password reset; cleared when the user picks a new one
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
 }
 
 // CreateUser creates a new user in the database
-func CreateUser(name, email, company, passwordHash string) (int64, error) {
+func CreateUser(ctx context.Context, name, email, company, passwordHash string) (int64, error) {
 	// Build insert dynamically to handle legacy schemas
 	cols := []string{usersNameColumn, "email"}
 	args := []any{name, email}
@@ -210,13 +583,7 @@ func CreateUser(name, email, company, passwordHash string) (int64, error) {
 	}
 	query := fmt.Sprintf("INSERT INTO users(%s) VALUES(%s)", joinCols(cols), placeholders)
 
-	stmt, err := DB.Prepare(query)
-	if err != nil {
-		return 0, err
-	}
-	defer stmt.Close()
-
-	res, err := stmt.Exec(args...)
+	res, err := DB.ExecContext(ctx, query, args...)
 	if err != nil {
 		return 0, err
 	}
@@ -225,43 +592,24 @@ func CreateUser(name, email, company, passwordHash string) (int64, error) {
 }
 
 // GetUserByEmail retrieves a user from the database by their email address
-func GetUserByEmail(email string) (*User, error) {
+func GetUserByEmail(ctx context.Context, email string) (*User, error) {
 	// Build select to support legacy schemas
-	selectCols := fmt.Sprintf("id, %s, email", usersNameColumn)
-	if hasCompanyColumn {
-		selectCols += ", company"
-	}
-	selectCols += ", password_hash, created_at, updated_at"
-	query := fmt.Sprintf("SELECT %s FROM users WHERE email = ?", selectCols)
-	row := DB.QueryRow(query, email)
-
-	user := &User{}
-	if hasCompanyColumn {
-		if err := row.Scan(&user.ID, &user.Name, &user.Email, &user.Company, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt); err != nil {
-			return nil, err
-		}
-	} else {
-		if err := row.Scan(&user.ID, &user.Name, &user.Email, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt); err != nil {
-			return nil, err
-		}
-		user.Company = ""
-	}
+	query := fmt.Sprintf("SELECT %s FROM users WHERE email = ?", userSelectCols(""))
+	return scanUser(DB.QueryRowContext(ctx, query, email))
+}
 
-	return user, nil
+// GetUserByID retrieves a user from the database by id
+func GetUserByID(ctx context.Context, userID int64) (*User, error) {
+	query := fmt.Sprintf("SELECT %s FROM users WHERE id = ?", userSelectCols(""))
+	return scanUser(DB.QueryRowContext(ctx, query, userID))
 }
 
 // CreateSession creates a new session for a user
-func CreateSession(userID int64) (string, error) {
+func CreateSession(ctx context.Context, userID int64) (string, error) {
 	sessionToken := uuid.New().String()
 	expiresAt := time.Now().Add(24 * time.Hour)
 
-	stmt, err := DB.Prepare("INSERT INTO sessions(user_id, session_token, expires_at) VALUES(?, ?, ?)")
-	if err != nil {
-		return "", err
-	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(userID, sessionToken, expiresAt)
+	_, err := DB.ExecContext(ctx, "INSERT INTO sessions(user_id, session_token, expires_at) VALUES(?, ?, ?)", userID, sessionToken, expiresAt)
 	if err != nil {
 		return "", err
 	}
@@ -270,56 +618,34 @@ func CreateSession(userID int64) (string, error) {
 }
 
 // ValidateSession validates a session token and returns the user ID if valid
-func ValidateSession(sessionToken string) (*User, error) {
+func ValidateSession(ctx context.Context, sessionToken string) (*User, error) {
 	// Get session and user information
-	selCols := fmt.Sprintf("u.id, u.%s, u.email", usersNameColumn)
-	if hasCompanyColumn {
-		selCols += ", u.company"
-	}
-	selCols += ", u.password_hash, u.created_at, u.updated_at"
 	query := fmt.Sprintf(`
 		SELECT %s
 		FROM users u 
 		INNER JOIN sessions s ON u.id = s.user_id 
-		WHERE s.session_token = ? AND s.expires_at > ?`, selCols)
-
-	row := DB.QueryRow(query, sessionToken, time.Now())
+		WHERE s.session_token = ? AND s.expires_at > ? AND u.disabled = 0`, userSelectCols("u"))
 
-	user := &User{}
-	var err error
-	if hasCompanyColumn {
-		err = row.Scan(&user.ID, &user.Name, &user.Email, &user.Company, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt)
-	} else {
-		err = row.Scan(&user.ID, &user.Name, &user.Email, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt)
-		user.Company = ""
-	}
-	if err != nil {
-		return nil, err
-	}
-
-	return user, nil
+	return scanUser(DB.QueryRowContext(ctx, query, sessionToken, time.Now()))
 }
 
 // CleanupExpiredSessions removes old sessions. Call periodically instead of on every ValidateSession.
-func CleanupExpiredSessions() error {
-	_, err := DB.Exec("DELETE FROM sessions WHERE expires_at < ?", time.Now())
+func CleanupExpiredSessions(ctx context.Context) error {
+	if _, err := DB.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at < ?", time.Now()); err != nil {
+		return err
+	}
+	_, err := DB.ExecContext(ctx, "DELETE FROM impersonations WHERE session_token NOT IN (SELECT session_token FROM sessions)")
 	return err
 }
 
 // DeleteSession deletes a session
-func DeleteSession(sessionToken string) error {
-	stmt, err := DB.Prepare("DELETE FROM sessions WHERE session_token = ?")
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(sessionToken)
+func DeleteSession(ctx context.Context, sessionToken string) error {
+	_, err := DB.ExecContext(ctx, "DELETE FROM sessions WHERE session_token = ?", sessionToken)
 	return err
 }
 
 // UpdateUser updates user profile information
-func UpdateUser(userID int64, name, email, company string) error {
+func UpdateUser(ctx context.Context, userID int64, name, email, company string) error {
 	// Build update for profile
 	setClause := fmt.Sprintf("%s = ?, email = ?", usersNameColumn)
 	args := []any{name, email}
@@ -331,24 +657,137 @@ func UpdateUser(userID int64, name, email, company string) error {
 	query := fmt.Sprintf("UPDATE users SET %s WHERE id = ?", setClause)
 	args = append(args, userID)
 
-	stmt, err := DB.Prepare(query)
+	_, err := DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// UpdateUserPassword sets a new password hash, keeping the previous one in the history
+// trimmed to keepHistory entries
+func UpdateUserPassword(ctx context.Context, userID int64, passwordHash string, keepHistory int) error {
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
+
+	if err := updateUserPassword(tx, userID, passwordHash, keepHistory, false); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateUserPassword(tx *Tx, userID int64, passwordHash string, keepHistory int, mustChange bool) error {
+	// Move the current hash into the history; accounts without a password have nothing to keep
+	if keepHistory > 0 {
+		if _, err := tx.Exec(`INSERT INTO password_history (user_id, password_hash)
+			SELECT id, password_hash FROM users WHERE id = ? AND password_hash != ''`, userID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM password_history WHERE user_id = ? AND id NOT IN (
+		SELECT id FROM password_history WHERE user_id = ? ORDER BY id DESC LIMIT ?)`, userID, userID, keepHistory); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE users SET password_hash = ?, password_must_change = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", passwordHash, mustChange, userID)
+	return err
+}
 
-	_, err = stmt.Exec(args...)
+// RehashUserPassword replaces a password hash with an equivalent stronger one. It does nothing
+// when the password was changed since oldHash was read.
+func RehashUserPassword(ctx context.Context, userID int64, oldHash, newHash string) error {
+	_, err := DB.ExecContext(ctx, "UPDATE users SET password_hash = ? WHERE id = ? AND password_hash = ?", newHash, userID, oldHash)
 	return err
 }
 
-// UpdateUserPassword updates user password
-func UpdateUserPassword(userID int64, passwordHash string) error {
-	stmt, err := DB.Prepare("UPDATE users SET password_hash = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?")
+// PasswordHistory returns up to n previous password hashes of a user, newest first
+func PasswordHistory(ctx context.Context, userID int64, n int) ([]string, error) {
+	rows, err := DB.QueryContext(ctx, "SELECT password_hash FROM password_history WHERE user_id = ? ORDER BY id DESC LIMIT ?", userID, n)
 	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, rows.Err()
+}
+
+// SetUserDisabled disables or re-enables an account. Disabling signs the user out
+// everywhere: sessions are deleted and OAuth grants revoked in the same transaction.
+func SetUserDisabled(ctx context.Context, userID int64, disabled bool) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET disabled = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", disabled, userID); err != nil {
 		return err
 	}
-	defer stmt.Close()
+	if disabled {
+		if err := revokeUserCredentials(tx, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// revokeUserCredentials deletes a user's sessions and pending codes and revokes their OAuth tokens
+func revokeUserCredentials(tx *Tx, userID int64) error {
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete sessions: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM oauth_codes WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete oauth codes: %v", err)
+	}
+	if _, err := tx.Exec("UPDATE oauth_tokens SET revoked = 1 WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to revoke oauth tokens: %v", err)
+	}
+	return nil
+}
+
+// DeleteUser removes a user and everything attached to the account. Foreign key
+// cascades are not relied on, so dependent rows are deleted explicitly.
+func DeleteUser(ctx context.Context, userID int64) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteUser(tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func deleteUser(tx *Tx, userID int64) error {
+	for _, table := range []string{"sessions", "oauth_codes", "oauth_tokens", "oauth_consents", "user_identities", "scim_group_members", "password_history", "magic_links"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", userID); err != nil {
+			return fmt.Errorf("failed to delete from %s: %v", table, err)
+		}
+	}
+	for _, table := range []string{"oauth_clients", "scim_tokens"} {
+		if _, err := tx.Exec("UPDATE "+table+" SET created_by = NULL WHERE created_by = ?", userID); err != nil {
+			return fmt.Errorf("failed to update %s: %v", table, err)
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM impersonations WHERE user_id = ? OR admin_id = ?", userID, userID); err != nil {
+		return fmt.Errorf("failed to delete from impersonations: %v", err)
+	}
+	_, err := tx.Exec("DELETE FROM users WHERE id = ?", userID)
+	return err
+}
 
-	_, err = stmt.Exec(passwordHash, userID)
+// SetUserRole changes a user's role. The role is then the administrator's decision, so
+// SCIM group mappings no longer take it away.
+func SetUserRole(ctx context.Context, userID int64, role string) error {
+	_, err := DB.ExecContext(ctx, "UPDATE users SET role = ?, role_from_scim = 0, updated_at = CURRENT_TIMESTAMP WHERE id = ?", role, userID)
 	return err
 }
@@ -0,0 +1,58 @@
+package orm
+
+import (
+	"context"
+	"os"
+)
+
+// Ping checks that the database file is still in place and answers a query. An open
+// connection keeps working after the file is deleted, which Ping reports instead of hiding.
+func Ping(ctx context.Context) error {
+	if _, err := os.Stat(dbFile); err != nil {
+		return err
+	}
+	var one int
+	return DB.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+// SchemaState compares the database with the schema this build expects
+type SchemaState struct {
+	Version       int      // PRAGMA user_version of the database
+	MissingTables []string // tables Init creates that are not there
+}
+
+// Current reports whether the database has exactly the schema of this build
+func (s *SchemaState) Current() bool {
+	return s.Version == SchemaVersion && len(s.MissingTables) == 0
+}
+
+// CheckSchema reads the schema version and looks for every table Init creates. A version
+// above SchemaVersion means a newer build has migrated the database.
+func CheckSchema(ctx context.Context) (*SchemaState, error) {
+	s := &SchemaState{}
+	if err := DB.QueryRowContext(ctx, "PRAGMA user_version").Scan(&s.Version); err != nil {
+		return nil, err
+	}
+	rows, err := DB.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	present := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		present[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, t := range schemaTables {
+		if !present[t] {
+			s.MissingTables = append(s.MissingTables, t)
+		}
+	}
+	return s, nil
+}
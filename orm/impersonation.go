@@ -0,0 +1,77 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Impersonation is a session an admin opened as another user
+type Impersonation struct {
+	AdminID    int64
+	AdminEmail string // empty when the admin account no longer exists
+	AdminOK    bool   // the admin account is enabled and still has the admin role
+	UserID     int64
+	Reason     string
+	CreatedAt  time.Time
+}
+
+// CreateImpersonation opens a session for userID on behalf of adminID, valid for ttl
+func CreateImpersonation(ctx context.Context, adminID, userID int64, reason string, ttl time.Duration) (string, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	token := uuid.New().String()
+	now := time.Now()
+	if _, err := tx.Exec("INSERT INTO sessions(user_id, session_token, expires_at) VALUES(?, ?, ?)", userID, token, now.Add(ttl)); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("INSERT INTO impersonations(session_token, admin_id, user_id, reason, created_at) VALUES(?, ?, ?, ?, ?)",
+		token, adminID, userID, nullString(reason), now.UTC()); err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// GetImpersonation returns the impersonation behind a session token, or sql.ErrNoRows for
+// an ordinary session
+func GetImpersonation(ctx context.Context, sessionToken string) (*Impersonation, error) {
+	imp := &Impersonation{}
+	var email, role, reason sql.NullString
+	var disabled sql.NullBool
+	err := DB.QueryRowContext(ctx, `
+		SELECT i.admin_id, a.email, a.role, a.disabled, i.user_id, i.reason, i.created_at
+		FROM impersonations i
+		LEFT JOIN users a ON a.id = i.admin_id
+		WHERE i.session_token = ?`, sessionToken).
+		Scan(&imp.AdminID, &email, &role, &disabled, &imp.UserID, &reason, &imp.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	imp.AdminEmail = email.String
+	imp.AdminOK = email.Valid && role.String == RoleAdmin && !disabled.Bool
+	imp.Reason = reason.String
+	return imp, nil
+}
+
+// EndImpersonation deletes an impersonation session
+func EndImpersonation(ctx context.Context, sessionToken string) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM impersonations WHERE session_token = ?", sessionToken); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE session_token = ?", sessionToken); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,79 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// MagicLink is a pending passwordless sign-in
+type MagicLink struct {
+	ID          int64
+	TokenHash   string
+	BrowserHash string // digest of the cookie set in the browser that asked for the link
+	UserID      int64  // 0 when no account matched the email
+	Email       string
+	IP          string
+	NextPath    string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// magicLinkRetention keeps requests long enough to count them against rate limits
+const magicLinkRetention = 24 * time.Hour
+
+// CreateMagicLink stores a sign-in link request
+func CreateMagicLink(ctx context.Context, l *MagicLink) error {
+	var userID any
+	if l.UserID != 0 {
+		userID = l.UserID
+	}
+	res, err := DB.ExecContext(ctx, `INSERT INTO magic_links(token_hash, browser_hash, user_id, email, ip, next_path, created_at, expires_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+		l.TokenHash, l.BrowserHash, userID, l.Email, nullString(l.IP), nullString(l.NextPath), l.CreatedAt, l.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	l.ID, err = res.LastInsertId()
+	return err
+}
+
+// CountMagicLinks returns how many links were requested for an email and from an IP since a time
+func CountMagicLinks(ctx context.Context, email, ip string, since time.Time) (byEmail, byIP int, err error) {
+	if err = DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM magic_links WHERE email = ? AND created_at >= ?", email, since).Scan(&byEmail); err != nil {
+		return
+	}
+	err = DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM magic_links WHERE ip = ? AND created_at >= ?", ip, since).Scan(&byIP)
+	return
+}
+
+// GetMagicLink returns an unused, unexpired link by token digest
+func GetMagicLink(ctx context.Context, tokenHash string) (*MagicLink, error) {
+	l := &MagicLink{}
+	var userID sql.NullInt64
+	var ip, next sql.NullString
+	err := DB.QueryRowContext(ctx, `SELECT id, token_hash, browser_hash, user_id, email, ip, next_path, created_at, expires_at
+		FROM magic_links WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?`, tokenHash, time.Now()).
+		Scan(&l.ID, &l.TokenHash, &l.BrowserHash, &userID, &l.Email, &ip, &next, &l.CreatedAt, &l.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	l.UserID, l.IP, l.NextPath = userID.Int64, ip.String, next.String
+	return l, nil
+}
+
+// UseMagicLink marks a link used. It reports false when another request used it first.
+func UseMagicLink(ctx context.Context, id int64) (bool, error) {
+	res, err := DB.ExecContext(ctx, "UPDATE magic_links SET used_at = ? WHERE id = ? AND used_at IS NULL", time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// CleanupExpiredMagicLinks removes requests older than the rate-limit window
+func CleanupExpiredMagicLinks(ctx context.Context) error {
+	_, err := DB.ExecContext(ctx, "DELETE FROM magic_links WHERE created_at < ?", time.Now().Add(-magicLinkRetention))
+	return err
+}
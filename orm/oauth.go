@@ -0,0 +1,254 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// OAuth token kinds stored in oauth_tokens
+const (
+	OAuthAccessToken  = "access"
+	OAuthRefreshToken = "refresh"
+)
+
+// OAuthClient is a third-party application allowed to request access on behalf of users
+type OAuthClient struct {
+	ID           int64     `json:"id"`
+	ClientID     string    `json:"client_id"`
+	SecretHash   string    `json:"-"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       string    `json:"scopes"`
+	CreatedBy    int64     `json:"created_by,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Public reports whether the client has no secret (native and browser apps relying on PKCE alone)
+func (c *OAuthClient) Public() bool {
+	return c.SecretHash == ""
+}
+
+const oauthClientSelectCols = "id, client_id, secret_hash, name, redirect_uris, scopes, created_by, created_at"
+
+func scanOAuthClient(row rowScanner) (*OAuthClient, error) {
+	c := &OAuthClient{}
+	var secret sql.NullString
+	var uris string
+	var createdBy sql.NullInt64
+	if err := row.Scan(&c.ID, &c.ClientID, &secret, &c.Name, &uris, &c.Scopes, &createdBy, &c.CreatedAt); err != nil {
+		return nil, err
+	}
+	c.SecretHash = secret.String
+	c.RedirectURIs = strings.Fields(uris)
+	c.CreatedBy = createdBy.Int64
+	return c, nil
+}
+
+// CreateOAuthClient registers a client; redirect URIs are stored space-separated
+func CreateOAuthClient(ctx context.Context, c *OAuthClient) error {
+	var createdBy sql.NullInt64
+	if c.CreatedBy > 0 {
+		createdBy = sql.NullInt64{Int64: c.CreatedBy, Valid: true}
+	}
+	res, err := DB.ExecContext(ctx, "INSERT INTO oauth_clients(client_id, secret_hash, name, redirect_uris, scopes, created_by) VALUES(?, ?, ?, ?, ?, ?)",
+		c.ClientID, nullString(c.SecretHash), c.Name, strings.Join(c.RedirectURIs, " "), c.Scopes, createdBy)
+	if err != nil {
+		return err
+	}
+	c.ID, err = res.LastInsertId()
+	return err
+}
+
+// GetOAuthClient retrieves a client by its public client_id
+func GetOAuthClient(ctx context.Context, clientID string) (*OAuthClient, error) {
+	return scanOAuthClient(DB.QueryRowContext(ctx, "SELECT "+oauthClientSelectCols+" FROM oauth_clients WHERE client_id = ?", clientID))
+}
+
+// ListOAuthClients returns all registered clients, newest first
+func ListOAuthClients(ctx context.Context) ([]*OAuthClient, error) {
+	rows, err := DB.QueryContext(ctx, "SELECT "+oauthClientSelectCols+" FROM oauth_clients ORDER BY id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := make([]*OAuthClient, 0)
+	for rows.Next() {
+		c, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+// DeleteOAuthClient removes a client together with its codes, tokens and consents
+func DeleteOAuthClient(ctx context.Context, clientID string) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"oauth_codes", "oauth_tokens", "oauth_consents", "oauth_clients"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE client_id = ?", clientID); err != nil {
+			return fmt.Errorf("failed to delete from %s: %v", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// OAuthCode is a pending authorization code
+type OAuthCode struct {
+	CodeHash      string
+	ClientID      string
+	UserID        int64
+	RedirectURI   string
+	Scope         string
+	CodeChallenge string
+	ExpiresAt     time.Time
+}
+
+// CreateOAuthCode stores an authorization code by its hash
+func CreateOAuthCode(ctx context.Context, code *OAuthCode) error {
+	_, err := DB.ExecContext(ctx, `INSERT INTO oauth_codes(code_hash, client_id, user_id, redirect_uri, scope, code_challenge, expires_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?)`,
+		code.CodeHash, code.ClientID, code.UserID, code.RedirectURI, code.Scope, code.CodeChallenge, code.ExpiresAt)
+	return err
+}
+
+// ConsumeOAuthCode returns and deletes an authorization code; expired codes are not returned
+func ConsumeOAuthCode(ctx context.Context, codeHash string) (*OAuthCode, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	code := &OAuthCode{}
+	err = tx.QueryRow(`SELECT code_hash, client_id, user_id, redirect_uri, scope, code_challenge, expires_at
+		FROM oauth_codes WHERE code_hash = ?`, codeHash).
+		Scan(&code.CodeHash, &code.ClientID, &code.UserID, &code.RedirectURI, &code.Scope, &code.CodeChallenge, &code.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec("DELETE FROM oauth_codes WHERE code_hash = ?", codeHash); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	if time.Now().After(code.ExpiresAt) {
+		return nil, sql.ErrNoRows
+	}
+	return code, nil
+}
+
+// OAuthToken is an issued access or refresh token
+type OAuthToken struct {
+	TokenHash string
+	Kind      string
+	FamilyID  string
+	ClientID  string
+	UserID    int64
+	Scope     string
+	ExpiresAt time.Time
+	Revoked   bool
+	CreatedAt time.Time
+}
+
+// Active reports whether the token can still be used
+func (t *OAuthToken) Active() bool {
+	return !t.Revoked && time.Now().Before(t.ExpiresAt)
+}
+
+const oauthTokenSelectCols = "token_hash, kind, family_id, client_id, user_id, scope, expires_at, revoked, created_at"
+
+func scanOAuthToken(row rowScanner) (*OAuthToken, error) {
+	t := &OAuthToken{}
+	if err := row.Scan(&t.TokenHash, &t.Kind, &t.FamilyID, &t.ClientID, &t.UserID, &t.Scope, &t.ExpiresAt, &t.Revoked, &t.CreatedAt); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// CreateOAuthToken stores an issued token by its hash
+func CreateOAuthToken(ctx context.Context, t *OAuthToken) error {
+	_, err := DB.ExecContext(ctx, `INSERT INTO oauth_tokens(token_hash, kind, family_id, client_id, user_id, scope, expires_at, created_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.TokenHash, t.Kind, t.FamilyID, t.ClientID, t.UserID, t.Scope, t.ExpiresAt, time.Now())
+	return err
+}
+
+// GetOAuthToken looks up a token by its hash, including revoked and expired ones
+func GetOAuthToken(ctx context.Context, tokenHash string) (*OAuthToken, error) {
+	return scanOAuthToken(DB.QueryRowContext(ctx, "SELECT "+oauthTokenSelectCols+" FROM oauth_tokens WHERE token_hash = ?", tokenHash))
+}
+
+// ValidateOAuthAccessToken returns the user and token for an active access token
+func ValidateOAuthAccessToken(ctx context.Context, tokenHash string) (*User, *OAuthToken, error) {
+	t, err := GetOAuthToken(ctx, tokenHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.Kind != OAuthAccessToken || !t.Active() {
+		return nil, nil, sql.ErrNoRows
+	}
+	user, err := GetUserByID(ctx, t.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Disabled {
+		return nil, nil, sql.ErrNoRows
+	}
+	return user, t, nil
+}
+
+// RevokeOAuthToken marks a single token revoked. It reports false when the token was
+// already revoked, which lets refresh token rotation detect concurrent reuse.
+func RevokeOAuthToken(ctx context.Context, tokenHash string) (bool, error) {
+	res, err := DB.ExecContext(ctx, "UPDATE oauth_tokens SET revoked = 1 WHERE token_hash = ? AND revoked = 0", tokenHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// RevokeOAuthTokenFamily revokes every token descending from one authorization
+func RevokeOAuthTokenFamily(ctx context.Context, familyID string) error {
+	_, err := DB.ExecContext(ctx, "UPDATE oauth_tokens SET revoked = 1 WHERE family_id = ?", familyID)
+	return err
+}
+
+// GetOAuthConsent returns the scopes a user has approved for a client ("" when none)
+func GetOAuthConsent(ctx context.Context, userID int64, clientID string) (string, error) {
+	var scope string
+	err := DB.QueryRowContext(ctx, "SELECT scope FROM oauth_consents WHERE user_id = ? AND client_id = ?", userID, clientID).Scan(&scope)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return scope, err
+}
+
+// SaveOAuthConsent records the scopes a user approved for a client
+func SaveOAuthConsent(ctx context.Context, userID int64, clientID, scope string) error {
+	_, err := DB.ExecContext(ctx, `INSERT INTO oauth_consents(user_id, client_id, scope) VALUES(?, ?, ?)
+		ON CONFLICT(user_id, client_id) DO UPDATE SET scope = excluded.scope, updated_at = CURRENT_TIMESTAMP`,
+		userID, clientID, scope)
+	return err
+}
+
+// CleanupExpiredOAuth removes expired authorization codes and tokens
+func CleanupExpiredOAuth(ctx context.Context) error {
+	now := time.Now()
+	if _, err := DB.ExecContext(ctx, "DELETE FROM oauth_codes WHERE expires_at < ?", now); err != nil {
+		return err
+	}
+	_, err := DB.ExecContext(ctx, "DELETE FROM oauth_tokens WHERE expires_at < ?", now)
+	return err
+}
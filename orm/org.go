@@ -0,0 +1,99 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Organization groups users and owns per-organization settings such as identity providers
+type Organization struct {
+	ID        int64     `json:"id"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const orgSelectCols = "id, slug, name, created_at"
+
+func scanOrganization(row rowScanner) (*Organization, error) {
+	org := &Organization{}
+	if err := row.Scan(&org.ID, &org.Slug, &org.Name, &org.CreatedAt); err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+// CreateOrganization creates a new organization
+func CreateOrganization(ctx context.Context, slug, name string) (int64, error) {
+	res, err := DB.ExecContext(ctx, "INSERT INTO organizations(slug, name) VALUES(?, ?)", slug, name)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// GetOrganizationBySlug retrieves an organization by its URL slug
+func GetOrganizationBySlug(ctx context.Context, slug string) (*Organization, error) {
+	return scanOrganization(DB.QueryRowContext(ctx, "SELECT "+orgSelectCols+" FROM organizations WHERE slug = ?", slug))
+}
+
+// GetOrganizationByID retrieves an organization by id
+func GetOrganizationByID(ctx context.Context, orgID int64) (*Organization, error) {
+	return scanOrganization(DB.QueryRowContext(ctx, "SELECT "+orgSelectCols+" FROM organizations WHERE id = ?", orgID))
+}
+
+// ListOrganizations returns all organizations ordered by slug
+func ListOrganizations(ctx context.Context) ([]*Organization, error) {
+	rows, err := DB.QueryContext(ctx, "SELECT "+orgSelectCols+" FROM organizations ORDER BY slug")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := make([]*Organization, 0)
+	for rows.Next() {
+		org, err := scanOrganization(rows)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs, rows.Err()
+}
+
+// DeleteOrganization deletes an organization; members are detached, not deleted
+func DeleteOrganization(ctx context.Context, orgID int64) error {
+	_, err := DB.ExecContext(ctx, "DELETE FROM organizations WHERE id = ?", orgID)
+	return err
+}
+
+// SetUserOrganization assigns a user to an organization; orgID 0 detaches the user
+func SetUserOrganization(ctx context.Context, userID, orgID int64) error {
+	var org sql.NullInt64
+	if orgID > 0 {
+		org = sql.NullInt64{Int64: orgID, Valid: true}
+	}
+	_, err := DB.ExecContext(ctx, "UPDATE users SET org_id = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", org, userID)
+	return err
+}
+
+// ListOrganizationUsers returns the members of an organization ordered by id
+func ListOrganizationUsers(ctx context.Context, orgID int64) ([]*User, error) {
+	rows, err := DB.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM users WHERE org_id = ? ORDER BY id", userSelectCols("")), orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]*User, 0)
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
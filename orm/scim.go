@@ -0,0 +1,326 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SCIMToken authenticates an organization's provisioning client. Only its hash is stored.
+type SCIMToken struct {
+	ID          int64      `json:"id"`
+	OrgID       int64      `json:"org_id"`
+	TokenHash   string     `json:"-"`
+	Description string     `json:"description"`
+	CreatedBy   int64      `json:"created_by,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+}
+
+const scimTokenSelectCols = "id, org_id, token_hash, description, created_by, created_at, last_used_at"
+
+func scanSCIMToken(row rowScanner) (*SCIMToken, error) {
+	t := &SCIMToken{}
+	var desc sql.NullString
+	var createdBy sql.NullInt64
+	var lastUsed sql.NullTime
+	if err := row.Scan(&t.ID, &t.OrgID, &t.TokenHash, &desc, &createdBy, &t.CreatedAt, &lastUsed); err != nil {
+		return nil, err
+	}
+	t.Description = desc.String
+	t.CreatedBy = createdBy.Int64
+	if lastUsed.Valid {
+		t.LastUsedAt = &lastUsed.Time
+	}
+	return t, nil
+}
+
+// CreateSCIMToken stores a provisioning token by its hash
+func CreateSCIMToken(ctx context.Context, t *SCIMToken) error {
+	var createdBy sql.NullInt64
+	if t.CreatedBy > 0 {
+		createdBy = sql.NullInt64{Int64: t.CreatedBy, Valid: true}
+	}
+	res, err := DB.ExecContext(ctx, "INSERT INTO scim_tokens(org_id, token_hash, description, created_by) VALUES(?, ?, ?, ?)",
+		t.OrgID, t.TokenHash, nullString(t.Description), createdBy)
+	if err != nil {
+		return err
+	}
+	t.ID, err = res.LastInsertId()
+	return err
+}
+
+// GetSCIMTokenByHash looks up a provisioning token and records that it was used
+func GetSCIMTokenByHash(ctx context.Context, tokenHash string) (*SCIMToken, error) {
+	t, err := scanSCIMToken(DB.QueryRowContext(ctx, "SELECT "+scimTokenSelectCols+" FROM scim_tokens WHERE token_hash = ?", tokenHash))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := DB.ExecContext(ctx, "UPDATE scim_tokens SET last_used_at = ? WHERE id = ?", time.Now(), t.ID); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ListSCIMTokens returns an organization's provisioning tokens, newest first
+func ListSCIMTokens(ctx context.Context, orgID int64) ([]*SCIMToken, error) {
+	rows, err := DB.QueryContext(ctx, "SELECT "+scimTokenSelectCols+" FROM scim_tokens WHERE org_id = ? ORDER BY id DESC", orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]*SCIMToken, 0)
+	for rows.Next() {
+		t, err := scanSCIMToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteSCIMToken revokes a provisioning token; it reports false when the token does not exist
+func DeleteSCIMToken(ctx context.Context, orgID, id int64) (bool, error) {
+	res, err := DB.ExecContext(ctx, "DELETE FROM scim_tokens WHERE org_id = ? AND id = ?", orgID, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// SCIMExternalIDs maps user ids to the externalId assigned by an organization's provisioning client
+func SCIMExternalIDs(ctx context.Context, orgSlug string) (map[int64]string, error) {
+	rows, err := DB.QueryContext(ctx, "SELECT user_id, subject FROM user_identities WHERE provider = ? AND issuer = ?", ProviderSCIM, orgSlug)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := map[int64]string{}
+	for rows.Next() {
+		var userID int64
+		var subject string
+		if err := rows.Scan(&userID, &subject); err != nil {
+			return nil, err
+		}
+		ids[userID] = subject
+	}
+	return ids, rows.Err()
+}
+
+// SetSCIMExternalID replaces the externalId of a user; an empty externalID removes it
+func SetSCIMExternalID(ctx context.Context, userID int64, orgSlug, externalID string) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM user_identities WHERE user_id = ? AND provider = ? AND issuer = ?", userID, ProviderSCIM, orgSlug); err != nil {
+		return err
+	}
+	if externalID != "" {
+		if _, err := tx.Exec("INSERT INTO user_identities(user_id, provider, issuer, subject) VALUES(?, ?, ?, ?)",
+			userID, ProviderSCIM, orgSlug, externalID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SCIMGroup is a group pushed by an organization's provisioning client
+type SCIMGroup struct {
+	ID          int64     `json:"id"`
+	OrgID       int64     `json:"org_id"`
+	DisplayName string    `json:"display_name"`
+	ExternalID  string    `json:"external_id,omitempty"`
+	Role        string    `json:"role,omitempty"` // role granted to members; empty grants nothing
+	Members     []int64   `json:"members"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+const scimGroupSelectCols = "id, org_id, display_name, external_id, role, created_at, updated_at"
+
+func scanSCIMGroup(row rowScanner) (*SCIMGroup, error) {
+	g := &SCIMGroup{Members: []int64{}}
+	var externalID, role sql.NullString
+	if err := row.Scan(&g.ID, &g.OrgID, &g.DisplayName, &externalID, &role, &g.CreatedAt, &g.UpdatedAt); err != nil {
+		return nil, err
+	}
+	g.ExternalID = externalID.String
+	g.Role = role.String
+	return g, nil
+}
+
+// ListSCIMGroups returns an organization's groups with their members, ordered by id
+func ListSCIMGroups(ctx context.Context, orgID int64) ([]*SCIMGroup, error) {
+	rows, err := DB.QueryContext(ctx, "SELECT "+scimGroupSelectCols+" FROM scim_groups WHERE org_id = ? ORDER BY id", orgID)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]*SCIMGroup, 0)
+	byID := map[int64]*SCIMGroup{}
+	for rows.Next() {
+		g, err := scanSCIMGroup(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		groups = append(groups, g)
+		byID[g.ID] = g
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	members, err := DB.QueryContext(ctx, `SELECT m.group_id, m.user_id FROM scim_group_members m
+		INNER JOIN scim_groups g ON g.id = m.group_id WHERE g.org_id = ? ORDER BY m.user_id`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer members.Close()
+	for members.Next() {
+		var groupID, userID int64
+		if err := members.Scan(&groupID, &userID); err != nil {
+			return nil, err
+		}
+		if g := byID[groupID]; g != nil {
+			g.Members = append(g.Members, userID)
+		}
+	}
+	return groups, members.Err()
+}
+
+// GetSCIMGroup returns one of an organization's groups with its members
+func GetSCIMGroup(ctx context.Context, orgID, id int64) (*SCIMGroup, error) {
+	g, err := scanSCIMGroup(DB.QueryRowContext(ctx, "SELECT "+scimGroupSelectCols+" FROM scim_groups WHERE org_id = ? AND id = ?", orgID, id))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := DB.QueryContext(ctx, "SELECT user_id FROM scim_group_members WHERE group_id = ? ORDER BY user_id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		g.Members = append(g.Members, userID)
+	}
+	return g, rows.Err()
+}
+
+// SaveSCIMGroup creates a group (ID 0) or replaces its name, externalId and members.
+// The role mapping is left untouched.
+func SaveSCIMGroup(ctx context.Context, g *SCIMGroup) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if g.ID == 0 {
+		res, err := tx.Exec("INSERT INTO scim_groups(org_id, display_name, external_id) VALUES(?, ?, ?)",
+			g.OrgID, g.DisplayName, nullString(g.ExternalID))
+		if err != nil {
+			return err
+		}
+		if g.ID, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	} else {
+		if _, err := tx.Exec("UPDATE scim_groups SET display_name = ?, external_id = ?, updated_at = CURRENT_TIMESTAMP WHERE org_id = ? AND id = ?",
+			g.DisplayName, nullString(g.ExternalID), g.OrgID, g.ID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM scim_group_members WHERE group_id = ?", g.ID); err != nil {
+			return err
+		}
+	}
+	for _, userID := range g.Members {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO scim_group_members(group_id, user_id) VALUES(?, ?)", g.ID, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteSCIMGroup removes a group and its memberships
+func DeleteSCIMGroup(ctx context.Context, orgID, id int64) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM scim_group_members WHERE group_id IN (SELECT id FROM scim_groups WHERE org_id = ? AND id = ?)", orgID, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM scim_groups WHERE org_id = ? AND id = ?", orgID, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetSCIMGroupRole maps a group to a role granted to its members; "" removes the mapping
+func SetSCIMGroupRole(ctx context.Context, orgID, id int64, role string) error {
+	_, err := DB.ExecContext(ctx, "UPDATE scim_groups SET role = ?, updated_at = CURRENT_TIMESTAMP WHERE org_id = ? AND id = ?",
+		nullString(role), orgID, id)
+	return err
+}
+
+// SyncSCIMGroupRoles applies role-mapped group memberships to users whose memberships or
+// mappings changed. Members of a group mapped to admin become admins. The mappings only take
+// away what they granted: an admin they made goes back to user once no mapped group grants
+// admin, while admins promoted any other way keep their role. A demotion that would leave no
+// enabled admin is skipped; the users kept as admins for that reason are returned.
+func SyncSCIMGroupRoles(ctx context.Context, userIDs []int64) ([]int64, error) {
+	kept := []int64{}
+	for _, userID := range userIDs {
+		var grants int
+		err := DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM scim_groups g
+			INNER JOIN scim_group_members m ON m.group_id = g.id
+			WHERE m.user_id = ? AND g.role = ?`, userID, RoleAdmin).Scan(&grants)
+		if err != nil {
+			return nil, err
+		}
+		var role string
+		var fromSCIM bool
+		err = DB.QueryRowContext(ctx, "SELECT role, role_from_scim FROM users WHERE id = ?", userID).Scan(&role, &fromSCIM)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case grants > 0 && role != RoleAdmin:
+			_, err = DB.ExecContext(ctx, "UPDATE users SET role = ?, role_from_scim = 1, updated_at = CURRENT_TIMESTAMP WHERE id = ?", RoleAdmin, userID)
+		case grants == 0 && role == RoleAdmin && fromSCIM:
+			// Checked in the same statement so concurrent demotions cannot both pass
+			var res sql.Result
+			res, err = DB.ExecContext(ctx, `UPDATE users SET role = ?, role_from_scim = 0, updated_at = CURRENT_TIMESTAMP
+				WHERE id = ? AND EXISTS (SELECT 1 FROM users WHERE id != ? AND role = ? AND disabled = 0 AND deletion_scheduled_at IS NULL)`,
+				RoleUser, userID, userID, RoleAdmin)
+			if err == nil {
+				if n, _ := res.RowsAffected(); n == 0 {
+					kept = append(kept, userID)
+				}
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to set role of user %d: %v", userID, err)
+		}
+	}
+	return kept, nil
+}
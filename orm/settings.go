@@ -0,0 +1,14 @@
+package orm
+
+import "context"
+
+// InitSetting stores value under key unless the key is already set, and returns the stored
+// value. Concurrent callers (or servers sharing the database) all end up with the same one.
+func InitSetting(ctx context.Context, key, value string) (string, error) {
+	if _, err := DB.ExecContext(ctx, "INSERT OR IGNORE INTO settings(key, value) VALUES(?, ?)", key, value); err != nil {
+		return "", err
+	}
+	var stored string
+	err := DB.QueryRowContext(ctx, "SELECT value FROM settings WHERE key = ?", key).Scan(&stored)
+	return stored, err
+}
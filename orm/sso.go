@@ -0,0 +1,303 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Identity providers linked through user_identities
+const (
+	ProviderOIDC = "oidc"
+	ProviderSAML = "saml"
+	ProviderSCIM = "scim" // externalId assigned by an organization's provisioning client
+)
+
+// OIDCProvider is an organization's OpenID Connect identity provider configuration
+type OIDCProvider struct {
+	ID           int64     `json:"id"`
+	OrgID        int64     `json:"org_id"`
+	Issuer       string    `json:"issuer"`
+	ClientID     string    `json:"client_id"`
+	ClientSecret string    `json:"-"`
+	Scopes       string    `json:"scopes"`
+	EmailDomains string    `json:"email_domains"` // comma-separated, used to route users to their IdP
+	Enabled      bool      `json:"enabled"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+const oidcProviderSelectCols = "id, org_id, issuer, client_id, client_secret, scopes, email_domains, enabled, created_at, updated_at"
+
+func scanOIDCProvider(row rowScanner) (*OIDCProvider, error) {
+	p := &OIDCProvider{}
+	var secret, domains sql.NullString
+	if err := row.Scan(&p.ID, &p.OrgID, &p.Issuer, &p.ClientID, &secret, &p.Scopes, &domains, &p.Enabled, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	p.ClientSecret = secret.String
+	p.EmailDomains = domains.String
+	return p, nil
+}
+
+// GetOIDCProvider returns the OIDC configuration of an organization
+func GetOIDCProvider(ctx context.Context, orgID int64) (*OIDCProvider, error) {
+	return scanOIDCProvider(DB.QueryRowContext(ctx, "SELECT "+oidcProviderSelectCols+" FROM oidc_providers WHERE org_id = ?", orgID))
+}
+
+// FindOIDCProviderByEmailDomain returns the enabled provider claiming the domain of the given email
+func FindOIDCProviderByEmailDomain(ctx context.Context, email string) (*OIDCProvider, error) {
+	domain := emailDomain(email)
+	if domain == "" {
+		return nil, sql.ErrNoRows
+	}
+
+	rows, err := DB.QueryContext(ctx, "SELECT "+oidcProviderSelectCols+" FROM oidc_providers WHERE enabled = 1 AND email_domains IS NOT NULL AND email_domains != ''")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanOIDCProvider(rows)
+		if err != nil {
+			return nil, err
+		}
+		if domainListed(p.EmailDomains, domain) {
+			return p, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return nil, sql.ErrNoRows
+}
+
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(email[at+1:])
+}
+
+// domainListed reports whether domain appears in a comma-separated domain list
+func domainListed(list, domain string) bool {
+	for _, d := range strings.Split(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(d), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// SaveOIDCProvider creates or replaces an organization's OIDC configuration.
+// An empty ClientSecret keeps the stored secret.
+func SaveOIDCProvider(ctx context.Context, p *OIDCProvider) error {
+	_, err := DB.ExecContext(ctx, `
+		INSERT INTO oidc_providers(org_id, issuer, client_id, client_secret, scopes, email_domains, enabled)
+		VALUES(?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(org_id) DO UPDATE SET
+			issuer = excluded.issuer,
+			client_id = excluded.client_id,
+			client_secret = COALESCE(excluded.client_secret, oidc_providers.client_secret),
+			scopes = excluded.scopes,
+			email_domains = excluded.email_domains,
+			enabled = excluded.enabled,
+			updated_at = CURRENT_TIMESTAMP`,
+		p.OrgID, p.Issuer, p.ClientID, nullString(p.ClientSecret), p.Scopes, p.EmailDomains, p.Enabled)
+	return err
+}
+
+// DeleteOIDCProvider removes an organization's OIDC configuration
+func DeleteOIDCProvider(ctx context.Context, orgID int64) error {
+	_, err := DB.ExecContext(ctx, "DELETE FROM oidc_providers WHERE org_id = ?", orgID)
+	return err
+}
+
+// SAMLProvider is an organization's SAML 2.0 identity provider configuration
+type SAMLProvider struct {
+	ID                int64     `json:"id"`
+	OrgID             int64     `json:"org_id"`
+	IDPEntityID       string    `json:"idp_entity_id"`
+	IDPMetadata       string    `json:"-"`
+	MetadataURL       string    `json:"metadata_url"`
+	AttrEmail         string    `json:"attr_email"` // attribute names override the built-in mapping
+	AttrName          string    `json:"attr_name"`
+	AttrCompany       string    `json:"attr_company"`
+	EmailDomains      string    `json:"email_domains"`
+	AllowIDPInitiated bool      `json:"allow_idp_initiated"`
+	Enabled           bool      `json:"enabled"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+const samlProviderSelectCols = "id, org_id, idp_entity_id, idp_metadata, metadata_url, attr_email, attr_name, attr_company, email_domains, allow_idp_initiated, enabled, created_at, updated_at"
+
+func scanSAMLProvider(row rowScanner) (*SAMLProvider, error) {
+	p := &SAMLProvider{}
+	var metadataURL, attrEmail, attrName, attrCompany, domains sql.NullString
+	if err := row.Scan(&p.ID, &p.OrgID, &p.IDPEntityID, &p.IDPMetadata, &metadataURL, &attrEmail, &attrName, &attrCompany,
+		&domains, &p.AllowIDPInitiated, &p.Enabled, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	p.MetadataURL = metadataURL.String
+	p.AttrEmail = attrEmail.String
+	p.AttrName = attrName.String
+	p.AttrCompany = attrCompany.String
+	p.EmailDomains = domains.String
+	return p, nil
+}
+
+// GetSAMLProvider returns the SAML configuration of an organization
+func GetSAMLProvider(ctx context.Context, orgID int64) (*SAMLProvider, error) {
+	return scanSAMLProvider(DB.QueryRowContext(ctx, "SELECT "+samlProviderSelectCols+" FROM saml_providers WHERE org_id = ?", orgID))
+}
+
+// FindSAMLProviderByEmailDomain returns the enabled SAML provider claiming the domain of the given email
+func FindSAMLProviderByEmailDomain(ctx context.Context, email string) (*SAMLProvider, error) {
+	domain := emailDomain(email)
+	if domain == "" {
+		return nil, sql.ErrNoRows
+	}
+
+	rows, err := DB.QueryContext(ctx, "SELECT "+samlProviderSelectCols+" FROM saml_providers WHERE enabled = 1 AND email_domains IS NOT NULL AND email_domains != ''")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanSAMLProvider(rows)
+		if err != nil {
+			return nil, err
+		}
+		if domainListed(p.EmailDomains, domain) {
+			return p, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return nil, sql.ErrNoRows
+}
+
+// SaveSAMLProvider creates or replaces an organization's SAML configuration
+func SaveSAMLProvider(ctx context.Context, p *SAMLProvider) error {
+	_, err := DB.ExecContext(ctx, `
+		INSERT INTO saml_providers(org_id, idp_entity_id, idp_metadata, metadata_url, attr_email, attr_name, attr_company, email_domains, allow_idp_initiated, enabled)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(org_id) DO UPDATE SET
+			idp_entity_id = excluded.idp_entity_id,
+			idp_metadata = excluded.idp_metadata,
+			metadata_url = excluded.metadata_url,
+			attr_email = excluded.attr_email,
+			attr_name = excluded.attr_name,
+			attr_company = excluded.attr_company,
+			email_domains = excluded.email_domains,
+			allow_idp_initiated = excluded.allow_idp_initiated,
+			enabled = excluded.enabled,
+			updated_at = CURRENT_TIMESTAMP`,
+		p.OrgID, p.IDPEntityID, p.IDPMetadata, nullString(p.MetadataURL), nullString(p.AttrEmail), nullString(p.AttrName),
+		nullString(p.AttrCompany), p.EmailDomains, p.AllowIDPInitiated, p.Enabled)
+	return err
+}
+
+// DeleteSAMLProvider removes an organization's SAML configuration
+func DeleteSAMLProvider(ctx context.Context, orgID int64) error {
+	_, err := DB.ExecContext(ctx, "DELETE FROM saml_providers WHERE org_id = ?", orgID)
+	return err
+}
+
+// MarkSAMLAssertionUsed records a consumed assertion ID. It reports false when the
+// assertion was already used, i.e. the response is being replayed.
+func MarkSAMLAssertionUsed(ctx context.Context, id string, expiresAt time.Time) (bool, error) {
+	res, err := DB.ExecContext(ctx, "INSERT OR IGNORE INTO saml_assertions(id, expires_at) VALUES(?, ?)", id, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// GetUserByIdentity returns the user linked to an external identity
+func GetUserByIdentity(ctx context.Context, provider, issuer, subject string) (*User, error) {
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM users u
+		INNER JOIN user_identities i ON u.id = i.user_id
+		WHERE i.provider = ? AND i.issuer = ? AND i.subject = ?`, userSelectCols("u"))
+	return scanUser(DB.QueryRowContext(ctx, query, provider, issuer, subject))
+}
+
+// LinkIdentity links an external identity to a user, or refreshes its last login time
+func LinkIdentity(ctx context.Context, userID int64, provider, issuer, subject, email string) error {
+	_, err := DB.ExecContext(ctx, `
+		INSERT INTO user_identities(user_id, provider, issuer, subject, email, last_login_at)
+		VALUES(?, ?, ?, ?, ?, ?)
+		ON CONFLICT(provider, issuer, subject) DO UPDATE SET
+			email = excluded.email,
+			last_login_at = excluded.last_login_at`,
+		userID, provider, issuer, subject, nullString(email), time.Now())
+	return err
+}
+
+// SSOState is a pending SSO login awaiting the identity provider callback
+type SSOState struct {
+	State        string
+	OrgID        int64
+	Nonce        string
+	CodeVerifier string
+	RedirectURI  string
+	NextPath     string
+	ExpiresAt    time.Time
+}
+
+// CreateSSOState stores a pending SSO login
+func CreateSSOState(ctx context.Context, s *SSOState) error {
+	_, err := DB.ExecContext(ctx, `INSERT INTO sso_states(state, org_id, nonce, code_verifier, redirect_uri, next_path, expires_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?)`,
+		s.State, s.OrgID, s.Nonce, s.CodeVerifier, s.RedirectURI, nullString(s.NextPath), s.ExpiresAt)
+	return err
+}
+
+// ConsumeSSOState returns and deletes a pending SSO login; expired states are not returned
+func ConsumeSSOState(ctx context.Context, state string) (*SSOState, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	s := &SSOState{}
+	var next sql.NullString
+	err = tx.QueryRow(`SELECT state, org_id, nonce, code_verifier, redirect_uri, next_path, expires_at
+		FROM sso_states WHERE state = ?`, state).
+		Scan(&s.State, &s.OrgID, &s.Nonce, &s.CodeVerifier, &s.RedirectURI, &next, &s.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec("DELETE FROM sso_states WHERE state = ?", state); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	if time.Now().After(s.ExpiresAt) {
+		return nil, sql.ErrNoRows
+	}
+	s.NextPath = next.String
+	return s, nil
+}
+
+// CleanupExpiredSSOStates removes abandoned SSO logins and expired SAML assertion IDs
+func CleanupExpiredSSOStates(ctx context.Context) error {
+	now := time.Now()
+	if _, err := DB.ExecContext(ctx, "DELETE FROM sso_states WHERE expires_at < ?", now); err != nil {
+		return err
+	}
+	_, err := DB.ExecContext(ctx, "DELETE FROM saml_assertions WHERE expires_at < ?", now)
+	return err
+}
@@ -0,0 +1,123 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/isymbo/sachi/tracing"
+)
+
+// Database is the connection pool. Its context methods record a span per statement under the
+// caller's trace, so slow queries and SQLite lock waits show up inside the request that ran them.
+// The embedded methods without a context are only used at startup, before there is a trace.
+type Database struct {
+	*sql.DB
+}
+
+// Tx is a transaction traced as one span, with a child span per statement and the commit
+type Tx struct {
+	*sql.Tx
+	ctx  context.Context
+	span *tracing.Span
+}
+
+// startQuery begins a span named after the statement's operation, e.g. "SELECT". Queries
+// outside a trace (startup, metrics scrapes) are not traced on their own.
+func startQuery(ctx context.Context, query string) (context.Context, *tracing.Span) {
+	if tracing.SpanFromContext(ctx) == nil {
+		return ctx, nil
+	}
+	var op string
+	if fields := strings.Fields(query); len(fields) > 0 {
+		op = strings.ToUpper(fields[0])
+	}
+	return tracing.Start(ctx, op, tracing.KindClient,
+		tracing.String("db.system.name", "sqlite"),
+		tracing.String("db.operation.name", op),
+		tracing.String("db.query.text", query),
+	)
+}
+
+func endQuery(span *tracing.Span, err error) {
+	if err != nil && err != sql.ErrNoRows {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+func (db *Database) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, span := startQuery(ctx, query)
+	res, err := db.DB.ExecContext(ctx, query, args...)
+	endQuery(span, err)
+	return res, err
+}
+
+// QueryContext traces running the query; reading the rows is not included
+func (db *Database) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, span := startQuery(ctx, query)
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	endQuery(span, err)
+	return rows, err
+}
+
+func (db *Database) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, span := startQuery(ctx, query)
+	row := db.DB.QueryRowContext(ctx, query, args...)
+	endQuery(span, row.Err())
+	return row
+}
+
+// BeginTx starts a transaction whose statements take their trace from ctx
+func (db *Database) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	var span *tracing.Span
+	if tracing.SpanFromContext(ctx) != nil {
+		ctx, span = tracing.Start(ctx, "transaction", tracing.KindInternal, tracing.String("db.system.name", "sqlite"))
+	}
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		endQuery(span, err)
+		return nil, err
+	}
+	return &Tx{Tx: tx, ctx: ctx, span: span}, nil
+}
+
+func (tx *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	ctx, span := startQuery(tx.ctx, query)
+	res, err := tx.Tx.ExecContext(ctx, query, args...)
+	endQuery(span, err)
+	return res, err
+}
+
+func (tx *Tx) Query(query string, args ...any) (*sql.Rows, error) {
+	ctx, span := startQuery(tx.ctx, query)
+	rows, err := tx.Tx.QueryContext(ctx, query, args...)
+	endQuery(span, err)
+	return rows, err
+}
+
+func (tx *Tx) QueryRow(query string, args ...any) *sql.Row {
+	ctx, span := startQuery(tx.ctx, query)
+	row := tx.Tx.QueryRowContext(ctx, query, args...)
+	endQuery(span, row.Err())
+	return row
+}
+
+func (tx *Tx) Commit() error {
+	_, span := startQuery(tx.ctx, "COMMIT")
+	err := tx.Tx.Commit()
+	endQuery(span, err)
+	tx.span.RecordError(err)
+	tx.span.End()
+	return err
+}
+
+// Rollback ends the transaction span; after Commit it is a no-op, as the deferred call usually is
+func (tx *Tx) Rollback() error {
+	err := tx.Tx.Rollback()
+	if err != sql.ErrTxDone {
+		tx.span.SetAttributes(tracing.Bool("db.rolled_back", true))
+		tx.span.End()
+	}
+	return err
+}
@@ -0,0 +1,182 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// User list filters for UserFilter.Status
+const (
+	UserStatusActive   = "active"
+	UserStatusDisabled = "disabled"
+	UserStatusDeleting = "deleting" // scheduled for self-deletion
+)
+
+// UserFilter narrows down user listings. Zero values are ignored.
+type UserFilter struct {
+	Query  string // substring of name or email
+	Role   string
+	Status string
+	OrgID  int64
+	Sort   string // "name", "email", or newest first by default
+	Limit  int
+	Offset int
+}
+
+func (f *UserFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if f.Query != "" {
+		conds = append(conds, fmt.Sprintf("(%s LIKE ? ESCAPE '\\' OR email LIKE ? ESCAPE '\\')", usersNameColumn))
+		q := "%" + escapeLike(f.Query) + "%"
+		args = append(args, q, q)
+	}
+	if f.Role != "" {
+		conds = append(conds, "role = ?")
+		args = append(args, f.Role)
+	}
+	switch f.Status {
+	case UserStatusActive:
+		conds = append(conds, "disabled = 0 AND deletion_scheduled_at IS NULL")
+	case UserStatusDisabled:
+		conds = append(conds, "disabled = 1")
+	case UserStatusDeleting:
+		conds = append(conds, "deletion_scheduled_at IS NOT NULL")
+	}
+	if f.OrgID > 0 {
+		conds = append(conds, "org_id = ?")
+		args = append(args, f.OrgID)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// ListUsers returns a page of users matching the filter and the total number of matches
+func ListUsers(ctx context.Context, f UserFilter) ([]*User, int, error) {
+	where, args := f.where()
+
+	var total int
+	if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM users"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	order := "id DESC"
+	switch f.Sort {
+	case "name":
+		order = usersNameColumn + " COLLATE NOCASE, id"
+	case "email":
+		order = "email COLLATE NOCASE, id"
+	}
+	query := fmt.Sprintf("SELECT %s FROM users%s ORDER BY %s", userSelectCols(""), where, order)
+	if f.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, f.Limit, f.Offset)
+	}
+	rows, err := DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+	return users, total, rows.Err()
+}
+
+// UserIdentity is an external identity linked to an account
+type UserIdentity struct {
+	Provider    string     `json:"provider"`
+	Issuer      string     `json:"issuer"`
+	Email       string     `json:"email,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+// ListUserIdentities returns the single sign-on and SCIM identities linked to a user
+func ListUserIdentities(ctx context.Context, userID int64) ([]*UserIdentity, error) {
+	rows, err := DB.QueryContext(ctx, "SELECT provider, issuer, email, created_at, last_login_at FROM user_identities WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []*UserIdentity{}
+	for rows.Next() {
+		id := &UserIdentity{}
+		var email sql.NullString
+		var lastLogin sql.NullTime
+		if err := rows.Scan(&id.Provider, &id.Issuer, &email, &id.CreatedAt, &lastLogin); err != nil {
+			return nil, err
+		}
+		id.Email = email.String
+		if lastLogin.Valid {
+			id.LastLoginAt = &lastLogin.Time
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// CountUserSessions returns how many unexpired sessions a user has
+func CountUserSessions(ctx context.Context, userID int64) (int, error) {
+	var n int
+	err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM sessions WHERE user_id = ? AND expires_at > ?", userID, time.Now()).Scan(&n)
+	return n, err
+}
+
+// CountActiveSessions returns how many unexpired sessions there are across all users
+func CountActiveSessions(ctx context.Context) (int, error) {
+	var n int
+	err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM sessions WHERE expires_at > ?", time.Now()).Scan(&n)
+	return n, err
+}
+
+// CountUsers returns the number of accounts, including disabled ones
+func CountUsers(ctx context.Context) (int, error) {
+	var n int
+	err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&n)
+	return n, err
+}
+
+// SignOutUser ends all of a user's sessions and revokes their OAuth tokens
+func SignOutUser(ctx context.Context, userID int64) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeUserCredentials(tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ResetUserPassword replaces a password with a temporary one the user must change at the
+// next sign-in, and signs them out everywhere
+func ResetUserPassword(ctx context.Context, userID int64, passwordHash string, keepHistory int) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updateUserPassword(tx, userID, passwordHash, keepHistory, true); err != nil {
+		return err
+	}
+	if err := revokeUserCredentials(tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
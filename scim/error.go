@@ -0,0 +1,50 @@
+package scim
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// SCIM error types (RFC 7644 section 3.12)
+const (
+	ErrInvalidFilter = "invalidFilter"
+	ErrInvalidPath   = "invalidPath"
+	ErrInvalidSyntax = "invalidSyntax"
+	ErrInvalidValue  = "invalidValue"
+	ErrMutability    = "mutability"
+	ErrNoTarget      = "noTarget"
+	ErrTooMany       = "tooMany"
+	ErrUniqueness    = "uniqueness"
+)
+
+// Error is a protocol error rendered with the SCIM Error schema
+type Error struct {
+	Status   int
+	ScimType string
+	Detail   string
+}
+
+func (e *Error) Error() string {
+	if e.ScimType != "" {
+		return e.ScimType + ": " + e.Detail
+	}
+	return e.Detail
+}
+
+// Body returns the JSON error document
+func (e *Error) Body() map[string]any {
+	body := map[string]any{
+		"schemas": []string{ErrorSchema},
+		"status":  fmt.Sprint(e.Status),
+		"detail":  e.Detail,
+	}
+	if e.ScimType != "" {
+		body["scimType"] = e.ScimType
+	}
+	return body
+}
+
+// BadRequest returns a 400 error of the given type
+func BadRequest(scimType, format string, args ...any) *Error {
+	return &Error{Status: http.StatusBadRequest, ScimType: scimType, Detail: fmt.Sprintf(format, args...)}
+}
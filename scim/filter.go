@@ -0,0 +1,472 @@
+package scim
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Filter is a parsed SCIM filter expression (RFC 7644 section 3.4.2.2) evaluated against
+// resources decoded from JSON (map[string]any, []any, string, float64, bool)
+type Filter interface {
+	Match(obj map[string]any) bool
+}
+
+// attrPath is an attribute reference: an optional extension schema URN, an attribute
+// name and an optional sub-attribute
+type attrPath struct {
+	urn  string
+	attr string
+	sub  string
+}
+
+func parseAttrPath(s string) (attrPath, error) {
+	urn, rest := splitSchema(s)
+	p := attrPath{urn: urn, attr: rest}
+	if i := strings.IndexByte(rest, '.'); i >= 0 {
+		p.attr, p.sub = rest[:i], rest[i+1:]
+	}
+	if !validAttrName(p.attr) || (p.sub != "" && !validAttrName(p.sub)) {
+		return p, BadRequest(ErrInvalidPath, "invalid attribute path %q", s)
+	}
+	return p, nil
+}
+
+func validAttrName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '$':
+		case i > 0 && (r >= '0' && r <= '9' || r == '_' || r == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// container returns the object holding the attribute: the resource itself or an extension
+func (p attrPath) container(obj map[string]any) map[string]any {
+	if p.urn == "" {
+		return obj
+	}
+	return GetMap(obj, p.urn)
+}
+
+// values returns every value the path refers to. Multi-valued attributes contribute each
+// element; without a sub-attribute, complex elements are represented by their "value".
+func (p attrPath) values(obj map[string]any) []any {
+	c := p.container(obj)
+	if c == nil {
+		return nil
+	}
+	v, ok := Get(c, p.attr)
+	if !ok || v == nil {
+		return nil
+	}
+	items, multi := v.([]any)
+	if !multi {
+		items = []any{v}
+	}
+	var out []any
+	for _, item := range items {
+		m, complex := item.(map[string]any)
+		switch {
+		case p.sub != "" && complex:
+			if sv, ok := Get(m, p.sub); ok && sv != nil {
+				out = append(out, sv)
+			}
+		case p.sub != "":
+		case complex && multi:
+			if sv, ok := Get(m, "value"); ok && sv != nil {
+				out = append(out, sv)
+			}
+		default:
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+type logicalFilter struct {
+	and         bool
+	left, right Filter
+}
+
+func (f *logicalFilter) Match(obj map[string]any) bool {
+	if f.and {
+		return f.left.Match(obj) && f.right.Match(obj)
+	}
+	return f.left.Match(obj) || f.right.Match(obj)
+}
+
+type notFilter struct{ f Filter }
+
+func (f *notFilter) Match(obj map[string]any) bool { return !f.f.Match(obj) }
+
+type presentFilter struct{ path attrPath }
+
+func (f *presentFilter) Match(obj map[string]any) bool {
+	for _, v := range f.path.values(obj) {
+		if s, ok := v.(string); !ok || s != "" {
+			return true
+		}
+	}
+	return false
+}
+
+type compareFilter struct {
+	path  attrPath
+	op    string
+	value any
+}
+
+func (f *compareFilter) Match(obj map[string]any) bool {
+	values := f.path.values(obj)
+	if f.op == "ne" {
+		for _, v := range values {
+			if compare("eq", v, f.value) {
+				return false
+			}
+		}
+		return f.value != nil || len(values) > 0
+	}
+	if f.value == nil && f.op == "eq" {
+		return len(values) == 0
+	}
+	for _, v := range values {
+		if compare(f.op, v, f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// valuePathFilter matches when any element of a multi-valued attribute matches the inner filter
+type valuePathFilter struct {
+	path  attrPath
+	inner Filter
+}
+
+func (f *valuePathFilter) Match(obj map[string]any) bool {
+	return len(f.elements(obj)) > 0
+}
+
+// elements returns the indexes of matching elements
+func (f *valuePathFilter) elements(obj map[string]any) []int {
+	c := f.path.container(obj)
+	if c == nil {
+		return nil
+	}
+	v, _ := Get(c, f.path.attr)
+	items, _ := v.([]any)
+	var out []int
+	for i, item := range items {
+		if m, ok := item.(map[string]any); ok && f.inner.Match(m) {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// compare applies a comparison operator; strings compare case-insensitively
+func compare(op string, actual, want any) bool {
+	switch w := want.(type) {
+	case string:
+		a, ok := actual.(string)
+		if !ok {
+			return false
+		}
+		a, w = strings.ToLower(a), strings.ToLower(w)
+		switch op {
+		case "eq":
+			return a == w
+		case "co":
+			return strings.Contains(a, w)
+		case "sw":
+			return strings.HasPrefix(a, w)
+		case "ew":
+			return strings.HasSuffix(a, w)
+		case "gt":
+			return a > w
+		case "ge":
+			return a >= w
+		case "lt":
+			return a < w
+		case "le":
+			return a <= w
+		}
+	case float64:
+		a, ok := actual.(float64)
+		if !ok {
+			if s, isStr := actual.(string); isStr {
+				if f, err := strconv.ParseFloat(s, 64); err == nil {
+					a, ok = f, true
+				}
+			}
+		}
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return a == w
+		case "gt":
+			return a > w
+		case "ge":
+			return a >= w
+		case "lt":
+			return a < w
+		case "le":
+			return a <= w
+		}
+	case bool:
+		switch a := actual.(type) {
+		case bool:
+			return op == "eq" && a == w
+		case string:
+			return op == "eq" && strings.EqualFold(a, strconv.FormatBool(w))
+		}
+	}
+	return false
+}
+
+// ParseFilter parses a filter expression
+func ParseFilter(s string) (Filter, error) {
+	toks, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{toks: toks}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, BadRequest(ErrInvalidFilter, "unexpected %q in filter", p.toks[p.pos].text)
+	}
+	return f, nil
+}
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokString
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			toks = append(toks, token{tokLParen, "("})
+			i++
+		case c == ')':
+			toks = append(toks, token{tokRParen, ")"})
+			i++
+		case c == '[':
+			toks = append(toks, token{tokLBracket, "["})
+			i++
+		case c == ']':
+			toks = append(toks, token{tokRBracket, "]"})
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, BadRequest(ErrInvalidFilter, "unterminated string in filter")
+			}
+			var str string
+			if err := json.Unmarshal([]byte(s[i:j+1]), &str); err != nil {
+				return nil, BadRequest(ErrInvalidFilter, "invalid string %s in filter", s[i:j+1])
+			}
+			toks = append(toks, token{tokString, str})
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n\r()[]\"", rune(s[j])) {
+				j++
+			}
+			toks = append(toks, token{tokWord, s[i:j]})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+type filterParser struct {
+	toks []token
+	pos  int
+}
+
+func (p *filterParser) peek() *token {
+	if p.pos < len(p.toks) {
+		return &p.toks[p.pos]
+	}
+	return nil
+}
+
+func (p *filterParser) keyword(kw string) bool {
+	t := p.peek()
+	if t != nil && t.kind == tokWord && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expect(kind tokenKind, what string) error {
+	t := p.peek()
+	if t == nil || t.kind != kind {
+		return BadRequest(ErrInvalidFilter, "expected %s in filter", what)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *filterParser) parseOr() (Filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalFilter{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (Filter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalFilter{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (Filter, error) {
+	if p.keyword("not") {
+		if err := p.expect(tokLParen, `"(" after not`); err != nil {
+			return nil, err
+		}
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokRParen, `")"`); err != nil {
+			return nil, err
+		}
+		return &notFilter{f}, nil
+	}
+
+	t := p.peek()
+	if t == nil {
+		return nil, BadRequest(ErrInvalidFilter, "unexpected end of filter")
+	}
+	if t.kind == tokLParen {
+		p.pos++
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokRParen, `")"`); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	if t.kind != tokWord {
+		return nil, BadRequest(ErrInvalidFilter, "expected attribute name, got %q", t.text)
+	}
+	p.pos++
+	path, err := parseAttrPath(t.text)
+	if err != nil {
+		return nil, BadRequest(ErrInvalidFilter, "invalid attribute %q in filter", t.text)
+	}
+
+	if next := p.peek(); next != nil && next.kind == tokLBracket {
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokRBracket, `"]"`); err != nil {
+			return nil, err
+		}
+		return &valuePathFilter{path: path, inner: inner}, nil
+	}
+
+	if p.keyword("pr") {
+		return &presentFilter{path}, nil
+	}
+	opTok := p.peek()
+	if opTok == nil || opTok.kind != tokWord {
+		return nil, BadRequest(ErrInvalidFilter, "expected operator after %q", t.text)
+	}
+	op := strings.ToLower(opTok.text)
+	switch op {
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, BadRequest(ErrInvalidFilter, "unknown operator %q", opTok.text)
+	}
+	p.pos++
+
+	valTok := p.peek()
+	if valTok == nil {
+		return nil, BadRequest(ErrInvalidFilter, "expected value after %q", opTok.text)
+	}
+	p.pos++
+	var value any
+	switch {
+	case valTok.kind == tokString:
+		value = valTok.text
+	case valTok.kind == tokWord && strings.EqualFold(valTok.text, "true"):
+		value = true
+	case valTok.kind == tokWord && strings.EqualFold(valTok.text, "false"):
+		value = false
+	case valTok.kind == tokWord && strings.EqualFold(valTok.text, "null"):
+		value = nil
+	case valTok.kind == tokWord:
+		n, err := strconv.ParseFloat(valTok.text, 64)
+		if err != nil {
+			return nil, BadRequest(ErrInvalidFilter, "invalid value %q", valTok.text)
+		}
+		value = n
+	default:
+		return nil, BadRequest(ErrInvalidFilter, "invalid value %q", valTok.text)
+	}
+	if value == nil && op != "eq" && op != "ne" {
+		return nil, BadRequest(ErrInvalidFilter, "null can only be compared with eq or ne")
+	}
+	if _, ok := value.(bool); ok && op != "eq" && op != "ne" {
+		return nil, BadRequest(ErrInvalidFilter, "booleans can only be compared with eq or ne")
+	}
+	return &compareFilter{path: path, op: op, value: value}, nil
+}
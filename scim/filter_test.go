@@ -0,0 +1,158 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// testUser is a User resource as handlers decode it, based on the example in RFC 7643
+const testUser = `{
+	"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User", "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"],
+	"id": "2819c223",
+	"userName": "Bjensen@example.com",
+	"name": {"familyName": "Jensen", "givenName": "Barbara"},
+	"title": "",
+	"active": true,
+	"emails": [
+		{"value": "bjensen@example.com", "type": "work", "primary": true},
+		{"value": "babs@jensen.org", "type": "home"}
+	],
+	"meta": {"resourceType": "User", "lastModified": "2011-05-13T04:42:34Z"},
+	"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"employeeNumber": "701984", "organization": "ACME"}
+}`
+
+func decodeResource(t *testing.T, s string) map[string]any {
+	t.Helper()
+	var m map[string]any
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestFilterMatch(t *testing.T) {
+	user := decodeResource(t, testUser)
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		// Attribute names, operators and string values are case-insensitive
+		{`userName eq "bjensen@example.com"`, true},
+		{`USERNAME Eq "BJENSEN@example.com"`, true},
+		{`userName ne "bjensen@example.com"`, false},
+		{`userName sw "bj"`, true},
+		{`userName ew "@EXAMPLE.COM"`, true},
+		{`userName ew ".org"`, false},
+		{`name.familyName co "ens"`, true},
+		{`name.givenName eq "Jensen"`, false},
+
+		// Ordering compares strings
+		{`meta.lastModified gt "2011-05-13T04:42:34Z"`, false},
+		{`meta.lastModified ge "2011-05-13T04:42:34Z"`, true},
+		{`meta.lastModified lt "2012-01-01T00:00:00Z"`, true},
+		{`meta.lastModified le "2011-01-01T00:00:00Z"`, false},
+
+		// Multi-valued attributes match when any value does
+		{`emails co "jensen.org"`, true},
+		{`emails.type eq "home"`, true},
+		{`emails.type eq "other"`, false},
+		{`emails ne "babs@jensen.org"`, false},
+
+		// valuePath filters match within one element; plain paths across elements
+		{`emails[type eq "work" and value co "@example.com"]`, true},
+		{`emails[type eq "home" and value co "@example.com"]`, false},
+		{`emails.type eq "home" and emails.value co "@example.com"`, true},
+		{`emails[primary eq true]`, true},
+		{`emails[not (type eq "work")]`, true},
+		{`emails[type eq "work"] and userName sw "x"`, false},
+
+		// Presence: empty strings and missing attributes are not present
+		{`name pr`, true},
+		{`emails pr`, true},
+		{`title pr`, false},
+		{`nickName pr`, false},
+
+		// Booleans, numbers and null
+		{`active eq true`, true},
+		{`active eq false`, false},
+		{`active ne false`, true},
+		{`urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:employeeNumber gt 700000`, true},
+		{`urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:employeeNumber eq 701984.0`, true},
+		{`nickName eq null`, true},
+		{`userName eq null`, false},
+		{`nickName ne null`, false},
+		{`userName ne null`, true},
+
+		// Schema URN prefixes: the core schema is the resource itself, extensions are nested
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName sw "bjensen"`, true},
+		{`urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:organization eq "acme"`, true},
+		{`urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:userName pr`, false},
+
+		// Strings are JSON strings
+		{`userName eq "bjensen\u0040example.com"`, true},
+		{`userName eq "a \"quoted\" (name)"`, false},
+
+		// not, and binds tighter than or, and parentheses
+		{`not (userName eq "x")`, true},
+		{`not(active eq true)`, false},
+		{`userName eq "x" or userName sw "bj" and active eq false`, false},
+		{`userName eq "x" or userName sw "bj" and active eq true`, true},
+		{`(userName eq "x" or userName sw "bj") and active eq true`, true},
+		{`userName sw "bj" or userName eq "x" and active eq false`, true},
+		{`(userName sw "bj" or userName eq "x") and active eq false`, false},
+		{`active eq true and not (emails[type eq "home"] or title pr)`, false},
+		{`userName eq "x" or name.givenName eq "y" or emails.type eq "work"`, true},
+		{"userName\teq\n\"bjensen@example.com\"", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			f, err := ParseFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("ParseFilter: %v", err)
+			}
+			if got := f.Match(user); got != tt.want {
+				t.Errorf("Match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterInvalid(t *testing.T) {
+	for _, filter := range []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName equals "x"`,
+		`userName eq "x`,
+		`userName eq x`,
+		`userName eq "x" and`,
+		`userName eq "x" userName eq "y"`,
+		`(userName eq "x"`,
+		`userName eq "x")`,
+		`not userName eq "x"`,
+		`not (userName eq "x"`,
+		`emails[type eq "work"`,
+		`emails[type eq "work"]]`,
+		`emails[]`,
+		`"userName" eq "x"`,
+		`1userName eq "x"`,
+		`user name eq "x"`,
+		`name.given.name eq "x"`,
+		`userName gt true`,
+		`userName co null`,
+		`userName eq "\x"`,
+		`userName eq "x" or`,
+	} {
+		t.Run(filter, func(t *testing.T) {
+			f, err := ParseFilter(filter)
+			var e *Error
+			if !errors.As(err, &e) {
+				t.Fatalf("got %#v, %v; want an error", f, err)
+			}
+			if e.Status != 400 || e.ScimType != ErrInvalidFilter {
+				t.Errorf("got %d %s, want 400 %s", e.Status, e.ScimType, ErrInvalidFilter)
+			}
+		})
+	}
+}
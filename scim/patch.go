@@ -0,0 +1,328 @@
+package scim
+
+import (
+	"reflect"
+	"strings"
+)
+
+// PatchOp is one operation of a PATCH request (RFC 7644 section 3.5.2)
+type PatchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// PatchRequest is the body of a PATCH request
+type PatchRequest struct {
+	Schemas    []string  `json:"schemas"`
+	Operations []PatchOp `json:"Operations"`
+}
+
+// extensionSchemas are URNs accepted as keys of path-less operation values
+var extensionSchemas = []string{EnterpriseUserSchema}
+
+// patchPath is an operation target: an attribute, optionally narrowed to the elements of a
+// multi-valued attribute matching a filter, optionally followed by a sub-attribute
+type patchPath struct {
+	attrPath
+	filter Filter
+}
+
+func parsePatchPath(s string) (*patchPath, error) {
+	urn, rest := splitSchema(strings.TrimSpace(s))
+	open := strings.IndexByte(rest, '[')
+	if open < 0 {
+		p, err := parseAttrPath(s)
+		if err != nil {
+			return nil, err
+		}
+		return &patchPath{attrPath: p}, nil
+	}
+
+	end := strings.LastIndexByte(rest, ']')
+	if end < open {
+		return nil, BadRequest(ErrInvalidPath, "invalid path %q", s)
+	}
+	p := &patchPath{attrPath: attrPath{urn: urn, attr: rest[:open]}}
+	if after := rest[end+1:]; after != "" {
+		if !strings.HasPrefix(after, ".") {
+			return nil, BadRequest(ErrInvalidPath, "invalid path %q", s)
+		}
+		p.sub = after[1:]
+	}
+	if !validAttrName(p.attr) || (p.sub != "" && !validAttrName(p.sub)) {
+		return nil, BadRequest(ErrInvalidPath, "invalid path %q", s)
+	}
+	f, err := ParseFilter(rest[open+1 : end])
+	if err != nil {
+		return nil, BadRequest(ErrInvalidPath, "invalid filter in path %q: %v", s, err)
+	}
+	p.filter = f
+	return p, nil
+}
+
+// ApplyPatch applies operations in order to a resource decoded from JSON. Callers validate
+// the resulting resource as they would a PUT body.
+func ApplyPatch(resource map[string]any, ops []PatchOp) error {
+	if len(ops) == 0 {
+		return BadRequest(ErrInvalidValue, "PATCH request has no Operations")
+	}
+	for _, op := range ops {
+		if err := applyOp(resource, strings.ToLower(op.Op), op.Path, op.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyOp(resource map[string]any, op, path string, value any) error {
+	switch op {
+	case "add", "replace", "remove":
+	default:
+		return BadRequest(ErrInvalidSyntax, "unsupported PATCH operation %q", op)
+	}
+
+	if path == "" {
+		if op == "remove" {
+			return BadRequest(ErrNoTarget, "remove requires a path")
+		}
+		values, ok := value.(map[string]any)
+		if !ok {
+			return BadRequest(ErrInvalidValue, "%s without a path requires an object value", op)
+		}
+		for k, v := range values {
+			if isExtensionSchema(k) {
+				ext, ok := v.(map[string]any)
+				if !ok {
+					return BadRequest(ErrInvalidValue, "%s must be an object", k)
+				}
+				for sub, sv := range ext {
+					if err := applyOp(resource, op, k+":"+sub, sv); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if strings.EqualFold(k, "schemas") || strings.EqualFold(k, "id") || strings.EqualFold(k, "meta") {
+				continue
+			}
+			if err := applyOp(resource, op, k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	p, err := parsePatchPath(path)
+	if err != nil {
+		return err
+	}
+	c := resource
+	if p.urn != "" {
+		k := key(resource, p.urn)
+		ext, _ := resource[k].(map[string]any)
+		if ext == nil {
+			if op == "remove" {
+				return nil
+			}
+			ext = map[string]any{}
+			resource[k] = ext
+		}
+		c = ext
+	}
+	if p.filter != nil {
+		return applyFiltered(c, op, p, value)
+	}
+	k := key(c, p.attr)
+
+	if p.sub != "" {
+		switch cur := c[k].(type) {
+		case map[string]any:
+			setSub(cur, op, p.sub, value)
+		case []any:
+			// Without a filter a sub-attribute path addresses every element
+			for _, item := range cur {
+				if m, ok := item.(map[string]any); ok {
+					setSub(m, op, p.sub, value)
+				}
+			}
+		case nil:
+			if op != "remove" {
+				c[k] = map[string]any{p.sub: value}
+			}
+		default:
+			return BadRequest(ErrInvalidPath, "%s has no sub-attributes", p.attr)
+		}
+		return nil
+	}
+
+	cur, exists := c[k]
+	switch op {
+	case "remove":
+		items, multi := cur.([]any)
+		remove, hasValue := value.([]any)
+		if multi && hasValue {
+			c[k] = removeItems(items, remove)
+		} else {
+			delete(c, k)
+		}
+	case "add":
+		items, multi := cur.([]any)
+		added, addList := value.([]any)
+		switch {
+		case multi || addList:
+			if !addList {
+				added = []any{value}
+			}
+			c[k] = appendItems(items, added)
+		case exists && isMap(cur) && isMap(value):
+			merge(cur.(map[string]any), value.(map[string]any))
+		default:
+			c[k] = value
+		}
+	case "replace":
+		if isMap(cur) && isMap(value) {
+			merge(cur.(map[string]any), value.(map[string]any))
+		} else {
+			c[k] = value
+		}
+	}
+	return nil
+}
+
+// applyFiltered applies an operation to the elements of a multi-valued attribute selected by a filter
+func applyFiltered(c map[string]any, op string, p *patchPath, value any) error {
+	k := key(c, p.attr)
+	items, _ := c[k].([]any)
+	vp := &valuePathFilter{path: attrPath{attr: k}, inner: p.filter}
+	matches := vp.elements(c)
+
+	if op == "remove" {
+		if p.sub == "" {
+			keep := make([]any, 0, len(items))
+			for i, item := range items {
+				if !containsInt(matches, i) {
+					keep = append(keep, item)
+				}
+			}
+			c[k] = keep
+			return nil
+		}
+		for _, i := range matches {
+			delete(items[i].(map[string]any), key(items[i].(map[string]any), p.sub))
+		}
+		return nil
+	}
+
+	if len(matches) == 0 {
+		// A simple equality filter names the element to create, e.g. emails[type eq "work"].value
+		eq, ok := p.filter.(*compareFilter)
+		if !ok || eq.op != "eq" || eq.path.urn != "" || eq.path.sub != "" {
+			return &Error{Status: 400, ScimType: ErrNoTarget, Detail: "no values match the path filter"}
+		}
+		elem := map[string]any{eq.path.attr: eq.value}
+		items = append(items, elem)
+		c[k] = items
+		matches = []int{len(items) - 1}
+	}
+
+	for _, i := range matches {
+		elem, _ := items[i].(map[string]any)
+		switch {
+		case p.sub != "":
+			elem[key(elem, p.sub)] = value
+		case op == "replace" && isMap(value):
+			items[i] = value
+		case isMap(value):
+			merge(elem, value.(map[string]any))
+		default:
+			return BadRequest(ErrInvalidValue, "value for %s must be an object", p.attr)
+		}
+	}
+	return nil
+}
+
+func setSub(m map[string]any, op, sub string, value any) {
+	k := key(m, sub)
+	if op == "remove" {
+		delete(m, k)
+		return
+	}
+	m[k] = value
+}
+
+func merge(dst, src map[string]any) {
+	for k, v := range src {
+		dst[key(dst, k)] = v
+	}
+}
+
+func isMap(v any) bool {
+	_, ok := v.(map[string]any)
+	return ok
+}
+
+func isExtensionSchema(k string) bool {
+	for _, s := range extensionSchemas {
+		if strings.EqualFold(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameItem compares elements of multi-valued attributes by their "value" sub-attribute when present
+func sameItem(a, b any) bool {
+	am, aok := a.(map[string]any)
+	bm, bok := b.(map[string]any)
+	if aok && bok {
+		av, _ := Get(am, "value")
+		bv, _ := Get(bm, "value")
+		if av != nil || bv != nil {
+			return reflect.DeepEqual(av, bv)
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func appendItems(items, added []any) []any {
+	for _, a := range added {
+		dup := false
+		for _, it := range items {
+			if sameItem(it, a) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			items = append(items, a)
+		}
+	}
+	return items
+}
+
+func removeItems(items, remove []any) []any {
+	keep := make([]any, 0, len(items))
+	for _, it := range items {
+		drop := false
+		for _, r := range remove {
+			if sameItem(it, r) {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			keep = append(keep, it)
+		}
+	}
+	return keep
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const testGroup = `{"displayName": "Engineering", "members": [{"value": "1"}, {"value": "2", "display": "Bo"}]}`
+
+func TestApplyPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource string
+		ops      string
+		want     string
+	}{
+		// Group membership, as identity providers send it
+		{"add members", testGroup,
+			`[{"op": "add", "path": "members", "value": [{"value": "3"}, {"value": "2"}]}]`,
+			`{"displayName": "Engineering", "members": [{"value": "1"}, {"value": "2", "display": "Bo"}, {"value": "3"}]}`},
+		{"add one member as an object", testGroup,
+			`[{"op": "add", "path": "members", "value": {"value": "4"}}]`,
+			`{"displayName": "Engineering", "members": [{"value": "1"}, {"value": "2", "display": "Bo"}, {"value": "4"}]}`},
+		{"remove a member by filter", testGroup,
+			`[{"op": "remove", "path": "members[value eq \"2\"]"}]`,
+			`{"displayName": "Engineering", "members": [{"value": "1"}]}`},
+		{"remove members by value", testGroup,
+			`[{"op": "remove", "path": "members", "value": [{"value": "1"}, {"value": "9"}]}]`,
+			`{"displayName": "Engineering", "members": [{"value": "2", "display": "Bo"}]}`},
+		{"remove all members", testGroup,
+			`[{"op": "remove", "path": "members"}]`,
+			`{"displayName": "Engineering"}`},
+		{"replace members", testGroup,
+			`[{"op": "replace", "path": "members", "value": [{"value": "5"}]}]`,
+			`{"displayName": "Engineering", "members": [{"value": "5"}]}`},
+		{"operations apply in order", testGroup,
+			`[{"op": "Replace", "path": "displayName", "value": "Platform"},
+			  {"op": "ADD", "path": "members", "value": [{"value": "3"}]},
+			  {"op": "remove", "path": "members[value eq \"1\"]"}]`,
+			`{"displayName": "Platform", "members": [{"value": "2", "display": "Bo"}, {"value": "3"}]}`},
+		{"path-less replace skips read-only attributes", testGroup,
+			`[{"op": "replace", "value": {"displayName": "Ops", "id": "x", "meta": {}, "schemas": []}}]`,
+			`{"displayName": "Ops", "members": [{"value": "1"}, {"value": "2", "display": "Bo"}]}`},
+		{"attribute names are case-insensitive", testGroup,
+			`[{"op": "replace", "path": "DISPLAYNAME", "value": "Ops"}]`,
+			`{"displayName": "Ops", "members": [{"value": "1"}, {"value": "2", "display": "Bo"}]}`},
+
+		// Users
+		{"deactivate without a path", `{"userName": "a@example.com", "active": true}`,
+			`[{"op": "replace", "value": {"active": false}}]`,
+			`{"userName": "a@example.com", "active": false}`},
+		{"replace a sub-attribute", `{"name": {"givenName": "Barbara", "familyName": "Jensen"}}`,
+			`[{"op": "replace", "path": "name.givenName", "value": "Babs"}]`,
+			`{"name": {"givenName": "Babs", "familyName": "Jensen"}}`},
+		{"add a sub-attribute to a missing attribute", `{"userName": "a"}`,
+			`[{"op": "add", "path": "name.familyName", "value": "Jensen"}]`,
+			`{"userName": "a", "name": {"familyName": "Jensen"}}`},
+		{"replace a complex attribute merges it", `{"name": {"givenName": "Barbara", "familyName": "Jensen"}}`,
+			`[{"op": "replace", "path": "name", "value": {"givenName": "Babs"}}]`,
+			`{"name": {"givenName": "Babs", "familyName": "Jensen"}}`},
+		{"remove a sub-attribute", `{"name": {"givenName": "Barbara", "familyName": "Jensen"}}`,
+			`[{"op": "remove", "path": "name.givenName"}]`,
+			`{"name": {"familyName": "Jensen"}}`},
+		{"sub-attribute of every element", `{"emails": [{"value": "a@x", "primary": true}, {"value": "b@x"}]}`,
+			`[{"op": "replace", "path": "emails.primary", "value": false}]`,
+			`{"emails": [{"value": "a@x", "primary": false}, {"value": "b@x", "primary": false}]}`},
+
+		// valuePath filters
+		{"replace the value of a filtered element", `{"emails": [{"type": "work", "value": "a@x"}, {"type": "home", "value": "b@x"}]}`,
+			`[{"op": "replace", "path": "emails[type eq \"work\"].value", "value": "c@x"}]`,
+			`{"emails": [{"type": "work", "value": "c@x"}, {"type": "home", "value": "b@x"}]}`},
+		{"an equality filter names the element to add", `{"emails": [{"type": "work", "value": "a@x"}]}`,
+			`[{"op": "add", "path": "emails[type eq \"other\"].value", "value": "o@x"}]`,
+			`{"emails": [{"type": "work", "value": "a@x"}, {"type": "other", "value": "o@x"}]}`},
+		{"filter on a missing attribute creates it", `{"userName": "a"}`,
+			`[{"op": "replace", "path": "emails[type eq \"work\"].value", "value": "a@x"}]`,
+			`{"userName": "a", "emails": [{"type": "work", "value": "a@x"}]}`},
+		{"filter with and", `{"emails": [{"type": "work", "value": "a@x"}, {"type": "work", "value": "b@y"}]}`,
+			`[{"op": "remove", "path": "emails[type eq \"work\" and value ew \"@y\"]"}]`,
+			`{"emails": [{"type": "work", "value": "a@x"}]}`},
+		{"remove a sub-attribute of filtered elements", `{"emails": [{"type": "work", "value": "a@x", "primary": true}, {"type": "home", "value": "b@x", "primary": true}]}`,
+			`[{"op": "remove", "path": "emails[type eq \"work\"].primary"}]`,
+			`{"emails": [{"type": "work", "value": "a@x"}, {"type": "home", "value": "b@x", "primary": true}]}`},
+		{"replace a filtered element", `{"emails": [{"type": "work", "value": "a@x", "primary": true}]}`,
+			`[{"op": "replace", "path": "emails[type eq \"work\"]", "value": {"type": "work", "value": "b@x"}}]`,
+			`{"emails": [{"type": "work", "value": "b@x"}]}`},
+		{"add to a filtered element merges", `{"emails": [{"type": "work", "value": "a@x"}]}`,
+			`[{"op": "add", "path": "emails[type eq \"work\"]", "value": {"primary": true}}]`,
+			`{"emails": [{"type": "work", "value": "a@x", "primary": true}]}`},
+		{"removing with a filter that matches nothing", `{"emails": [{"type": "work", "value": "a@x"}]}`,
+			`[{"op": "remove", "path": "emails[type eq \"home\"]"}]`,
+			`{"emails": [{"type": "work", "value": "a@x"}]}`},
+
+		// The enterprise extension
+		{"extension attribute by path", `{"userName": "a"}`,
+			`[{"op": "replace", "path": "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:organization", "value": "ACME"}]`,
+			`{"userName": "a", "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"organization": "ACME"}}`},
+		{"extension object without a path", `{"userName": "a", "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"organization": "ACME"}}`,
+			`[{"op": "add", "value": {"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"department": "R&D"}, "title": "CTO"}}]`,
+			`{"userName": "a", "title": "CTO", "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"organization": "ACME", "department": "R&D"}}`},
+		{"removing from a missing extension", `{"userName": "a"}`,
+			`[{"op": "remove", "path": "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:organization"}]`,
+			`{"userName": "a"}`},
+		{"core schema prefix", `{"userName": "a"}`,
+			`[{"op": "replace", "path": "urn:ietf:params:scim:schemas:core:2.0:User:userName", "value": "b"}]`,
+			`{"userName": "b"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resource := decodeResource(t, tt.resource)
+			var ops []PatchOp
+			if err := json.Unmarshal([]byte(tt.ops), &ops); err != nil {
+				t.Fatal(err)
+			}
+			if err := ApplyPatch(resource, ops); err != nil {
+				t.Fatalf("ApplyPatch: %v", err)
+			}
+			if want := decodeResource(t, tt.want); !reflect.DeepEqual(resource, want) {
+				got, _ := json.Marshal(resource)
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyPatchErrors(t *testing.T) {
+	user := `{"userName": "a", "title": "CTO", "emails": [{"type": "work", "value": "a@x"}]}`
+	tests := []struct {
+		name     string
+		ops      string
+		scimType string
+	}{
+		{"no operations", `[]`, ErrInvalidValue},
+		{"unknown operation", `[{"op": "move", "path": "title", "value": "x"}]`, ErrInvalidSyntax},
+		{"remove without a path", `[{"op": "remove"}]`, ErrNoTarget},
+		{"path-less value that is not an object", `[{"op": "replace", "value": "x"}]`, ErrInvalidValue},
+		{"extension value that is not an object", `[{"op": "add", "value": {"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": "x"}}]`, ErrInvalidValue},
+		{"unterminated filter", `[{"op": "remove", "path": "emails[type eq \"work\""}]`, ErrInvalidPath},
+		{"invalid filter", `[{"op": "remove", "path": "emails[type eq]"}]`, ErrInvalidPath},
+		{"text after a filter", `[{"op": "remove", "path": "emails[type eq \"work\"]value"}]`, ErrInvalidPath},
+		{"invalid sub-attribute after a filter", `[{"op": "replace", "path": "emails[type eq \"work\"].1x", "value": "x"}]`, ErrInvalidPath},
+		{"nested sub-attributes", `[{"op": "replace", "path": "name.given.name", "value": "x"}]`, ErrInvalidPath},
+		{"invalid attribute name", `[{"op": "replace", "path": "user name", "value": "x"}]`, ErrInvalidPath},
+		{"sub-attribute of a simple attribute", `[{"op": "replace", "path": "title.text", "value": "x"}]`, ErrInvalidPath},
+		{"filter matching nothing that names no element", `[{"op": "replace", "path": "emails[type co \"x\"].value", "value": "b@x"}]`, ErrNoTarget},
+		{"filtered element replaced by a string", `[{"op": "add", "path": "emails[type eq \"work\"]", "value": "b@x"}]`, ErrInvalidValue},
+		{"a later operation fails", `[{"op": "replace", "path": "title", "value": "CEO"}, {"op": "remove"}]`, ErrNoTarget},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ops []PatchOp
+			if err := json.Unmarshal([]byte(tt.ops), &ops); err != nil {
+				t.Fatal(err)
+			}
+			err := ApplyPatch(decodeResource(t, user), ops)
+			var e *Error
+			if !errors.As(err, &e) {
+				t.Fatalf("got %v, want a SCIM error", err)
+			}
+			if e.Status != 400 || e.ScimType != tt.scimType {
+				t.Errorf("got %d %s (%s), want 400 %s", e.Status, e.ScimType, e.Detail, tt.scimType)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// Package scim implements the protocol pieces of SCIM 2.0 (RFC 7643/7644) that do not
+// depend on storage: schemas, the filter language and PATCH operations over JSON resources.
+package scim
+
+import (
+	"strings"
+)
+
+// Schema URNs
+const (
+	UserSchema           = "urn:ietf:params:scim:schemas:core:2.0:User"
+	GroupSchema          = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	EnterpriseUserSchema = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+	ListResponseSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	PatchOpSchema        = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ErrorSchema          = "urn:ietf:params:scim:api:messages:2.0:Error"
+	ServiceConfigSchema  = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	ResourceTypeSchema   = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	SchemaSchema         = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+)
+
+// ContentType is the media type of SCIM requests and responses
+const ContentType = "application/scim+json"
+
+// MaxResults caps the page size of list responses
+const MaxResults = 200
+
+// coreSchemas are the schemas whose attributes live at the top level of a resource
+var coreSchemas = []string{UserSchema, GroupSchema}
+
+// ListResponse wraps one page of resources; startIndex is 1-based
+func ListResponse(resources []map[string]any, total, startIndex int) map[string]any {
+	if resources == nil {
+		resources = []map[string]any{}
+	}
+	return map[string]any{
+		"schemas":      []string{ListResponseSchema},
+		"totalResults": total,
+		"startIndex":   startIndex,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	}
+}
+
+// Get returns an attribute of a JSON object; SCIM attribute names are case-insensitive
+func Get(obj map[string]any, name string) (any, bool) {
+	if v, ok := obj[name]; ok {
+		return v, true
+	}
+	for k, v := range obj {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// GetString returns a string attribute, or "" when absent or not a string
+func GetString(obj map[string]any, name string) string {
+	v, _ := Get(obj, name)
+	s, _ := v.(string)
+	return s
+}
+
+// GetMap returns a complex attribute, or nil when absent
+func GetMap(obj map[string]any, name string) map[string]any {
+	v, _ := Get(obj, name)
+	m, _ := v.(map[string]any)
+	return m
+}
+
+// GetBool returns a boolean attribute. Some providers send booleans as "True"/"False" strings.
+func GetBool(obj map[string]any, name string) (bool, bool) {
+	v, ok := Get(obj, name)
+	if !ok {
+		return false, false
+	}
+	switch b := v.(type) {
+	case bool:
+		return b, true
+	case string:
+		switch strings.ToLower(b) {
+		case "true":
+			return true, true
+		case "false":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// key returns the existing spelling of an attribute name in obj, or name itself
+func key(obj map[string]any, name string) string {
+	if _, ok := obj[name]; ok {
+		return name
+	}
+	for k := range obj {
+		if strings.EqualFold(k, name) {
+			return k
+		}
+	}
+	return name
+}
+
+// splitSchema separates a URN prefix from an attribute path, e.g.
+// "urn:...:enterprise:2.0:User:manager.value" -> ("urn:...:enterprise:2.0:User", "manager.value").
+// Core schema prefixes are dropped since their attributes are top-level.
+func splitSchema(path string) (string, string) {
+	if !strings.HasPrefix(strings.ToLower(path), "urn:") {
+		return "", path
+	}
+	end := len(path)
+	if i := strings.IndexByte(path, '['); i >= 0 {
+		end = i
+	}
+	i := strings.LastIndexByte(path[:end], ':')
+	if i < 0 {
+		return "", path
+	}
+	urn, attr := path[:i], path[i+1:]
+	for _, s := range coreSchemas {
+		if strings.EqualFold(urn, s) {
+			return "", attr
+		}
+	}
+	return urn, attr
+}
+
+// Project applies the attributes and excludedAttributes query parameters (comma-separated
+// top-level names) to a resource. id, schemas and meta are always returned.
+func Project(resource map[string]any, attributes, excluded string) map[string]any {
+	keep := func(k string) bool {
+		return strings.EqualFold(k, "id") || strings.EqualFold(k, "schemas") || strings.EqualFold(k, "meta")
+	}
+	if attributes != "" {
+		out := map[string]any{}
+		for k, v := range resource {
+			if keep(k) || listed(attributes, k) {
+				out[k] = v
+			}
+		}
+		return out
+	}
+	if excluded != "" {
+		out := map[string]any{}
+		for k, v := range resource {
+			if keep(k) || !listed(excluded, k) {
+				out[k] = v
+			}
+		}
+		return out
+	}
+	return resource
+}
+
+func listed(list, name string) bool {
+	for _, item := range strings.Split(list, ",") {
+		_, attr := splitSchema(strings.TrimSpace(item))
+		if i := strings.IndexByte(attr, '.'); i >= 0 {
+			attr = attr[:i]
+		}
+		if strings.EqualFold(attr, name) || strings.EqualFold(strings.TrimSpace(item), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServiceProviderConfig describes the supported protocol features
+func ServiceProviderConfig(documentationURI string) map[string]any {
+	return map[string]any{
+		"schemas":          []string{ServiceConfigSchema},
+		"documentationUri": documentationURI,
+		"patch":            map[string]any{"supported": true},
+		"bulk":             map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":           map[string]any{"supported": true, "maxResults": MaxResults},
+		"changePassword":   map[string]any{"supported": false},
+		"sort":             map[string]any{"supported": false},
+		"etag":             map[string]any{"supported": false},
+		"authenticationSchemes": []map[string]any{{
+			"type":        "oauthbearertoken",
+			"name":        "OAuth Bearer Token",
+			"description": "Organization-scoped bearer token issued by a Sachi administrator",
+			"primary":     true,
+		}},
+		"meta": map[string]any{"resourceType": "ServiceProviderConfig"},
+	}
+}
+
+// ResourceTypes describes the User and Group endpoints
+func ResourceTypes() []map[string]any {
+	return []map[string]any{
+		{
+			"schemas":     []string{ResourceTypeSchema},
+			"id":          "User",
+			"name":        "User",
+			"endpoint":    "/Users",
+			"description": "User Account",
+			"schema":      UserSchema,
+			"schemaExtensions": []map[string]any{
+				{"schema": EnterpriseUserSchema, "required": false},
+			},
+			"meta": map[string]any{"resourceType": "ResourceType"},
+		},
+		{
+			"schemas":     []string{ResourceTypeSchema},
+			"id":          "Group",
+			"name":        "Group",
+			"endpoint":    "/Groups",
+			"description": "Group",
+			"schema":      GroupSchema,
+			"meta":        map[string]any{"resourceType": "ResourceType"},
+		},
+	}
+}
+
+func attr(name, typ string, multi, required bool, mutability string, sub ...map[string]any) map[string]any {
+	a := map[string]any{
+		"name":        name,
+		"type":        typ,
+		"multiValued": multi,
+		"required":    required,
+		"caseExact":   false,
+		"mutability":  mutability,
+		"returned":    "default",
+		"uniqueness":  "none",
+	}
+	if len(sub) > 0 {
+		a["subAttributes"] = sub
+	}
+	return a
+}
+
+// Schemas describes the attributes Sachi stores for each resource type
+func Schemas() []map[string]any {
+	user := attr("userName", "string", false, true, "readWrite")
+	user["uniqueness"] = "server"
+	password := attr("password", "string", false, false, "writeOnly")
+	password["returned"] = "never"
+	return []map[string]any{
+		{
+			"schemas":     []string{SchemaSchema},
+			"id":          UserSchema,
+			"name":        "User",
+			"description": "User Account",
+			"attributes": []map[string]any{
+				user,
+				attr("name", "complex", false, false, "readWrite",
+					attr("formatted", "string", false, false, "readWrite"),
+					attr("givenName", "string", false, false, "readWrite"),
+					attr("familyName", "string", false, false, "readWrite")),
+				attr("displayName", "string", false, false, "readWrite"),
+				attr("active", "boolean", false, false, "readWrite"),
+				password,
+				attr("emails", "complex", true, false, "readWrite",
+					attr("value", "string", false, false, "readWrite"),
+					attr("type", "string", false, false, "readWrite"),
+					attr("primary", "boolean", false, false, "readWrite")),
+				attr("groups", "complex", true, false, "readOnly",
+					attr("value", "string", false, false, "readOnly"),
+					attr("display", "string", false, false, "readOnly")),
+			},
+			"meta": map[string]any{"resourceType": "Schema"},
+		},
+		{
+			"schemas":     []string{SchemaSchema},
+			"id":          EnterpriseUserSchema,
+			"name":        "EnterpriseUser",
+			"description": "Enterprise User",
+			"attributes": []map[string]any{
+				attr("organization", "string", false, false, "readWrite"),
+			},
+			"meta": map[string]any{"resourceType": "Schema"},
+		},
+		{
+			"schemas":     []string{SchemaSchema},
+			"id":          GroupSchema,
+			"name":        "Group",
+			"description": "Group",
+			"attributes": []map[string]any{
+				attr("displayName", "string", false, true, "readWrite"),
+				attr("members", "complex", true, false, "readWrite",
+					attr("value", "string", false, false, "immutable"),
+					attr("display", "string", false, false, "readOnly")),
+			},
+			"meta": map[string]any{"resourceType": "Schema"},
+		},
+	}
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+)
+
+// Local keeps blobs as files below a directory. The content type is derived from the key's
+// extension, so keys should carry one.
+type Local struct {
+	dir string
+}
+
+// NewLocal creates the storage directory
+func NewLocal(dir string) (*Local, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("storage directory is empty")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %v", err)
+	}
+	return &Local{dir: dir}, nil
+}
+
+// Dir returns the storage directory
+func (l *Local) Dir() string {
+	return l.dir
+}
+
+func (l *Local) path(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(l.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes the blob through a temporary file so readers never see a partial one
+func (l *Local) Put(key, contentType string, data []byte) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get reads a blob
+func (l *Local) Get(key string) (*Object, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj := &Object{Data: data, ContentType: mime.TypeByExtension(filepath.Ext(path))}
+	if fi, err := os.Stat(path); err == nil {
+		obj.ModTime = fi.ModTime()
+	}
+	if obj.ContentType == "" {
+		obj.ContentType = "application/octet-stream"
+	}
+	return obj, nil
+}
+
+// Delete removes a blob
+func (l *Local) Delete(key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "blobs")
+	l, err := NewLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("\x89PNG not really")
+
+	if err := l.Put("avatars/12-ab_C.png", "image/png", data); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "avatars", "12-ab_C.png")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("file holds %q: %v", got, err)
+	}
+	obj, err := l.Get("avatars/12-ab_C.png")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !bytes.Equal(obj.Data, data) || obj.ContentType != "image/png" || obj.ModTime.IsZero() {
+		t.Errorf("got %q as %s at %v", obj.Data, obj.ContentType, obj.ModTime)
+	}
+
+	// Put replaces the blob without leaving temporary files behind
+	if err := l.Put("avatars/12-ab_C.png", "image/png", []byte("new")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if obj, _ := l.Get("avatars/12-ab_C.png"); string(obj.Data) != "new" {
+		t.Errorf("got %q after replacing", obj.Data)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "avatars")); len(entries) != 1 {
+		t.Errorf("directory holds %d files, want 1", len(entries))
+	}
+
+	if err := l.Put("notes/readme", "", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if obj, _ := l.Get("notes/readme"); obj.ContentType != "application/octet-stream" {
+		t.Errorf("content type %s for a key without extension", obj.ContentType)
+	}
+
+	if err := l.Delete("avatars/12-ab_C.png"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := l.Get("avatars/12-ab_C.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete: %v, want ErrNotFound", err)
+	}
+	if err := l.Delete("avatars/12-ab_C.png"); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+}
+
+func TestLocalRejectsKeysOutsideDir(t *testing.T) {
+	root := t.TempDir()
+	l, err := NewLocal(filepath.Join(root, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", "../outside.txt", "a/../../outside.txt", "/etc/passwd", "a//b", "./a", `a\b`, "a b", "ä.png"} {
+		if err := l.Put(key, "", []byte("x")); err == nil {
+			t.Errorf("Put accepted key %q", key)
+		}
+		if _, err := l.Get(key); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q): %v, want an invalid key error", key, err)
+		}
+		if err := l.Delete(key); err == nil {
+			t.Errorf("Delete accepted key %q", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "outside.txt")); err == nil {
+		t.Error("a blob was written outside the storage directory")
+	}
+}
+
+func TestNewLocal(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "from-url")
+	s, err := New("file://"+dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, ok := s.(*Local); !ok || l.Dir() != dir {
+		t.Errorf("New gave %#v, want a local store in %s", s, dir)
+	}
+	if s, err = New("", dir+"-default"); err != nil || s.(*Local).Dir() != dir+"-default" {
+		t.Errorf("New without a URL gave %#v: %v", s, err)
+	}
+	if _, err := NewLocal(""); err == nil {
+		t.Error("NewLocal accepted an empty directory")
+	}
+}
@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Timeout bounds one request so a slow endpoint cannot hold up an upload forever
+const s3Timeout = 30 * time.Second
+
+// S3 keeps blobs in a bucket of an S3-compatible service, addressed path-style
+// (https://host/bucket/key) so it works with MinIO and other self-hosted endpoints.
+// Requests are signed with AWS Signature Version 4.
+type S3 struct {
+	endpoint     *url.URL // scheme and host
+	bucket       string
+	prefix       string // prepended to every key, without a trailing slash
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+	now          func() time.Time
+}
+
+// NewS3 configures a bucket from s3://ACCESS_KEY:SECRET@host[:port]/bucket[/prefix]?region=...
+// Credentials and region fall back to AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// AWS_SESSION_TOKEN and AWS_REGION.
+func NewS3(u *url.URL) (*S3, error) {
+	s := &S3{
+		endpoint:     &url.URL{Scheme: "https", Host: u.Host},
+		region:       u.Query().Get("region"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: s3Timeout},
+		now:          time.Now,
+	}
+	if u.Scheme == "s3+http" {
+		s.endpoint.Scheme = "http"
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("S3 URL has no endpoint host")
+	}
+	path := strings.Trim(u.Path, "/")
+	s.bucket, s.prefix, _ = strings.Cut(path, "/")
+	if s.bucket == "" {
+		return nil, fmt.Errorf("S3 URL has no bucket")
+	}
+	if s.prefix != "" {
+		if err := checkKey(s.prefix); err != nil {
+			return nil, fmt.Errorf("invalid S3 key prefix %q", s.prefix)
+		}
+	}
+	if u.User != nil {
+		s.accessKey = u.User.Username()
+		s.secretKey, _ = u.User.Password()
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("S3 credentials missing: put them in the URL or set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	return s, nil
+}
+
+// Put uploads a blob
+func (s *S3) Put(key, contentType string, data []byte) error {
+	resp, err := s.do(http.MethodPut, key, data, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+// Get downloads a blob
+func (s *S3) Get(key string) (*Object, error) {
+	resp, err := s.do(http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error(resp)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	obj := &Object{Data: data, ContentType: resp.Header.Get("Content-Type")}
+	obj.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return obj, nil
+}
+
+// Delete removes a blob
+func (s *S3) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *S3) do(method, key string, body []byte, contentType string) (*http.Response, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	u := *s.endpoint
+	u.Path = "/" + s.bucket + "/" + key
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, body)
+	return s.client.Do(req)
+}
+
+// sign adds the SigV4 Authorization header. The payload hash is always computed (no
+// UNSIGNED-PAYLOAD) since blobs are small and held in memory anyway.
+func (s *S3) sign(req *http.Request, body []byte) {
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	signV4(req, payloadHash, s.accessKey, s.secretKey, s.region, "s3", s.now())
+}
+
+// signV4 sets X-Amz-Date and the AWS Signature Version 4 Authorization header for service in
+// region. Every header already on req is signed. The path is encoded once, as S3 expects.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	// Canonical headers: host plus every header set, lowercased and sorted
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, and slashes unless
+// encodeSlash is set, as SigV4 requires
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Error turns an S3 XML error document into an error
+func s3Error(resp *http.Response) error {
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return fmt.Errorf("S3 %s: %s: %s", resp.Status, e.Code, e.Message)
+	}
+	return fmt.Errorf("S3 %s", resp.Status)
+}
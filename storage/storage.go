@@ -0,0 +1,67 @@
+// Package storage keeps uploaded files (avatars and the like) in a pluggable Store: a
+// directory under DataDir by default, or an S3-compatible bucket (AWS S3, MinIO, R2, ...).
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a key does not exist
+var ErrNotFound = errors.New("blob not found")
+
+// Object is a stored blob
+type Object struct {
+	Data        []byte
+	ContentType string
+	ModTime     time.Time
+}
+
+// Store keeps blobs under slash-separated keys such as "avatars/12-ab34.png"
+type Store interface {
+	Put(key, contentType string, data []byte) error
+	Get(key string) (*Object, error)
+	// Delete removes a blob; deleting a missing key is not an error
+	Delete(key string) error
+}
+
+// New returns the store for storageURL: a directory for file:///path, an S3-compatible bucket
+// for s3://ACCESS_KEY:SECRET@host/bucket[/prefix]?region=... (s3+http:// for a plain-HTTP
+// endpoint such as a local MinIO), or localDir when storageURL is empty
+func New(storageURL, localDir string) (Store, error) {
+	if storageURL == "" {
+		return NewLocal(localDir)
+	}
+	u, err := url.Parse(storageURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage URL: %v", err)
+	}
+	switch u.Scheme {
+	case "file":
+		return NewLocal(u.Path)
+	case "s3", "s3+http":
+		return NewS3(u)
+	}
+	return nil, fmt.Errorf("unsupported storage URL scheme %q (want file, s3 or s3+http)", u.Scheme)
+}
+
+// checkKey rejects keys that could escape the store's root or need escaping to be portable
+func checkKey(key string) error {
+	if key == "" || len(key) > 512 {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return fmt.Errorf("invalid blob key %q", key)
+		}
+		for _, r := range seg {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+				return fmt.Errorf("invalid blob key %q", key)
+			}
+		}
+	}
+	return nil
+}
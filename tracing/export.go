@@ -0,0 +1,388 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/isymbo/sachi/metrics"
+)
+
+// Exporters selectable with Config.Exporter
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// DefaultOTLPEndpoint is where an OpenTelemetry Collector on the same host accepts OTLP/HTTP
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+// EndpointFromEnv returns the traces URL named by OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or by
+// OTEL_EXPORTER_OTLP_ENDPOINT with the signal path added, or DefaultOTLPEndpoint
+func EndpointFromEnv() string {
+	if u := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); u != "" {
+		return u
+	}
+	if u := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); u != "" {
+		return strings.TrimRight(u, "/") + "/v1/traces"
+	}
+	return DefaultOTLPEndpoint
+}
+
+const (
+	queueSize     = 2048
+	batchSize     = 512
+	flushInterval = 5 * time.Second
+	exportTimeout = 10 * time.Second
+)
+
+var (
+	spansExported = metrics.NewCounter("sachi_trace_spans_exported_total",
+		"Spans handed to the trace exporter.")
+	spansDropped = metrics.NewCounter("sachi_trace_spans_dropped_total",
+		"Spans dropped because the export queue was full or shut down.")
+	exportErrors = metrics.NewCounter("sachi_trace_export_errors_total",
+		"Failed trace export batches.")
+)
+
+// Config selects where spans go
+type Config struct {
+	Exporter       string            // none, otlp, stdout or file
+	Endpoint       string            // OTLP/HTTP traces URL
+	Headers        map[string]string // sent with every OTLP request, e.g. an API key
+	File           string            // OTLP JSON lines file for the file exporter
+	SampleRatio    float64           // share of new traces recorded, 0 to 1; continued traces follow the caller
+	ServiceName    string
+	ServiceVersion string
+}
+
+// provider batches ended spans and hands them to the exporter on its own goroutine
+type provider struct {
+	sampleBound uint64
+	resource    []Attr
+	exporter    exporter
+	queue       chan *Span
+	done        chan struct{}
+
+	// mu guards sends on queue against Shutdown closing it
+	mu     sync.RWMutex
+	closed bool
+}
+
+var active atomic.Pointer[provider]
+
+func current() *provider {
+	return active.Load()
+}
+
+// Enabled reports whether spans are being recorded
+func Enabled() bool {
+	return current() != nil
+}
+
+// Init starts exporting spans as configured. The none exporter leaves tracing off.
+func Init(cfg Config) error {
+	var exp exporter
+	switch cfg.Exporter {
+	case "", ExporterNone:
+		return nil
+	case ExporterOTLP:
+		u, err := url.Parse(cfg.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid OTLP endpoint %q", cfg.Endpoint)
+		}
+		exp = &otlpExporter{endpoint: cfg.Endpoint, headers: cfg.Headers, client: &http.Client{Timeout: exportTimeout}}
+	case ExporterStdout:
+		exp = &writerExporter{w: os.Stdout}
+	case ExporterFile:
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open trace file: %v", err)
+		}
+		exp = &writerExporter{w: f, closer: f}
+	default:
+		return fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+
+	host, _ := os.Hostname()
+	p := &provider{
+		sampleBound: sampleBound(cfg.SampleRatio),
+		resource: []Attr{
+			String("service.name", cfg.ServiceName),
+			String("service.version", cfg.ServiceVersion),
+			String("host.name", host),
+			Int("process.pid", os.Getpid()),
+		},
+		exporter: exp,
+		queue:    make(chan *Span, queueSize),
+		done:     make(chan struct{}),
+	}
+	active.Store(p)
+	go p.run()
+	return nil
+}
+
+// Shutdown exports the spans still queued and stops tracing
+func Shutdown() {
+	p := active.Swap(nil)
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+	select {
+	case <-p.done:
+	case <-time.After(exportTimeout):
+		log.Printf("tracing: gave up flushing spans on shutdown")
+	}
+}
+
+// enqueue hands an ended span to the exporter. It never blocks: spans are dropped when the
+// queue is full, or closed because a span ended after Shutdown.
+func (p *provider) enqueue(s *Span) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		spansDropped.Inc()
+		return
+	}
+	select {
+	case p.queue <- s:
+	default:
+		spansDropped.Inc()
+	}
+}
+
+func (p *provider) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := p.exporter.export(encodeSpans(p.resource, batch)); err != nil {
+			exportErrors.Inc()
+			log.Printf("tracing: export of %d spans failed: %v", len(batch), err)
+		} else {
+			spansExported.Add(float64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s, ok := <-p.queue:
+			if !ok {
+				flush()
+				p.exporter.close()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) == batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// exporter sends one OTLP JSON ExportTraceServiceRequest
+type exporter interface {
+	export(body []byte) error
+	close()
+}
+
+// otlpExporter posts to an OTLP/HTTP receiver using the JSON encoding
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+func (e *otlpExporter) export(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (e *otlpExporter) close() {}
+
+// writerExporter writes one request per line, the format the Collector's otlpjsonfile
+// receiver reads, so offline traces can be replayed into a backend later
+type writerExporter struct {
+	w      io.Writer
+	closer io.Closer
+}
+
+func (e *writerExporter) export(body []byte) error {
+	_, err := e.w.Write(append(body, '\n'))
+	return err
+}
+
+func (e *writerExporter) close() {
+	if e.closer != nil {
+		e.closer.Close()
+	}
+}
+
+// ParseHeaders reads OTEL_EXPORTER_OTLP_HEADERS syntax: comma-separated key=value pairs with
+// URL-encoded values
+func ParseHeaders(s string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid header %q, want key=value", pair)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid header %q: %v", pair, err)
+		}
+		headers[strings.TrimSpace(k)] = value
+	}
+	return headers, nil
+}
+
+// OTLP JSON encoding (https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding):
+// IDs are hex, 64-bit integers are strings and enums are numbers.
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    string   `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	TraceState        string         `json:"traceState,omitempty"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              Kind           `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func encodeAttrs(attrs []Attr) []otlpKeyValue {
+	out := make([]otlpKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		kv := otlpKeyValue{Key: a.Key}
+		switch v := a.Value.(type) {
+		case string:
+			kv.Value.StringValue = &v
+		case bool:
+			kv.Value.BoolValue = &v
+		case int64:
+			kv.Value.IntValue = strconv.FormatInt(v, 10)
+		case float64:
+			kv.Value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			kv.Value.StringValue = &s
+		}
+		out = append(out, kv)
+	}
+	return out
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// encodeSpans builds an ExportTraceServiceRequest for one batch
+func encodeSpans(resource []Attr, batch []*Span) []byte {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		out := otlpSpan{
+			TraceID:           s.sc.TraceID.String(),
+			SpanID:            s.sc.SpanID.String(),
+			TraceState:        s.sc.TraceState,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: unixNano(s.start),
+			EndTimeUnixNano:   unixNano(s.end),
+			Attributes:        encodeAttrs(s.attrs),
+		}
+		if s.parent.IsValid() {
+			out.ParentSpanID = s.parent.String()
+		}
+		for _, e := range s.events {
+			out.Events = append(out.Events, otlpEvent{TimeUnixNano: unixNano(e.time), Name: e.name, Attributes: encodeAttrs(e.attrs)})
+		}
+		if s.statusError {
+			out.Status = otlpStatus{Code: 2, Message: s.statusMessage}
+		}
+		s.mu.Unlock()
+		spans = append(spans, out)
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": encodeAttrs(resource)},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/isymbo/sachi"},
+				"spans": spans,
+			}},
+		}},
+	})
+	return body
+}
@@ -0,0 +1,286 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is an OTLP/HTTP receiver that keeps the requests it gets
+type collector struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newCollector(t *testing.T) *collector {
+	c := &collector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		c.mu.Lock()
+		c.requests = append(c.requests, r)
+		c.bodies = append(c.bodies, body)
+		c.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// initOTLP starts tracing to c, recording every trace, and stops it when the test ends
+func initOTLP(t *testing.T, c *collector) {
+	t.Helper()
+	err := Init(Config{
+		Exporter:       ExporterOTLP,
+		Endpoint:       c.URL + "/v1/traces",
+		Headers:        map[string]string{"X-Api-Key": "secret"},
+		SampleRatio:    1,
+		ServiceName:    "sachi-test",
+		ServiceVersion: "1.2.3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(Shutdown)
+}
+
+// The parts of an ExportTraceServiceRequest the tests look at, decoded without the
+// exporter's own types
+type exportRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []keyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Scope struct {
+				Name string `json:"name"`
+			} `json:"scope"`
+			Spans []exportedSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+type exportedSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	TraceState        string     `json:"traceState"`
+	ParentSpanID      *string    `json:"parentSpanId"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano any        `json:"startTimeUnixNano"`
+	EndTimeUnixNano   any        `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes"`
+	Events            []struct {
+		TimeUnixNano any        `json:"timeUnixNano"`
+		Name         string     `json:"name"`
+		Attributes   []keyValue `json:"attributes"`
+	} `json:"events"`
+	Status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+type keyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+// attr returns the single OTLP AnyValue field of the named attribute, like {"intValue": "42"}
+func attr(kvs []keyValue, key string) map[string]any {
+	for _, kv := range kvs {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return nil
+}
+
+var (
+	hexTraceID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	hexSpanID  = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+// checkNano checks that v is a decimal string of nanoseconds between from and to
+func checkNano(t *testing.T, field string, v any, from, to time.Time) int64 {
+	t.Helper()
+	s, ok := v.(string)
+	if !ok {
+		t.Errorf("%s is %T %v, want a string", field, v, v)
+		return 0
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < from.UnixNano() || n > to.UnixNano() {
+		t.Errorf("%s %q is not a time in nanoseconds between %v and %v", field, s, from, to)
+	}
+	return n
+}
+
+func TestOTLPExport(t *testing.T) {
+	c := newCollector(t)
+	initOTLP(t, c)
+
+	before := time.Now()
+	ctx, root := Start(context.Background(), "GET /api/me", KindServer, String("http.request.method", "GET"))
+	root.SetAttributes(Int("http.response.status_code", 200), Bool("cached", false))
+	_, child := Start(ctx, "db.query", KindInternal)
+	child.RecordError(errors.New("database is locked"))
+	child.End()
+	root.End()
+	Shutdown()
+	after := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.bodies) != 1 {
+		t.Fatalf("collector got %d requests, want 1", len(c.bodies))
+	}
+	r := c.requests[0]
+	if r.Method != "POST" || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Api-Key") != "secret" {
+		t.Errorf("unexpected request %s %s with headers %v", r.Method, r.URL, r.Header)
+	}
+
+	var req exportRequest
+	if err := json.Unmarshal(c.bodies[0], &req); err != nil {
+		t.Fatalf("body is not OTLP JSON: %v\n%s", err, c.bodies[0])
+	}
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected structure:\n%s", c.bodies[0])
+	}
+	resource := req.ResourceSpans[0].Resource.Attributes
+	if attr(resource, "service.name")["stringValue"] != "sachi-test" || attr(resource, "service.version")["stringValue"] != "1.2.3" {
+		t.Errorf("unexpected resource %v", resource)
+	}
+	if pid := attr(resource, "process.pid")["intValue"]; pid == nil {
+		t.Errorf("no process.pid in %v", resource)
+	}
+	scope := req.ResourceSpans[0].ScopeSpans[0]
+	if scope.Scope.Name != "github.com/isymbo/sachi" || len(scope.Spans) != 2 {
+		t.Fatalf("unexpected scope %s with %d spans", scope.Scope.Name, len(scope.Spans))
+	}
+
+	// Spans are exported in the order they ended
+	gotChild, gotRoot := scope.Spans[0], scope.Spans[1]
+	for _, s := range scope.Spans {
+		if !hexTraceID.MatchString(s.TraceID) || !hexSpanID.MatchString(s.SpanID) {
+			t.Errorf("span %s has IDs %q/%q, want lowercase hex", s.Name, s.TraceID, s.SpanID)
+		}
+		start := checkNano(t, s.Name+" startTimeUnixNano", s.StartTimeUnixNano, before, after)
+		end := checkNano(t, s.Name+" endTimeUnixNano", s.EndTimeUnixNano, before, after)
+		if end < start {
+			t.Errorf("span %s ends before it starts", s.Name)
+		}
+	}
+	if gotRoot.TraceID != root.TraceID() || gotRoot.SpanID != root.SpanContext().SpanID.String() {
+		t.Errorf("root exported as %s/%s", gotRoot.TraceID, gotRoot.SpanID)
+	}
+	if gotRoot.ParentSpanID != nil {
+		t.Errorf("root span has parent %q", *gotRoot.ParentSpanID)
+	}
+	if gotChild.TraceID != gotRoot.TraceID || gotChild.ParentSpanID == nil || *gotChild.ParentSpanID != gotRoot.SpanID {
+		t.Errorf("child is not linked to the root: trace %s, parent %v", gotChild.TraceID, gotChild.ParentSpanID)
+	}
+
+	if gotRoot.Name != "GET /api/me" || gotRoot.Kind != int(KindServer) || gotChild.Kind != int(KindInternal) {
+		t.Errorf("names and kinds %s/%d, %s/%d", gotRoot.Name, gotRoot.Kind, gotChild.Name, gotChild.Kind)
+	}
+	// 64-bit integers are strings in OTLP JSON
+	if v := attr(gotRoot.Attributes, "http.response.status_code"); v["intValue"] != "200" {
+		t.Errorf("status code attribute %v, want intValue \"200\"", v)
+	}
+	if v := attr(gotRoot.Attributes, "cached"); v["boolValue"] != false {
+		t.Errorf("bool attribute %v", v)
+	}
+	if v := attr(gotRoot.Attributes, "http.request.method"); v["stringValue"] != "GET" {
+		t.Errorf("string attribute %v", v)
+	}
+	if gotRoot.Status.Code != 0 {
+		t.Errorf("root status %+v, want unset", gotRoot.Status)
+	}
+
+	if gotChild.Status.Code != 2 || gotChild.Status.Message != "database is locked" {
+		t.Errorf("child status %+v, want error", gotChild.Status)
+	}
+	if len(gotChild.Events) != 1 || gotChild.Events[0].Name != "exception" {
+		t.Fatalf("child events %+v", gotChild.Events)
+	}
+	checkNano(t, "event timeUnixNano", gotChild.Events[0].TimeUnixNano, before, after)
+	if v := attr(gotChild.Events[0].Attributes, "exception.message"); v["stringValue"] != "database is locked" {
+		t.Errorf("exception.message %v", v)
+	}
+}
+
+func TestOTLPExportRemoteParent(t *testing.T) {
+	c := newCollector(t)
+	initOTLP(t, c)
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := Extract(context.Background(), traceparent, "vendor=opaque")
+	_, span := Start(ctx, "POST /api/login", KindServer)
+	span.End()
+	Shutdown()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var req exportRequest
+	if len(c.bodies) != 1 || json.Unmarshal(c.bodies[0], &req) != nil {
+		t.Fatalf("collector got %d requests", len(c.bodies))
+	}
+	s := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || s.ParentSpanID == nil || *s.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("span continues trace %s under %v, want the caller's", s.TraceID, s.ParentSpanID)
+	}
+	if s.SpanID == "00f067aa0ba902b7" || s.TraceState != "vendor=opaque" {
+		t.Errorf("span ID %s, trace state %q", s.SpanID, s.TraceState)
+	}
+}
+
+func TestSpansEndingAfterShutdown(t *testing.T) {
+	c := newCollector(t)
+	initOTLP(t, c)
+
+	// Spans ending on other goroutines race with Shutdown; the ones that lose are dropped
+	p := current()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, s := Start(context.Background(), "work", KindInternal)
+				s.End()
+			}
+		}()
+	}
+	Shutdown()
+	wg.Wait()
+
+	// End may have loaded the provider just before Shutdown closed its queue
+	p.enqueue(&Span{name: "late"})
+	if _, s := Start(context.Background(), "after", KindInternal); s != nil {
+		t.Error("Start recorded a span after Shutdown")
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	h, err := ParseHeaders("api-key=abc%3D%3D, x-tenant = acme ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 2 || h["api-key"] != "abc==" || h["x-tenant"] != "acme" {
+		t.Errorf("got %v", h)
+	}
+	if _, err := ParseHeaders("no-value"); err == nil {
+		t.Error("a header without = was accepted")
+	}
+}
@@ -0,0 +1,122 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+)
+
+// W3C Trace Context headers (https://www.w3.org/TR/trace-context/)
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+// ParseTraceparent reads a version-00 traceparent header such as
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01. Higher versions are read the same
+// way as the specification asks, as long as the known fields are intact.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	var sc SpanContext
+	if len(header) < 55 || header[2] != '-' || header[35] != '-' || header[52] != '-' || !lowerHex(header[:55]) {
+		return sc, false
+	}
+	version, err := hex.DecodeString(header[:2])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(header) != 55) || (len(header) > 55 && header[55] != '-') {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(header[3:35])); err != nil || !sc.TraceID.IsValid() {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(header[36:52])); err != nil || !sc.SpanID.IsValid() {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(header[53:55], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags&1 == 1
+	return sc, true
+}
+
+// lowerHex reports whether s has only lowercase hex digits and dashes, as traceparent fields
+// must; the decoders below would also take uppercase
+func lowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Traceparent formats the span context as a version-00 traceparent header
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// Extract returns a context whose spans continue the trace named by the incoming headers.
+// Without a valid traceparent ctx is returned unchanged and a new trace starts.
+func Extract(ctx context.Context, traceparent, tracestate string) context.Context {
+	sc, ok := ParseTraceparent(traceparent)
+	if !ok {
+		return ctx
+	}
+	sc.TraceState = tracestate
+	return ContextWithRemote(ctx, sc)
+}
+
+// Inject writes the trace context of the span in ctx into outgoing request headers
+func Inject(ctx context.Context, h http.Header) {
+	s := SpanFromContext(ctx)
+	if s == nil {
+		return
+	}
+	h.Set(TraceparentHeader, s.sc.Traceparent())
+	if s.sc.TraceState != "" {
+		h.Set(TracestateHeader, s.sc.TraceState)
+	}
+}
+
+// Transport wraps an http.RoundTripper (nil for http.DefaultTransport) so outgoing requests
+// get a client span and carry its trace context to the server
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{base}
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := Start(req.Context(), "HTTP "+req.Method, KindClient,
+		String("http.request.method", req.Method),
+		String("server.address", req.URL.Hostname()),
+		String("url.full", req.URL.Redacted()),
+	)
+	if span == nil {
+		return t.base.RoundTrip(req)
+	}
+	defer span.End()
+
+	// RoundTrippers must not modify the caller's request
+	req = req.Clone(ctx)
+	Inject(ctx, req.Header)
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes(Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetError(resp.Status)
+	}
+	return resp, nil
+}
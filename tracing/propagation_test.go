@@ -0,0 +1,97 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name    string
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"sampled", "00-" + traceID + "-" + spanID + "-01", true, true},
+		{"not sampled", "00-" + traceID + "-" + spanID + "-00", true, false},
+		{"unknown flags ignored", "00-" + traceID + "-" + spanID + "-09", true, true},
+		{"higher version", "cc-" + traceID + "-" + spanID + "-01", true, true},
+		{"higher version with more fields", "cc-" + traceID + "-" + spanID + "-01-what-the-future-will-be-like", true, true},
+
+		{"empty", "", false, false},
+		{"version ff", "ff-" + traceID + "-" + spanID + "-01", false, false},
+		{"version 00 with more fields", "00-" + traceID + "-" + spanID + "-01-extra", false, false},
+		{"higher version, field not delimited", "cc-" + traceID + "-" + spanID + "-01x", false, false},
+		{"all-zero trace ID", "00-00000000000000000000000000000000-" + spanID + "-01", false, false},
+		{"all-zero span ID", "00-" + traceID + "-0000000000000000-01", false, false},
+		{"uppercase trace ID", "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanID + "-01", false, false},
+		{"uppercase flags", "00-" + traceID + "-" + spanID + "-0A", false, false},
+		{"non-hex version", "0g-" + traceID + "-" + spanID + "-01", false, false},
+		{"non-hex span ID", "00-" + traceID + "-00f067aa0ba902bz-01", false, false},
+		{"short trace ID", "00-" + traceID[1:] + "-" + spanID + "-01", false, false},
+		{"wrong delimiter", "00_" + traceID + "_" + spanID + "_01", false, false},
+		{"padded", " 00-" + traceID + "-" + spanID + "-01", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.header)
+			if ok != tt.ok {
+				t.Fatalf("ParseTraceparent(%q) ok = %v, want %v", tt.header, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if sc.TraceID.String() != traceID || sc.SpanID.String() != spanID || sc.Sampled != tt.sampled {
+				t.Errorf("got %s %s sampled=%v", sc.TraceID, sc.SpanID, sc.Sampled)
+			}
+			// What is sent on is always version 00
+			if tt.sampled && sc.Traceparent() != "00-"+traceID+"-"+spanID+"-01" {
+				t.Errorf("Traceparent() = %s", sc.Traceparent())
+			}
+		})
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: Transport(nil)}
+
+	// Without tracing nothing is added
+	if _, err := client.Get(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if got.Get(TraceparentHeader) != "" {
+		t.Errorf("traceparent sent with tracing off: %s", got.Get(TraceparentHeader))
+	}
+
+	initOTLP(t, newCollector(t))
+	ctx := Extract(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "vendor=opaque")
+	ctx, parent := Start(ctx, "job", KindInternal)
+	defer parent.End()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server sees the client span, a child of the caller's span in the same trace
+	sc, ok := ParseTraceparent(got.Get(TraceparentHeader))
+	if !ok || sc.TraceID != parent.sc.TraceID || sc.SpanID == parent.sc.SpanID || !sc.Sampled {
+		t.Errorf("traceparent %q does not continue trace %s", got.Get(TraceparentHeader), parent.sc.TraceID)
+	}
+	if got.Get(TracestateHeader) != "vendor=opaque" {
+		t.Errorf("tracestate %q", got.Get(TracestateHeader))
+	}
+	if req.Header.Get(TraceparentHeader) != "" {
+		t.Error("the caller's request was modified")
+	}
+}
@@ -0,0 +1,249 @@
+// Package tracing records OpenTelemetry-compatible spans and exports them in batches over
+// OTLP/HTTP or as OTLP JSON lines to stdout or a file. It is off until Init is called with an
+// exporter; until then Start returns nil spans, whose methods do nothing.
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace across services
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid reports whether the ID is not all zeros, which W3C trace context forbids
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid reports whether the ID is not all zeros, which W3C trace context forbids
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// SpanContext is the part of a span that crosses process boundaries
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string // vendor data from the tracestate header, passed on unchanged
+	Remote     bool   // extracted from an incoming request
+}
+
+// Kind says what role a span plays, numbered as in OTLP
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Attr is a span attribute; Value is a string, bool, int64 or float64
+type Attr struct {
+	Key   string
+	Value any
+}
+
+func String(key, value string) Attr    { return Attr{key, value} }
+func Int(key string, value int) Attr   { return Attr{key, int64(value)} }
+func Bool(key string, value bool) Attr { return Attr{key, value} }
+
+// event is a timestamped annotation, used for recorded errors
+type event struct {
+	name  string
+	time  time.Time
+	attrs []Attr
+}
+
+// Span is one timed operation. A nil *Span is valid and ignores every call, which is what
+// Start returns while tracing is off.
+type Span struct {
+	sc     SpanContext
+	parent SpanID
+	kind   Kind
+
+	mu            sync.Mutex
+	name          string
+	start, end    time.Time
+	attrs         []Attr
+	events        []event
+	statusError   bool
+	statusMessage string
+	ended         bool
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Start begins a span as a child of the span in ctx, or of a remote parent extracted from an
+// incoming request, or as the root of a new trace. End must be called on the returned span.
+func Start(ctx context.Context, name string, kind Kind, attrs ...Attr) (context.Context, *Span) {
+	p := current()
+	if p == nil {
+		return ctx, nil
+	}
+
+	s := &Span{kind: kind, name: name, start: time.Now()}
+	parent, ok := parentContext(ctx)
+	if ok {
+		s.sc.TraceID = parent.TraceID
+		s.sc.Sampled = parent.Sampled
+		s.sc.TraceState = parent.TraceState
+		s.parent = parent.SpanID
+	} else {
+		binary.BigEndian.PutUint64(s.sc.TraceID[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(s.sc.TraceID[8:], rand.Uint64())
+		s.sc.Sampled = sampled(s.sc.TraceID, p.sampleBound)
+	}
+	binary.BigEndian.PutUint64(s.sc.SpanID[:], rand.Uint64()|1)
+	if s.sc.Sampled {
+		s.attrs = attrs
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func parentContext(ctx context.Context) (SpanContext, bool) {
+	if s, ok := ctx.Value(spanKey{}).(*Span); ok && s != nil {
+		return s.sc, true
+	}
+	if sc, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		return sc, true
+	}
+	return SpanContext{}, false
+}
+
+// SpanFromContext returns the span started by the caller, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// TraceIDFromContext returns the trace ID of the span in ctx, or "" when there is none
+func TraceIDFromContext(ctx context.Context) string {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.sc.TraceID.String()
+	}
+	return ""
+}
+
+// LogSuffix is appended to log lines about work done under ctx, " trace_id=..." or nothing,
+// so a log line leads to its trace
+func LogSuffix(ctx context.Context) string {
+	if id := TraceIDFromContext(ctx); id != "" {
+		return " trace_id=" + id
+	}
+	return ""
+}
+
+// ContextWithRemote makes sc the parent of spans started from the returned context
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	sc.Remote = true
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// SpanContext returns what is propagated to other services
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// TraceID returns the hex trace ID, or "" for a nil span
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.sc.TraceID.String()
+}
+
+// IsRecording reports whether attributes and events set on the span will be exported
+func (s *Span) IsRecording() bool {
+	return s != nil && s.sc.Sampled
+}
+
+// SetName replaces the name given to Start, for names only known at the end such as a route
+func (s *Span) SetName(name string) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// RecordError marks the span failed with err and adds an exception event. A nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if err == nil || !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	s.events = append(s.events, event{name: "exception", time: time.Now(), attrs: []Attr{
+		String("exception.type", fmt.Sprintf("%T", err)),
+		String("exception.message", err.Error()),
+	}})
+	s.statusError = true
+	s.statusMessage = err.Error()
+	s.mu.Unlock()
+}
+
+// SetError marks the span failed without an error value, e.g. for a 5xx response
+func (s *Span) SetError(message string) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	s.statusError = true
+	s.statusMessage = message
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export. Later calls do nothing.
+func (s *Span) End() {
+	if !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	if p := current(); p != nil {
+		p.enqueue(s)
+	}
+}
+
+// sampleBound turns a ratio into a threshold compared with the low bits of the trace ID, so
+// every service with the same ratio makes the same decision for a trace
+func sampleBound(ratio float64) uint64 {
+	if b := ratio * 0x1p64; b < 0x1p64 {
+		return uint64(math.Max(b, 0))
+	}
+	return math.MaxUint64
+}
+
+func sampled(id TraceID, bound uint64) bool {
+	return bound == math.MaxUint64 || binary.BigEndian.Uint64(id[8:]) < bound
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Thumbnail center-crops src to a square and scales it to size×size. Each output pixel
+// averages the source pixels it covers (a box filter), which keeps downscaled photos smooth
+// without pulling in an imaging library; smaller sources are enlarged by pixel repetition.
+func Thumbnail(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	side := min(b.Dx(), b.Dy())
+	origin := image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2)
+
+	// Copy the square into premultiplied RGBA once; draw has fast paths for the decoder formats
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), src, origin, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		y0 := dy * side / size
+		y1 := max((dy+1)*side/size, y0+1)
+		for dx := 0; dx < size; dx++ {
+			x0 := dx * side / size
+			x1 := max((dx+1)*side/size, x0+1)
+
+			var r, g, bl, a, n uint64
+			for y := y0; y < y1; y++ {
+				row := square.Pix[y*square.Stride+x0*4 : y*square.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					r += uint64(row[i])
+					g += uint64(row[i+1])
+					bl += uint64(row[i+2])
+					a += uint64(row[i+3])
+					n++
+				}
+			}
+			o := dy*dst.Stride + dx*4
+			dst.Pix[o] = uint8((r + n/2) / n)
+			dst.Pix[o+1] = uint8((g + n/2) / n)
+			dst.Pix[o+2] = uint8((bl + n/2) / n)
+			dst.Pix[o+3] = uint8((a + n/2) / n)
+		}
+	}
+	return dst
+}
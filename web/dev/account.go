@@ -0,0 +1,285 @@
+package dev
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/orm"
+	"github.com/isymbo/sachi/storage"
+	"github.com/isymbo/sachi/tracing"
+)
+
+// Audit actions
+const (
+	auditDataExport          = "account.data_export"
+	auditDeleteRequest       = "account.delete_request"
+	auditDeleteRequestFailed = "account.delete_request_failed"
+	auditDeleteCancel        = "account.delete_cancel"
+	auditAccountPurged       = "account.purged"
+)
+
+// accountDeletionGrace is how long a deleted account can still be restored; set by Run
+var accountDeletionGrace = 14 * 24 * time.Hour
+
+// exportReadme explains the archive to whoever opens it
+const exportReadme = `This archive contains the personal data Sachi stores about your account.
+
+profile.json        your account details
+avatar.jpg/.png     your profile picture, if you uploaded one
+organization.json   the organization your account belongs to, if any
+audit_events.json   security events you performed or that concern your account
+sessions.json       your sign-in sessions (tokens are not included)
+identities.json     single sign-on identities linked to your account
+oauth_*.json        applications you authorized and their tokens (without the tokens themselves)
+groups.json         groups your identity provider placed you in
+password_changes.json  when you changed your password (password hashes are not included)
+sign_in_links.json  emailed sign-in links you requested
+*_created.json      applications and tokens you registered as an administrator
+`
+
+// accountExport collects everything stored about a user
+func accountExport(c *fiber.Ctx, user *orm.User) (map[string]any, error) {
+	data, err := orm.ExportUserData(c.UserContext(), user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Events the user performed and events about the account, in order and without duplicates
+	events := make([]*orm.AuditEvent, 0)
+	seen := map[int64]bool{}
+	collect := func(e *orm.AuditEvent) error {
+		if !seen[e.ID] {
+			seen[e.ID] = true
+			events = append(events, e)
+		}
+		return nil
+	}
+	if err := orm.EachAuditEvent(c.UserContext(), orm.AuditFilter{ActorID: user.ID}, collect); err != nil {
+		return nil, err
+	}
+	if err := orm.EachAuditEvent(c.UserContext(), orm.AuditFilter{Target: user.Email}, collect); err != nil {
+		return nil, err
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+
+	profile := fiber.Map{
+		"id":         user.ID,
+		"name":       user.Name,
+		"email":      user.Email,
+		"company":    user.Company,
+		"role":       user.Role,
+		"disabled":   user.Disabled,
+		"created_at": user.CreatedAt,
+		"updated_at": user.UpdatedAt,
+	}
+	if !user.DeleteAt.IsZero() {
+		profile["delete_at"] = user.DeleteAt
+	}
+	if url := avatarURL(user); url != "" {
+		profile["avatar_url"] = externalURL(c, url)
+	}
+
+	out := map[string]any{
+		"exported_at":  time.Now().UTC(),
+		"profile":      profile,
+		"audit_events": events,
+	}
+	if user.OrgID != 0 {
+		if org, err := orm.GetOrganizationByID(c.UserContext(), user.OrgID); err == nil {
+			out["organization"] = org
+		}
+	}
+	for name, rows := range data {
+		out[name] = rows
+	}
+	return out, nil
+}
+
+// handleAccountExport downloads the user's personal data as a ZIP of JSON files, or as one
+// JSON document with ?format=json
+func handleAccountExport(c *fiber.Ctx) error {
+	user := c.Locals("user").(*orm.User)
+
+	export, err := accountExport(c, user)
+	if err != nil {
+		logf(c, "Error exporting data of user %d: %v", user.ID, err)
+		return newAPIError(500, codeInternal, "Failed to export account data")
+	}
+	format := c.Query("format", "zip")
+	recordAudit(c, user, auditDataExport, user.Email, fiber.Map{"format": format})
+
+	name := fmt.Sprintf("sachi-data-%d-%s", user.ID, time.Now().UTC().Format("20060102"))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	if format == "json" {
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+name+`.json"`)
+		return c.JSON(export)
+	}
+
+	files := []string{"README.txt"}
+	for key := range export {
+		if key != "exported_at" {
+			files = append(files, key+".json")
+		}
+	}
+	sort.Strings(files[1:])
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	now := time.Now()
+	for _, file := range files {
+		var data []byte
+		if file == "README.txt" {
+			data = []byte(exportReadme)
+		} else if data, err = json.MarshalIndent(export[strings.TrimSuffix(file, ".json")], "", "  "); err != nil {
+			break
+		}
+		var w io.Writer
+		if w, err = zw.CreateHeader(&zip.FileHeader{Name: file, Method: zip.Deflate, Modified: now}); err != nil {
+			break
+		}
+		if _, err = w.Write(data); err != nil {
+			break
+		}
+	}
+	// The picture itself, not just a link that expires
+	if err == nil && user.AvatarKey != "" {
+		var obj *storage.Object
+		if obj, err = blobs.Get(user.AvatarKey); err == nil {
+			var w io.Writer
+			if w, err = zw.CreateHeader(&zip.FileHeader{Name: "avatar" + path.Ext(user.AvatarKey), Method: zip.Store, Modified: now}); err == nil {
+				_, err = w.Write(obj.Data)
+			}
+		} else if errors.Is(err, storage.ErrNotFound) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		logf(c, "Error writing data export of user %d: %v", user.ID, err)
+		return newAPIError(500, codeInternal, "Failed to export account data")
+	}
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+name+`.zip"`)
+	return c.Send(buf.Bytes())
+}
+
+// handleAccountDelete schedules the account for deletion after re-confirming the password.
+// Accounts without a password (single sign-on, sign-in links) confirm by typing their email.
+func handleAccountDelete(c *fiber.Ctx) error {
+	user := c.Locals("user").(*orm.User)
+
+	type DeleteAccountRequest struct {
+		Password string `json:"password"`
+		Confirm  string `json:"confirm"`
+	}
+	req := new(DeleteAccountRequest)
+	if err := c.BodyParser(req); err != nil {
+		return errInvalidBody()
+	}
+
+	if user.PasswordHash != "" {
+		if req.Password == "" || !verifyPassword(c.UserContext(), user, req.Password) {
+			recordAudit(c, user, auditDeleteRequestFailed, user.Email, fiber.Map{"reason": "bad_password"})
+			return newAPIError(401, codeInvalidCredentials, "Password is incorrect")
+		}
+	} else if !strings.EqualFold(strings.TrimSpace(req.Confirm), user.Email) {
+		return newAPIError(400, codeValidationFailed, "Type your email address to confirm").
+			withField("confirm", fieldInvalid, "Does not match your email address")
+	}
+
+	// Someone has to be able to manage the instance afterwards
+	if user.Role == orm.RoleAdmin {
+		admins, err := orm.CountAdmins(c.UserContext())
+		if err != nil {
+			logf(c, "Error counting admins: %v", err)
+			return newAPIError(500, codeInternal, "Failed to delete account")
+		}
+		if admins <= 1 {
+			recordAudit(c, user, auditDeleteRequestFailed, user.Email, fiber.Map{"reason": "last_admin"})
+			return newAPIError(409, codeConflict, "You are the only administrator. Make someone else an administrator first.")
+		}
+	}
+
+	deleteAt := time.Now().Add(accountDeletionGrace)
+	if err := orm.ScheduleUserDeletion(c.UserContext(), user.ID, deleteAt); err != nil {
+		logf(c, "Error scheduling deletion of user %d: %v", user.ID, err)
+		return newAPIError(500, codeInternal, "Failed to delete account")
+	}
+	recordAudit(c, user, auditDeleteRequest, user.Email, fiber.Map{"delete_at": deleteAt.UTC()})
+	setSessionCookie(c, "", time.Now().Add(-time.Hour))
+
+	// Without a grace period the account goes right away
+	if accountDeletionGrace <= 0 {
+		user.DeleteAt = deleteAt
+		purgeAccount(c.UserContext(), user)
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "Your account has been deleted",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"success":   true,
+		"message":   fmt.Sprintf("Your account will be deleted on %s and you have been signed out. To keep it, sign in again before then and choose Keep my account on your profile page.", deleteAt.UTC().Format("January 2, 2006")),
+		"delete_at": deleteAt.UTC(),
+	})
+}
+
+// handleAccountDeleteCancel keeps an account scheduled for deletion
+func handleAccountDeleteCancel(c *fiber.Ctx) error {
+	user := c.Locals("user").(*orm.User)
+	if user.DeleteAt.IsZero() {
+		return newAPIError(400, codeInvalidRequest, "Account is not scheduled for deletion")
+	}
+	if err := orm.CancelUserDeletion(c.UserContext(), user.ID); err != nil {
+		logf(c, "Error cancelling deletion of user %d: %v", user.ID, err)
+		return newAPIError(500, codeInternal, "Failed to cancel account deletion")
+	}
+	recordAudit(c, user, auditDeleteCancel, user.Email, nil)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Account deletion cancelled",
+	})
+}
+
+// purgeAccount deletes an account whose grace period is over and records it under the
+// pseudonym, after the user's own events have been anonymised
+func purgeAccount(ctx context.Context, user *orm.User) {
+	if err := orm.PurgeUser(ctx, user); err != nil {
+		log.Printf("account purge error (user %d): %v%s", user.ID, err, tracing.LogSuffix(ctx))
+		return
+	}
+	deleteBlob(user.AvatarKey)
+	pseudonym := orm.DeletedUserPseudonym(user.ID)
+	if err := orm.InsertAuditEvent(ctx, &orm.AuditEvent{Action: auditAccountPurged, Target: pseudonym}); err != nil {
+		log.Printf("audit write error (%s): %v%s", auditAccountPurged, err, tracing.LogSuffix(ctx))
+	}
+}
+
+// purgeDeletedAccounts removes every account whose deletion is due
+func purgeDeletedAccounts(ctx context.Context) error {
+	users, err := orm.UsersDueForDeletion(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		purgeAccount(ctx, u)
+	}
+	if len(users) > 0 {
+		log.Printf("account purge: deleted %d accounts", len(users))
+	}
+	return nil
+}
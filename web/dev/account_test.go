@@ -0,0 +1,102 @@
+package dev
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/orm"
+)
+
+// auditMentions returns the actions of the audit events that name an address, as actor,
+// target or a metadata value
+func auditMentions(t *testing.T, addr string) []string {
+	t.Helper()
+	rows, err := orm.DB.QueryContext(context.Background(), `SELECT action FROM audit_events
+		WHERE actor_email = ?1 OR target = ?1 OR instr(metadata, '"' || ?1 || '"') > 0`, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var actions []string
+	for rows.Next() {
+		var a string
+		rows.Scan(&a)
+		actions = append(actions, a)
+	}
+	return actions
+}
+
+func TestAccountDeletion(t *testing.T) {
+	ctx := context.Background()
+	user := createTestUser(t, "Del", "first@delete.example", "a long enough passphrase")
+	other := createTestUser(t, "Reuse", "other@delete.example", "a long enough passphrase")
+	b := newTestBrowser("192.0.2.90")
+	if resp := b.postJSON(t, "/api/login", map[string]string{"email": user.Email, "password": "a long enough passphrase"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: got status %d", resp.StatusCode)
+	}
+
+	// Two email changes; the second address is taken over by another account afterwards
+	for _, email := range []string{"second@delete.example", "third@delete.example"} {
+		req, _ := http.NewRequest("PUT", "/api/profile", strings.NewReader(`{"name": "Del", "email": "`+email+`"}`))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		req.Header.Set(csrfHeaderName, b.csrfToken(t))
+		if resp := b.do(t, req); resp.StatusCode != http.StatusOK {
+			t.Fatalf("changing the email to %s: got status %d", email, resp.StatusCode)
+		}
+	}
+	if _, err := orm.DB.ExecContext(ctx, "UPDATE users SET email = 'second@delete.example' WHERE id = ?", other.ID); err != nil {
+		t.Fatal(err)
+	}
+	// An event about an earlier address that the account is not the actor of
+	orm.InsertAuditEvent(ctx, &orm.AuditEvent{Action: "test.mention", Target: "first@delete.example", Metadata: map[string]any{"email": "first@delete.example"}})
+	orm.InsertAuditEvent(ctx, &orm.AuditEvent{Action: "test.mention", Target: "notfirst@delete.example"})
+
+	resp := b.postJSON(t, "/api/account/delete", map[string]string{"password": "a long enough passphrase"})
+	var out struct {
+		Message  string    `json:"message"`
+		DeleteAt time.Time `json:"delete_at"`
+	}
+	json.NewDecoder(resp.Body).Decode(&out)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(out.Message, "Keep my account") {
+		t.Fatalf("got status %d, message %q", resp.StatusCode, out.Message)
+	}
+
+	// Signing in again and keeping the account cancels the deletion
+	b = newTestBrowser("192.0.2.90")
+	b.postJSON(t, "/api/login", map[string]string{"email": "third@delete.example", "password": "a long enough passphrase"})
+	if resp := b.postJSON(t, "/api/account/delete/cancel", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("keeping the account: got status %d", resp.StatusCode)
+	}
+	if u, _ := orm.GetUserByID(ctx, user.ID); !u.DeleteAt.IsZero() {
+		t.Errorf("account still scheduled for deletion on %v", u.DeleteAt)
+	}
+
+	u, err := orm.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	purgeAccount(ctx, u)
+	if _, err := orm.GetUserByID(ctx, user.ID); err == nil {
+		t.Fatal("account was not purged")
+	}
+	for _, email := range []string{"first@delete.example", "third@delete.example"} {
+		if events := auditMentions(t, email); len(events) > 0 {
+			t.Errorf("%s is still in the audit log: %v", email, events)
+		}
+	}
+	if len(auditMentions(t, orm.DeletedUserPseudonym(user.ID))) == 0 {
+		t.Error("no audit event names the pseudonym")
+	}
+	// Addresses that belong to someone else now, or merely contain a former one, are kept
+	if len(auditMentions(t, "second@delete.example")) == 0 {
+		t.Error("events naming an address now used by another account were rewritten")
+	}
+	if len(auditMentions(t, "notfirst@delete.example")) == 0 {
+		t.Error("an address containing a former one was rewritten")
+	}
+}
@@ -0,0 +1,162 @@
+package dev
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/config"
+	"github.com/isymbo/sachi/web/static"
+)
+
+// assetFS holds the frontend: the copy embedded in the binary, or --assets-dir; set up by Run
+var assetFS fs.FS = static.FS
+
+// precomputedAssets maps request paths to embedded files, with what go generate prepared for
+// them, under both their plain (/css/ui.css) and fingerprinted (/css/ui.3f2a9c0d1e4b.css)
+// paths. It is nil with --assets-dir, where files are read on every request so edits show up
+// without a restart.
+var precomputedAssets map[string]*asset
+
+// asset is a static file with its ETag and the compressed variants worth sending
+type asset struct {
+	path        string // plain request path, e.g. /css/ui.css
+	hashedPath  string // path with a content hash before the extension, cached forever
+	contentType string
+	etag        string // strong ETag of the uncompressed content, quoted
+	data        []byte
+	gzip        []byte // nil when compression does not pay off
+	brotli      []byte
+}
+
+// newAssetFS returns the --assets-dir directory, or the embedded files with their
+// precomputed variants
+func newAssetFS(args *config.CmdArgs) (fs.FS, map[string]*asset, error) {
+	if args.AssetsDir != "" {
+		return os.DirFS(args.AssetsDir), nil, nil
+	}
+	assets, err := loadAssets()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load embedded assets: %v", err)
+	}
+	return static.FS, assets, nil
+}
+
+// loadAssets reads the embedded files listed in the manifest along with their compressed
+// variants; nothing is hashed or compressed here
+func loadAssets() (map[string]*asset, error) {
+	manifest, err := static.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	assets := map[string]*asset{}
+	for _, m := range manifest {
+		a := &asset{path: m.Path, hashedPath: m.HashedPath, contentType: m.ContentType, etag: m.ETag}
+		if a.data, err = fs.ReadFile(static.FS, m.Path[1:]); err != nil {
+			return nil, err
+		}
+		if m.Gzip {
+			if a.gzip, err = fs.ReadFile(static.FS, static.PrecomputedDir+m.Path+".gz"); err != nil {
+				return nil, err
+			}
+		}
+		if m.Brotli {
+			if a.brotli, err = fs.ReadFile(static.FS, static.PrecomputedDir+m.Path+".br"); err != nil {
+				return nil, err
+			}
+		}
+		assets[a.path] = a
+		assets[a.hashedPath] = a
+	}
+	return assets, nil
+}
+
+// servePrecomputedAsset answers for embedded files: 304 when the client has the current
+// version, otherwise the best precompressed variant the client accepts. Other paths go on to
+// the filesystem middleware.
+func servePrecomputedAsset(c *fiber.Ctx) error {
+	a, ok := precomputedAssets[c.Path()]
+	if !ok || (c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead) {
+		return c.Next()
+	}
+
+	c.Vary(fiber.HeaderAcceptEncoding)
+	if etagMatches(c.Get(fiber.HeaderIfNoneMatch), a.etag) {
+		c.Set(fiber.HeaderETag, a.etag)
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	// AcceptsEncodings says yes to anything when the header is missing
+	body, encoding := a.data, ""
+	switch {
+	case c.Get(fiber.HeaderAcceptEncoding) == "":
+	case a.brotli != nil && c.AcceptsEncodings("br") == "br":
+		body, encoding = a.brotli, "br"
+	case a.gzip != nil && c.AcceptsEncodings("gzip") == "gzip":
+		body, encoding = a.gzip, "gzip"
+	}
+	c.Set(fiber.HeaderContentType, a.contentType)
+	if encoding != "" {
+		c.Set(fiber.HeaderContentEncoding, encoding)
+		// Each representation needs its own strong ETag
+		c.Set(fiber.HeaderETag, strings.TrimSuffix(a.etag, `"`)+"-"+encoding+`"`)
+	} else {
+		c.Set(fiber.HeaderETag, a.etag)
+	}
+	return c.Send(body)
+}
+
+// etagMatches reports whether an If-None-Match header names any representation of etag
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	base := strings.TrimSuffix(etag, `"`)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag || strings.HasPrefix(tag, base+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// isFingerprinted reports whether a request path names an asset by its content hash, so the
+// response can be cached for good
+func isFingerprinted(p string) bool {
+	a, ok := precomputedAssets[p]
+	return ok && p == a.hashedPath
+}
+
+// assetManifest maps plain asset paths to the URLs pages should use: the fingerprinted ones
+// for embedded assets, or the files themselves with --assets-dir
+func assetManifest() map[string]string {
+	manifest := map[string]string{}
+	if precomputedAssets != nil {
+		for p, a := range precomputedAssets {
+			if p == a.path {
+				manifest[p] = appPath(a.hashedPath)
+			}
+		}
+		return manifest
+	}
+	for _, dir := range static.AssetDirs {
+		fs.WalkDir(assetFS, dir, func(name string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				manifest["/"+name] = appPath("/" + name)
+			}
+			return nil
+		})
+	}
+	return manifest
+}
+
+// pageNames lists the HTML pages of the frontend
+func pageNames() []string {
+	matches, _ := fs.Glob(assetFS, "*.html")
+	sort.Strings(matches)
+	return matches
+}
@@ -0,0 +1,203 @@
+package dev
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/web/static"
+)
+
+// getAsset requests an asset with the given Accept-Encoding and If-None-Match headers
+func getAsset(t *testing.T, path, acceptEncoding, ifNoneMatch string) (*http.Response, []byte) {
+	t.Helper()
+	req := httptest.NewRequest("GET", path, nil)
+	if acceptEncoding != "" {
+		req.Header.Set(fiber.HeaderAcceptEncoding, acceptEncoding)
+	}
+	if ifNoneMatch != "" {
+		req.Header.Set(fiber.HeaderIfNoneMatch, ifNoneMatch)
+	}
+	resp := testRequest(t, req)
+	body, _ := io.ReadAll(resp.Body)
+	return resp, body
+}
+
+func TestPrecomputedAssets(t *testing.T) {
+	manifest, err := static.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m static.Asset
+	for _, a := range manifest {
+		if a.Path == "/css/ui.css" {
+			m = a
+		}
+	}
+	if !m.Gzip || !m.Brotli {
+		t.Fatalf("ui.css has no precomputed variants: %+v", m)
+	}
+	plain, _ := static.FS.ReadFile("css/ui.css")
+	gz, _ := static.FS.ReadFile(static.PrecomputedDir + "/css/ui.css.gz")
+	br, _ := static.FS.ReadFile(static.PrecomputedDir + "/css/ui.css.br")
+	variantETag := func(encoding string) string { return strings.TrimSuffix(m.ETag, `"`) + "-" + encoding + `"` }
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		body           []byte
+		encoding       string
+		etag           string
+	}{
+		{"no Accept-Encoding", m.Path, "", plain, "", m.ETag},
+		{"identity only", m.Path, "identity", plain, "", m.ETag},
+		{"gzip", m.Path, "gzip", gz, "gzip", variantETag("gzip")},
+		{"brotli preferred", m.Path, "gzip, deflate, br", br, "br", variantETag("br")},
+		{"brotli refused", m.Path, "br;q=0, gzip", gz, "gzip", variantETag("gzip")},
+		{"fingerprinted path", m.HashedPath, "br", br, "br", variantETag("br")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := getAsset(t, tt.path, tt.acceptEncoding, "")
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(body, tt.body) {
+				t.Fatalf("got status %d and %d bytes, want the %d precomputed ones", resp.StatusCode, len(body), len(tt.body))
+			}
+			if got := resp.Header.Get(fiber.HeaderContentEncoding); got != tt.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			if got := resp.Header.Get(fiber.HeaderETag); got != tt.etag {
+				t.Errorf("ETag = %s, want %s", got, tt.etag)
+			}
+			if got := resp.Header.Get(fiber.HeaderContentType); got != m.ContentType {
+				t.Errorf("Content-Type = %q", got)
+			}
+			if !strings.Contains(resp.Header.Get(fiber.HeaderVary), fiber.HeaderAcceptEncoding) {
+				t.Error("response does not vary on Accept-Encoding")
+			}
+		})
+	}
+
+	// Any representation the client holds is current
+	for _, etag := range []string{m.ETag, variantETag("gzip"), "W/" + variantETag("br"), `"other", ` + m.ETag, "*"} {
+		if resp, _ := getAsset(t, m.Path, "gzip", etag); resp.StatusCode != http.StatusNotModified {
+			t.Errorf("If-None-Match %s: got status %d, want 304", etag, resp.StatusCode)
+		}
+	}
+	if resp, _ := getAsset(t, m.Path, "gzip", `"stale"`); resp.StatusCode != http.StatusOK {
+		t.Errorf("stale If-None-Match: got status %d, want 200", resp.StatusCode)
+	}
+
+	// Only fingerprinted URLs may be cached without revalidation
+	if resp, _ := getAsset(t, m.HashedPath, "", ""); !strings.Contains(resp.Header.Get(fiber.HeaderCacheControl), "immutable") {
+		t.Errorf("fingerprinted path: Cache-Control = %q", resp.Header.Get(fiber.HeaderCacheControl))
+	}
+	if resp, _ := getAsset(t, m.Path, "", ""); resp.Header.Get(fiber.HeaderCacheControl) != "no-cache" {
+		t.Errorf("plain path: Cache-Control = %q", resp.Header.Get(fiber.HeaderCacheControl))
+	}
+	if got := assetURL("css/ui.css"); got != m.HashedPath[1:] {
+		t.Errorf("assetURL = %s, want %s", got, m.HashedPath[1:])
+	}
+}
+
+// useAssetsDir serves the frontend from a directory until the test ends, as --assets-dir does
+func useAssetsDir(t *testing.T, dir string) {
+	t.Helper()
+	savedFS, savedAssets, savedTemplates := assetFS, precomputedAssets, pageTemplates
+	assetFS, precomputedAssets, pageTemplates = os.DirFS(dir), nil, nil
+	t.Cleanup(func() { assetFS, precomputedAssets, pageTemplates = savedFS, savedAssets, savedTemplates })
+}
+
+// getAssetManifest fetches /api/assets
+func getAssetManifest(t *testing.T) (info struct {
+	CSS      string            `json:"css"`
+	JS       string            `json:"js"`
+	Assets   map[string]string `json:"assets"`
+	Pages    []string          `json:"pages"`
+	Embedded bool              `json:"embedded"`
+}) {
+	t.Helper()
+	resp := testRequest(t, httptest.NewRequest("GET", "/api/assets", nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestAssetFingerprints(t *testing.T) {
+	manifest, err := static.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := map[string]string{}
+	for _, a := range manifest {
+		hashed[a.Path] = a.HashedPath
+		dir, file := path.Split(a.Path)
+		ext := path.Ext(file)
+		if !regexp.MustCompile(`^` + regexp.QuoteMeta(dir+strings.TrimSuffix(file, ext)) + `\.[0-9a-f]{12}` + regexp.QuoteMeta(ext) + `$`).MatchString(a.HashedPath) {
+			t.Errorf("%s is fingerprinted as %s", a.Path, a.HashedPath)
+		}
+	}
+
+	info := getAssetManifest(t)
+	if !info.Embedded || !reflect.DeepEqual(info.Assets, hashed) {
+		t.Errorf("/api/assets lists %v (embedded %v), want %v", info.Assets, info.Embedded, hashed)
+	}
+	if info.CSS != hashed["/css/styles.css"] || info.JS != hashed["/js/main.js"] {
+		t.Errorf("/api/assets names css %s and js %s", info.CSS, info.JS)
+	}
+	if !slices.Contains(info.Pages, "/") || !slices.Contains(info.Pages, "/login.html") || slices.Contains(info.Pages, "/index.html") {
+		t.Errorf("/api/assets lists pages %v", info.Pages)
+	}
+
+	// Pages load the fingerprinted files, and only those
+	resp, body := getAsset(t, "/login.html", "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login page: got status %d", resp.StatusCode)
+	}
+	for _, p := range []string{"/css/ui.css", "/js/main.js", "/js/auth.js"} {
+		if !bytes.Contains(body, []byte(`"`+hashed[p][1:]+`"`)) {
+			t.Errorf("login page does not load %s", hashed[p])
+		}
+		if bytes.Contains(body, []byte(`"`+p[1:]+`"`)) {
+			t.Errorf("login page loads %s by its plain name", p)
+		}
+	}
+	if resp, _ := getAsset(t, "/css/ui.000000000000.css", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown fingerprint: got status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestAssetsDir(t *testing.T) {
+	useAssetsDir(t, "../static")
+
+	info := getAssetManifest(t)
+	if info.Embedded || info.CSS != "/css/styles.css" || info.Assets["/js/auth.js"] != "/js/auth.js" {
+		t.Errorf("/api/assets with --assets-dir: %+v", info)
+	}
+	_, body := getAsset(t, "/login.html", "", "")
+	if !bytes.Contains(body, []byte(`"css/ui.css"`)) || !bytes.Contains(body, []byte(`"js/auth.js"`)) {
+		t.Error("login page does not load the plain files")
+	}
+	plain, _ := os.ReadFile("../static/css/ui.css")
+	resp, data := getAsset(t, "/css/ui.css", "", "")
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(data, plain) {
+		t.Fatalf("got status %d and %d bytes, want the file", resp.StatusCode, len(data))
+	}
+	if got := resp.Header.Get(fiber.HeaderCacheControl); got != "no-cache" {
+		t.Errorf("Cache-Control = %q, want no-cache", got)
+	}
+}
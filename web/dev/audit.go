@@ -0,0 +1,187 @@
+package dev
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/orm"
+)
+
+// Audit actions
+const (
+	auditRegister             = "auth.register"
+	auditRegisterFailed       = "auth.register_failed"
+	auditLogin                = "auth.login"
+	auditLoginFailed          = "auth.login_failed"
+	auditLogout               = "auth.logout"
+	auditProfileUpdate        = "account.profile_update"
+	auditProfileUpdateFailed  = "account.profile_update_failed"
+	auditPasswordChange       = "account.password_change"
+	auditPasswordChangeFailed = "account.password_change_failed"
+	auditAdminAuditQuery      = "admin.audit_query"
+	auditAdminAuditExport     = "admin.audit_export"
+)
+
+const (
+	auditDefaultPageSize = 50
+	auditMaxPageSize     = 500
+)
+
+// recordAudit appends an audit event for the current request.
+// Write failures are logged and never fail the request.
+func recordAudit(c *fiber.Ctx, actor *orm.User, action, target string, meta fiber.Map) {
+	e := &orm.AuditEvent{
+		Action:    action,
+		Target:    target,
+		IP:        clientIP(c),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		Metadata:  meta,
+	}
+	// Actions taken while impersonating name the admin behind them
+	if imp, ok := c.Locals(impersonationKey).(*orm.Impersonation); ok {
+		m := fiber.Map{}
+		for k, v := range meta {
+			m[k] = v
+		}
+		m["impersonated_by"] = imp.AdminEmail
+		e.Metadata = m
+	}
+	if actor != nil {
+		e.ActorID = actor.ID
+		e.ActorEmail = actor.Email
+	}
+	if err := orm.InsertAuditEvent(c.UserContext(), e); err != nil {
+		logf(c, "audit write error (%s): %v", action, err)
+	}
+}
+
+// requireAdmin must run after requireAuth
+func requireAdmin(c *fiber.Ctx) error {
+	user, ok := c.Locals("user").(*orm.User)
+	if _, impersonating := c.Locals(impersonationKey).(*orm.Impersonation); !ok || user.Role != orm.RoleAdmin || impersonating {
+		return newAPIError(403, codeForbidden, "Admin access required")
+	}
+	return c.Next()
+}
+
+// parseAuditFilter reads audit filters from the query string:
+// actor_id, actor, action, target, ip, since, until (RFC3339), page, per_page
+func parseAuditFilter(c *fiber.Ctx) (orm.AuditFilter, error) {
+	f := orm.AuditFilter{
+		ActorEmail: c.Query("actor"),
+		Action:     c.Query("action"),
+		Target:     c.Query("target"),
+		IP:         c.Query("ip"),
+	}
+	if v := c.Query("actor_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return f, newAPIError(400, codeValidationFailed, "Invalid actor_id").
+				withField("actor_id", fieldInvalid, "Must be a user ID")
+		}
+		f.ActorID = id
+	}
+	for key, dst := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := c.Query(key); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, newAPIError(400, codeValidationFailed, "Invalid "+key+", expected RFC3339 timestamp").
+					withField(key, fieldInvalid, "Must be an RFC3339 timestamp")
+			}
+			*dst = t
+		}
+	}
+	return f, nil
+}
+
+// handleAuditList returns a filtered, paginated page of audit events
+func handleAuditList(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+
+	f, err := parseAuditFilter(c)
+	if err != nil {
+		return err
+	}
+	page := c.QueryInt("page", 1)
+	if page < 1 {
+		page = 1
+	}
+	perPage := c.QueryInt("per_page", auditDefaultPageSize)
+	if perPage < 1 || perPage > auditMaxPageSize {
+		perPage = auditDefaultPageSize
+	}
+	f.Limit = perPage
+	f.Offset = (page - 1) * perPage
+
+	events, total, err := orm.ListAuditEvents(c.UserContext(), f)
+	if err != nil {
+		logf(c, "Error listing audit events: %v", err)
+		return newAPIError(500, codeInternal, "Failed to load audit events")
+	}
+
+	recordAudit(c, admin, auditAdminAuditQuery, "", fiber.Map{"query": c.Context().QueryArgs().String()})
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"events":   events,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
+
+// handleAuditExport streams all matching audit events as JSON Lines. The etag and compress
+// middleware skip it (see isStreamed), since both would buffer the whole export.
+func handleAuditExport(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+
+	f, err := parseAuditFilter(c)
+	if err != nil {
+		return err
+	}
+
+	recordAudit(c, admin, auditAdminAuditExport, "", fiber.Map{"query": c.Context().QueryArgs().String()})
+
+	filename := "audit-" + time.Now().UTC().Format("20060102-150405") + ".jsonl"
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+	c.Set("Cache-Control", "no-store")
+	// The writer runs after the handler returns, when c belongs to another request
+	ctx, suffix := c.UserContext(), logSuffix(c)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		enc := json.NewEncoder(w)
+		err := orm.EachAuditEvent(ctx, f, func(e *orm.AuditEvent) error {
+			return enc.Encode(e)
+		})
+		if err != nil {
+			log.Printf("audit export error: %v%s", err, suffix)
+		}
+		w.Flush()
+	})
+	return nil
+}
+
+// isStreamed reports whether the request is for the audit export, which is written as it is
+// read from the database. Routing ignores case and a trailing slash, so this does too.
+func isStreamed(c *fiber.Ctx) bool {
+	return strings.EqualFold(strings.TrimSuffix(c.Path(), "/"), "/api/admin/audit/export")
+}
+
+// purgeAuditEvents deletes audit events older than the retention window
+func purgeAuditEvents(ctx context.Context, retentionDays int) error {
+	cutoff := time.Now().AddDate(0, 0, -retentionDays)
+	n, err := orm.PurgeAuditEvents(ctx, cutoff)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("audit retention: purged %d events older than %s", n, cutoff.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package dev
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/orm"
+)
+
+func TestAuditExport(t *testing.T) {
+	ctx := context.Background()
+	admin := signInAdmin(t, "Ada", "ada@audit.example", "192.0.2.80")
+
+	// More events than fit on one page of the list endpoint
+	n := auditMaxPageSize + 25
+	for i := range n {
+		if err := orm.InsertAuditEvent(ctx, &orm.AuditEvent{Action: "test.export", Target: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/api/admin/audit/export?action=test.export", nil)
+	req.Header.Set(fiber.HeaderAcceptEncoding, "gzip, br")
+	resp := admin.do(t, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get(fiber.HeaderContentType); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	// Both would need the whole export in memory first
+	if h := resp.Header.Get(fiber.HeaderETag); h != "" {
+		t.Errorf("export has an ETag %q", h)
+	}
+	if h := resp.Header.Get(fiber.HeaderContentEncoding); h != "" {
+		t.Errorf("export is compressed with %q", h)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	var count int
+	var lastID int64
+	for scanner.Scan() {
+		var e orm.AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("line %d: %v", count+1, err)
+		}
+		if e.Action != "test.export" || e.Target != fmt.Sprint(count) || e.ID <= lastID {
+			t.Fatalf("line %d is %+v", count+1, e)
+		}
+		lastID = e.ID
+		count++
+	}
+	if count != n {
+		t.Errorf("exported %d events, want %d", count, n)
+	}
+	lastAuditEvent(t, auditAdminAuditExport, "")
+
+	// Other responses still get both
+	req, _ = http.NewRequest("GET", "/api/admin/audit?action=test.export", nil)
+	req.Header.Set(fiber.HeaderAcceptEncoding, "gzip")
+	resp = admin.do(t, req)
+	if resp.Header.Get(fiber.HeaderETag) == "" || resp.Header.Get(fiber.HeaderContentEncoding) != "gzip" {
+		t.Errorf("audit list: ETag %q, Content-Encoding %q", resp.Header.Get(fiber.HeaderETag), resp.Header.Get(fiber.HeaderContentEncoding))
+	}
+}
+
+func TestAuditExportRequiresAdmin(t *testing.T) {
+	createTestUser(t, "Uma", "uma@audit.example", "a long enough passphrase")
+	b := newTestBrowser("192.0.2.81")
+	b.postJSON(t, "/api/login", map[string]string{"email": "uma@audit.example", "password": "a long enough passphrase"})
+	if resp := b.get(t, "/api/admin/audit/export"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d, want 403", resp.StatusCode)
+	}
+}
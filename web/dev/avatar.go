@@ -0,0 +1,223 @@
+package dev
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // decode GIF uploads
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/auth"
+	"github.com/isymbo/sachi/config"
+	"github.com/isymbo/sachi/core"
+	"github.com/isymbo/sachi/orm"
+	"github.com/isymbo/sachi/storage"
+	"github.com/isymbo/sachi/utils"
+)
+
+const (
+	maxAvatarBytes  = 2 << 20     // upload limit
+	maxAvatarPixels = 4096 * 4096 // decoded size limit (64 MB as RGBA), so a small file cannot expand into gigabytes
+	avatarSize      = 256         // stored pictures are avatarSize×avatarSize
+
+	// Signed avatar URLs stay valid 7 to 8 days. The expiry is rounded to whole days so the
+	// URL, and with it the browser cache entry, stays the same for a day.
+	avatarURLTTL = 7 * 24 * time.Hour
+)
+
+// Audit actions
+const (
+	auditAvatarUpdate = "account.avatar_update"
+	auditAvatarRemove = "account.avatar_remove"
+)
+
+var (
+	// blobs keeps uploaded files; set up by Run
+	blobs storage.Store
+	// avatarURLKey signs avatar URLs; generated once and kept in the settings table
+	avatarURLKey []byte
+)
+
+// newBlobStore opens the --storage-url store, or a blobs directory in the data directory
+func newBlobStore(args *config.CmdArgs) (storage.Store, error) {
+	s, err := storage.New(args.StorageURL, filepath.Join(args.DataDir, "blobs"))
+	if err != nil {
+		return nil, err
+	}
+	key, err := orm.InitSetting(core.Ctx, "avatar_url_key", auth.RandomToken(32))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load avatar URL key: %v", err)
+	}
+	avatarURLKey = []byte(key)
+	return s, nil
+}
+
+// avatarURL returns a signed URL for the user's picture, or "" when there is none
+func avatarURL(user *orm.User) string {
+	name, ok := strings.CutPrefix(user.AvatarKey, "avatars/")
+	if !ok {
+		return ""
+	}
+	day := int64(24 * time.Hour / time.Second)
+	exp := (time.Now().Add(avatarURLTTL).Unix()/day + 1) * day
+	return "/api/avatars/" + name + "?exp=" + strconv.FormatInt(exp, 10) + "&sig=" + avatarSignature(name, exp)
+}
+
+func avatarSignature(name string, exp int64) string {
+	mac := hmac.New(sha256.New, avatarURLKey)
+	mac.Write([]byte(name + "\n" + strconv.FormatInt(exp, 10)))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// handleAvatar serves a picture by signed URL. Anyone holding the URL can load it until it
+// expires, so pages can use it in <img> and browsers may cache it.
+func handleAvatar(c *fiber.Ctx) error {
+	name := c.Params("name")
+	exp, err := strconv.ParseInt(c.Query("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > exp ||
+		!hmac.Equal([]byte(c.Query("sig")), []byte(avatarSignature(name, exp))) {
+		return newAPIError(403, codeForbidden, "Invalid or expired link")
+	}
+	obj, err := blobs.Get("avatars/" + name)
+	if errors.Is(err, storage.ErrNotFound) {
+		return fiber.ErrNotFound
+	}
+	if err != nil {
+		logf(c, "Error reading avatar %s: %v", name, err)
+		return newAPIError(500, codeInternal, "Failed to load picture")
+	}
+	// Keys are never reused, so the content behind a URL never changes
+	c.Set(fiber.HeaderContentType, obj.ContentType)
+	c.Set(fiber.HeaderCacheControl, fmt.Sprintf("private, max-age=%d, immutable", exp-time.Now().Unix()))
+	return c.Send(obj.Data)
+}
+
+// makeAvatar validates an uploaded image and returns it cropped and scaled to a square,
+// re-encoded (which also drops any metadata such as GPS coordinates)
+func makeAvatar(data []byte) (out []byte, ext string, err error) {
+	kind := http.DetectContentType(data)
+	if kind != "image/png" && kind != "image/jpeg" && kind != "image/gif" {
+		return nil, "", errors.New("only PNG, JPEG and GIF images are supported")
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width < 1 || cfg.Height < 1 {
+		return nil, "", errors.New("the image could not be read")
+	}
+	if cfg.Width*cfg.Height > maxAvatarPixels {
+		return nil, "", errors.New("the image has too many pixels")
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errors.New("the image could not be read")
+	}
+	thumb := utils.Thumbnail(img, avatarSize)
+
+	// Photos stay JPEG; everything else becomes PNG to keep transparency
+	var buf bytes.Buffer
+	ext = ".png"
+	if kind == "image/jpeg" {
+		ext = ".jpg"
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), ext, nil
+}
+
+// handleAvatarUpload replaces the user's picture with the multipart "avatar" file
+func handleAvatarUpload(c *fiber.Ctx) error {
+	user := c.Locals("user").(*orm.User)
+
+	file, err := c.FormFile("avatar")
+	if err != nil {
+		return newAPIError(400, codeInvalidRequest, "No picture uploaded")
+	}
+	if file.Size > maxAvatarBytes {
+		return newAPIError(413, codePayloadTooLarge, fmt.Sprintf("Pictures can be at most %d MB", maxAvatarBytes>>20))
+	}
+	f, err := file.Open()
+	if err != nil {
+		return newAPIError(400, codeInvalidRequest, "No picture uploaded")
+	}
+	data, err := io.ReadAll(io.LimitReader(f, maxAvatarBytes))
+	f.Close()
+	if err != nil {
+		return newAPIError(400, codeInvalidRequest, "Failed to read picture")
+	}
+
+	avatar, ext, err := makeAvatar(data)
+	if err != nil {
+		return newAPIError(400, codeValidationFailed, "Invalid picture: "+err.Error()).
+			withField("avatar", fieldInvalid, err.Error())
+	}
+	key := fmt.Sprintf("avatars/%d-%s%s", user.ID, auth.RandomToken(12), ext)
+	contentType := "image/png"
+	if ext == ".jpg" {
+		contentType = "image/jpeg"
+	}
+	if err := blobs.Put(key, contentType, avatar); err != nil {
+		logf(c, "Error storing avatar of user %d: %v", user.ID, err)
+		return newAPIError(500, codeInternal, "Failed to save picture")
+	}
+	previous, err := orm.SetUserAvatar(c.UserContext(), user.ID, key)
+	if err != nil {
+		logf(c, "Error updating avatar of user %d: %v", user.ID, err)
+		deleteBlob(key)
+		return newAPIError(500, codeInternal, "Failed to save picture")
+	}
+	deleteBlob(previous)
+	recordAudit(c, user, auditAvatarUpdate, user.Email, nil)
+
+	user.AvatarKey = key
+	return c.JSON(fiber.Map{
+		"success":    true,
+		"message":    "Picture updated",
+		"avatar_url": appPath(avatarURL(user)),
+	})
+}
+
+// handleAvatarDelete removes the user's picture
+func handleAvatarDelete(c *fiber.Ctx) error {
+	user := c.Locals("user").(*orm.User)
+
+	previous, err := orm.SetUserAvatar(c.UserContext(), user.ID, "")
+	if err != nil {
+		logf(c, "Error removing avatar of user %d: %v", user.ID, err)
+		return newAPIError(500, codeInternal, "Failed to remove picture")
+	}
+	deleteBlob(previous)
+	if previous != "" {
+		recordAudit(c, user, auditAvatarRemove, user.Email, nil)
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Picture removed",
+	})
+}
+
+// deleteBlob removes a blob that is no longer referenced. Failures only leave an orphan
+// behind, so they are logged rather than reported.
+func deleteBlob(key string) {
+	if key == "" {
+		return
+	}
+	if err := blobs.Delete(key); err != nil {
+		log.Printf("Error deleting blob %s: %v", key, err)
+	}
+}
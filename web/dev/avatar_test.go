@@ -0,0 +1,269 @@
+package dev
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isymbo/sachi/orm"
+)
+
+// testImage is a w×h gradient
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	return img
+}
+
+func encodeTestImage(t *testing.T, format string, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withEXIF inserts an APP1 Exif segment holding payload after the JPEG start marker, where
+// cameras put it
+func withEXIF(data []byte, payload string) []byte {
+	segment := append([]byte("Exif\x00\x00"), payload...)
+	out := append([]byte{}, data[:2]...)
+	out = append(out, 0xFF, 0xE1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+// pngBomb is a small valid PNG whose header claims w×h pixels
+func pngBomb(t *testing.T, w, h uint32) []byte {
+	t.Helper()
+	data := encodeTestImage(t, "png", testImage(1, 1))
+	// The IHDR chunk follows the 8-byte signature: length, type, width, height, ..., CRC
+	binary.BigEndian.PutUint32(data[16:], w)
+	binary.BigEndian.PutUint32(data[20:], h)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestMakeAvatar(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		ext    string
+		format string
+	}{
+		{"PNG", encodeTestImage(t, "png", testImage(300, 200)), ".png", "png"},
+		{"JPEG", encodeTestImage(t, "jpeg", testImage(640, 480)), ".jpg", "jpeg"},
+		{"GIF becomes PNG", encodeTestImage(t, "gif", testImage(100, 120)), ".png", "png"},
+		{"small image", encodeTestImage(t, "png", testImage(16, 16)), ".png", "png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, ext, err := makeAvatar(tt.data)
+			if err != nil {
+				t.Fatalf("makeAvatar: %v", err)
+			}
+			if ext != tt.ext {
+				t.Errorf("extension %s, want %s", ext, tt.ext)
+			}
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("result does not decode: %v", err)
+			}
+			if format != tt.format || cfg.Width != avatarSize || cfg.Height != avatarSize {
+				t.Errorf("got a %d×%d %s, want a %d×%[4]d %s", cfg.Width, cfg.Height, format, avatarSize, tt.format)
+			}
+		})
+	}
+}
+
+func TestMakeAvatarStripsMetadata(t *testing.T) {
+	photo := withEXIF(encodeTestImage(t, "jpeg", testImage(400, 300)), "GPSLatitude=48.858370")
+	if _, _, err := image.Decode(bytes.NewReader(photo)); err != nil {
+		t.Fatalf("test photo does not decode: %v", err)
+	}
+
+	out, ext, err := makeAvatar(photo)
+	if err != nil {
+		t.Fatalf("makeAvatar: %v", err)
+	}
+	if ext != ".jpg" {
+		t.Errorf("extension %s, want .jpg", ext)
+	}
+	if bytes.Contains(out, []byte("Exif")) || bytes.Contains(out, []byte("GPSLatitude")) {
+		t.Error("EXIF data survived")
+	}
+}
+
+func TestMakeAvatarRejects(t *testing.T) {
+	valid := encodeTestImage(t, "png", testImage(64, 64))
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"text", []byte("hello, this is not a picture"), "only PNG, JPEG and GIF"},
+		{"SVG", []byte(`<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"/>`), "only PNG, JPEG and GIF"},
+		{"WebP", append([]byte("RIFF\x00\x00\x00\x00WEBPVP8 "), make([]byte, 32)...), "only PNG, JPEG and GIF"},
+		{"decompression bomb", pngBomb(t, 10000, 10000), "too many pixels"},
+		{"one pixel over the limit", pngBomb(t, 4097, 4096), "too many pixels"},
+		{"corrupt header", append(append([]byte{}, valid[:20]...), 0xFF, 0xFF), "could not be read"},
+		{"truncated data", valid[:len(valid)-40], "could not be read"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, err := makeAvatar(tt.data)
+			if err == nil {
+				t.Fatalf("accepted, giving %d bytes", len(out))
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %q, want %q", err, tt.err)
+			}
+		})
+	}
+
+	// An image at the limit gets past the pixel check; this one then fails to decode
+	if _, _, err := makeAvatar(pngBomb(t, 4096, 4096)); err != nil && strings.Contains(err.Error(), "too many pixels") {
+		t.Errorf("an image at the limit was rejected: %v", err)
+	}
+}
+
+// uploadAvatar posts data as the "avatar" file from b
+func uploadAvatar(t *testing.T, b *testBrowser, data []byte) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("avatar", "photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	w.Close()
+	req := httptest.NewRequest("POST", "/api/account/avatar", &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.Header.Set(csrfHeaderName, b.csrfToken(t))
+	return b.do(t, req)
+}
+
+func TestAvatarUpload(t *testing.T) {
+	createTestUser(t, "Uma", "uma@avatar.example", "a long enough passphrase")
+	b := newTestBrowser("192.0.2.30")
+	if resp := b.postJSON(t, "/api/login", map[string]string{"email": "uma@avatar.example", "password": "a long enough passphrase"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: got status %d", resp.StatusCode)
+	}
+
+	resp := uploadAvatar(t, b, withEXIF(encodeTestImage(t, "jpeg", testImage(400, 300)), "GPSLatitude=48.858370"))
+	var out struct {
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: got status %d: %v", resp.StatusCode, err)
+	}
+	user, err := orm.GetUserByEmail(context.Background(), "uma@avatar.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The signed URL works for anyone, without a session
+	resp = testRequest(t, httptest.NewRequest("GET", out.AvatarURL, nil))
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("avatar: got status %d as %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if !strings.HasPrefix(resp.Header.Get("Cache-Control"), "private, max-age=") {
+		t.Errorf("Cache-Control %q", resp.Header.Get("Cache-Control"))
+	}
+	if bytes.Contains(data, []byte("GPSLatitude")) {
+		t.Error("the stored picture kept its EXIF data")
+	}
+	stored, err := blobs.Get(user.AvatarKey)
+	if err != nil || !bytes.Equal(stored.Data, data) {
+		t.Errorf("served picture differs from the stored one: %v", err)
+	}
+
+	// Not an image
+	resp = uploadAvatar(t, b, []byte("#!/bin/sh\nrm -rf /\n"))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("non-image upload: got status %d, want 400", resp.StatusCode)
+	}
+
+	// Removing the picture deletes the blob
+	req := httptest.NewRequest("DELETE", "/api/account/avatar", nil)
+	req.Header.Set(csrfHeaderName, b.csrfToken(t))
+	if resp := b.do(t, req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete: got status %d", resp.StatusCode)
+	}
+	if resp := testRequest(t, httptest.NewRequest("GET", out.AvatarURL, nil)); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("removed avatar: got status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestAvatarSignedURL(t *testing.T) {
+	if err := blobs.Put("avatars/99-signed.png", "image/png", encodeTestImage(t, "png", testImage(4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	good := avatarURL(&orm.User{AvatarKey: "avatars/99-signed.png"})
+	u, err := url.Parse(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, sig := u.Query().Get("exp"), u.Query().Get("sig")
+	if resp := testRequest(t, httptest.NewRequest("GET", good, nil)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("signed URL: got status %d", resp.StatusCode)
+	}
+
+	past := time.Now().Add(-time.Minute).Unix()
+	expired := strconv.FormatInt(past, 10)
+	flipped := "0" + sig[1:]
+	if sig[0] == '0' {
+		flipped = "1" + sig[1:]
+	}
+	tests := []struct {
+		name, target string
+	}{
+		{"tampered signature", "/api/avatars/99-signed.png?exp=" + exp + "&sig=" + flipped},
+		{"no signature", "/api/avatars/99-signed.png?exp=" + exp},
+		{"extended expiry", "/api/avatars/99-signed.png?exp=" + exp + "0&sig=" + sig},
+		{"another picture", "/api/avatars/98-signed.png?exp=" + exp + "&sig=" + sig},
+		{"expired", "/api/avatars/99-signed.png?exp=" + expired + "&sig=" + avatarSignature("99-signed.png", past)},
+		{"no expiry", "/api/avatars/99-signed.png?sig=" + sig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := testRequest(t, httptest.NewRequest("GET", tt.target, nil))
+			if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("got status %d, want 403", resp.StatusCode)
+			}
+		})
+	}
+}
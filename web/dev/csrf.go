@@ -0,0 +1,125 @@
+package dev
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/csrf"
+	"github.com/isymbo/sachi/orm"
+)
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfContextKey = "csrf"
+)
+
+const auditCSRFRejected = "security.csrf_rejected"
+
+// newCSRFMiddleware protects state-changing API requests with a double-submit token:
+// the csrf_token cookie must be echoed in the X-CSRF-Token header. Safe methods only
+// issue or refresh the token. See csrfExempt for requests that skip the check. Tokens are
+// kept in memory unless shared is set, for prefork processes that must accept each other's.
+func newCSRFMiddleware(secure, shared bool) fiber.Handler {
+	var storage fiber.Storage
+	if shared {
+		storage = csrfStorage{}
+	}
+	return csrf.New(csrf.Config{
+		Storage:        storage,
+		Next:           csrfExempt,
+		KeyLookup:      "header:" + csrfHeaderName,
+		CookieName:     csrfCookieName,
+		CookiePath:     "/",
+		CookieSameSite: "Lax",
+		CookieSecure:   secure,
+		CookieHTTPOnly: true,
+		Expiration:     2 * time.Hour,
+		ContextKey:     csrfContextKey,
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			recordAudit(c, nil, auditCSRFRejected, c.Path(), fiber.Map{"method": c.Method(), "reason": err.Error()})
+			return newAPIError(403, codeCSRFFailed, "Invalid or missing CSRF token")
+		},
+	})
+}
+
+// handleCSRFToken bootstraps the CSRF token for browser clients. The middleware has
+// already set the cookie; the token is returned so scripts can send it as a header.
+func handleCSRFToken(c *fiber.Ctx) error {
+	token, _ := c.Locals(csrfContextKey).(string)
+	c.Set("Cache-Control", "no-store")
+	return c.JSON(fiber.Map{
+		"success":    true,
+		"csrf_token": token,
+		"header":     csrfHeaderName,
+	})
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header, if any
+func bearerToken(c *fiber.Ctx) string {
+	auth := c.Get(fiber.HeaderAuthorization)
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// csrfExempt skips CSRF checks for API clients that authenticate with a Bearer token and
+// send no session cookie, for endpoints browsers post to on their own (CSP violation
+// reports), and for the SAML assertion consumer, which receives cross-site posts from IdPs
+// and validates signed responses instead. A Bearer header alone exempts nothing: it may be
+// made up, and a browser sending one along with its cookie is still a browser.
+func csrfExempt(c *fiber.Ctx) bool {
+	p := c.Path()
+	if p == cspReportPath || (strings.HasPrefix(p, "/api/sso/saml/") && strings.HasSuffix(p, "/acs")) {
+		return true
+	}
+	return c.Cookies("session_token") == "" && bearerAuthenticates(c)
+}
+
+// bearerAuthenticates reports whether the Bearer token is a session or OAuth access token
+func bearerAuthenticates(c *fiber.Ctx) bool {
+	bearer := bearerToken(c)
+	if bearer == "" {
+		return false
+	}
+	if _, err := orm.ValidateSession(c.UserContext(), bearer); err == nil {
+		return true
+	}
+	_, _, ok := oauthUser(c.UserContext(), bearer)
+	return ok
+}
+
+// sessionTokenFromRequest prefers a Bearer token (API clients) over the session cookie (browsers)
+func sessionTokenFromRequest(c *fiber.Ctx) string {
+	if token := bearerToken(c); token != "" {
+		return token
+	}
+	return c.Cookies("session_token")
+}
+
+// csrfStorage keeps CSRF tokens in the database so every process of a prefork server sees them.
+// fiber.Storage has no context, so these lookups are not part of the request's trace.
+type csrfStorage struct{}
+
+func (csrfStorage) Get(key string) ([]byte, error) {
+	return orm.GetCSRFToken(context.Background(), key)
+}
+
+func (csrfStorage) Set(key string, val []byte, exp time.Duration) error {
+	return orm.SetCSRFToken(context.Background(), key, val, exp)
+}
+
+func (csrfStorage) Delete(key string) error {
+	return orm.DeleteCSRFToken(context.Background(), key)
+}
+
+func (csrfStorage) Reset() error {
+	return orm.DeleteAllCSRFTokens(context.Background())
+}
+
+func (csrfStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,140 @@
+package dev
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/orm"
+)
+
+// csrfBootstrap fetches a CSRF token as the pages do and returns it with its cookie
+func csrfBootstrap(t *testing.T, app *fiber.App) (string, *http.Cookie) {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/csrf", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Token  string `json:"csrf_token"`
+		Header string `json:"header"`
+	}
+	json.NewDecoder(resp.Body).Decode(&out)
+	if out.Token == "" || out.Header != csrfHeaderName {
+		t.Fatalf("GET /api/csrf returned %+v", out)
+	}
+	for _, c := range resp.Cookies() {
+		if c.Name == csrfCookieName {
+			return out.Token, c
+		}
+	}
+	t.Fatal("no CSRF cookie")
+	return "", nil
+}
+
+func TestCSRFToken(t *testing.T) {
+	token, cookie := csrfBootstrap(t, testApp)
+	if cookie.Value != token || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/" {
+		t.Errorf("cookie %+v does not carry the token %q as an HttpOnly, SameSite=Lax, site-wide cookie", cookie, token)
+	}
+}
+
+func TestCSRFProtection(t *testing.T) {
+	ctx := context.Background()
+	user, b := signInForOAuth(t, "Cyd", "cyd@csrf.example", "192.0.2.100")
+	session, err := orm.CreateSession(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID, secret := testOAuthClient(t)
+	_, tokens := exchangeCode(t, clientID, secret, authorizeOAuth(t, b, clientID, scopeProfile+" "+scopeProfileWrite, testVerifier), testVerifier)
+	access := tokens["access_token"].(string)
+	token := b.csrfToken(t)
+
+	tests := []struct {
+		name    string
+		cookie  bool              // send the browser's cookies
+		headers map[string]string // sent as they are
+		ok      bool
+	}{
+		{"token in the header", true, map[string]string{csrfHeaderName: token}, true},
+		{"no token", true, nil, false},
+		{"wrong token", true, map[string]string{csrfHeaderName: "x" + token}, false},
+		{"token in another header", true, map[string]string{"X-XSRF-Token": token}, false},
+		{"token without its cookie", false, map[string]string{csrfHeaderName: token}, false},
+
+		// Bearer clients, which send no cookies
+		{"session token as Bearer", false, map[string]string{"Authorization": "Bearer " + session}, true},
+		{"access token as Bearer", false, map[string]string{"Authorization": "bearer " + access}, true},
+		{"made-up Bearer token", false, map[string]string{"Authorization": "Bearer made-up"}, false},
+		{"made-up Bearer token with the session cookie", true, map[string]string{"Authorization": "Bearer made-up"}, false},
+		{"valid Bearer token with the session cookie", true, map[string]string{"Authorization": "Bearer " + session}, false},
+		{"Basic credentials", false, map[string]string{"Authorization": "Basic " + session}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "/api/profile", strings.NewReader(`{"name": "Cyd", "email": "cyd@csrf.example"}`))
+			req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			var resp *http.Response
+			if tt.cookie {
+				resp = b.do(t, req)
+			} else {
+				resp = testRequest(t, req)
+			}
+			var out struct {
+				Code string `json:"code"`
+			}
+			json.NewDecoder(resp.Body).Decode(&out)
+			if rejected := out.Code == codeCSRFFailed; rejected == tt.ok || (tt.ok && resp.StatusCode != http.StatusOK) {
+				t.Errorf("got %d %q", resp.StatusCode, out.Code)
+			}
+		})
+	}
+	lastAuditEvent(t, auditCSRFRejected, "/api/profile")
+}
+
+func TestCSRFExemptPaths(t *testing.T) {
+	for _, path := range []string{cspReportPath, "/api/sso/saml/acme/acs"} {
+		resp := testRequest(t, httptest.NewRequest("POST", path, strings.NewReader("{}")))
+		var out struct {
+			Code string `json:"code"`
+		}
+		json.NewDecoder(resp.Body).Decode(&out)
+		if out.Code == codeCSRFFailed {
+			t.Errorf("POST %s was refused for its CSRF token", path)
+		}
+	}
+}
+
+// TestCSRFSharedStorage stands in for two prefork processes: a token one of them issued must
+// work on the other only when tokens are kept in the database
+func TestCSRFSharedStorage(t *testing.T) {
+	newProcess := func(shared bool) *fiber.App {
+		app := fiber.New(fiber.Config{ErrorHandler: errorHandler})
+		app.Use(newCSRFMiddleware(false, shared))
+		app.Get("/api/csrf", handleCSRFToken)
+		app.Post("/api/echo", func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusNoContent) })
+		return app
+	}
+	for _, shared := range []bool{true, false} {
+		first, second := newProcess(shared), newProcess(shared)
+		token, cookie := csrfBootstrap(t, first)
+		req := httptest.NewRequest("POST", "/api/echo", nil)
+		req.AddCookie(cookie)
+		req.Header.Set(csrfHeaderName, token)
+		resp, err := second.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[bool]int{true: fiber.StatusNoContent, false: fiber.StatusForbidden}[shared]; resp.StatusCode != want {
+			t.Errorf("shared=%v: got status %d, want %d", shared, resp.StatusCode, want)
+		}
+	}
+}
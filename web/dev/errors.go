@@ -0,0 +1,162 @@
+package dev
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Error codes of the API error envelope. Clients branch on them, so they are stable: a code
+// is never renamed or reused, and new ones are only added for situations a client can act on.
+const (
+	codeInvalidRequest         = "invalid_request"          // malformed body or parameters
+	codeValidationFailed       = "validation_failed"        // well-formed but invalid; fields says which
+	codeUnauthenticated        = "unauthenticated"          // no valid session or token
+	codeInvalidCredentials     = "invalid_credentials"      // wrong email or password
+	codeForbidden              = "forbidden"                // signed in, but not allowed
+	codeAccountDisabled        = "account_disabled"         // the account was disabled by an administrator
+	codePasswordChangeRequired = "password_change_required" // a new password must be chosen first
+	codeCSRFFailed             = "csrf_failed"              // missing or wrong X-CSRF-Token
+	codeNotFound               = "not_found"
+	codeMethodNotAllowed       = "method_not_allowed"
+	codeConflict               = "conflict"    // the change clashes with the current state
+	codeEmailTaken             = "email_taken" // another account has the email address
+	codePayloadTooLarge        = "payload_too_large"
+	codeRateLimited            = "rate_limited"
+	codeInternal               = "internal_error"
+	codeUnavailable            = "service_unavailable" // a dependency such as an identity provider failed
+)
+
+// Field error codes in APIError.Fields; password fields use the rule names of the policy
+const (
+	fieldRequired = "required"
+	fieldInvalid  = "invalid"
+)
+
+// APIError is an error a handler returns to answer with the API error envelope:
+//
+//	{"error": true, "code": "validation_failed", "message": "...",
+//	 "fields": [{"field": "email", "code": "required", "message": "..."}],
+//	 "request_id": "...", "trace_id": "..."}
+//
+// errorHandler renders it; handlers never write error bodies themselves. OAuth2 protocol
+// endpoints and SCIM keep the error formats of their specifications.
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+	Fields  []FieldError
+}
+
+// FieldError says what is wrong with one request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// newAPIError returns an error answered with status, a code from the list above and a
+// message for people
+func newAPIError(status int, code, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+// withField adds a field-level detail
+func (e *APIError) withField(field, code, message string) *APIError {
+	e.Fields = append(e.Fields, FieldError{Field: field, Code: code, Message: message})
+	return e
+}
+
+// errInvalidBody rejects a body that cannot be parsed
+func errInvalidBody() *APIError {
+	return newAPIError(fiber.StatusBadRequest, codeInvalidRequest, "Invalid request body")
+}
+
+// requireFields returns a validation error naming every empty field, or nil. Pairs are
+// the JSON names of fields and their values, in the order the form shows them.
+func requireFields(message string, pairs ...string) error {
+	e := newAPIError(fiber.StatusBadRequest, codeValidationFailed, message)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if strings.TrimSpace(pairs[i+1]) == "" {
+			e.withField(pairs[i], fieldRequired, "This field is required")
+		}
+	}
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// statusCodes gives errors raised without a code, such as fiber.ErrNotFound from the router,
+// the code of their status
+var statusCodes = map[int]string{
+	fiber.StatusBadRequest:            codeInvalidRequest,
+	fiber.StatusUnauthorized:          codeUnauthenticated,
+	fiber.StatusForbidden:             codeForbidden,
+	fiber.StatusNotFound:              codeNotFound,
+	fiber.StatusMethodNotAllowed:      codeMethodNotAllowed,
+	fiber.StatusConflict:              codeConflict,
+	fiber.StatusRequestEntityTooLarge: codePayloadTooLarge,
+	fiber.StatusTooManyRequests:       codeRateLimited,
+	fiber.StatusServiceUnavailable:    codeUnavailable,
+}
+
+// errorStatus is the status errorHandler answers err with
+func errorStatus(err error) int {
+	var e *APIError
+	var fe *fiber.Error
+	switch {
+	case errors.As(err, &e):
+		return e.Status
+	case errors.As(err, &fe):
+		return fe.Code
+	}
+	return fiber.StatusInternalServerError
+}
+
+func codeForStatus(status int) string {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status < 500 {
+		return codeInvalidRequest
+	}
+	return codeInternal
+}
+
+// errorBody is the JSON of the envelope. "error": true stays for clients written before codes.
+type errorBody struct {
+	Error     bool         `json:"error"`
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	Fields    []FieldError `json:"fields,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+	TraceID   string       `json:"trace_id,omitempty"`
+}
+
+// errorHandler renders every error returned by a handler or middleware. An *APIError is sent
+// as it is and a *fiber.Error gets the code of its status. Any other error is internal
+// (database, I/O, panics): it is logged, and the client only learns the request ID to quote.
+func errorHandler(c *fiber.Ctx, err error) error {
+	var e *APIError
+	var fe *fiber.Error
+	switch {
+	case errors.As(err, &e):
+	case errors.As(err, &fe):
+		e = newAPIError(fe.Code, codeForStatus(fe.Code), fe.Message)
+	default:
+		logf(c, "%s %s: %v", c.Method(), c.Path(), err)
+		e = newAPIError(fiber.StatusInternalServerError, codeInternal, "Internal server error")
+	}
+
+	body := errorBody{Error: true, Code: e.Code, Message: e.Message, Fields: e.Fields}
+	body.RequestID = requestID(c)
+	// Quoting the trace ID in a bug report leads straight to the logs and spans of the request
+	body.TraceID, _ = c.Locals(traceIDKey).(string)
+	return c.Status(e.Status).JSON(body)
+}
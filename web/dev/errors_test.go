@@ -0,0 +1,154 @@
+package dev
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+)
+
+// decodeErrorBody decodes an error envelope, failing unless the response is one
+func decodeErrorBody(t *testing.T, resp *http.Response) errorBody {
+	t.Helper()
+	if ct := resp.Header.Get(fiber.HeaderContentType); !strings.HasPrefix(ct, fiber.MIMEApplicationJSON) {
+		t.Fatalf("error response has Content-Type %q", ct)
+	}
+	var body errorBody
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestErrorHandler(t *testing.T) {
+	fields := []FieldError{{Field: "email", Code: fieldRequired, Message: "This field is required"}}
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		want   errorBody
+	}{
+		{"API error", newAPIError(fiber.StatusConflict, codeEmailTaken, "Email already exists"),
+			409, errorBody{Code: codeEmailTaken, Message: "Email already exists"}},
+		{"field errors", newAPIError(fiber.StatusBadRequest, codeValidationFailed, "Check the form").withField("email", fieldRequired, "This field is required"),
+			400, errorBody{Code: codeValidationFailed, Message: "Check the form", Fields: fields}},
+		{"wrapped API error", errors.Join(errors.New("context"), errInvalidBody()),
+			400, errorBody{Code: codeInvalidRequest, Message: "Invalid request body"}},
+		{"router error", fiber.ErrNotFound,
+			404, errorBody{Code: codeNotFound, Message: "Cannot GET /fail"}},
+		{"Fiber error with a code", fiber.NewError(fiber.StatusTooManyRequests, "Slow down"),
+			429, errorBody{Code: codeRateLimited, Message: "Slow down"}},
+		{"Fiber client error without a code", fiber.NewError(fiber.StatusTeapot, "Short and stout"),
+			418, errorBody{Code: codeInvalidRequest, Message: "Short and stout"}},
+		{"Fiber server error without a code", fiber.NewError(fiber.StatusBadGateway, "Upstream down"),
+			502, errorBody{Code: codeInternal, Message: "Upstream down"}},
+		{"internal error", errors.New("database is locked at /var/lib/sachi/sachi.db"),
+			500, errorBody{Code: codeInternal, Message: "Internal server error"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New(fiber.Config{ErrorHandler: errorHandler})
+			app.Use(newRequestIDMiddleware())
+			app.Get("/fail", func(c *fiber.Ctx) error {
+				if tt.err == fiber.ErrNotFound {
+					return c.Next()
+				}
+				return tt.err
+			})
+			resp, err := app.Test(httptest.NewRequest("GET", "/fail", nil), -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status || errorStatus(tt.err) != tt.status {
+				t.Errorf("got status %d, errorStatus %d, want %d", resp.StatusCode, errorStatus(tt.err), tt.status)
+			}
+			got := decodeErrorBody(t, resp)
+			tt.want.Error = true
+			tt.want.RequestID = resp.Header.Get(requestIDHeader)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorHandlerPanic(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: errorHandler})
+	app.Use(newRequestIDMiddleware())
+	app.Use(recover.New())
+	app.Get("/panic", func(c *fiber.Ctx) error {
+		c.Locals(traceIDKey, "4bf92f3577b34da6a3ce929d0e0e4736")
+		panic("secret internal state")
+	})
+	resp, err := app.Test(httptest.NewRequest("GET", "/panic", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := errorBody{Error: true, Code: codeInternal, Message: "Internal server error",
+		RequestID: resp.Header.Get(requestIDHeader), TraceID: "4bf92f3577b34da6a3ce929d0e0e4736"}
+	if got := decodeErrorBody(t, resp); resp.StatusCode != 500 || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d %+v", resp.StatusCode, got)
+	}
+}
+
+func TestRequireFields(t *testing.T) {
+	if err := requireFields("Missing", "name", "Ada", "email", "ada@example.com"); err != nil {
+		t.Errorf("all fields set: got %v", err)
+	}
+	err := requireFields("Missing", "name", " ", "email", "ada@example.com", "password", "")
+	var e *APIError
+	if !errors.As(err, &e) {
+		t.Fatalf("got %v, want an API error", err)
+	}
+	var names []string
+	for _, f := range e.Fields {
+		names = append(names, f.Field+":"+f.Code)
+	}
+	if e.Status != 400 || e.Code != codeValidationFailed || strings.Join(names, ",") != "name:required,password:required" {
+		t.Errorf("got %d %s %v", e.Status, e.Code, names)
+	}
+}
+
+// TestAPIErrors checks the envelope as clients see it through the whole middleware chain
+func TestAPIErrors(t *testing.T) {
+	b := newTestBrowser("192.0.2.95")
+
+	resp := b.postJSON(t, "/api/register", map[string]string{"email": "x@errors.example"})
+	body := decodeErrorBody(t, resp)
+	if resp.StatusCode != 400 || body.Code != codeValidationFailed || len(body.Fields) != 2 ||
+		body.Fields[0].Field != "name" || body.Fields[1].Field != "password" {
+		t.Errorf("register with missing fields: got %d %+v", resp.StatusCode, body)
+	}
+	if body.RequestID == "" || body.RequestID != resp.Header.Get(requestIDHeader) {
+		t.Errorf("request_id %q, X-Request-ID %q", body.RequestID, resp.Header.Get(requestIDHeader))
+	}
+
+	req := httptest.NewRequest("POST", "/api/register", strings.NewReader("{"))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(csrfHeaderName, b.csrfToken(t))
+	req.Header.Set(requestIDHeader, "client-chosen-id")
+	resp = b.do(t, req)
+	if body = decodeErrorBody(t, resp); resp.StatusCode != 400 || body.Code != codeInvalidRequest || body.RequestID != "client-chosen-id" {
+		t.Errorf("malformed body: got %d %+v", resp.StatusCode, body)
+	}
+
+	for target, want := range map[string]struct {
+		status int
+		code   string
+	}{
+		"/api/me":         {401, codeUnauthenticated},
+		"/api/no-such":    {404, codeNotFound},
+		"/api/admin/orgs": {401, codeUnauthenticated},
+	} {
+		resp := testRequest(t, httptest.NewRequest("GET", target, nil))
+		if body := decodeErrorBody(t, resp); resp.StatusCode != want.status || body.Code != want.code || !body.Error || body.Message == "" {
+			t.Errorf("GET %s: got %d %+v, want %d %s", target, resp.StatusCode, body, want.status, want.code)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package dev
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/config"
+	"github.com/isymbo/sachi/core"
+	"github.com/isymbo/sachi/health"
+	"github.com/isymbo/sachi/jobs"
+	"github.com/isymbo/sachi/orm"
+	"github.com/isymbo/sachi/tracing"
+)
+
+const (
+	// readyTimeout bounds each readiness check, well inside the usual probe timeouts
+	readyTimeout = 2 * time.Second
+
+	// Below diskDownBytes SQLite writes start failing; below diskDegradedBytes it is time to act
+	diskDownBytes     = 64 << 20
+	diskDegradedBytes = 1 << 30
+)
+
+// jobScheduler runs the background jobs; nil in prefork children, which leave them to the parent
+var jobScheduler *jobs.Scheduler
+
+// handleHealthz is the liveness probe: the process is up and serving requests. It checks
+// nothing else, so an outage of a dependency does not get the instance restarted.
+func handleHealthz(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(fiber.Map{"status": health.StatusOK})
+}
+
+// handleReadyz is the readiness probe. Every check is reported with its status and latency;
+// the instance is ready (200) when none is down, even if some are degraded.
+func handleReadyz(c *fiber.Ctx) error {
+	report := health.Run(c.UserContext(), readyTimeout, readinessChecks())
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	code := fiber.StatusOK
+	if report.Status == health.StatusDown {
+		code = fiber.StatusServiceUnavailable
+	}
+	return c.Status(code).JSON(fiber.Map{
+		"status":  report.Status,
+		"version": core.Version,
+		"checks":  report.Checks,
+	})
+}
+
+func readinessChecks() []health.Check {
+	return []health.Check{
+		{Name: "database", Run: checkDatabase},
+		{Name: "migrations", Run: checkMigrations},
+		{Name: "disk", Run: checkDisk},
+		{Name: "jobs", Run: checkJobs},
+	}
+}
+
+func checkDatabase(ctx context.Context) health.Result {
+	if err := orm.Ping(ctx); err != nil {
+		log.Printf("readiness: database: %v%s", err, tracing.LogSuffix(ctx))
+		return health.Down("database unavailable")
+	}
+	s := orm.DB.Stats()
+	return health.OK().With("open_connections", s.OpenConnections).With("in_use", s.InUse)
+}
+
+func checkMigrations(ctx context.Context) health.Result {
+	s, err := orm.CheckSchema(ctx)
+	if err != nil {
+		log.Printf("readiness: schema: %v%s", err, tracing.LogSuffix(ctx))
+		return health.Down("cannot read schema")
+	}
+	var r health.Result
+	switch {
+	case len(s.MissingTables) > 0:
+		r = health.Down("missing tables: %s", strings.Join(s.MissingTables, ", "))
+	case s.Version < orm.SchemaVersion:
+		r = health.Down("schema version %d is behind %d; restart to migrate", s.Version, orm.SchemaVersion)
+	case s.Version > orm.SchemaVersion:
+		// A newer build migrated the database, as during a rolling upgrade
+		r = health.Degraded("schema version %d is newer than this build's %d", s.Version, orm.SchemaVersion)
+	default:
+		r = health.OK()
+	}
+	return r.With("version", s.Version).With("expected", orm.SchemaVersion)
+}
+
+// checkDisk looks at the file system of the data directory, which holds the database,
+// uploads and the outbox
+func checkDisk(ctx context.Context) health.Result {
+	free, total, err := health.DiskSpace(config.Args.DataDir)
+	if err == health.ErrDiskSpaceUnsupported {
+		return health.OK().With("supported", false)
+	}
+	if err != nil {
+		log.Printf("readiness: disk: %v%s", err, tracing.LogSuffix(ctx))
+		return health.Down("cannot read free space")
+	}
+	var r health.Result
+	switch {
+	case free < diskDownBytes:
+		r = health.Down("only %d MiB free in the data directory", free>>20)
+	case free < diskDegradedBytes:
+		r = health.Degraded("only %d MiB free in the data directory", free>>20)
+	default:
+		r = health.OK()
+	}
+	return r.With("free_bytes", free).With("total_bytes", total)
+}
+
+// checkJobs makes sure the scheduler still wakes up and names jobs whose last run failed; the
+// errors themselves are in the log. Neither stops requests from being served, so the worst
+// result is degraded.
+func checkJobs(ctx context.Context) health.Result {
+	if jobScheduler == nil {
+		if fiber.IsChild() {
+			return health.OK().With("note", "background jobs run in the prefork parent")
+		}
+		return health.Degraded("job scheduler not started")
+	}
+	st := jobScheduler.Status()
+	if st.Heartbeat.IsZero() {
+		return health.Degraded("job scheduler not started")
+	}
+
+	age := time.Since(st.Heartbeat)
+	var failed []string
+	for _, j := range st.Jobs {
+		if j.LastError != "" {
+			failed = append(failed, j.Name)
+		}
+	}
+	var r health.Result
+	switch {
+	case st.Running == "" && age > jobs.StaleAfter:
+		r = health.Degraded("job scheduler last ran %s ago", age.Round(time.Second))
+	case len(failed) > 0:
+		r = health.Degraded("last run failed: %s", strings.Join(failed, ", "))
+	default:
+		r = health.OK()
+	}
+	r = r.With("heartbeat_age_seconds", int(age.Seconds()))
+	if st.Running != "" {
+		r = r.With("running", st.Running).With("running_seconds", int(time.Since(st.RunningSince).Seconds()))
+	}
+	return r
+}
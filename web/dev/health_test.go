@@ -0,0 +1,25 @@
+package dev
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// /api/health is the liveness check, like /healthz: it must not fail when a dependency does
+func TestHealthAlias(t *testing.T) {
+	for _, path := range []string{"/healthz", "/api/health"} {
+		resp := testRequest(t, httptest.NewRequest("GET", path, nil))
+		var body map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if resp.StatusCode != http.StatusOK || len(body) != 1 || body["status"] != "ok" {
+			t.Errorf("%s: got %d %v, want 200 {\"status\":\"ok\"}", path, resp.StatusCode, body)
+		}
+		if resp.Header.Get("Cache-Control") != "no-store" {
+			t.Errorf("%s: Cache-Control %q", path, resp.Header.Get("Cache-Control"))
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package dev
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/orm"
+)
+
+const (
+	// impersonationKey holds the *orm.Impersonation when an admin acts as another user
+	impersonationKey = "impersonation"
+	// impersonatorCookie keeps the admin's own session while they act as someone else
+	impersonatorCookie = "impersonator_session"
+	impersonationTTL   = time.Hour
+)
+
+// Audit actions
+const (
+	auditImpersonateStart = "admin.impersonate_start"
+	auditImpersonateStop  = "admin.impersonate_stop"
+)
+
+// passwordChangePaths stay reachable while a user has to replace an admin-issued password
+var passwordChangePaths = map[string]bool{
+	"/api/me":                 true,
+	"/api/change-password":    true,
+	"/api/password-policy":    true,
+	"/api/impersonation/stop": true,
+	"/profile":                true,
+	"/profile.html":           true,
+}
+
+// checkSessionRestrictions runs after a session has been resolved to its user. Impersonation
+// sessions end as soon as their admin loses the role; users with a temporary password can
+// only change it. A returned error ends the request.
+func checkSessionRestrictions(c *fiber.Ctx, sessionToken string, user *orm.User) error {
+	imp, err := orm.GetImpersonation(c.UserContext(), sessionToken)
+	if err == nil {
+		if !imp.AdminOK {
+			if err := orm.EndImpersonation(c.UserContext(), sessionToken); err != nil {
+				logf(c, "Error ending impersonation: %v", err)
+			}
+			return newAPIError(401, codeUnauthenticated, "Invalid session")
+		}
+		c.Locals(impersonationKey, imp)
+		// The admin is not the user and cannot know their new password
+		return nil
+	}
+	if user.MustChangePassword && !passwordChangePaths[c.Path()] {
+		return newAPIError(403, codePasswordChangeRequired, "You must choose a new password before continuing")
+	}
+	return nil
+}
+
+// denyImpersonation keeps admins acting as a user away from the user's credentials and
+// from anything that needs the real user's consent
+func denyImpersonation(c *fiber.Ctx) error {
+	if _, ok := c.Locals(impersonationKey).(*orm.Impersonation); ok {
+		return newAPIError(403, codeForbidden, "Not available while impersonating a user")
+	}
+	return c.Next()
+}
+
+// handleAdminImpersonate signs the admin in as another user for an hour. The admin's own
+// session is kept aside and restored by handleImpersonationStop.
+func handleAdminImpersonate(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+	target, err := adminTargetUser(c)
+	if err != nil {
+		return err
+	}
+
+	type ImpersonateRequest struct {
+		Reason string `json:"reason"`
+	}
+	req := new(ImpersonateRequest)
+	if err := c.BodyParser(req); err != nil || req.Reason == "" {
+		return newAPIError(400, codeValidationFailed, "A reason is required").
+			withField("reason", fieldRequired, "This field is required")
+	}
+	switch {
+	case target.ID == admin.ID:
+		return newAPIError(400, codeInvalidRequest, "You cannot impersonate yourself")
+	case target.Role == orm.RoleAdmin:
+		return newAPIError(403, codeForbidden, "Administrators cannot be impersonated")
+	case target.Disabled:
+		return newAPIError(409, codeConflict, "The account is disabled")
+	}
+
+	token, err := orm.CreateImpersonation(c.UserContext(), admin.ID, target.ID, req.Reason, impersonationTTL)
+	if err != nil {
+		logf(c, "Error creating impersonation session: %v", err)
+		return newAPIError(500, codeInternal, "Failed to impersonate user")
+	}
+	recordAudit(c, admin, auditImpersonateStart, target.Email, fiber.Map{"user_id": target.ID, "reason": req.Reason})
+
+	expires := time.Now().Add(impersonationTTL)
+	if own := c.Cookies("session_token"); own != "" {
+		c.Cookie(&fiber.Cookie{
+			Name:     impersonatorCookie,
+			Value:    own,
+			Path:     appPath("/api/impersonation"),
+			Expires:  expires,
+			Secure:   secureCookies(c),
+			HTTPOnly: true,
+			SameSite: "Strict",
+		})
+	}
+	setSessionCookie(c, token, expires)
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"message":  "You are now signed in as " + target.Email,
+		"redirect": appPath("/profile"),
+	})
+}
+
+// handleImpersonationStop ends an impersonation and returns the admin to their own session
+func handleImpersonationStop(c *fiber.Ctx) error {
+	user := c.Locals("user").(*orm.User)
+	imp, ok := c.Locals(impersonationKey).(*orm.Impersonation)
+	if !ok {
+		return newAPIError(400, codeInvalidRequest, "You are not impersonating anyone")
+	}
+	if err := orm.EndImpersonation(c.UserContext(), sessionTokenFromRequest(c)); err != nil {
+		logf(c, "Error ending impersonation: %v", err)
+		return newAPIError(500, codeInternal, "Failed to end impersonation")
+	}
+	c.Locals(impersonationKey, nil)
+	recordAudit(c, &orm.User{ID: imp.AdminID, Email: imp.AdminEmail}, auditImpersonateStop, user.Email, fiber.Map{"user_id": user.ID})
+
+	// Put the admin's session back if it is still theirs and valid
+	redirect := "/login.html"
+	own := c.Cookies(impersonatorCookie)
+	if admin, err := orm.ValidateSession(c.UserContext(), own); err == nil && admin.ID == imp.AdminID {
+		setSessionCookie(c, own, time.Now().Add(24*time.Hour))
+		redirect = "/admin.html"
+	} else {
+		setSessionCookie(c, "", time.Now().Add(-time.Hour))
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     impersonatorCookie,
+		Value:    "",
+		Path:     appPath("/api/impersonation"),
+		Expires:  time.Now().Add(-time.Hour),
+		Secure:   secureCookies(c),
+		HTTPOnly: true,
+		SameSite: "Strict",
+	})
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"message":  "Impersonation ended",
+		"redirect": appPath(redirect),
+	})
+}
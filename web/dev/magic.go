@@ -0,0 +1,174 @@
+package dev
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/auth"
+	"github.com/isymbo/sachi/mail"
+	"github.com/isymbo/sachi/orm"
+)
+
+const (
+	magicLinkCookie = "magic_link"
+	magicLinkTTL    = 15 * time.Minute
+
+	// Abuse limits over a sliding window. Requests count whether or not the email has an
+	// account, so hitting a limit reveals nothing about which emails are registered.
+	magicLinkWindow   = time.Hour
+	magicLinkPerEmail = 5
+	magicLinkPerIP    = 20
+)
+
+// Audit actions
+const (
+	auditMagicLinkRequest = "auth.magic_link_request"
+	auditMagicLinkLimited = "auth.magic_link_limited"
+)
+
+// magicLinksEnabled is set by Run from --magic-links
+var magicLinksEnabled = true
+
+// handleMagicLinkRequest emails a single-use sign-in link. The response is the same whether
+// or not the email belongs to an account.
+func handleMagicLinkRequest(c *fiber.Ctx) error {
+	if !magicLinksEnabled {
+		return newAPIError(404, codeNotFound, "Sign-in links are not enabled")
+	}
+
+	type MagicLinkRequest struct {
+		Email string `json:"email"`
+		Next  string `json:"next"`
+	}
+	req := new(MagicLinkRequest)
+	if err := c.BodyParser(req); err != nil {
+		return errInvalidBody()
+	}
+	email := strings.TrimSpace(req.Email)
+	if !strings.Contains(email, "@") {
+		return newAPIError(400, codeValidationFailed, "A valid email is required").
+			withField("email", fieldInvalid, "Not an email address")
+	}
+
+	now := time.Now()
+	ip := clientIP(c)
+	byEmail, byIP, err := orm.CountMagicLinks(c.UserContext(), strings.ToLower(email), ip, now.Add(-magicLinkWindow))
+	if err != nil {
+		logf(c, "Error counting sign-in links: %v", err)
+		return newAPIError(500, codeInternal, "Failed to send sign-in link")
+	}
+	if byEmail >= magicLinkPerEmail || byIP >= magicLinkPerIP {
+		recordAudit(c, nil, auditMagicLinkLimited, email, fiber.Map{"by_email": byEmail, "by_ip": byIP})
+		c.Set(fiber.HeaderRetryAfter, "900")
+		return newAPIError(429, codeRateLimited, "Too many sign-in link requests. Please try again later.")
+	}
+
+	// Reuse this browser's binding so an earlier link still works after "send again"
+	browser := c.Cookies(magicLinkCookie)
+	if len(browser) < 32 {
+		browser = auth.RandomToken(32)
+	}
+	token := auth.RandomToken(32)
+	link := &orm.MagicLink{
+		TokenHash:   auth.HashToken(token),
+		BrowserHash: auth.HashToken(browser),
+		Email:       strings.ToLower(email),
+		IP:          ip,
+		NextPath:    safeNextPath(req.Next),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(magicLinkTTL),
+	}
+	user, err := orm.GetUserByEmail(c.UserContext(), email)
+	if err == nil && !user.Disabled {
+		link.UserID = user.ID
+	} else {
+		user = nil
+	}
+	if err := orm.CreateMagicLink(c.UserContext(), link); err != nil {
+		logf(c, "Error storing sign-in link: %v", err)
+		return newAPIError(500, codeInternal, "Failed to send sign-in link")
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     magicLinkCookie,
+		Value:    browser,
+		Path:     appPath("/api/login/magic"),
+		Expires:  link.ExpiresAt,
+		Secure:   secureCookies(c),
+		HTTPOnly: true,
+		SameSite: "Lax",
+	})
+
+	if user != nil {
+		msg := &mail.Message{
+			To:      user.Email,
+			Subject: "Your Sachi sign-in link",
+			Text: "Hi " + user.Name + ",\n\n" +
+				"Use the link below to sign in to Sachi. It works once, for the next " +
+				"15 minutes, and only in the browser you requested it from.\n\n" +
+				externalURL(c, "/api/login/magic/verify?token="+token) + "\n\n" +
+				"If you did not ask to sign in, you can ignore this email.\n",
+		}
+		// Send in the background so response time does not reveal whether the account exists
+		suffix := logSuffix(c)
+		go func() {
+			if err := mailer.Send(msg); err != nil {
+				log.Printf("Error sending sign-in link: %v%s", err, suffix)
+			}
+		}()
+	}
+	recordAudit(c, user, auditMagicLinkRequest, email, fiber.Map{"sent": user != nil})
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "If an account exists for this email, a sign-in link is on its way.",
+	})
+}
+
+// handleMagicLinkVerify signs the user in from an emailed link. A link opened in another
+// browser (or fetched by a mail scanner) is rejected without being used up.
+func handleMagicLinkVerify(c *fiber.Ctx) error {
+	link, err := orm.GetMagicLink(c.UserContext(), auth.HashToken(c.Query("token")))
+	if err != nil || link.UserID == 0 {
+		return magicLinkFailed(c, nil, "", "invalid_or_expired", "magic_link_invalid")
+	}
+	if !auth.TokenHashEqual(c.Cookies(magicLinkCookie), link.BrowserHash) {
+		return magicLinkFailed(c, nil, link.Email, "other_browser", "magic_link_browser")
+	}
+	used, err := orm.UseMagicLink(c.UserContext(), link.ID)
+	if err != nil || !used {
+		return magicLinkFailed(c, nil, link.Email, "already_used", "magic_link_invalid")
+	}
+	user, err := orm.GetUserByID(c.UserContext(), link.UserID)
+	if err != nil {
+		return magicLinkFailed(c, nil, link.Email, "unknown_user", "magic_link_invalid")
+	}
+	if user.Disabled {
+		return magicLinkFailed(c, user, link.Email, "account_disabled", "magic_link_invalid")
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     magicLinkCookie,
+		Value:    "",
+		Path:     appPath("/api/login/magic"),
+		Expires:  time.Now().Add(-time.Hour),
+		Secure:   secureCookies(c),
+		HTTPOnly: true,
+		SameSite: "Lax",
+	})
+	if err := startSession(c, user); err != nil {
+		logf(c, "Error creating session: %v", err)
+		return redirectTo(c, "/login.html?error=magic_link_invalid")
+	}
+	recordAudit(c, user, auditLogin, user.Email, fiber.Map{"method": "magic_link"})
+	countLogin("magic_link", true)
+	return redirectTo(c, link.NextPath)
+}
+
+func magicLinkFailed(c *fiber.Ctx, user *orm.User, email, reason, code string) error {
+	recordAudit(c, user, auditLoginFailed, email, fiber.Map{"method": "magic_link", "reason": reason})
+	countLogin("magic_link", false)
+	return redirectTo(c, "/login.html?error="+code)
+}
@@ -0,0 +1,199 @@
+package dev
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/isymbo/sachi/auth"
+	"github.com/isymbo/sachi/orm"
+)
+
+// requestMagicLink asks for a sign-in link from browser b
+func requestMagicLink(t *testing.T, b *testBrowser, email string) *http.Response {
+	t.Helper()
+	return b.postJSON(t, "/api/login/magic", map[string]string{"email": email, "next": "/profile.html"})
+}
+
+// assertMagicLinkSent checks the response, which is the same whether or not the account exists
+func assertMagicLinkSent(t *testing.T, resp *http.Response) {
+	t.Helper()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+}
+
+// assertMagicLinkFailed checks that opening a link went back to the login page with code,
+// recording reason
+func assertMagicLinkFailed(t *testing.T, resp *http.Response, email, code, reason string) {
+	t.Helper()
+	if got := redirectPath(t, resp); got != "/login.html?error="+code {
+		t.Errorf("redirected to %s, want the login page with %s", got, code)
+	}
+	if _, ok := responseCookie(resp, "session_token"); ok {
+		t.Error("a session cookie was set")
+	}
+	e := lastAuditEvent(t, auditLoginFailed, email)
+	if e.Metadata["method"] != "magic_link" || e.Metadata["reason"] != reason {
+		t.Errorf("failure recorded as %v, want %s", e.Metadata, reason)
+	}
+}
+
+// assertRateLimited checks for the 429 error envelope and its Retry-After
+func assertRateLimited(t *testing.T, resp *http.Response) {
+	t.Helper()
+	var body struct {
+		Code string `json:"code"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusTooManyRequests || body.Code != codeRateLimited {
+		t.Fatalf("got status %d with code %q, want 429 %s", resp.StatusCode, body.Code, codeRateLimited)
+	}
+	if resp.Header.Get("Retry-After") != "900" {
+		t.Errorf("Retry-After %q, want 900", resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestMagicLinkSignIn(t *testing.T) {
+	createTestUser(t, "Mia", "mia@magic.example", "a long enough passphrase")
+	b := newTestBrowser("192.0.2.1")
+
+	assertMagicLinkSent(t, requestMagicLink(t, b, "mia@magic.example"))
+	link := waitForMail(t, "mia@magic.example")
+	assertSignedIn(t, b.get(t, link), "mia@magic.example", "/profile.html")
+	if e := lastAuditEvent(t, auditLogin, "mia@magic.example"); e.Metadata["method"] != "magic_link" {
+		t.Errorf("login recorded as %v", e.Metadata)
+	}
+
+	// The link works once
+	assertMagicLinkFailed(t, b.get(t, link), "", "magic_link_invalid", "invalid_or_expired")
+}
+
+func TestMagicLinkOtherBrowser(t *testing.T) {
+	createTestUser(t, "Nia", "nia@magic.example", "a long enough passphrase")
+	b := newTestBrowser("192.0.2.2")
+	assertMagicLinkSent(t, requestMagicLink(t, b, "nia@magic.example"))
+	link := waitForMail(t, "nia@magic.example")
+
+	// Another browser, or a mail scanner following the link, is turned away
+	other := newTestBrowser("198.51.100.2")
+	assertMagicLinkFailed(t, other.get(t, link), "nia@magic.example", "magic_link_browser", "other_browser")
+	other.jar.SetCookies(testAppURL.JoinPath("/api/login/magic"), []*http.Cookie{{Name: magicLinkCookie, Value: auth.RandomToken(32)}})
+	assertMagicLinkFailed(t, other.get(t, link), "nia@magic.example", "magic_link_browser", "other_browser")
+
+	// without using the link up
+	assertSignedIn(t, b.get(t, link), "nia@magic.example", "/profile.html")
+}
+
+func TestMagicLinkSendAgain(t *testing.T) {
+	createTestUser(t, "Oda", "oda@magic.example", "a long enough passphrase")
+	b := newTestBrowser("192.0.2.3")
+	assertMagicLinkSent(t, requestMagicLink(t, b, "oda@magic.example"))
+	first := waitForMail(t, "oda@magic.example")
+	assertMagicLinkSent(t, requestMagicLink(t, b, "oda@magic.example"))
+	waitForMail(t, "oda@magic.example")
+
+	// Asking again keeps the browser binding, so the first link still works
+	assertSignedIn(t, b.get(t, first), "oda@magic.example", "/profile.html")
+}
+
+func TestMagicLinkExpires(t *testing.T) {
+	createTestUser(t, "Pia", "pia@magic.example", "a long enough passphrase")
+	b := newTestBrowser("192.0.2.4")
+	assertMagicLinkSent(t, requestMagicLink(t, b, "pia@magic.example"))
+	link := waitForMail(t, "pia@magic.example")
+
+	token := link[len("/api/login/magic/verify?token="):]
+	_, err := orm.DB.Exec("UPDATE magic_links SET expires_at = ? WHERE token_hash = ?", time.Now().Add(-time.Second), auth.HashToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMagicLinkFailed(t, b.get(t, link), "", "magic_link_invalid", "invalid_or_expired")
+}
+
+func TestMagicLinkUnknownAccount(t *testing.T) {
+	createTestUser(t, "Quin", "quin@magic.example", "a long enough passphrase")
+	b := newTestBrowser("192.0.2.5")
+
+	assertMagicLinkSent(t, requestMagicLink(t, b, "nobody@magic.example"))
+	if e := lastAuditEvent(t, auditMagicLinkRequest, "nobody@magic.example"); e.Metadata["sent"] != false {
+		t.Errorf("request recorded as %v", e.Metadata)
+	}
+
+	// Mail is handled in order of requests; by the time the next one arrives, nothing went
+	// to the unknown address
+	assertMagicLinkSent(t, requestMagicLink(t, b, "quin@magic.example"))
+	waitForMail(t, "quin@magic.example")
+	if files, _ := filepath.Glob(filepath.Join(testMail.Dir(), "*-nobody@magic.example.eml")); len(files) != 0 {
+		t.Errorf("mail sent to an address without an account: %v", files)
+	}
+}
+
+func TestMagicLinkSendFails(t *testing.T) {
+	createTestUser(t, "Ray", "undeliverable@magic.example", "a long enough passphrase")
+	b := newTestBrowser("192.0.2.6")
+
+	// Delivery happens after the response, which does not tell
+	assertMagicLinkSent(t, requestMagicLink(t, b, "undeliverable@magic.example"))
+	select {
+	case msg := <-testMail.sent:
+		if msg.To != "undeliverable@magic.example" {
+			t.Errorf("sent to %s", msg.To)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mail was not sent")
+	}
+}
+
+func TestMagicLinkLimits(t *testing.T) {
+	t.Run("per email", func(t *testing.T) {
+		createTestUser(t, "Sam", "sam@magic.example", "a long enough passphrase")
+		b := newTestBrowser("192.0.2.7")
+		for i := 0; i < magicLinkPerEmail; i++ {
+			assertMagicLinkSent(t, requestMagicLink(t, b, "sam@magic.example"))
+			waitForMail(t, "sam@magic.example")
+		}
+		// Limits apply whatever the IP and the case of the email
+		assertRateLimited(t, requestMagicLink(t, newTestBrowser("198.51.100.7"), "SAM@magic.example"))
+		e := lastAuditEvent(t, auditMagicLinkLimited, "SAM@magic.example")
+		if e.Metadata["by_email"] != float64(magicLinkPerEmail) {
+			t.Errorf("limit recorded as %v", e.Metadata)
+		}
+
+		// Other emails from the same IP are not affected
+		assertMagicLinkSent(t, requestMagicLink(t, b, "sam.other@magic.example"))
+	})
+
+	t.Run("per IP", func(t *testing.T) {
+		b := newTestBrowser("192.0.2.8")
+		for i := 0; i < magicLinkPerIP; i++ {
+			assertMagicLinkSent(t, requestMagicLink(t, b, fmt.Sprintf("ip-%d@magic.example", i)))
+		}
+		assertRateLimited(t, requestMagicLink(t, b, "ip-new@magic.example"))
+
+		// A new browser does not reset the limit, another IP does
+		assertRateLimited(t, requestMagicLink(t, newTestBrowser("192.0.2.8"), "ip-new@magic.example"))
+		assertMagicLinkSent(t, requestMagicLink(t, newTestBrowser("198.51.100.8"), "ip-new@magic.example"))
+	})
+
+	// Requests older than the window no longer count
+	t.Run("window", func(t *testing.T) {
+		createTestUser(t, "Tao", "tao@magic.example", "a long enough passphrase")
+		b := newTestBrowser("192.0.2.9")
+		for i := 0; i < magicLinkPerEmail; i++ {
+			assertMagicLinkSent(t, requestMagicLink(t, b, "tao@magic.example"))
+			waitForMail(t, "tao@magic.example")
+		}
+		_, err := orm.DB.ExecContext(context.Background(), "UPDATE magic_links SET created_at = ? WHERE email = ?",
+			time.Now().Add(-magicLinkWindow-time.Minute), "tao@magic.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertMagicLinkSent(t, requestMagicLink(t, b, "tao@magic.example"))
+		waitForMail(t, "tao@magic.example")
+	})
+}
@@ -0,0 +1,24 @@
+package dev
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/isymbo/sachi/config"
+	"github.com/isymbo/sachi/mail"
+)
+
+// mailer delivers transactional email; set up by Run
+var mailer mail.Mailer
+
+// newMailer connects to the --smtp-url relay, or falls back to an outbox in the data directory
+func newMailer(args *config.CmdArgs) (mail.Mailer, error) {
+	m, err := mail.New(args.SMTPURL, args.MailFrom, filepath.Join(args.DataDir, "outbox"))
+	if err != nil {
+		return nil, err
+	}
+	if outbox, ok := m.(*mail.Outbox); ok {
+		log.Printf("No --smtp-url configured; outgoing email is written to %s", outbox.Dir())
+	}
+	return m, nil
+}
@@ -1,8 +1,11 @@
 package dev
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net/http"
+	"net/netip"
 	"strings"
 	"time"
 
@@ -10,15 +13,18 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/compress"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/etag"
+	"github.com/gofiber/fiber/v2/middleware/filesystem"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/isymbo/sachi/config"
 	"github.com/isymbo/sachi/core"
+	"github.com/isymbo/sachi/jobs"
 	"github.com/isymbo/sachi/orm"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/isymbo/sachi/tracing"
+	"github.com/isymbo/sachi/web/static"
 )
 
-// Run starts the development web server
+// Run starts the web server; args.Production selects the hardened "sachi serve" behaviour
 func Run(args *config.CmdArgs) error {
 	// Initialize database
 	err := orm.Init(args.DBFile)
@@ -26,31 +32,154 @@ func Run(args *config.CmdArgs) error {
 		return fmt.Errorf("failed to initialize database: %v", err)
 	}
 
-	// Initial session cleanup to avoid bloating queries
-	_ = orm.CleanupExpiredSessions()
+	traceCfg, err := args.TracingConfig()
+	if err != nil {
+		return err
+	}
+	traceCfg.ServiceVersion = core.Version
+	if err := tracing.Init(traceCfg); err != nil {
+		return fmt.Errorf("failed to initialize tracing: %v", err)
+	}
 
-	// Create Fiber app
+	// Prefork children leave background work to the parent process
+	background := !fiber.IsChild()
+
+	trustedProxies, err := args.TrustedProxyPrefixes()
+	if err != nil {
+		return err
+	}
+
+	passwordHashing, err = args.NewPasswordHashing()
+	if err != nil {
+		return err
+	}
+	passwordPolicy, err = args.NewPasswordPolicy(passwordHashing.MaxPasswordBytes())
+	if err != nil {
+		return err
+	}
+	mailer, err = newMailer(args)
+	if err != nil {
+		return err
+	}
+	magicLinksEnabled = args.MagicLinks
+	blobs, err = newBlobStore(args)
+	if err != nil {
+		return err
+	}
+	accountDeletionGrace = time.Duration(args.AccountDeletionGraceDays) * 24 * time.Hour
+	assetFS, precomputedAssets, err = newAssetFS(args)
+	if err != nil {
+		return err
+	}
+	if precomputedAssets != nil {
+		if pageTemplates, err = loadPageTemplates(assetFS); err != nil {
+			return err
+		}
+	}
+
+	app := newApp(args, trustedProxies)
+	if background {
+		// The same check as "sachi openapi check", so a stale document shows up in development
+		problems, err := checkOpenAPIRoutes(app)
+		if err != nil {
+			return err
+		}
+		for _, p := range problems {
+			log.Printf("openapi.json: %s", p)
+		}
+	}
+
+	if background {
+		startJobs(args)
+	}
+	if args.MetricsAddr != "" {
+		go runMetricsListener(args)
+	}
+
+	// Start server
+	addr := fmt.Sprintf("%s:%d", args.Host, args.Port)
+
+	// Register cleanup callback
+	core.AddExitCallback(func() {
+		if err := app.Shutdown(); err != nil {
+			log.Printf("Error shutting down server: %v", err)
+		}
+	})
+	// After the server, so spans of the requests it waited for are still exported
+	core.AddExitCallback(tracing.Shutdown)
+
+	if args.TLSEnabled() {
+		return listenTLS(app, args, addr)
+	}
+
+	log.Printf("Sachi web server starting at http://%s (%s mode)", addr, args.Mode())
+	return app.Listen(addr)
+}
+
+// newApp creates the Fiber app with its middleware and routes
+func newApp(args *config.CmdArgs, trustedProxies []netip.Prefix) *fiber.App {
 	app := fiber.New(fiber.Config{
 		AppName:      "Sachi",
 		ErrorHandler: errorHandler,
+		// Ignore X-Forwarded-* from clients unless they come from a trusted proxy
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          args.TrustedProxyList(),
+		Prefork:                 args.Prefork,
+		BodyLimit:               args.BodyLimit,
+		ReadTimeout:             args.ReadTimeout,
+		WriteTimeout:            args.WriteTimeout,
+		IdleTimeout:             args.IdleTimeout,
 	})
 
-	// Middleware
-	app.Use(recover.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,HEAD,PUT,DELETE,PATCH,OPTIONS",
-		AllowHeaders: "*",
-	}))
+	// Middleware. The request ID comes first so every log line and error carries it; metrics
+	// and tracing next so they see the final status of every request.
+	app.Use(newRequestIDMiddleware())
+	app.Use(newMetricsMiddleware())
+	app.Use(newTracingMiddleware())
+	app.Use(recover.New(recover.Config{EnableStackTrace: !args.Production}))
+	app.Use(newProxyMiddleware(trustedProxies, args.BasePath))
+	// Without an allow-list no CORS headers are sent and browsers keep to same-origin requests
+	if args.CORSOrigins != "" {
+		app.Use(cors.New(cors.Config{
+			AllowOrigins:     args.CORSOrigins,
+			AllowMethods:     args.CORSMethods,
+			AllowHeaders:     args.CORSHeaders,
+			AllowCredentials: args.CORSCredentials,
+			ExposeHeaders:    requestIDHeader,
+		}))
+	}
+	app.Use(newSecurityHeaders(defaultSecurityPolicy(args)))
+	app.Use("/api", withSecurityHeaders(apiSecurityPolicy))
 
 	// Enable ETag for client-side caching and gzip compression for smaller payloads
-	app.Use(etag.New())
-	app.Use(compress.New(compress.Config{Level: compress.LevelDefault}))
+	app.Use(traced("etag", etag.New(etag.Config{Next: isStreamed})))
+	app.Use(traced("compress", compress.New(compress.Config{Next: isStreamed, Level: compress.LevelDefault})))
 
 	if args.LogLevel == "debug" {
-		app.Use(logger.New())
+		app.Use(logger.New(logger.Config{
+			Format: "${time} | ${status} | ${latency} | ${ip} | ${method} | ${path} | ${locals:" + requestIDKey + "} | ${locals:" + traceIDKey + "} | ${error}\n",
+		}))
+	}
+
+	// CSRF protection for all API routes (Bearer-token clients are exempt)
+	app.Use("/api", traced("csrf", newCSRFMiddleware(args.TLSEnabled() || args.SecureCookies, args.Prefork)))
+
+	setupRoutes(app, args)
+	return app
+}
+
+// setupRoutes registers the handlers: the API, the OAuth2 and SCIM endpoints, the pages and
+// the static files. The API routes must match openapi.json; see checkOpenAPIRoutes.
+func setupRoutes(app *fiber.App, args *config.CmdArgs) {
+	// Prometheus scrape endpoint, unless it has a listener of its own
+	if args.MetricsToken != "" && args.MetricsAddr == "" {
+		app.Get(metricsPath, newMetricsHandler(args.MetricsToken))
 	}
 
+	// Liveness and readiness probes
+	app.Get("/healthz", handleHealthz)
+	app.Get("/readyz", handleReadyz)
+
 	// API routes
 	api := app.Group("/api")
 	setupAPIRoutes(api)
@@ -59,6 +188,23 @@ func Run(args *config.CmdArgs) error {
 	auth := app.Group("/api")
 	setupAuthRoutes(auth)
 
+	// Single sign-on routes
+	sso := app.Group("/api/sso")
+	setupSSORoutes(sso)
+
+	// OAuth2 authorization server for third-party integrations
+	app.Get("/.well-known/oauth-authorization-server", handleOAuthMetadata)
+	oauth := app.Group("/oauth")
+	setupOAuthRoutes(oauth)
+
+	// SCIM 2.0 provisioning, authenticated by organization-scoped bearer tokens
+	scimAPI := app.Group(scimBasePath, requireSCIMToken)
+	setupSCIMRoutes(scimAPI)
+
+	// Admin routes
+	admin := app.Group("/api/admin", requireAuth, requireFirstParty, requireAdmin)
+	setupAdminRoutes(admin)
+
 	// Home route - marketing page for guests, profile for authenticated users
 	app.Get("/", handleHome)
 
@@ -67,116 +213,122 @@ func Run(args *config.CmdArgs) error {
 		c.Set("Cache-Control", "no-store")
 		c.Set("Pragma", "no-cache")
 		c.Set("Expires", "0")
-		return c.SendFile("./web/static/profile.html")
+		return sendPage(c, "profile.html")
 	})
 	app.Get("/profile.html", requireAuth, func(c *fiber.Ctx) error {
 		c.Set("Cache-Control", "no-store")
 		c.Set("Pragma", "no-cache")
 		c.Set("Expires", "0")
-		return c.SendFile("./web/static/profile.html")
+		return sendPage(c, "profile.html")
 	})
 
+	// Admin console; the API behind it enforces the admin role on its own
+	app.Get("/admin", requireAuth, handleAdminPage)
+	app.Get("/admin.html", requireAuth, handleAdminPage)
+
 	// Public HTML routes
 	app.Get("/index.html", func(c *fiber.Ctx) error {
-		return c.SendFile("./web/static/index.html")
+		return sendPage(c, "index.html")
 	})
 	app.Get("/login.html", func(c *fiber.Ctx) error {
 		c.Set("Cache-Control", "no-store")
 		c.Set("Pragma", "no-cache")
 		c.Set("Expires", "0")
-		return c.SendFile("./web/static/login.html")
+		return renderPage(c, "login.html", fiber.Map{"MagicLinks": magicLinksEnabled})
+	})
+	app.Get("/consent.html", func(c *fiber.Ctx) error {
+		c.Set("Cache-Control", "no-store")
+		c.Set("Pragma", "no-cache")
+		c.Set("Expires", "0")
+		return sendPage(c, "consent.html")
 	})
 	app.Get("/register.html", func(c *fiber.Ctx) error {
 		c.Set("Cache-Control", "no-store")
 		c.Set("Pragma", "no-cache")
 		c.Set("Expires", "0")
-		return c.SendFile("./web/static/register.html")
+		return sendPage(c, "register.html")
 	})
 	app.Get("/product.html", func(c *fiber.Ctx) error {
-		return c.SendFile("./web/static/product.html")
+		return sendPage(c, "product.html")
 	})
 	app.Get("/pricing.html", func(c *fiber.Ctx) error {
-		return c.SendFile("./web/static/pricing.html")
+		return sendPage(c, "pricing.html")
 	})
 	app.Get("/about.html", func(c *fiber.Ctx) error {
-		return c.SendFile("./web/static/about.html")
+		return sendPage(c, "about.html")
+	})
+	app.Get("/docs", func(c *fiber.Ctx) error {
+		return sendPage(c, "api-docs.html")
 	})
 
-	// Set aggressive cache headers for static assets (fingerprint if file names change)
+	// Fingerprinted asset URLs change with their content and are cached for a year. Plain
+	// names (old links, --assets-dir) are revalidated by ETag so a deploy shows up at once.
 	app.Use(func(c *fiber.Ctx) error {
 		p := c.Path()
 		if strings.HasPrefix(p, "/css/") || strings.HasPrefix(p, "/js/") || strings.HasPrefix(p, "/images/") || strings.HasPrefix(p, "/fonts/") {
-			c.Set("Cache-Control", "public, max-age=31536000, immutable")
+			if isFingerprinted(p) {
+				c.Set("Cache-Control", "public, max-age=31536000, immutable")
+			} else {
+				c.Set("Cache-Control", "no-cache")
+			}
 		}
 		return c.Next()
 	})
 
-	// Serve static files from web/static directory (CSS, JS, images, etc.)
-	app.Static("/css", "./web/static/css")
-	app.Static("/js", "./web/static/js")
-	app.Static("/images", "./web/static/images")
-	app.Static("/fonts", "./web/static/fonts")
+	// Scripts reference app routes by absolute path; rewrite them when mounted under a prefix
+	if args.BasePath != "" {
+		app.Get("/js/*", handleScript)
+	}
+
+	// Serve static files (CSS, JS, images, fonts), embedded ones with precomputed ETags and compression
+	app.Use(servePrecomputedAsset)
+	for _, dir := range static.AssetDirs {
+		app.Use("/"+dir, filesystem.New(filesystem.Config{
+			Root:       http.FS(assetFS),
+			PathPrefix: dir,
+		}))
+	}
 
-	// Fallback: serve .html files from ./web/static for any unmatched routes
+	// Fallback: serve .html pages for any unmatched routes
 	app.Use(func(c *fiber.Ctx) error {
 		path := c.Path()
 		if strings.HasSuffix(path, ".html") {
 			// Protected profile.html -> redirect to /profile to enforce auth middleware
 			if path == "/profile.html" {
-				return c.Redirect("/profile")
+				return redirectTo(c, "/profile")
 			}
-			return c.SendFile("./web/static" + path)
+			return sendPage(c, path)
 		}
 		return fiber.ErrNotFound
 	})
-
-	// Start periodic session cleanup (every hour)
-	go func() {
-		ticker := time.NewTicker(time.Hour)
-		defer ticker.Stop()
-		for range ticker.C {
-			if err := orm.CleanupExpiredSessions(); err != nil {
-				log.Printf("session cleanup error: %v", err)
-			}
-		}
-	}()
-
-	// Start server
-	addr := fmt.Sprintf("%s:%d", args.Host, args.Port)
-	log.Printf("Sachi web server starting at http://%s", addr)
-
-	// Register cleanup callback
-	core.AddExitCallback(func() {
-		if err := app.Shutdown(); err != nil {
-			log.Printf("Error shutting down server: %v", err)
-		}
-	})
-
-	return app.Listen(addr)
 }
 
-// errorHandler handles Fiber errors
-func errorHandler(c *fiber.Ctx, err error) error {
-	code := fiber.StatusInternalServerError
-	if e, ok := err.(*fiber.Error); ok {
-		code = e.Code
+// startJobs schedules the background maintenance: expired rows every hour, audit
+// retention daily. Every job also runs once at startup.
+func startJobs(args *config.CmdArgs) {
+	scheduler := jobs.New()
+	scheduler.Add("session_cleanup", time.Hour, orm.CleanupExpiredSessions)
+	scheduler.Add("sso_state_cleanup", time.Hour, orm.CleanupExpiredSSOStates)
+	scheduler.Add("oauth_cleanup", time.Hour, orm.CleanupExpiredOAuth)
+	scheduler.Add("magic_link_cleanup", time.Hour, orm.CleanupExpiredMagicLinks)
+	scheduler.Add("csrf_token_cleanup", time.Hour, orm.CleanupExpiredCSRFTokens)
+	scheduler.Add("account_purge", time.Hour, purgeDeletedAccounts)
+	if args.AuditRetentionDays > 0 {
+		scheduler.Add("audit_retention", 24*time.Hour, func(ctx context.Context) error {
+			return purgeAuditEvents(ctx, args.AuditRetentionDays)
+		})
 	}
-
-	return c.Status(code).JSON(fiber.Map{
-		"error":   true,
-		"message": err.Error(),
-	})
+	scheduler.Start(core.Ctx)
+	jobScheduler = scheduler
 }
 
 // setupAPIRoutes sets up API routes
 func setupAPIRoutes(api fiber.Router) {
-	// Health check
-	api.Get("/health", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{
-			"status":  "ok",
-			"version": core.Version,
-		})
-	})
+	// Health check for clients of the API, the same liveness check as /healthz
+	api.Get("/health", handleHealthz)
+
+	// OpenAPI document of this API; /docs renders it
+	api.Get("/openapi.json", handleOpenAPI)
 
 	// Info endpoint
 	api.Get("/info", func(c *fiber.Ctx) error {
@@ -184,55 +336,105 @@ func setupAPIRoutes(api fiber.Router) {
 			"name":        "Sachi",
 			"description": "AI-Powered Analytics Platform",
 			"version":     core.Version,
-			"mode":        "development",
+			"mode":        config.Args.Mode(),
 		})
 	})
 
-	// Static assets info (for backward compatibility)
+	// Asset manifest: plain paths to the URLs to load them from, and the pages
 	api.Get("/assets", func(c *fiber.Ctx) error {
+		manifest := assetManifest()
+		pages := []string{appPath("/")}
+		for _, name := range pageNames() {
+			if name != "index.html" {
+				pages = append(pages, appPath("/"+name))
+			}
+		}
 		return c.JSON(fiber.Map{
-			"css": "/css/styles.css",
-			"js":  "/js/main.js",
-			"pages": []string{
-				"/",
-				"/product.html",
-				"/pricing.html",
-				"/about.html",
-				"/login.html",
-				"/register.html",
-				"/profile.html",
-			},
-			"static_root": "/web/static",
+			"css":      manifest["/css/styles.css"],
+			"js":       manifest["/js/main.js"],
+			"assets":   manifest,
+			"pages":    pages,
+			"embedded": precomputedAssets != nil,
 		})
 	})
 }
 
 // setupAuthRoutes sets up authentication routes
 func setupAuthRoutes(auth fiber.Router) {
+	auth.Get("/csrf", handleCSRFToken)
+	auth.Post("/csp-report", handleCSPReport)
+	auth.Get("/password-policy", handlePasswordPolicy)
 	auth.Post("/register", handleRegister)
 	auth.Post("/login", handleLogin)
+	auth.Post("/login/magic", handleMagicLinkRequest)
+	auth.Get("/login/magic/verify", handleMagicLinkVerify)
 	auth.Post("/logout", handleLogout)
-	auth.Get("/me", requireAuth, handleMe)
-	auth.Put("/profile", requireAuth, handleUpdateProfile)
-	auth.Post("/change-password", requireAuth, handleChangePassword)
+	auth.Get("/me", requireAuth, requireScope(scopeProfile), handleMe)
+	auth.Put("/profile", requireAuth, requireScope(scopeProfileWrite), handleUpdateProfile)
+	auth.Post("/change-password", requireAuth, requireFirstParty, denyImpersonation, handleChangePassword)
+	auth.Post("/account/avatar", requireAuth, requireFirstParty, handleAvatarUpload)
+	auth.Delete("/account/avatar", requireAuth, requireFirstParty, handleAvatarDelete)
+	auth.Get("/avatars/:name", handleAvatar)
+	auth.Get("/account/export", requireAuth, requireFirstParty, denyImpersonation, handleAccountExport)
+	auth.Post("/account/delete", requireAuth, requireFirstParty, denyImpersonation, handleAccountDelete)
+	auth.Post("/account/delete/cancel", requireAuth, requireFirstParty, denyImpersonation, handleAccountDeleteCancel)
+	auth.Get("/oauth/consent", requireAuth, requireFirstParty, denyImpersonation, handleOAuthConsentInfo)
+	auth.Post("/oauth/consent", requireAuth, requireFirstParty, denyImpersonation, handleOAuthConsent)
+	auth.Post("/impersonation/stop", requireAuth, handleImpersonationStop)
+}
+
+// setupAdminRoutes sets up admin-only routes
+func setupAdminRoutes(admin fiber.Router) {
+	admin.Get("/audit", handleAuditList)
+	admin.Get("/audit/export", handleAuditExport)
+	admin.Get("/orgs", handleOrgList)
+	admin.Post("/orgs", handleOrgCreate)
+	admin.Get("/orgs/:slug/oidc", handleOIDCProviderGet)
+	admin.Put("/orgs/:slug/oidc", handleOIDCProviderPut)
+	admin.Delete("/orgs/:slug/oidc", handleOIDCProviderDelete)
+	admin.Get("/orgs/:slug/saml", handleSAMLProviderGet)
+	admin.Put("/orgs/:slug/saml", handleSAMLProviderPut)
+	admin.Delete("/orgs/:slug/saml", handleSAMLProviderDelete)
+	admin.Get("/oauth/clients", handleOAuthClientList)
+	admin.Post("/oauth/clients", handleOAuthClientCreate)
+	admin.Delete("/oauth/clients/:client_id", handleOAuthClientDelete)
+	admin.Get("/orgs/:slug/scim/tokens", handleSCIMTokenList)
+	admin.Post("/orgs/:slug/scim/tokens", handleSCIMTokenCreate)
+	admin.Delete("/orgs/:slug/scim/tokens/:id", handleSCIMTokenDelete)
+	admin.Get("/orgs/:slug/scim/groups", handleSCIMGroupAdminList)
+	admin.Put("/orgs/:slug/scim/groups/:id", handleSCIMGroupRoleSet)
+	admin.Get("/users", handleAdminUserList)
+	admin.Get("/users/:id", handleAdminUserGet)
+	admin.Post("/users/:id/disable", handleAdminUserDisable)
+	admin.Post("/users/:id/enable", handleAdminUserEnable)
+	admin.Post("/users/:id/logout", handleAdminUserLogout)
+	admin.Post("/users/:id/reset-password", handleAdminUserPasswordReset)
+	admin.Put("/users/:id/role", handleAdminUserRole)
+	admin.Post("/users/:id/impersonate", handleAdminImpersonate)
 }
 
 // requireAuth middleware to protect routes
 func requireAuth(c *fiber.Ctx) error {
-	sessionToken := c.Cookies("session_token")
+	sessionToken := sessionTokenFromRequest(c)
 	if sessionToken == "" {
-		return c.Status(401).JSON(fiber.Map{
-			"error":   true,
-			"message": "Authentication required",
-		})
+		return newAPIError(401, codeUnauthenticated, "Authentication required")
 	}
 
-	user, err := orm.ValidateSession(sessionToken)
+	user, err := orm.ValidateSession(c.UserContext(), sessionToken)
 	if err != nil {
-		return c.Status(401).JSON(fiber.Map{
-			"error":   true,
-			"message": "Invalid session",
-		})
+		// Bearer tokens may also be access tokens issued to third-party OAuth clients
+		if bearer := bearerToken(c); bearer != "" {
+			if user, tok, ok := oauthUser(c.UserContext(), bearer); ok {
+				c.Locals("user", user)
+				c.Locals(oauthTokenKey, tok)
+				return c.Next()
+			}
+		}
+		return newAPIError(401, codeUnauthenticated, "Invalid session")
+	}
+
+	if err := checkSessionRestrictions(c, sessionToken, user); err != nil {
+		return err
 	}
 
 	// Store user in context
@@ -250,53 +452,45 @@ type User struct {
 func handleRegister(c *fiber.Ctx) error {
 	user := new(User)
 	if err := c.BodyParser(user); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"error":   true,
-			"message": "Invalid request body",
-		})
+		return errInvalidBody()
 	}
 
 	// Validate required fields
-	if user.Name == "" || user.Email == "" || user.Password == "" {
-		return c.Status(400).JSON(fiber.Map{
-			"error":   true,
-			"message": "Name, email, and password are required",
-		})
+	if err := requireFields("Name, email, and password are required",
+		"name", user.Name, "email", user.Email, "password", user.Password); err != nil {
+		return err
+	}
+
+	if violations := checkNewPassword(c.UserContext(), nil, user.Password, user.Name, user.Email); len(violations) > 0 {
+		return passwordViolationError("password", violations)
 	}
 
 	// Check if user already exists
-	existingUser, err := orm.GetUserByEmail(user.Email)
+	existingUser, err := orm.GetUserByEmail(c.UserContext(), user.Email)
 	if err == nil && existingUser != nil {
-		return c.Status(409).JSON(fiber.Map{
-			"error":   true,
-			"message": "User with this email already exists",
-		})
+		recordAudit(c, nil, auditRegisterFailed, user.Email, fiber.Map{"reason": "email_exists"})
+		return newAPIError(409, codeEmailTaken, "User with this email already exists")
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	hashedPassword, err := hashPassword(c.UserContext(), user.Password)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   true,
-			"message": "Failed to hash password",
-		})
+		return newAPIError(500, codeInternal, "Failed to hash password")
 	}
 
-	_, err = orm.CreateUser(user.Name, user.Email, user.Company, string(hashedPassword))
+	userID, err := orm.CreateUser(c.UserContext(), user.Name, user.Email, user.Company, hashedPassword)
 	if err != nil {
 		// Handle duplicate email race condition
 		if strings.Contains(err.Error(), "UNIQUE constraint failed: users.email") {
-			return c.Status(409).JSON(fiber.Map{
-				"error":   true,
-				"message": "User with this email already exists",
-			})
+			recordAudit(c, nil, auditRegisterFailed, user.Email, fiber.Map{"reason": "email_exists"})
+			return newAPIError(409, codeEmailTaken, "User with this email already exists")
 		}
-		log.Printf("Error creating user: %v", err)
-		return c.Status(500).JSON(fiber.Map{
-			"error":   true,
-			"message": fmt.Sprintf("Failed to create user: %v", err),
-		})
+		logf(c, "Error creating user: %v", err)
+		return newAPIError(500, codeInternal, "Failed to create user")
 	}
 
+	recordAudit(c, &orm.User{ID: userID, Email: user.Email}, auditRegister, user.Email, nil)
+	signups.Inc("password")
+
 	return c.JSON(fiber.Map{
 		"success": true,
 		"message": "User created successfully",
@@ -310,92 +504,89 @@ func handleLogin(c *fiber.Ctx) error {
 	}
 	req := new(LoginRequest)
 	if err := c.BodyParser(req); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"error":   true,
-			"message": "Invalid request body",
-		})
+		return errInvalidBody()
 	}
 
 	// Validate required fields
-	if req.Email == "" || req.Password == "" {
-		return c.Status(400).JSON(fiber.Map{
-			"error":   true,
-			"message": "Email and password are required",
-		})
+	if err := requireFields("Email and password are required", "email", req.Email, "password", req.Password); err != nil {
+		return err
 	}
 
-	user, err := orm.GetUserByEmail(req.Email)
+	user, err := orm.GetUserByEmail(c.UserContext(), req.Email)
 	if err != nil {
-		return c.Status(401).JSON(fiber.Map{
-			"error":   true,
-			"message": "Invalid email or password",
-		})
+		recordAudit(c, nil, auditLoginFailed, req.Email, fiber.Map{"reason": "unknown_email"})
+		countLogin("password", false)
+		return newAPIError(401, codeInvalidCredentials, "Invalid email or password")
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
-		return c.Status(401).JSON(fiber.Map{
-			"error":   true,
-			"message": "Invalid email or password",
-		})
+	if !verifyPassword(c.UserContext(), user, req.Password) {
+		recordAudit(c, user, auditLoginFailed, req.Email, fiber.Map{"reason": "bad_password"})
+		countLogin("password", false)
+		return newAPIError(401, codeInvalidCredentials, "Invalid email or password")
 	}
 
-	// Create session
-	sessionToken, err := orm.CreateSession(user.ID)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   true,
-			"message": "Failed to create session",
-		})
+	// Only reveal the account state to someone who knows the password
+	if user.Disabled {
+		recordAudit(c, user, auditLoginFailed, req.Email, fiber.Map{"reason": "account_disabled"})
+		countLogin("password", false)
+		return newAPIError(403, codeAccountDisabled, "This account has been disabled")
 	}
 
-	// Clear any old cookie set on /api path (from previous versions)
-	c.Cookie(&fiber.Cookie{
-		Name:     "session_token",
-		Value:    "",
-		Path:     "/api",
-		Expires:  time.Now().Add(-time.Hour),
-		HTTPOnly: true,
-		SameSite: "Lax",
-	})
+	if err := startSession(c, user); err != nil {
+		return newAPIError(500, codeInternal, "Failed to create session")
+	}
 
-	// Set cookie for full site scope
-	c.Cookie(&fiber.Cookie{
-		Name:     "session_token",
-		Value:    sessionToken,
-		Path:     "/",
-		Expires:  time.Now().Add(24 * time.Hour),
-		HTTPOnly: true,
-		SameSite: "Lax",
-	})
+	recordAudit(c, user, auditLogin, user.Email, nil)
+	countLogin("password", true)
 
 	return c.JSON(fiber.Map{
 		"success": true,
 		"message": "Login successful",
 		"user": fiber.Map{
-			"id":      user.ID,
-			"name":    user.Name,
-			"email":   user.Email,
-			"company": user.Company,
+			"id":                   user.ID,
+			"name":                 user.Name,
+			"email":                user.Email,
+			"company":              user.Company,
+			"must_change_password": user.MustChangePassword,
 		},
 	})
 }
 
-func handleLogout(c *fiber.Ctx) error {
-	sessionToken := c.Cookies("session_token")
-	if sessionToken != "" {
-		orm.DeleteSession(sessionToken)
+// startSession creates a session for the user and sets the site-wide session cookie
+func startSession(c *fiber.Ctx, user *orm.User) error {
+	sessionToken, err := orm.CreateSession(c.UserContext(), user.ID)
+	if err != nil {
+		return err
 	}
 
-	// Clear the cookie
+	// Clear any old cookie set on /api path (from previous versions)
 	c.Cookie(&fiber.Cookie{
 		Name:     "session_token",
 		Value:    "",
-		Path:     "/",
+		Path:     "/api",
 		Expires:  time.Now().Add(-time.Hour),
 		HTTPOnly: true,
 		SameSite: "Lax",
 	})
 
+	// Set cookie for full site scope
+	setSessionCookie(c, sessionToken, time.Now().Add(24*time.Hour))
+	return nil
+}
+
+func handleLogout(c *fiber.Ctx) error {
+	sessionToken := sessionTokenFromRequest(c)
+	if sessionToken != "" {
+		// Resolve the user before the session is gone so the event has an actor
+		if user, err := orm.ValidateSession(c.UserContext(), sessionToken); err == nil {
+			recordAudit(c, user, auditLogout, user.Email, nil)
+		}
+		orm.DeleteSession(c.UserContext(), sessionToken)
+	}
+
+	// Clear the cookie
+	setSessionCookie(c, "", time.Now().Add(-time.Hour))
+
 	return c.JSON(fiber.Map{
 		"success": true,
 		"message": "Logged out successfully",
@@ -407,12 +598,7 @@ func handleMe(c *fiber.Ctx) error {
 
 	return c.JSON(fiber.Map{
 		"success": true,
-		"user": fiber.Map{
-			"id":      user.ID,
-			"name":    user.Name,
-			"email":   user.Email,
-			"company": user.Company,
-		},
+		"user":    newMeUser(c, user),
 	})
 }
 
@@ -427,40 +613,52 @@ func handleUpdateProfile(c *fiber.Ctx) error {
 
 	req := new(UpdateProfileRequest)
 	if err := c.BodyParser(req); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"error":   true,
-			"message": "Invalid request body",
-		})
+		return errInvalidBody()
 	}
 
 	// Validate required fields
-	if req.Name == "" || req.Email == "" {
-		return c.Status(400).JSON(fiber.Map{
-			"error":   true,
-			"message": "Name and email are required",
-		})
+	if err := requireFields("Name and email are required", "name", req.Name, "email", req.Email); err != nil {
+		return err
 	}
 
 	// Check if email is being changed and if it already exists
 	if req.Email != user.Email {
-		existingUser, err := orm.GetUserByEmail(req.Email)
+		// The email address signs the account in through magic links, so only the user may
+		// change it: not a third-party application, and not an admin acting as the user
+		if _, ok := c.Locals(oauthTokenKey).(*orm.OAuthToken); ok {
+			return newAPIError(403, codeForbidden, "Third-party applications cannot change the email address").
+				withField("email", fieldInvalid, "The email address can only be changed on the profile page")
+		}
+		if _, ok := c.Locals(impersonationKey).(*orm.Impersonation); ok {
+			return newAPIError(403, codeForbidden, "Not available while impersonating a user").
+				withField("email", fieldInvalid, "The email address can only be changed by the user")
+		}
+		existingUser, err := orm.GetUserByEmail(c.UserContext(), req.Email)
 		if err == nil && existingUser != nil {
-			return c.Status(409).JSON(fiber.Map{
-				"error":   true,
-				"message": "Email already exists",
-			})
+			recordAudit(c, user, auditProfileUpdateFailed, user.Email, fiber.Map{"reason": "email_exists", "email": req.Email})
+			return newAPIError(409, codeEmailTaken, "Email already exists")
 		}
 	}
 
 	// Update user profile
-	err := orm.UpdateUser(user.ID, req.Name, req.Email, req.Company)
+	err := orm.UpdateUser(c.UserContext(), user.ID, req.Name, req.Email, req.Company)
 	if err != nil {
-		log.Printf("Error updating user profile: %v", err)
-		return c.Status(500).JSON(fiber.Map{
-			"error":   true,
-			"message": "Failed to update profile",
-		})
+		logf(c, "Error updating user profile: %v", err)
+		return newAPIError(500, codeInternal, "Failed to update profile")
+	}
+
+	// Record which fields changed without copying unchanged values into the log
+	changes := fiber.Map{}
+	if req.Name != user.Name {
+		changes["name"] = fiber.Map{"from": user.Name, "to": req.Name}
 	}
+	if req.Email != user.Email {
+		changes["email"] = fiber.Map{"from": user.Email, "to": req.Email}
+	}
+	if req.Company != user.Company {
+		changes["company"] = fiber.Map{"from": user.Company, "to": req.Company}
+	}
+	recordAudit(c, user, auditProfileUpdate, user.Email, fiber.Map{"changes": changes})
 
 	return c.JSON(fiber.Map{
 		"success": true,
@@ -478,55 +676,41 @@ func handleChangePassword(c *fiber.Ctx) error {
 
 	req := new(ChangePasswordRequest)
 	if err := c.BodyParser(req); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"error":   true,
-			"message": "Invalid request body",
-		})
+		return errInvalidBody()
 	}
 
 	// Validate required fields
-	if req.CurrentPassword == "" || req.NewPassword == "" {
-		return c.Status(400).JSON(fiber.Map{
-			"error":   true,
-			"message": "Current and new password are required",
-		})
+	if err := requireFields("Current and new password are required",
+		"currentPassword", req.CurrentPassword, "newPassword", req.NewPassword); err != nil {
+		return err
 	}
 
 	// Validate current password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.CurrentPassword)); err != nil {
-		return c.Status(401).JSON(fiber.Map{
-			"error":   true,
-			"message": "Current password is incorrect",
-		})
+	if !verifyPassword(c.UserContext(), user, req.CurrentPassword) {
+		recordAudit(c, user, auditPasswordChangeFailed, user.Email, fiber.Map{"reason": "bad_current_password"})
+		return newAPIError(401, codeInvalidCredentials, "Current password is incorrect")
 	}
 
-	// Validate new password length
-	if len(req.NewPassword) < 6 {
-		return c.Status(400).JSON(fiber.Map{
-			"error":   true,
-			"message": "New password must be at least 6 characters long",
-		})
+	if violations := checkNewPassword(c.UserContext(), user, req.NewPassword, user.Name, user.Email); len(violations) > 0 {
+		recordAudit(c, user, auditPasswordChangeFailed, user.Email, fiber.Map{"reason": "policy"})
+		return passwordViolationError("newPassword", violations)
 	}
 
 	// Hash new password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	hashedPassword, err := hashPassword(c.UserContext(), req.NewPassword)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   true,
-			"message": "Failed to hash new password",
-		})
+		return newAPIError(500, codeInternal, "Failed to hash new password")
 	}
 
 	// Update password in database
-	err = orm.UpdateUserPassword(user.ID, string(hashedPassword))
+	err = orm.UpdateUserPassword(c.UserContext(), user.ID, hashedPassword, passwordPolicy.History)
 	if err != nil {
-		log.Printf("Error updating user password: %v", err)
-		return c.Status(500).JSON(fiber.Map{
-			"error":   true,
-			"message": "Failed to update password",
-		})
+		logf(c, "Error updating user password: %v", err)
+		return newAPIError(500, codeInternal, "Failed to update password")
 	}
 
+	recordAudit(c, user, auditPasswordChange, user.Email, nil)
+
 	return c.JSON(fiber.Map{
 		"success": true,
 		"message": "Password changed successfully",
@@ -537,10 +721,10 @@ func handleChangePassword(c *fiber.Ctx) error {
 func handleHome(c *fiber.Ctx) error {
 	sessionToken := c.Cookies("session_token")
 	if sessionToken == "" {
-		return c.SendFile("./web/static/index.html")
+		return sendPage(c, "index.html")
 	}
-	if _, err := orm.ValidateSession(sessionToken); err != nil {
-		return c.SendFile("./web/static/index.html")
+	if _, err := orm.ValidateSession(c.UserContext(), sessionToken); err != nil {
+		return sendPage(c, "index.html")
 	}
-	return c.Redirect("/profile")
+	return redirectTo(c, "/profile")
 }
@@ -0,0 +1,306 @@
+package dev
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime/quotedprintable"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	netmail "net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/config"
+	"github.com/isymbo/sachi/mail"
+	"github.com/isymbo/sachi/orm"
+)
+
+// testApp is the server under test, set up by TestMain like Run does, with a database and
+// data directory of its own. Mail goes to testMail. The server trusts the forwarding
+// headers of app.Test's peer, so tests pick their client IP with X-Forwarded-For.
+var (
+	testApp  *fiber.App
+	testMail *testMailer
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	dir, err := os.MkdirTemp("", "sachi-test-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	err = setupTestServer(dir)
+	code := 1
+	if err == nil {
+		code = m.Run()
+	} else {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	orm.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func setupTestServer(dir string) error {
+	args := &config.CmdArgs{
+		DataDir:        dir,
+		DBFile:         "sachi.db",
+		PasswordHasher: "bcrypt",
+		BcryptCost:     4,
+		MagicLinks:     true,
+		TrustedProxies: "0.0.0.0",
+	}
+	if err := config.Init(args); err != nil {
+		return err
+	}
+	if err := orm.Init(args.DBFile); err != nil {
+		return err
+	}
+
+	var err error
+	if passwordHashing, err = args.NewPasswordHashing(); err != nil {
+		return err
+	}
+	if passwordPolicy, err = args.NewPasswordPolicy(passwordHashing.MaxPasswordBytes()); err != nil {
+		return err
+	}
+	m, err := newMailer(args)
+	if err != nil {
+		return err
+	}
+	testMail = &testMailer{Outbox: m.(*mail.Outbox), sent: make(chan *mail.Message, 100)}
+	mailer = testMail
+	magicLinksEnabled = args.MagicLinks
+	if blobs, err = newBlobStore(args); err != nil {
+		return err
+	}
+	if assetFS, precomputedAssets, err = newAssetFS(args); err != nil {
+		return err
+	}
+	if precomputedAssets != nil {
+		if pageTemplates, err = loadPageTemplates(assetFS); err != nil {
+			return err
+		}
+	}
+	trustedProxies, err := args.TrustedProxyPrefixes()
+	if err != nil {
+		return err
+	}
+	testApp = newApp(args, trustedProxies)
+	return nil
+}
+
+// testMailer delivers to the outbox and tells the tests about each message it handled.
+// Recipients starting with "undeliverable" fail, like a rejecting mail server.
+type testMailer struct {
+	*mail.Outbox
+	sent chan *mail.Message
+}
+
+func (m *testMailer) Send(msg *mail.Message) error {
+	err := errors.New("550 mailbox unavailable")
+	if !strings.HasPrefix(msg.To, "undeliverable") {
+		err = m.Outbox.Send(msg)
+	}
+	m.sent <- msg
+	return err
+}
+
+var signInLinkRegexp = regexp.MustCompile(`http://example\.com(/api/login/magic/verify\?token=[\w-]+)`)
+
+// waitForMail waits for the next message to this address, skipping others, and returns the
+// path of the sign-in link in the copy the outbox stored
+func waitForMail(t *testing.T, to string) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for received := false; !received; {
+		select {
+		case msg := <-testMail.sent:
+			received = msg.To == to
+		case <-timeout:
+			t.Fatalf("no mail to %s", to)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(testMail.Dir(), "*-"+to+".eml"))
+	if len(files) == 0 {
+		t.Fatalf("no mail to %s in the outbox", to)
+	}
+	sort.Strings(files)
+	f, err := os.Open(files[len(files)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	msg, err := netmail.ReadMessage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := signInLinkRegexp.FindSubmatch(body)
+	if m == nil {
+		t.Fatalf("no sign-in link in the mail to %s:\n%s", to, body)
+	}
+	return string(m[1])
+}
+
+// testRequest sends req to testApp
+func testRequest(t *testing.T, req *http.Request) *http.Response {
+	t.Helper()
+	resp, err := testApp.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", req.Method, req.URL, err)
+	}
+	return resp
+}
+
+// testBrowser sends requests to testApp from one client IP and keeps cookies between them
+type testBrowser struct {
+	ip   string
+	jar  *cookiejar.Jar
+	csrf string
+}
+
+// testAppURL is where requests to testApp are sent, for matching cookies
+var testAppURL = &url.URL{Scheme: "http", Host: "example.com", Path: "/"}
+
+func newTestBrowser(ip string) *testBrowser {
+	jar, _ := cookiejar.New(nil)
+	return &testBrowser{ip: ip, jar: jar}
+}
+
+func (b *testBrowser) do(t *testing.T, req *http.Request) *http.Response {
+	t.Helper()
+	u := testAppURL.ResolveReference(req.URL)
+	for _, c := range b.jar.Cookies(u) {
+		req.AddCookie(c)
+	}
+	req.Header.Set("X-Forwarded-For", b.ip)
+	resp := testRequest(t, req)
+	b.jar.SetCookies(u, resp.Cookies())
+	return resp
+}
+
+func (b *testBrowser) get(t *testing.T, target string) *http.Response {
+	t.Helper()
+	return b.do(t, httptest.NewRequest("GET", target, nil))
+}
+
+// csrfToken returns the CSRF token for state-changing requests, fetching one first as the
+// pages do
+func (b *testBrowser) csrfToken(t *testing.T) string {
+	t.Helper()
+	if b.csrf == "" {
+		var out struct {
+			Token string `json:"csrf_token"`
+		}
+		if err := json.NewDecoder(b.get(t, "/api/csrf").Body).Decode(&out); err != nil || out.Token == "" {
+			t.Fatalf("no CSRF token: %v", err)
+		}
+		b.csrf = out.Token
+	}
+	return b.csrf
+}
+
+// postJSON sends body as JSON with the CSRF token
+func (b *testBrowser) postJSON(t *testing.T, target string, body any) *http.Response {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", target, strings.NewReader(string(data)))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(csrfHeaderName, b.csrfToken(t))
+	return b.do(t, req)
+}
+
+// createTestUser adds an account with a password
+func createTestUser(t *testing.T, name, email, password string) *orm.User {
+	t.Helper()
+	ctx := context.Background()
+	hash, err := hashPassword(ctx, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := orm.CreateUser(ctx, name, email, "", hash)
+	if err != nil {
+		t.Fatalf("creating %s: %v", email, err)
+	}
+	user, err := orm.GetUserByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// signInAdmin creates an admin and signs them in
+func signInAdmin(t *testing.T, name, email, ip string) *testBrowser {
+	t.Helper()
+	admin := createTestUser(t, name, email, "a long enough passphrase")
+	if err := orm.SetUserRole(context.Background(), admin.ID, orm.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBrowser(ip)
+	if resp := b.postJSON(t, "/api/login", map[string]string{"email": email, "password": "a long enough passphrase"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("admin login: got status %d", resp.StatusCode)
+	}
+	return b
+}
+
+// responseCookie returns the value of a cookie set by resp, and whether it was set
+func responseCookie(resp *http.Response, name string) (string, bool) {
+	for _, c := range resp.Cookies() {
+		if c.Name == name {
+			return c.Value, true
+		}
+	}
+	return "", false
+}
+
+// lastAuditEvent returns the newest audit event with this action and target
+func lastAuditEvent(t *testing.T, action, target string) *orm.AuditEvent {
+	t.Helper()
+	events, _, err := orm.ListAuditEvents(context.Background(), orm.AuditFilter{Action: action, Target: target, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 {
+		t.Fatalf("no %s event for %q", action, target)
+	}
+	return events[0]
+}
+
+// redirectPath returns the path and query a redirect points to
+func redirectPath(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	if resp.StatusCode != fiber.StatusFound && resp.StatusCode != fiber.StatusSeeOther {
+		t.Fatalf("got status %d, want a redirect", resp.StatusCode)
+	}
+	loc := resp.Header.Get(fiber.HeaderLocation)
+	if i := strings.Index(loc, "://"); i >= 0 {
+		loc = loc[i+3:]
+		loc = loc[strings.IndexByte(loc, '/'):]
+	}
+	return loc
+}
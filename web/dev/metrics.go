@@ -0,0 +1,181 @@
+package dev
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/auth"
+	"github.com/isymbo/sachi/config"
+	"github.com/isymbo/sachi/core"
+	"github.com/isymbo/sachi/metrics"
+	"github.com/isymbo/sachi/orm"
+)
+
+// metricsPath is where Prometheus scrapes, on the main listener or on --metrics-addr
+const metricsPath = "/metrics"
+
+var (
+	httpRequests = metrics.NewCounter("sachi_http_requests_total",
+		"HTTP requests by method, route and status code.", "method", "route", "status")
+	httpDuration = metrics.NewHistogram("sachi_http_request_duration_seconds",
+		"HTTP request latency by method and route.", metrics.DefBuckets, "method", "route")
+	httpInFlight = metrics.NewGauge("sachi_http_requests_in_flight",
+		"HTTP requests currently being served.")
+
+	signups = metrics.NewCounter("sachi_signups_total",
+		"Accounts created, by method (password, sso or scim).", "method")
+	logins = metrics.NewCounter("sachi_logins_total",
+		"Sign-in attempts by method (password, magic_link, oidc or saml) and result (success or failure).", "method", "result")
+)
+
+func init() {
+	// database/sql pool statistics
+	dbStats := func(f func(s sql.DBStats) float64) func() float64 {
+		return func() float64 {
+			if orm.DB == nil {
+				return 0
+			}
+			return f(orm.DB.Stats())
+		}
+	}
+	metrics.NewGaugeFunc("sachi_db_max_open_connections", "Maximum number of open database connections, 0 for unlimited.",
+		dbStats(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	metrics.NewGaugeFunc("sachi_db_open_connections", "Established database connections, in use or idle.",
+		dbStats(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	metrics.NewGaugeFunc("sachi_db_connections_in_use", "Database connections currently in use.",
+		dbStats(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	metrics.NewGaugeFunc("sachi_db_connections_idle", "Idle database connections.",
+		dbStats(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	metrics.NewCounterFunc("sachi_db_wait_count_total", "Times a query waited for a free database connection.",
+		dbStats(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	metrics.NewCounterFunc("sachi_db_wait_duration_seconds_total", "Time spent waiting for a free database connection.",
+		dbStats(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	metrics.NewCounterFunc("sachi_db_max_idle_closed_total", "Connections closed because the idle pool was full.",
+		dbStats(func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }))
+	metrics.NewCounterFunc("sachi_db_max_lifetime_closed_total", "Connections closed because they reached their maximum lifetime.",
+		dbStats(func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }))
+
+	// Business gauges are counted in the database on each scrape
+	metrics.NewGaugeFunc("sachi_sessions_active", "Unexpired browser sessions.", countMetric(orm.CountActiveSessions))
+	metrics.NewGaugeFunc("sachi_users", "User accounts, including disabled ones.", countMetric(orm.CountUsers))
+}
+
+// countMetric adapts an orm count to a gauge; a failed query reports NaN rather than a wrong number
+func countMetric(count func(ctx context.Context) (int, error)) func() float64 {
+	return func() float64 {
+		if orm.DB == nil {
+			return 0
+		}
+		n, err := count(context.Background())
+		if err != nil {
+			log.Printf("metrics: %v", err)
+			return math.NaN()
+		}
+		return float64(n)
+	}
+}
+
+// countLogin records a sign-in attempt for sachi_logins_total
+func countLogin(method string, ok bool) {
+	result := "failure"
+	if ok {
+		result = "success"
+	}
+	logins.Inc(method, result)
+}
+
+// newMetricsMiddleware counts and times every request. It runs first so the recorded status
+// is the one the client gets: errors from the rest of the chain go through the app's error
+// handler here, as Fiber's logger middleware does.
+func newMetricsMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		httpInFlight.Inc()
+		defer httpInFlight.Dec()
+
+		if err := c.Next(); err != nil {
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		method, route := c.Method(), metricsRoute(c)
+		httpRequests.Inc(method, route, strconv.Itoa(c.Response().StatusCode()))
+		httpDuration.Observe(time.Since(start).Seconds(), method, route)
+		return nil
+	}
+}
+
+// metricsRoute labels a request by the pattern of the route that answered it, keeping the
+// number of series bounded. Requests answered by middleware (static files, page fallback,
+// CSRF rejections) are labelled by the middleware's prefix, e.g. "/api/*" or "/*".
+func metricsRoute(c *fiber.Ctx) string {
+	r := c.Route()
+	// The index page and the root middleware share the path "/"
+	if handlerRoutes(c.App())[r.Method+" "+r.Path] && (r.Path != "/" || c.Path() == "/") {
+		return r.Path
+	}
+	if r.Path == "/" {
+		return "/*"
+	}
+	return r.Path + "/*"
+}
+
+var (
+	handlerRoutesOnce sync.Once
+	handlerRoutesSet  map[string]bool
+)
+
+// handlerRoutes returns "METHOD /path" for every route not registered with app.Use. Fiber
+// gives middleware routes the request's method, so they can only be told apart this way.
+func handlerRoutes(app *fiber.App) map[string]bool {
+	handlerRoutesOnce.Do(func() {
+		handlerRoutesSet = map[string]bool{}
+		for _, r := range app.GetRoutes(true) {
+			handlerRoutesSet[r.Method+" "+r.Path] = true
+		}
+	})
+	return handlerRoutesSet
+}
+
+// newMetricsHandler serves the registry, requiring the bearer token when one is configured
+func newMetricsHandler(token string) fiber.Handler {
+	tokenHash := auth.HashToken(token)
+	return func(c *fiber.Ctx) error {
+		if token != "" && !auth.TokenHashEqual(bearerToken(c), tokenHash) {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="metrics"`)
+			return newAPIError(fiber.StatusUnauthorized, codeUnauthenticated, "Metrics token required")
+		}
+		c.Set(fiber.HeaderContentType, metrics.ContentType)
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		return metrics.Write(c)
+	}
+}
+
+// runMetricsListener serves only /metrics on its own address, so it can be bound to a
+// private interface that Prometheus reaches and the public does not
+func runMetricsListener(args *config.CmdArgs) {
+	app := fiber.New(fiber.Config{
+		AppName:               "Sachi metrics",
+		DisableStartupMessage: true,
+		ErrorHandler:          errorHandler,
+	})
+	app.Get(metricsPath, newMetricsHandler(args.MetricsToken))
+
+	core.AddExitCallback(func() {
+		if err := app.Shutdown(); err != nil {
+			log.Printf("Error shutting down metrics server: %v", err)
+		}
+	})
+
+	log.Printf("Metrics listening at http://%s%s", args.MetricsAddr, metricsPath)
+	if err := app.Listen(args.MetricsAddr); err != nil {
+		log.Printf("metrics server error: %v", err)
+	}
+}
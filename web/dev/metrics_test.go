@@ -0,0 +1,143 @@
+package dev
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/metrics"
+)
+
+// metricValue returns the current value of one series, e.g.
+// sachi_logins_total{method="password",result="success"}, or 0 before it is first recorded
+func metricValue(t *testing.T, series string) float64 {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := metrics.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), series+" "); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return f
+		}
+	}
+	return 0
+}
+
+// metricDelta runs f and returns how much each series grew
+func metricDelta(t *testing.T, f func(), series ...string) []float64 {
+	t.Helper()
+	before := make([]float64, len(series))
+	for i, s := range series {
+		before[i] = metricValue(t, s)
+	}
+	f()
+	for i, s := range series {
+		before[i] = metricValue(t, s) - before[i]
+	}
+	return before
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	admin := signInAdmin(t, "Mia", "mia@metrics.example", "192.0.2.140")
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		series string
+	}{
+		{"route pattern, not the path", "GET", "/api/admin/orgs/no-such-org/oidc",
+			`sachi_http_requests_total{method="GET",route="/api/admin/orgs/:slug/oidc",status="404"}`},
+		{"error from middleware", "POST", "/api/logout",
+			`sachi_http_requests_total{method="POST",route="/api/*",status="403"}`},
+		{"index page", "GET", "/",
+			`sachi_http_requests_total{method="GET",route="/",status="302"}`}, // signed in, so sent to the profile
+		{"page fallback", "GET", "/no-such-page",
+			`sachi_http_requests_total{method="GET",route="/*",status="404"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			histogram := `sachi_http_request_duration_seconds_count{method="` + tt.method + `",route="` +
+				strings.Split(strings.Split(tt.series, `route="`)[1], `"`)[0] + `"}`
+			delta := metricDelta(t, func() {
+				req := httptest.NewRequest(tt.method, tt.path, nil)
+				if tt.method == "GET" {
+					admin.do(t, req)
+				} else {
+					testRequest(t, req) // no CSRF token
+				}
+			}, tt.series, histogram)
+			if delta[0] != 1 || delta[1] != 1 {
+				t.Errorf("%s grew by %v, its histogram by %v", tt.series, delta[0], delta[1])
+			}
+		})
+	}
+	if v := metricValue(t, "sachi_http_requests_in_flight"); v != 0 {
+		t.Errorf("%v requests in flight after all returned", v)
+	}
+}
+
+func TestLoginMetrics(t *testing.T) {
+	user := createTestUser(t, "Lou", "lou@metrics.example", "a long enough passphrase")
+	const (
+		success = `sachi_logins_total{method="password",result="success"}`
+		failure = `sachi_logins_total{method="password",result="failure"}`
+	)
+	delta := metricDelta(t, func() {
+		newTestBrowser("192.0.2.141").postJSON(t, "/api/login", map[string]string{"email": user.Email, "password": "wrong"})
+		newTestBrowser("192.0.2.142").postJSON(t, "/api/login", map[string]string{"email": "nobody@metrics.example", "password": "wrong"})
+		newTestBrowser("192.0.2.143").postJSON(t, "/api/login", map[string]string{"email": user.Email, "password": "a long enough passphrase"})
+	}, success, failure)
+	if delta[0] != 1 || delta[1] != 2 {
+		t.Errorf("logins: %v successes and %v failures, want 1 and 2", delta[0], delta[1])
+	}
+	if metricValue(t, "sachi_users") < 1 || metricValue(t, "sachi_sessions_active") < 1 {
+		t.Error("database gauges are not reported")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	tests := []struct {
+		token         string
+		authorization string
+		status        int
+	}{
+		{"", "", http.StatusOK},
+		{"scrape-token", "", http.StatusUnauthorized},
+		{"scrape-token", "Bearer other-token", http.StatusUnauthorized},
+		{"scrape-token", "Basic c2NyYXBlLXRva2Vu", http.StatusUnauthorized},
+		{"scrape-token", "Bearer scrape-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		app := fiber.New(fiber.Config{ErrorHandler: errorHandler})
+		app.Get(metricsPath, newMetricsHandler(tt.token))
+		req := httptest.NewRequest("GET", metricsPath, nil)
+		if tt.authorization != "" {
+			req.Header.Set(fiber.HeaderAuthorization, tt.authorization)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("token %q, Authorization %q: got status %d, want %d", tt.token, tt.authorization, resp.StatusCode, tt.status)
+			continue
+		}
+		if tt.status == http.StatusOK && resp.Header.Get(fiber.HeaderContentType) != metrics.ContentType {
+			t.Errorf("Content-Type = %q", resp.Header.Get(fiber.HeaderContentType))
+		}
+		if tt.status == http.StatusUnauthorized && resp.Header.Get(fiber.HeaderWWWAuthenticate) == "" {
+			t.Error("401 without WWW-Authenticate")
+		}
+	}
+}
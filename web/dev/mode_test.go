@@ -0,0 +1,45 @@
+package dev
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/config"
+)
+
+func TestServerModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     config.CmdArgs
+		wantCORS string // Access-Control-Allow-Origin for a cross-origin request
+	}{
+		{"development", config.CmdArgs{BodyLimit: 4 << 20, CORSOrigins: "*", CORSMethods: "GET"}, "*"},
+		{"production", config.CmdArgs{Production: true, BodyLimit: 64,
+			ReadTimeout: 15 * time.Second, WriteTimeout: 30 * time.Second, IdleTimeout: 2 * time.Minute}, ""},
+		{"production with listed origins", config.CmdArgs{Production: true, BodyLimit: 64,
+			CORSOrigins: "https://a.example", CORSMethods: "GET"}, "https://a.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			app := newApp(&args, nil)
+			cfg := app.Config()
+			if cfg.BodyLimit != args.BodyLimit || cfg.ReadTimeout != args.ReadTimeout ||
+				cfg.WriteTimeout != args.WriteTimeout || cfg.IdleTimeout != args.IdleTimeout {
+				t.Errorf("got body limit %d and timeouts %v/%v/%v", cfg.BodyLimit, cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout)
+			}
+
+			req := httptest.NewRequest("GET", "/api/info", nil)
+			req.Header.Set(fiber.HeaderOrigin, "https://a.example")
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Header.Get(fiber.HeaderAccessControlAllowOrigin); got != tt.wantCORS {
+				t.Errorf("got Access-Control-Allow-Origin %q, want %q", got, tt.wantCORS)
+			}
+		})
+	}
+}
@@ -0,0 +1,685 @@
+package dev
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/isymbo/sachi/auth"
+	"github.com/isymbo/sachi/orm"
+)
+
+const (
+	oauthCodeTTL    = 5 * time.Minute
+	oauthAccessTTL  = time.Hour
+	oauthRefreshTTL = 30 * 24 * time.Hour
+
+	// oauthTokenKey holds the *orm.OAuthToken when a request is authenticated by a third-party access token
+	oauthTokenKey = "oauth_token"
+)
+
+// Scopes third-party clients may request
+const (
+	scopeProfile      = "profile"
+	scopeProfileWrite = "profile:write"
+)
+
+// oauthScopes lists the supported scopes with the text shown on the consent screen
+var oauthScopes = []struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}{
+	{scopeProfile, "View your name, email address and company"},
+	{scopeProfileWrite, "Update your name and company"},
+}
+
+const (
+	auditOAuthAuthorize         = "oauth.authorize"
+	auditOAuthConsentGranted    = "oauth.consent_granted"
+	auditOAuthConsentDenied     = "oauth.consent_denied"
+	auditOAuthTokenRevoked      = "oauth.token_revoked"
+	auditOAuthRefreshReuse      = "security.oauth_refresh_reuse"
+	auditAdminOAuthClientList   = "admin.oauth_client_list"
+	auditAdminOAuthClientCreate = "admin.oauth_client_create"
+	auditAdminOAuthClientDelete = "admin.oauth_client_delete"
+)
+
+func knownScope(name string) bool {
+	for _, s := range oauthScopes {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// setupOAuthRoutes sets up the OAuth2 authorization server endpoints
+func setupOAuthRoutes(oauth fiber.Router) {
+	oauth.Get("/authorize", handleOAuthAuthorize)
+	oauth.Post("/token", handleOAuthToken)
+	oauth.Post("/introspect", handleOAuthIntrospect)
+	oauth.Post("/revoke", handleOAuthRevoke)
+}
+
+// oauthUser resolves a Bearer token issued by the authorization server
+func oauthUser(ctx context.Context, bearer string) (*orm.User, *orm.OAuthToken, bool) {
+	user, tok, err := orm.ValidateOAuthAccessToken(ctx, auth.HashToken(bearer))
+	if err != nil {
+		return nil, nil, false
+	}
+	return user, tok, true
+}
+
+// requireScope lets first-party sessions through and requires third-party access
+// tokens to carry the given scope
+func requireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tok, ok := c.Locals(oauthTokenKey).(*orm.OAuthToken)
+		if ok && !auth.ScopeSubset(scope, tok.Scope) {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			return newAPIError(403, codeForbidden, "Insufficient scope")
+		}
+		return c.Next()
+	}
+}
+
+// requireFirstParty rejects third-party access tokens on routes only the user may call
+func requireFirstParty(c *fiber.Ctx) error {
+	if _, ok := c.Locals(oauthTokenKey).(*orm.OAuthToken); ok {
+		return newAPIError(403, codeForbidden, "Not available to third-party applications")
+	}
+	return c.Next()
+}
+
+// oauthError is an RFC 6749 error; redirect tells whether it may be sent back to the
+// client's redirect_uri (only once the client and redirect_uri are known to be valid)
+type oauthError struct {
+	Code        string
+	Description string
+	redirect    bool
+}
+
+// authorizeRequest is a validated authorization request
+type authorizeRequest struct {
+	Client        *orm.OAuthClient
+	RedirectURI   string
+	Scope         string
+	State         string
+	CodeChallenge string
+}
+
+// parseAuthorizeRequest validates authorization request parameters, shared by the
+// authorize endpoint and the consent API
+func parseAuthorizeRequest(ctx context.Context, get func(string) string) (*authorizeRequest, *oauthError) {
+	client, err := orm.GetOAuthClient(ctx, get("client_id"))
+	if err != nil {
+		return nil, &oauthError{Code: "invalid_client", Description: "Unknown client_id"}
+	}
+
+	redirectURI := get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	registered := false
+	for _, u := range client.RedirectURIs {
+		if u == redirectURI {
+			registered = true
+			break
+		}
+	}
+	if !registered {
+		return nil, &oauthError{Code: "invalid_request", Description: "redirect_uri is not registered for this client"}
+	}
+
+	req := &authorizeRequest{Client: client, RedirectURI: redirectURI, State: get("state")}
+	if get("response_type") != "code" {
+		return req, &oauthError{"unsupported_response_type", "Only response_type=code is supported", true}
+	}
+	if get("code_challenge") == "" || get("code_challenge_method") != "S256" {
+		return req, &oauthError{"invalid_request", "PKCE with code_challenge_method=S256 is required", true}
+	}
+	req.CodeChallenge = get("code_challenge")
+
+	scope := get("scope")
+	if scope == "" {
+		scope = client.Scopes
+	}
+	scopes := auth.ParseScope(scope)
+	for _, s := range scopes {
+		if !knownScope(s) || !auth.ScopeSubset(s, client.Scopes) {
+			return req, &oauthError{"invalid_scope", "Scope " + s + " is not available to this client", true}
+		}
+	}
+	if len(scopes) == 0 {
+		return req, &oauthError{"invalid_scope", "No scope requested", true}
+	}
+	req.Scope = strings.Join(scopes, " ")
+	return req, nil
+}
+
+// redirectURL appends response parameters to the client's redirect_uri
+func (r *authorizeRequest) redirectURL(params url.Values) string {
+	if r.State != "" {
+		params.Set("state", r.State)
+	}
+	sep := "?"
+	if strings.Contains(r.RedirectURI, "?") {
+		sep = "&"
+	}
+	return r.RedirectURI + sep + params.Encode()
+}
+
+func (r *authorizeRequest) errorURL(e *oauthError) string {
+	return r.redirectURL(url.Values{"error": {e.Code}, "error_description": {e.Description}})
+}
+
+// issueAuthorizationCode stores a single-use code for the request and returns the redirect to the client
+func issueAuthorizationCode(c *fiber.Ctx, user *orm.User, r *authorizeRequest) (string, error) {
+	code := auth.RandomToken(32)
+	err := orm.CreateOAuthCode(c.UserContext(), &orm.OAuthCode{
+		CodeHash:      auth.HashToken(code),
+		ClientID:      r.Client.ClientID,
+		UserID:        user.ID,
+		RedirectURI:   r.RedirectURI,
+		Scope:         r.Scope,
+		CodeChallenge: r.CodeChallenge,
+		ExpiresAt:     time.Now().Add(oauthCodeTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	recordAudit(c, user, auditOAuthAuthorize, r.Client.ClientID, fiber.Map{"scope": r.Scope})
+	return r.redirectURL(url.Values{"code": {code}}), nil
+}
+
+// handleOAuthAuthorize is the authorization endpoint. Signed-in users who already approved
+// the requested scopes are sent straight back with a code; others go through login and consent.
+func handleOAuthAuthorize(c *fiber.Ctx) error {
+	r, oe := parseAuthorizeRequest(c.UserContext(), func(k string) string { return c.Query(k) })
+	if oe != nil {
+		if !oe.redirect {
+			return newAPIError(400, codeInvalidRequest, oe.Description)
+		}
+		return c.Redirect(r.errorURL(oe))
+	}
+
+	query := string(c.Request().URI().QueryString())
+
+	// Only the browser session counts here; Bearer tokens cannot grant consent
+	user, err := orm.ValidateSession(c.UserContext(), c.Cookies("session_token"))
+	if err != nil {
+		next := appPath("/oauth/authorize?" + query)
+		return redirectTo(c, "/login.html?next="+url.QueryEscape(next))
+	}
+
+	if c.Query("prompt") != "consent" {
+		granted, err := orm.GetOAuthConsent(c.UserContext(), user.ID, r.Client.ClientID)
+		if err == nil && granted != "" && auth.ScopeSubset(r.Scope, granted) {
+			target, err := issueAuthorizationCode(c, user, r)
+			if err != nil {
+				logf(c, "Error issuing authorization code: %v", err)
+				return c.Redirect(r.errorURL(&oauthError{Code: "server_error", Description: "Failed to issue authorization code"}))
+			}
+			return c.Redirect(target)
+		}
+	}
+
+	c.Set("Cache-Control", "no-store")
+	return redirectTo(c, "/consent.html?"+query)
+}
+
+// handleOAuthConsentInfo describes a pending authorization request for the consent screen
+func handleOAuthConsentInfo(c *fiber.Ctx) error {
+	user := c.Locals("user").(*orm.User)
+	r, oe := parseAuthorizeRequest(c.UserContext(), func(k string) string { return c.Query(k) })
+	if oe != nil {
+		return newAPIError(400, codeInvalidRequest, oe.Description)
+	}
+
+	scopes := make([]fiber.Map, 0)
+	for _, s := range oauthScopes {
+		if auth.ScopeSubset(s.Name, r.Scope) {
+			scopes = append(scopes, fiber.Map{"name": s.Name, "description": s.Description})
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"client": fiber.Map{
+			"client_id": r.Client.ClientID,
+			"name":      r.Client.Name,
+		},
+		"redirect_host": hostOf(r.RedirectURI),
+		"scopes":        scopes,
+		"user": fiber.Map{
+			"name":  user.Name,
+			"email": user.Email,
+		},
+	})
+}
+
+// handleOAuthConsent records the user's decision and returns where to send the browser
+func handleOAuthConsent(c *fiber.Ctx) error {
+	user := c.Locals("user").(*orm.User)
+
+	type ConsentRequest struct {
+		ClientID            string `json:"client_id"`
+		RedirectURI         string `json:"redirect_uri"`
+		ResponseType        string `json:"response_type"`
+		Scope               string `json:"scope"`
+		State               string `json:"state"`
+		CodeChallenge       string `json:"code_challenge"`
+		CodeChallengeMethod string `json:"code_challenge_method"`
+		Approve             bool   `json:"approve"`
+	}
+	req := new(ConsentRequest)
+	if err := c.BodyParser(req); err != nil {
+		return errInvalidBody()
+	}
+	params := map[string]string{
+		"client_id":             req.ClientID,
+		"redirect_uri":          req.RedirectURI,
+		"response_type":         req.ResponseType,
+		"scope":                 req.Scope,
+		"state":                 req.State,
+		"code_challenge":        req.CodeChallenge,
+		"code_challenge_method": req.CodeChallengeMethod,
+	}
+	r, oe := parseAuthorizeRequest(c.UserContext(), func(k string) string { return params[k] })
+	if oe != nil {
+		return newAPIError(400, codeInvalidRequest, oe.Description)
+	}
+
+	if !req.Approve {
+		recordAudit(c, user, auditOAuthConsentDenied, r.Client.ClientID, fiber.Map{"scope": r.Scope})
+		return c.JSON(fiber.Map{
+			"success":      true,
+			"redirect_url": r.errorURL(&oauthError{Code: "access_denied", Description: "The user denied the request"}),
+		})
+	}
+
+	// Remember the union of everything approved so far for this client
+	granted, err := orm.GetOAuthConsent(c.UserContext(), user.ID, r.Client.ClientID)
+	if err == nil {
+		err = orm.SaveOAuthConsent(c.UserContext(), user.ID, r.Client.ClientID, strings.Join(auth.ParseScope(granted+" "+r.Scope), " "))
+	}
+	if err != nil {
+		logf(c, "Error saving OAuth consent: %v", err)
+		return newAPIError(500, codeInternal, "Failed to save consent")
+	}
+	recordAudit(c, user, auditOAuthConsentGranted, r.Client.ClientID, fiber.Map{"scope": r.Scope})
+
+	target, err := issueAuthorizationCode(c, user, r)
+	if err != nil {
+		logf(c, "Error issuing authorization code: %v", err)
+		return newAPIError(500, codeInternal, "Failed to issue authorization code")
+	}
+	return c.JSON(fiber.Map{
+		"success":      true,
+		"redirect_url": target,
+	})
+}
+
+func hostOf(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// oauthErrorResponse writes an RFC 6749 section 5.2 error. OAuth clients expect this
+// shape rather than the APIError envelope used by the rest of the API.
+func oauthErrorResponse(c *fiber.Ctx, status int, code, description string) error {
+	if status == fiber.StatusUnauthorized {
+		c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="sachi"`)
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// authenticateOAuthClient authenticates the client with client_secret_basic,
+// client_secret_post, or client_id alone for public clients
+func authenticateOAuthClient(c *fiber.Ctx) (*orm.OAuthClient, bool) {
+	clientID, secret := c.FormValue("client_id"), c.FormValue("client_secret")
+	if h := c.Get(fiber.HeaderAuthorization); len(h) > 6 && strings.EqualFold(h[:6], "basic ") {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(h[6:]))
+		if err != nil {
+			return nil, false
+		}
+		id, sec, ok := strings.Cut(string(raw), ":")
+		if !ok {
+			return nil, false
+		}
+		// RFC 6749 2.3.1: credentials are form-urlencoded before being joined
+		if clientID, err = url.QueryUnescape(id); err != nil {
+			return nil, false
+		}
+		if secret, err = url.QueryUnescape(sec); err != nil {
+			return nil, false
+		}
+	}
+
+	client, err := orm.GetOAuthClient(c.UserContext(), clientID)
+	if err != nil {
+		return nil, false
+	}
+	if client.Public() {
+		return client, secret == ""
+	}
+	return client, secret != "" && auth.TokenHashEqual(secret, client.SecretHash)
+}
+
+// handleOAuthToken is the token endpoint for the authorization_code and refresh_token grants
+func handleOAuthToken(c *fiber.Ctx) error {
+	c.Set("Cache-Control", "no-store")
+	c.Set("Pragma", "no-cache")
+
+	client, ok := authenticateOAuthClient(c)
+	if !ok {
+		return oauthErrorResponse(c, 401, "invalid_client", "Client authentication failed")
+	}
+
+	switch c.FormValue("grant_type") {
+	case "authorization_code":
+		return handleAuthorizationCodeGrant(c, client)
+	case "refresh_token":
+		return handleRefreshTokenGrant(c, client)
+	}
+	return oauthErrorResponse(c, 400, "unsupported_grant_type", "Supported grant types are authorization_code and refresh_token")
+}
+
+func handleAuthorizationCodeGrant(c *fiber.Ctx, client *orm.OAuthClient) error {
+	code, err := orm.ConsumeOAuthCode(c.UserContext(), auth.HashToken(c.FormValue("code")))
+	if err != nil {
+		return oauthErrorResponse(c, 400, "invalid_grant", "Authorization code is invalid or expired")
+	}
+	if code.ClientID != client.ClientID {
+		return oauthErrorResponse(c, 400, "invalid_grant", "Authorization code was issued to another client")
+	}
+	if c.FormValue("redirect_uri") != code.RedirectURI {
+		return oauthErrorResponse(c, 400, "invalid_grant", "redirect_uri does not match the authorization request")
+	}
+	if !auth.CheckPKCE(c.FormValue("code_verifier"), code.CodeChallenge) {
+		return oauthErrorResponse(c, 400, "invalid_grant", "PKCE verification failed")
+	}
+	return issueOAuthTokens(c, client, code.UserID, code.Scope, uuid.New().String())
+}
+
+// handleRefreshTokenGrant rotates refresh tokens. Presenting a token that was already
+// rotated means it leaked, so the whole token family is revoked.
+func handleRefreshTokenGrant(c *fiber.Ctx, client *orm.OAuthClient) error {
+	old, err := orm.GetOAuthToken(c.UserContext(), auth.HashToken(c.FormValue("refresh_token")))
+	if err != nil || old.Kind != orm.OAuthRefreshToken || old.ClientID != client.ClientID {
+		return oauthErrorResponse(c, 400, "invalid_grant", "Refresh token is invalid")
+	}
+	if !old.Revoked && !old.Active() {
+		return oauthErrorResponse(c, 400, "invalid_grant", "Refresh token has expired")
+	}
+
+	rotated := false
+	if !old.Revoked {
+		if rotated, err = orm.RevokeOAuthToken(c.UserContext(), old.TokenHash); err != nil {
+			logf(c, "Error rotating refresh token: %v", err)
+			return oauthErrorResponse(c, 500, "server_error", "Failed to rotate refresh token")
+		}
+	}
+	if !rotated {
+		if err := orm.RevokeOAuthTokenFamily(c.UserContext(), old.FamilyID); err != nil {
+			logf(c, "Error revoking token family: %v", err)
+		}
+		user, _ := orm.GetUserByID(c.UserContext(), old.UserID)
+		recordAudit(c, user, auditOAuthRefreshReuse, client.ClientID, fiber.Map{"family": old.FamilyID})
+		return oauthErrorResponse(c, 400, "invalid_grant", "Refresh token is invalid")
+	}
+
+	scope := old.Scope
+	if s := c.FormValue("scope"); s != "" {
+		if !auth.ScopeSubset(s, old.Scope) {
+			return oauthErrorResponse(c, 400, "invalid_scope", "Requested scope exceeds the original grant")
+		}
+		scope = strings.Join(auth.ParseScope(s), " ")
+	}
+	return issueOAuthTokens(c, client, old.UserID, scope, old.FamilyID)
+}
+
+// issueOAuthTokens mints an access token and a refresh token in the given family
+func issueOAuthTokens(c *fiber.Ctx, client *orm.OAuthClient, userID int64, scope, familyID string) error {
+	user, err := orm.GetUserByID(c.UserContext(), userID)
+	if err != nil {
+		return oauthErrorResponse(c, 400, "invalid_grant", "The resource owner no longer exists")
+	}
+	if user.Disabled {
+		return oauthErrorResponse(c, 400, "invalid_grant", "The resource owner account is disabled")
+	}
+
+	now := time.Now()
+	access, refresh := auth.RandomToken(32), auth.RandomToken(32)
+	for _, t := range []*orm.OAuthToken{
+		{TokenHash: auth.HashToken(access), Kind: orm.OAuthAccessToken, ExpiresAt: now.Add(oauthAccessTTL)},
+		{TokenHash: auth.HashToken(refresh), Kind: orm.OAuthRefreshToken, ExpiresAt: now.Add(oauthRefreshTTL)},
+	} {
+		t.FamilyID, t.ClientID, t.UserID, t.Scope = familyID, client.ClientID, userID, scope
+		if err := orm.CreateOAuthToken(c.UserContext(), t); err != nil {
+			logf(c, "Error storing OAuth token: %v", err)
+			return oauthErrorResponse(c, 500, "server_error", "Failed to issue tokens")
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    int(oauthAccessTTL.Seconds()),
+		"refresh_token": refresh,
+		"scope":         scope,
+	})
+}
+
+// handleOAuthIntrospect implements RFC 7662 for confidential clients; a client can only
+// introspect tokens issued to itself
+func handleOAuthIntrospect(c *fiber.Ctx) error {
+	c.Set("Cache-Control", "no-store")
+	client, ok := authenticateOAuthClient(c)
+	if !ok || client.Public() {
+		return oauthErrorResponse(c, 401, "invalid_client", "Client authentication failed")
+	}
+
+	tok, err := orm.GetOAuthToken(c.UserContext(), auth.HashToken(c.FormValue("token")))
+	if err != nil || !tok.Active() || tok.ClientID != client.ClientID {
+		return c.JSON(fiber.Map{"active": false})
+	}
+	user, err := orm.GetUserByID(c.UserContext(), tok.UserID)
+	if err != nil || user.Disabled {
+		return c.JSON(fiber.Map{"active": false})
+	}
+
+	return c.JSON(fiber.Map{
+		"active":     true,
+		"scope":      tok.Scope,
+		"client_id":  tok.ClientID,
+		"username":   user.Email,
+		"sub":        strconv.FormatInt(user.ID, 10),
+		"token_type": tok.Kind + "_token",
+		"exp":        tok.ExpiresAt.Unix(),
+		"iat":        tok.CreatedAt.Unix(),
+	})
+}
+
+// handleOAuthRevoke implements RFC 7009. Revoking a refresh token also revokes the access
+// tokens issued from the same grant. Unknown tokens still get 200 as the RFC requires.
+func handleOAuthRevoke(c *fiber.Ctx) error {
+	client, ok := authenticateOAuthClient(c)
+	if !ok {
+		return oauthErrorResponse(c, 401, "invalid_client", "Client authentication failed")
+	}
+
+	tok, err := orm.GetOAuthToken(c.UserContext(), auth.HashToken(c.FormValue("token")))
+	if err != nil || tok.ClientID != client.ClientID || tok.Revoked {
+		return c.SendStatus(200)
+	}
+	if tok.Kind == orm.OAuthRefreshToken {
+		err = orm.RevokeOAuthTokenFamily(c.UserContext(), tok.FamilyID)
+	} else {
+		_, err = orm.RevokeOAuthToken(c.UserContext(), tok.TokenHash)
+	}
+	if err != nil {
+		logf(c, "Error revoking OAuth token: %v", err)
+		return oauthErrorResponse(c, 503, "temporarily_unavailable", "Failed to revoke token")
+	}
+
+	user, _ := orm.GetUserByID(c.UserContext(), tok.UserID)
+	recordAudit(c, user, auditOAuthTokenRevoked, client.ClientID, fiber.Map{"kind": tok.Kind})
+	return c.SendStatus(200)
+}
+
+// handleOAuthMetadata publishes RFC 8414 authorization server metadata
+func handleOAuthMetadata(c *fiber.Ctx) error {
+	scopes := make([]string, 0, len(oauthScopes))
+	for _, s := range oauthScopes {
+		scopes = append(scopes, s.Name)
+	}
+	return c.JSON(fiber.Map{
+		"issuer":                                externalURL(c, ""),
+		"authorization_endpoint":                externalURL(c, "/oauth/authorize"),
+		"token_endpoint":                        externalURL(c, "/oauth/token"),
+		"introspection_endpoint":                externalURL(c, "/oauth/introspect"),
+		"revocation_endpoint":                   externalURL(c, "/oauth/revoke"),
+		"scopes_supported":                      scopes,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+	})
+}
+
+// handleOAuthClientList lists registered clients
+func handleOAuthClientList(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+	clients, err := orm.ListOAuthClients(c.UserContext())
+	if err != nil {
+		logf(c, "Error listing OAuth clients: %v", err)
+		return newAPIError(500, codeInternal, "Failed to load OAuth clients")
+	}
+
+	list := make([]fiber.Map, 0, len(clients))
+	for _, cl := range clients {
+		list = append(list, fiber.Map{
+			"client_id":     cl.ClientID,
+			"name":          cl.Name,
+			"redirect_uris": cl.RedirectURIs,
+			"scopes":        cl.Scopes,
+			"public":        cl.Public(),
+			"created_at":    cl.CreatedAt,
+		})
+	}
+	recordAudit(c, admin, auditAdminOAuthClientList, "", nil)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"clients": list,
+	})
+}
+
+// handleOAuthClientCreate registers a client. The secret is only returned here.
+func handleOAuthClientCreate(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+
+	type CreateClientRequest struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       string   `json:"scopes"`
+		Public       bool     `json:"public"`
+	}
+	req := new(CreateClientRequest)
+	if err := c.BodyParser(req); err != nil {
+		return errInvalidBody()
+	}
+	if strings.TrimSpace(req.Name) == "" || len(req.RedirectURIs) == 0 {
+		e := newAPIError(400, codeValidationFailed, "Name and at least one redirect URI are required")
+		if strings.TrimSpace(req.Name) == "" {
+			e.withField("name", fieldRequired, "This field is required")
+		}
+		if len(req.RedirectURIs) == 0 {
+			e.withField("redirect_uris", fieldRequired, "Add at least one redirect URI")
+		}
+		return e
+	}
+	for _, u := range req.RedirectURIs {
+		if !auth.ValidRedirectURI(u) {
+			return newAPIError(400, codeValidationFailed, "Redirect URIs must be absolute https URLs (http is allowed for localhost) without fragments: "+u).
+				withField("redirect_uris", fieldInvalid, "Not an absolute https URL without fragment: "+u)
+		}
+	}
+	if req.Scopes == "" {
+		req.Scopes = scopeProfile
+	}
+	scopes := auth.ParseScope(req.Scopes)
+	for _, s := range scopes {
+		if !knownScope(s) {
+			return newAPIError(400, codeValidationFailed, "Unknown scope: "+s).
+				withField("scopes", fieldInvalid, "Unknown scope: "+s)
+		}
+	}
+
+	client := &orm.OAuthClient{
+		ClientID:     auth.RandomToken(16),
+		Name:         strings.TrimSpace(req.Name),
+		RedirectURIs: req.RedirectURIs,
+		Scopes:       strings.Join(scopes, " "),
+		CreatedBy:    admin.ID,
+	}
+	var secret string
+	if !req.Public {
+		secret = auth.RandomToken(32)
+		client.SecretHash = auth.HashToken(secret)
+	}
+	if err := orm.CreateOAuthClient(c.UserContext(), client); err != nil {
+		logf(c, "Error creating OAuth client: %v", err)
+		return newAPIError(500, codeInternal, "Failed to create OAuth client")
+	}
+
+	recordAudit(c, admin, auditAdminOAuthClientCreate, client.ClientID, fiber.Map{
+		"name":          client.Name,
+		"redirect_uris": client.RedirectURIs,
+		"scopes":        client.Scopes,
+		"public":        req.Public,
+	})
+	resp := fiber.Map{
+		"success":   true,
+		"client_id": client.ClientID,
+		"scopes":    client.Scopes,
+	}
+	if secret != "" {
+		resp["client_secret"] = secret
+	}
+	return c.JSON(resp)
+}
+
+// handleOAuthClientDelete removes a client and invalidates everything issued to it
+func handleOAuthClientDelete(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+	clientID := c.Params("client_id")
+	if _, err := orm.GetOAuthClient(c.UserContext(), clientID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(404, codeNotFound, "OAuth client not found")
+		}
+		return err
+	}
+	if err := orm.DeleteOAuthClient(c.UserContext(), clientID); err != nil {
+		logf(c, "Error deleting OAuth client: %v", err)
+		return newAPIError(500, codeInternal, "Failed to delete OAuth client")
+	}
+	recordAudit(c, admin, auditAdminOAuthClientDelete, clientID, nil)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "OAuth client deleted",
+	})
+}
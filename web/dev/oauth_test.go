@@ -0,0 +1,299 @@
+package dev
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/auth"
+	"github.com/isymbo/sachi/orm"
+)
+
+const testRedirectURI = "https://partner.example/callback"
+
+// testOAuthClient registers a confidential client allowed every scope and returns its
+// ID and secret
+func testOAuthClient(t *testing.T) (string, string) {
+	t.Helper()
+	id, secret := auth.RandomToken(16), auth.RandomToken(32)
+	err := orm.CreateOAuthClient(context.Background(), &orm.OAuthClient{
+		ClientID:     id,
+		Name:         "Partner",
+		RedirectURIs: []string{testRedirectURI},
+		Scopes:       scopeProfile + " " + scopeProfileWrite,
+		SecretHash:   auth.HashToken(secret),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, secret
+}
+
+// authorizeOAuth approves the client for scope on the consent screen as the user signed
+// in to b, and returns the authorization code
+func authorizeOAuth(t *testing.T, b *testBrowser, clientID, scope, verifier string) string {
+	t.Helper()
+	resp := b.postJSON(t, "/api/oauth/consent", map[string]any{
+		"client_id":             clientID,
+		"redirect_uri":          testRedirectURI,
+		"response_type":         "code",
+		"scope":                 scope,
+		"state":                 "xyz",
+		"code_challenge":        auth.S256Challenge(verifier),
+		"code_challenge_method": "S256",
+		"approve":               true,
+	})
+	var out struct {
+		RedirectURL string `json:"redirect_url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("consent: got status %d: %v", resp.StatusCode, err)
+	}
+	u, err := url.Parse(out.RedirectURL)
+	if err != nil || u.Query().Get("code") == "" || u.Query().Get("state") != "xyz" {
+		t.Fatalf("consent redirects to %q", out.RedirectURL)
+	}
+	return u.Query().Get("code")
+}
+
+// oauthPost posts form parameters to an OAuth endpoint and decodes the JSON answer
+func oauthPost(t *testing.T, path string, params url.Values) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest("POST", path, strings.NewReader(params.Encode()))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	resp := testRequest(t, req)
+	out := map[string]any{}
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+// signInForOAuth creates a user and signs them in to a new browser
+func signInForOAuth(t *testing.T, name, email, ip string) (*orm.User, *testBrowser) {
+	t.Helper()
+	user := createTestUser(t, name, email, "a long enough passphrase")
+	b := newTestBrowser(ip)
+	if resp := b.postJSON(t, "/api/login", map[string]string{"email": email, "password": "a long enough passphrase"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: got status %d", resp.StatusCode)
+	}
+	return user, b
+}
+
+// exchangeCode redeems an authorization code for tokens
+func exchangeCode(t *testing.T, clientID, secret, code, verifier string) (int, map[string]any) {
+	t.Helper()
+	return oauthPost(t, "/oauth/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientID},
+		"client_secret": {secret},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	})
+}
+
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+func TestOAuthPKCE(t *testing.T) {
+	_, b := signInForOAuth(t, "Ola", "ola@oauth.example", "192.0.2.60")
+	clientID, secret := testOAuthClient(t)
+
+	// A verifier that does not match the challenge is refused, and burns the code
+	code := authorizeOAuth(t, b, clientID, scopeProfile, testVerifier)
+	status, out := exchangeCode(t, clientID, secret, code, strings.Repeat("x", 43))
+	if status != http.StatusBadRequest || out["error"] != "invalid_grant" {
+		t.Errorf("wrong verifier: got %d %v, want invalid_grant", status, out)
+	}
+	if status, out := exchangeCode(t, clientID, secret, code, testVerifier); status != http.StatusBadRequest || out["error"] != "invalid_grant" {
+		t.Errorf("code reused after a failed exchange: got %d %v", status, out)
+	}
+	code = authorizeOAuth(t, b, clientID, scopeProfile, testVerifier)
+	if status, out := exchangeCode(t, clientID, secret, code, ""); status != http.StatusBadRequest || out["error"] != "invalid_grant" {
+		t.Errorf("no verifier: got %d %v, want invalid_grant", status, out)
+	}
+
+	code = authorizeOAuth(t, b, clientID, scopeProfile, testVerifier)
+	status, out = exchangeCode(t, clientID, secret, code, testVerifier)
+	if status != http.StatusOK || out["access_token"] == nil || out["refresh_token"] == nil || out["scope"] != scopeProfile {
+		t.Fatalf("matching verifier: got %d %v", status, out)
+	}
+	if status, _ := exchangeCode(t, clientID, secret, code, testVerifier); status != http.StatusBadRequest {
+		t.Errorf("code redeemed twice: got status %d", status)
+	}
+}
+
+// refresh exchanges a refresh token
+func refresh(t *testing.T, clientID, secret, token string) (int, map[string]any) {
+	t.Helper()
+	return oauthPost(t, "/oauth/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {clientID},
+		"client_secret": {secret},
+		"refresh_token": {token},
+	})
+}
+
+// introspect reports whether the client sees token as active
+func introspect(t *testing.T, clientID, secret, token string) map[string]any {
+	t.Helper()
+	status, out := oauthPost(t, "/oauth/introspect", url.Values{
+		"client_id":     {clientID},
+		"client_secret": {secret},
+		"token":         {token},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("introspect: got status %d %v", status, out)
+	}
+	return out
+}
+
+func TestOAuthRefreshTokenReuse(t *testing.T) {
+	_, b := signInForOAuth(t, "Pia", "pia@oauth.example", "192.0.2.61")
+	clientID, secret := testOAuthClient(t)
+	_, first := exchangeCode(t, clientID, secret, authorizeOAuth(t, b, clientID, scopeProfile, testVerifier), testVerifier)
+
+	status, second := refresh(t, clientID, secret, first["refresh_token"].(string))
+	if status != http.StatusOK || second["refresh_token"] == first["refresh_token"] {
+		t.Fatalf("refresh: got %d %v", status, second)
+	}
+	if introspect(t, clientID, secret, second["access_token"].(string))["active"] != true {
+		t.Fatal("the refreshed access token is not active")
+	}
+
+	// Replaying the rotated token revokes everything issued from the grant
+	if status, out := refresh(t, clientID, secret, first["refresh_token"].(string)); status != http.StatusBadRequest || out["error"] != "invalid_grant" {
+		t.Errorf("replayed refresh token: got %d %v", status, out)
+	}
+	for _, tok := range []string{first["access_token"].(string), second["access_token"].(string), second["refresh_token"].(string)} {
+		if introspect(t, clientID, secret, tok)["active"] != false {
+			t.Errorf("token %s… is still active after the replay", tok[:8])
+		}
+	}
+	if status, _ := refresh(t, clientID, secret, second["refresh_token"].(string)); status != http.StatusBadRequest {
+		t.Errorf("the newest refresh token still works: got status %d", status)
+	}
+	lastAuditEvent(t, auditOAuthRefreshReuse, clientID)
+}
+
+func TestOAuthIntrospection(t *testing.T) {
+	user, b := signInForOAuth(t, "Quinn", "quinn@oauth.example", "192.0.2.62")
+	clientID, secret := testOAuthClient(t)
+	otherID, otherSecret := testOAuthClient(t)
+	_, tokens := exchangeCode(t, clientID, secret, authorizeOAuth(t, b, clientID, scopeProfile, testVerifier), testVerifier)
+	access := tokens["access_token"].(string)
+
+	out := introspect(t, clientID, secret, access)
+	if out["active"] != true || out["scope"] != scopeProfile || out["client_id"] != clientID ||
+		out["username"] != user.Email || out["token_type"] != "access_token" {
+		t.Errorf("active token: got %v", out)
+	}
+	if out := introspect(t, otherID, otherSecret, access); len(out) != 1 || out["active"] != false {
+		t.Errorf("another client's token: got %v", out)
+	}
+	if out := introspect(t, clientID, secret, "not-a-token"); out["active"] != false {
+		t.Errorf("unknown token: got %v", out)
+	}
+
+	// Expired
+	_, err := orm.DB.Exec("UPDATE oauth_tokens SET expires_at = ? WHERE token_hash = ?", time.Now().Add(-time.Minute), auth.HashToken(access))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := introspect(t, clientID, secret, access); len(out) != 1 || out["active"] != false {
+		t.Errorf("expired token: got %v", out)
+	}
+
+	// Revoked: revoking the refresh token revokes the access tokens of the grant
+	_, tokens = exchangeCode(t, clientID, secret, authorizeOAuth(t, b, clientID, scopeProfile, testVerifier), testVerifier)
+	if out := introspect(t, clientID, secret, tokens["access_token"].(string)); out["active"] != true {
+		t.Fatalf("new token: got %v", out)
+	}
+	status, _ := oauthPost(t, "/oauth/revoke", url.Values{"client_id": {clientID}, "client_secret": {secret}, "token": {tokens["refresh_token"].(string)}})
+	if status != http.StatusOK {
+		t.Fatalf("revoke: got status %d", status)
+	}
+	for _, tok := range []string{tokens["access_token"].(string), tokens["refresh_token"].(string)} {
+		if out := introspect(t, clientID, secret, tok); len(out) != 1 || out["active"] != false {
+			t.Errorf("revoked token: got %v", out)
+		}
+	}
+
+	// Only authenticated confidential clients may ask
+	status, out = oauthPost(t, "/oauth/introspect", url.Values{"client_id": {clientID}, "client_secret": {"wrong"}, "token": {access}})
+	if status != http.StatusUnauthorized || out["error"] != "invalid_client" {
+		t.Errorf("wrong client secret: got %d %v", status, out)
+	}
+}
+
+// putProfile sends a profile update with the given Authorization header, or from b when
+// bearer is empty
+func putProfile(t *testing.T, b *testBrowser, bearer string, body map[string]string) *http.Response {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest("PUT", "/api/profile", strings.NewReader(string(data)))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if bearer != "" {
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+bearer)
+		return testRequest(t, req)
+	}
+	req.Header.Set(csrfHeaderName, b.csrfToken(t))
+	return b.do(t, req)
+}
+
+func TestOAuthProfileWriteCannotChangeEmail(t *testing.T) {
+	user, b := signInForOAuth(t, "Rui", "rui@oauth.example", "192.0.2.63")
+	clientID, secret := testOAuthClient(t)
+	scope := scopeProfile + " " + scopeProfileWrite
+	_, tokens := exchangeCode(t, clientID, secret, authorizeOAuth(t, b, clientID, scope, testVerifier), testVerifier)
+	access := tokens["access_token"].(string)
+
+	resp := putProfile(t, nil, access, map[string]string{"name": "Rui Costa", "email": "attacker@evil.example", "company": "ACME"})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("email change with an access token: got status %d, want 403", resp.StatusCode)
+	}
+	if resp := putProfile(t, nil, access, map[string]string{"name": "Rui Costa", "email": user.Email, "company": "ACME"}); resp.StatusCode != http.StatusOK {
+		t.Errorf("name change with an access token: got status %d", resp.StatusCode)
+	}
+	got, err := orm.GetUserByID(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Email != user.Email || got.Name != "Rui Costa" || got.Company != "ACME" {
+		t.Errorf("profile is now %s <%s> at %s", got.Name, got.Email, got.Company)
+	}
+
+	// The user can still change it on the profile page
+	if resp := putProfile(t, b, "", map[string]string{"name": "Rui Costa", "email": "rui.costa@oauth.example"}); resp.StatusCode != http.StatusOK {
+		t.Errorf("email change by the user: got status %d", resp.StatusCode)
+	}
+}
+
+func TestImpersonationCannotChangeEmail(t *testing.T) {
+	ctx := context.Background()
+	admin := createTestUser(t, "Sam", "sam@oauth.example", "a long enough passphrase")
+	if err := orm.SetUserRole(ctx, admin.ID, orm.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	user := createTestUser(t, "Tia", "tia@oauth.example", "a long enough passphrase")
+	token, err := orm.CreateImpersonation(ctx, admin.ID, user.ID, "support ticket", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBrowser("192.0.2.64")
+	b.jar.SetCookies(testAppURL, []*http.Cookie{{Name: "session_token", Value: token}})
+
+	if resp := putProfile(t, b, "", map[string]string{"name": "Tia", "email": "sam.owns.this@oauth.example"}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("email change while impersonating: got status %d, want 403", resp.StatusCode)
+	}
+	if resp := putProfile(t, b, "", map[string]string{"name": "Tia Silva", "email": user.Email}); resp.StatusCode != http.StatusOK {
+		t.Errorf("name change while impersonating: got status %d", resp.StatusCode)
+	}
+	if got, _ := orm.GetUserByID(ctx, user.ID); got.Email != user.Email {
+		t.Errorf("email is now %s", got.Email)
+	}
+}
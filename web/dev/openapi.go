@@ -0,0 +1,200 @@
+package dev
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/config"
+	"github.com/isymbo/sachi/core"
+)
+
+// openAPIJSON describes every API route. It is maintained by hand next to the handlers;
+// checkOpenAPIRoutes, run at startup and by "sachi openapi check", keeps the two in step.
+//
+//go:embed openapi.json
+var openAPIJSON []byte
+
+// openAPIRequiresKey marks operations only served with some flag, such as /metrics
+const openAPIRequiresKey = "x-sachi-requires"
+
+// openAPIMethods are the operations of a path item; HEAD routes are added by Fiber for GET
+var openAPIMethods = []string{"get", "put", "post", "delete", "options", "patch", "trace"}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  map[string]any
+	openAPIErr  error
+)
+
+// loadOpenAPI parses the embedded document once
+func loadOpenAPI() (map[string]any, error) {
+	openAPIOnce.Do(func() {
+		if err := json.Unmarshal(openAPIJSON, &openAPIDoc); err != nil {
+			openAPIErr = fmt.Errorf("invalid openapi.json: %v", err)
+		}
+	})
+	return openAPIDoc, openAPIErr
+}
+
+// OpenAPISpec returns the OpenAPI document as it is embedded
+func OpenAPISpec() []byte {
+	return openAPIJSON
+}
+
+// handleOpenAPI serves the document with this server as its server and the running version
+func handleOpenAPI(c *fiber.Ctx) error {
+	doc, err := loadOpenAPI()
+	if err != nil {
+		return err
+	}
+	out := make(map[string]any, len(doc))
+	for k, v := range doc {
+		out[k] = v
+	}
+	info := map[string]any{}
+	if m, ok := doc["info"].(map[string]any); ok {
+		for k, v := range m {
+			info[k] = v
+		}
+	}
+	info["version"] = core.Version
+	out["info"] = info
+	out["servers"] = []fiber.Map{{"url": externalURL(c, "")}}
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	return c.JSON(out)
+}
+
+// documentedRoute reports whether a route belongs in the document. Pages, the home page and
+// static files do not.
+func documentedRoute(path string) bool {
+	switch path {
+	case "/healthz", "/readyz", metricsPath:
+		return true
+	}
+	for _, prefix := range []string{"/api/", "/oauth/", scimBasePath + "/", "/.well-known/"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	routeParam   = regexp.MustCompile(`:(\w+)`)
+	openAPIParam = regexp.MustCompile(`\{(\w+)\}`)
+)
+
+// openAPIPath writes a Fiber route path the OpenAPI way: /users/:id becomes /users/{id}
+func openAPIPath(route string) string {
+	return routeParam.ReplaceAllString(route, "{$1}")
+}
+
+// checkOpenAPIRoutes compares the handler routes of app with the document. It returns one
+// line per problem: a route missing from the document, an operation no route serves (unless
+// it is marked x-sachi-requires), or an operation without an operationId or with path
+// parameters that do not match its path.
+func checkOpenAPIRoutes(app *fiber.App) ([]string, error) {
+	doc, err := loadOpenAPI()
+	if err != nil {
+		return nil, err
+	}
+	paths, _ := doc["paths"].(map[string]any)
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("openapi.json has no paths")
+	}
+
+	var problems []string
+	served := map[string]bool{}
+	for _, r := range app.GetRoutes(true) {
+		if r.Method == fiber.MethodHead || !documentedRoute(r.Path) {
+			continue
+		}
+		key := r.Method + " " + openAPIPath(r.Path)
+		if served[key] {
+			continue
+		}
+		served[key] = true
+		item, _ := paths[openAPIPath(r.Path)].(map[string]any)
+		if _, ok := item[strings.ToLower(r.Method)]; !ok {
+			problems = append(problems, key+" is served but not documented")
+		}
+	}
+
+	names := make([]string, 0, len(paths))
+	for path := range paths {
+		names = append(names, path)
+	}
+	sort.Strings(names)
+	operationIDs := map[string]string{}
+	for _, path := range names {
+		item, _ := paths[path].(map[string]any)
+		for _, method := range openAPIMethods {
+			op, ok := item[method].(map[string]any)
+			if !ok {
+				continue
+			}
+			key := strings.ToUpper(method) + " " + path
+			if _, conditional := op[openAPIRequiresKey]; !served[key] && !conditional {
+				problems = append(problems, key+" is documented but not served")
+			}
+			id, _ := op["operationId"].(string)
+			switch {
+			case id == "":
+				problems = append(problems, key+" has no operationId")
+			case operationIDs[id] != "":
+				problems = append(problems, fmt.Sprintf("%s repeats the operationId %q of %s", key, id, operationIDs[id]))
+			default:
+				operationIDs[id] = key
+			}
+			if p := checkPathParams(path, item, op); p != "" {
+				problems = append(problems, key+" "+p)
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// checkPathParams compares the {names} in path with the path parameters declared on the path
+// item and the operation
+func checkPathParams(path string, item, op map[string]any) string {
+	want := map[string]bool{}
+	for _, m := range openAPIParam.FindAllStringSubmatch(path, -1) {
+		want[m[1]] = true
+	}
+	declared := map[string]bool{}
+	for _, list := range []any{item["parameters"], op["parameters"]} {
+		params, _ := list.([]any)
+		for _, p := range params {
+			if m, ok := p.(map[string]any); ok && m["in"] == "path" {
+				name, _ := m["name"].(string)
+				declared[name] = true
+			}
+		}
+	}
+	for name := range want {
+		if !declared[name] {
+			return "does not declare the path parameter " + name
+		}
+	}
+	for name := range declared {
+		if !want[name] {
+			return "declares the path parameter " + name + " its path does not have"
+		}
+	}
+	return ""
+}
+
+// CheckOpenAPI registers the routes of a server with default flags, without starting it,
+// and compares them with the document; see checkOpenAPIRoutes
+func CheckOpenAPI() ([]string, error) {
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	setupRoutes(app, &config.CmdArgs{})
+	return checkOpenAPIRoutes(app)
+}
@@ -0,0 +1,265 @@
+package dev
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/config"
+)
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	// As "sachi openapi check" sees it, with default flags
+	problems, err := CheckOpenAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("openapi.json: %s", p)
+	}
+
+	// and as the test server, with its middleware and optional features, serves it
+	problems, err = checkOpenAPIRoutes(testApp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("openapi.json: %s", p)
+	}
+}
+
+func TestCheckOpenAPIRoutesFindsDrift(t *testing.T) {
+	ok := func(c *fiber.Ctx) error { return nil }
+
+	// A route added without documenting it
+	app := fiber.New()
+	setupRoutes(app, &config.CmdArgs{})
+	app.Get("/api/undocumented/:id", ok)
+	app.Post("/api/info", ok)
+	app.Get("/about.html", ok) // pages are not part of the API
+	problems, err := checkOpenAPIRoutes(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"GET /api/undocumented/{id} is served but not documented",
+		"POST /api/info is served but not documented",
+	}
+	if !slices.Equal(problems, want) {
+		t.Errorf("got problems %q, want %q", problems, want)
+	}
+
+	// Documented operations whose routes are gone
+	app = fiber.New()
+	app.Get("/healthz", ok)
+	problems, err = checkOpenAPIRoutes(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"GET /readyz is documented but not served", "GET /api/me is documented but not served", "POST /api/login is documented but not served"} {
+		if !slices.Contains(problems, p) {
+			t.Errorf("no problem %q", p)
+		}
+	}
+	for _, p := range problems {
+		if strings.HasPrefix(p, "GET /healthz ") || strings.HasPrefix(p, "GET /metrics ") {
+			t.Errorf("unexpected problem %q", p)
+		}
+	}
+}
+
+// openAPIOperation returns the documented operation for a method and path template
+func openAPIOperation(t *testing.T, method, path string) map[string]any {
+	t.Helper()
+	doc, err := loadOpenAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, _ := doc["paths"].(map[string]any)[path].(map[string]any)
+	op, ok := item[strings.ToLower(method)].(map[string]any)
+	if !ok {
+		t.Fatalf("%s %s is not documented", method, path)
+	}
+	return op
+}
+
+// resolveRef follows a local "#/components/..." reference
+func resolveRef(t *testing.T, v map[string]any) map[string]any {
+	t.Helper()
+	ref, ok := v["$ref"].(string)
+	if !ok {
+		return v
+	}
+	doc, _ := loadOpenAPI()
+	var node any = doc
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		m, _ := node.(map[string]any)
+		node = m[part]
+	}
+	target, ok := node.(map[string]any)
+	if !ok {
+		t.Fatalf("unresolved reference %s", ref)
+	}
+	return resolveRef(t, target)
+}
+
+// checkResponse validates the JSON body of resp against what the document says the
+// operation answers with its status code
+func checkResponse(t *testing.T, method, path string, resp *http.Response) {
+	t.Helper()
+	op := openAPIOperation(t, method, path)
+	responses, _ := op["responses"].(map[string]any)
+	documented, ok := responses[strconv.Itoa(resp.StatusCode)].(map[string]any)
+	if !ok {
+		t.Fatalf("%s %s answered %d, which is not documented", method, path, resp.StatusCode)
+	}
+	documented = resolveRef(t, documented)
+	content, _ := documented["content"].(map[string]any)
+	media, _ := content["application/json"].(map[string]any)
+	schema, ok := media["schema"].(map[string]any)
+	if !ok {
+		t.Fatalf("%s %s %d has no JSON schema", method, path, resp.StatusCode)
+	}
+	if ct := resp.Header.Get(fiber.HeaderContentType); !strings.HasPrefix(ct, fiber.MIMEApplicationJSON) {
+		t.Errorf("%s %s: Content-Type %q", method, path, ct)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body any
+	if err := json.Unmarshal(data, &body); err != nil {
+		t.Fatalf("%s %s: body is not JSON: %v", method, path, err)
+	}
+	for _, p := range validateSchema(t, schema, body, "body") {
+		t.Errorf("%s %s %d: %s\n%s", method, path, resp.StatusCode, p, data)
+	}
+}
+
+// validateSchema checks value against the subset of OpenAPI 3.0 schemas the document uses.
+// Objects may only have the properties their schema lists, so undocumented fields show up.
+func validateSchema(t *testing.T, schema map[string]any, value any, at string) []string {
+	t.Helper()
+	schema = resolveRef(t, schema)
+	if value == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return []string{at + " is null"}
+	}
+	if enum, ok := schema["enum"].([]any); ok && !slices.Contains(enum, value) {
+		return []string{fmt.Sprintf("%s is %v, not one of %v", at, value, enum)}
+	}
+
+	var problems []string
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s is %T, want an object", at, value)}
+		}
+		props, _ := schema["properties"].(map[string]any)
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s.%s is missing", at, name))
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prop, ok := props[name].(map[string]any); ok {
+				problems = append(problems, validateSchema(t, prop, obj[name], at+"."+name)...)
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case map[string]any:
+				problems = append(problems, validateSchema(t, extra, obj[name], at+"."+name)...)
+			case bool:
+				if !extra {
+					problems = append(problems, at+"."+name+" is not documented")
+				}
+			default:
+				if props != nil {
+					problems = append(problems, at+"."+name+" is not documented")
+				}
+			}
+		}
+	case "array":
+		list, ok := value.([]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s is %T, want an array", at, value)}
+		}
+		items, _ := schema["items"].(map[string]any)
+		for i, v := range list {
+			problems = append(problems, validateSchema(t, items, v, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s is %T, want a string", at, value)}
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(s) {
+			problems = append(problems, fmt.Sprintf("%s %q does not match %s", at, s, pattern))
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				problems = append(problems, fmt.Sprintf("%s %q is not a date-time", at, s))
+			}
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != float64(int64(n)) {
+			problems = append(problems, fmt.Sprintf("%s is %v, want an integer", at, value))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			problems = append(problems, fmt.Sprintf("%s is %T, want a number", at, value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			problems = append(problems, fmt.Sprintf("%s is %T, want a boolean", at, value))
+		}
+	}
+	return problems
+}
+
+func TestOpenAPIResponses(t *testing.T) {
+	createTestUser(t, "Vic", "vic@openapi.example", "a long enough passphrase")
+	b := newTestBrowser("192.0.2.50")
+
+	checkResponse(t, "GET", "/api/me", b.get(t, "/api/me"))
+	checkResponse(t, "GET", "/api/csrf", b.get(t, "/api/csrf"))
+	checkResponse(t, "GET", "/api/info", b.get(t, "/api/info"))
+	checkResponse(t, "GET", "/api/password-policy", b.get(t, "/api/password-policy"))
+	checkResponse(t, "GET", "/healthz", b.get(t, "/healthz"))
+	checkResponse(t, "GET", "/api/health", b.get(t, "/api/health"))
+	checkResponse(t, "GET", "/readyz", b.get(t, "/readyz"))
+
+	// Errors use the envelope, with field errors where the request had them
+	checkResponse(t, "POST", "/api/login", b.postJSON(t, "/api/login", map[string]string{"email": "vic@openapi.example", "password": "wrong"}))
+	checkResponse(t, "POST", "/api/register", b.postJSON(t, "/api/register", map[string]string{"name": "", "email": "not an email", "password": "x"}))
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	checkResponse(t, "POST", "/api/login", testRequest(t, req))
+
+	if resp := b.postJSON(t, "/api/login", map[string]string{"email": "vic@openapi.example", "password": "a long enough passphrase"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: got status %d", resp.StatusCode)
+	} else {
+		checkResponse(t, "POST", "/api/login", resp)
+	}
+	checkResponse(t, "GET", "/api/me", b.get(t, "/api/me"))
+}
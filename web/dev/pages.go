@@ -0,0 +1,15 @@
+package dev
+
+import (
+	"io/fs"
+	"path"
+)
+
+// readAsset reads a file of the frontend by its URL path, fingerprinted or not
+func readAsset(name string) ([]byte, error) {
+	name = path.Clean("/" + name)
+	if a, ok := precomputedAssets[name]; ok {
+		return a.data, nil
+	}
+	return fs.ReadFile(assetFS, name[1:])
+}
@@ -0,0 +1,95 @@
+package dev
+
+import (
+	"context"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/auth"
+	"github.com/isymbo/sachi/config"
+	"github.com/isymbo/sachi/orm"
+	"github.com/isymbo/sachi/tracing"
+)
+
+// passwordPolicy applies to every password a user chooses; set up by Run
+var passwordPolicy = &auth.PasswordPolicy{MinLength: config.DefaultPasswordMinLength}
+
+// passwordHashing hashes new passwords and verifies stored ones; set up by Run
+var passwordHashing = &auth.PasswordHashing{Preferred: &auth.BcryptHasher{Cost: config.DefaultBcryptCost}}
+
+// checkNewPassword validates a password chosen by a new (user == nil) or existing user.
+// name and email are the values the account will have once the request succeeds.
+func checkNewPassword(ctx context.Context, user *orm.User, password, name, email string) []auth.PasswordViolation {
+	violations, err := passwordPolicy.Check(password, email, name)
+	if err != nil {
+		// Fail open: an unreadable list must not lock everybody out of choosing a password
+		log.Printf("breached password lookup error: %v%s", err, tracing.LogSuffix(ctx))
+	}
+	if user != nil && passwordPolicy.History > 0 && passwordReused(ctx, user, password) {
+		violations = append(violations, passwordPolicy.ReusedViolation())
+	}
+	return violations
+}
+
+// passwordReused compares the password with the current one and the remembered previous ones
+func passwordReused(ctx context.Context, user *orm.User, password string) bool {
+	hashes := []string{user.PasswordHash}
+	history, err := orm.PasswordHistory(ctx, user.ID, passwordPolicy.History)
+	if err != nil {
+		log.Printf("Error loading password history: %v%s", err, tracing.LogSuffix(ctx))
+	}
+	for _, h := range append(hashes, history...) {
+		if ok, _, _ := passwordHashing.Verify(h, password); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hashPassword hashes a new password with the preferred algorithm
+func hashPassword(ctx context.Context, password string) (string, error) {
+	_, span := tracing.Start(ctx, "password.hash", tracing.KindInternal)
+	defer span.End()
+	return passwordHashing.Hash(password)
+}
+
+// verifyPassword checks a user's password. Hashes made with an older algorithm or weaker
+// parameters are replaced once the password is known to be correct.
+func verifyPassword(ctx context.Context, user *orm.User, password string) bool {
+	// Hashing is deliberately slow and usually the bulk of a sign-in
+	_, span := tracing.Start(ctx, "password.verify", tracing.KindInternal)
+	ok, rehash, err := passwordHashing.Verify(user.PasswordHash, password)
+	span.SetAttributes(tracing.Bool("password.rehash", rehash))
+	span.End()
+	if err != nil {
+		log.Printf("Error verifying password of user %d: %v%s", user.ID, err, tracing.LogSuffix(ctx))
+		return false
+	}
+	if rehash {
+		upgraded, err := hashPassword(ctx, password)
+		if err == nil {
+			err = orm.RehashUserPassword(ctx, user.ID, user.PasswordHash, upgraded)
+		}
+		if err != nil {
+			log.Printf("Error upgrading password hash of user %d: %v%s", user.ID, err, tracing.LogSuffix(ctx))
+		} else {
+			user.PasswordHash = upgraded
+		}
+	}
+	return ok
+}
+
+// passwordViolationError rejects a password, listing every unmet rule as a field error of
+// field, with the rule as its code, so forms can show them next to the input
+func passwordViolationError(field string, violations []auth.PasswordViolation) error {
+	e := newAPIError(400, codeValidationFailed, "Password does not meet the requirements")
+	for _, v := range violations {
+		e.withField(field, v.Rule, v.Message)
+	}
+	return e
+}
+
+// handlePasswordPolicy describes the requirements so forms can show them up front
+func handlePasswordPolicy(c *fiber.Ctx) error {
+	return c.JSON(passwordPolicy.Describe())
+}
@@ -0,0 +1,192 @@
+package dev
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/isymbo/sachi/auth"
+	"github.com/isymbo/sachi/config"
+	"github.com/isymbo/sachi/orm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// usePasswordPolicy applies the policy of args until the test ends
+func usePasswordPolicy(t *testing.T, args *config.CmdArgs) {
+	t.Helper()
+	policy, err := args.NewPasswordPolicy(passwordHashing.MaxPasswordBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := passwordPolicy
+	passwordPolicy = policy
+	t.Cleanup(func() { passwordPolicy = saved })
+}
+
+// fieldCodes returns the codes of the field errors in an error response
+func fieldCodes(t *testing.T, resp *http.Response) []string {
+	t.Helper()
+	var out struct {
+		Fields []FieldError `json:"fields"`
+	}
+	json.NewDecoder(resp.Body).Decode(&out)
+	var codes []string
+	for _, f := range out.Fields {
+		codes = append(codes, f.Code)
+	}
+	return codes
+}
+
+func TestPasswordHistory(t *testing.T) {
+	usePasswordPolicy(t, &config.CmdArgs{PasswordMinLength: 8, PasswordHistory: 2})
+	user := createTestUser(t, "Hal", "hal@password.example", "first passphrase")
+	b := newTestBrowser("192.0.2.120")
+	b.postJSON(t, "/api/login", map[string]string{"email": user.Email, "password": "first passphrase"})
+
+	current := "first passphrase"
+	change := func(next string) *http.Response {
+		t.Helper()
+		resp := b.postJSON(t, "/api/change-password", map[string]string{"currentPassword": current, "newPassword": next})
+		if resp.StatusCode == http.StatusOK {
+			current = next
+		}
+		return resp
+	}
+	for _, tt := range []struct {
+		password string
+		ok       bool
+	}{
+		{"first passphrase", false}, // the current password
+		{"second passphrase", true},
+		{"first passphrase", false}, // one back
+		{"third passphrase", true},
+		{"second passphrase", false},
+		{"first passphrase", false}, // two back
+		{"fourth passphrase", true},
+		{"first passphrase", true}, // no longer remembered
+	} {
+		resp := change(tt.password)
+		if codes := fieldCodes(t, resp); (resp.StatusCode == http.StatusOK) != tt.ok || (!tt.ok && strings.Join(codes, ",") != auth.RuleReused) {
+			t.Errorf("changing to %q: got %d %v", tt.password, resp.StatusCode, codes)
+		}
+	}
+}
+
+func TestPasswordPolicyRules(t *testing.T) {
+	usePasswordPolicy(t, &config.CmdArgs{PasswordMinLength: 12, PasswordMinClasses: 3, PasswordBreachCheck: true})
+	for _, tt := range []struct {
+		password string
+		want     string
+	}{
+		{"Sh0rt!", auth.RuleMinLength},
+		{"lowercase only here", auth.RuleCharClasses},
+		{"Rita-Password-9", auth.RulePersonalInfo},
+		{"Welcome123456", ""},
+		{"Password123", auth.RuleMinLength + "," + auth.RuleBreached},
+		{"Tr0ub4dor&3xyz", ""},
+	} {
+		b := newTestBrowser("192.0.2.121")
+		resp := b.postJSON(t, "/api/register", map[string]string{"name": "Rita Policy", "email": "rita." + auth.RandomToken(4) + "@password.example", "password": tt.password})
+		codes := strings.Join(fieldCodes(t, resp), ",")
+		if codes != tt.want || (tt.want == "" && resp.StatusCode >= 300) {
+			t.Errorf("registering with %q: got %d %q, want %q", tt.password, resp.StatusCode, codes, tt.want)
+		}
+	}
+
+	var policy map[string]any
+	json.NewDecoder(newTestBrowser("192.0.2.121").get(t, "/api/password-policy").Body).Decode(&policy)
+	if policy["min_length"] != float64(12) || policy["min_classes"] != float64(3) || policy["breached_check"] != true {
+		t.Errorf("GET /api/password-policy = %v", policy)
+	}
+}
+
+func TestBreachedPasswordsFileOption(t *testing.T) {
+	// The file replaces the bundled list
+	sum := sha1.Sum([]byte("Only-In-The-Custom-List-7"))
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	os.WriteFile(path, []byte(strings.ToUpper(hex.EncodeToString(sum[:]))+":42\n"), 0o644)
+	usePasswordPolicy(t, &config.CmdArgs{PasswordMinLength: 8, PasswordBreachCheck: true, BreachedPasswordsFile: path})
+
+	for password, breached := range map[string]bool{"Only-In-The-Custom-List-7": true, "Password123": false} {
+		b := newTestBrowser("192.0.2.122")
+		resp := b.postJSON(t, "/api/register", map[string]string{"name": "Bree", "email": "bree." + auth.RandomToken(4) + "@password.example", "password": password})
+		if codes := strings.Join(fieldCodes(t, resp), ","); (codes == auth.RuleBreached) != breached {
+			t.Errorf("registering with %q: got %d %q", password, resp.StatusCode, codes)
+		}
+	}
+
+	if _, err := (&config.CmdArgs{PasswordBreachCheck: true, BreachedPasswordsFile: filepath.Join(t.TempDir(), "missing.txt")}).NewPasswordPolicy(72); err == nil {
+		t.Error("a missing list was accepted")
+	}
+}
+
+// usePasswordHashing hashes and verifies passwords with h until the test ends
+func usePasswordHashing(t *testing.T, h *auth.PasswordHashing) {
+	t.Helper()
+	saved := passwordHashing
+	passwordHashing = h
+	t.Cleanup(func() { passwordHashing = saved })
+}
+
+func TestRehashOnLogin(t *testing.T) {
+	ctx := context.Background()
+	user := createTestUser(t, "Ray", "ray@password.example", "a long enough passphrase")
+	argon := &auth.Argon2idHasher{Memory: 64, Time: 1, Threads: 1}
+	storedHash := func(t *testing.T) string {
+		t.Helper()
+		u, err := orm.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.PasswordHash
+	}
+	login := func(t *testing.T, ip, password string, wantStatus int) {
+		t.Helper()
+		b := newTestBrowser(ip)
+		if resp := b.postJSON(t, "/api/login", map[string]string{"email": user.Email, "password": password}); resp.StatusCode != wantStatus {
+			t.Fatalf("login with %q: got status %d, want %d", password, resp.StatusCode, wantStatus)
+		}
+	}
+
+	for _, step := range []struct {
+		name    string
+		hashing *auth.PasswordHashing
+		check   func(hash string) bool
+	}{
+		{"bcrypt cost raised", &auth.PasswordHashing{Preferred: &auth.BcryptHasher{Cost: 5}, Others: []auth.Hasher{argon}},
+			func(hash string) bool { cost, err := bcrypt.Cost([]byte(hash)); return err == nil && cost == 5 }},
+		{"switched to argon2id", &auth.PasswordHashing{Preferred: argon, Others: []auth.Hasher{&auth.BcryptHasher{Cost: 5}}},
+			func(hash string) bool { return strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") }},
+		{"argon2id memory raised", &auth.PasswordHashing{Preferred: &auth.Argon2idHasher{Memory: 128, Time: 1, Threads: 1}},
+			func(hash string) bool { return strings.HasPrefix(hash, "$argon2id$v=19$m=128,t=1,p=1$") }},
+		{"switched back to bcrypt", &auth.PasswordHashing{Preferred: &auth.BcryptHasher{Cost: 4}, Others: []auth.Hasher{argon}},
+			func(hash string) bool { return strings.HasPrefix(hash, "$2a$04$") }},
+	} {
+		t.Run(step.name, func(t *testing.T) {
+			usePasswordHashing(t, step.hashing)
+			before := storedHash(t)
+
+			// Only a correct password may replace the hash
+			login(t, "192.0.2.130", "not the passphrase", http.StatusUnauthorized)
+			if storedHash(t) != before {
+				t.Fatal("a wrong password replaced the hash")
+			}
+			login(t, "192.0.2.131", "a long enough passphrase", http.StatusOK)
+			after := storedHash(t)
+			if after == before || !step.check(after) {
+				t.Fatalf("hash after login: %s", after)
+			}
+			// The upgraded hash is current, so the next login keeps it
+			login(t, "192.0.2.132", "a long enough passphrase", http.StatusOK)
+			if storedHash(t) != after {
+				t.Error("a current hash was replaced")
+			}
+		})
+	}
+}
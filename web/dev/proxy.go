@@ -0,0 +1,221 @@
+package dev
+
+import (
+	"errors"
+	"io/fs"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/config"
+)
+
+const (
+	clientIPKey = "clientIP"
+	schemeKey   = "scheme"
+)
+
+// newProxyMiddleware resolves the real client IP and scheme from X-Forwarded-For,
+// X-Forwarded-Proto and Forwarded (RFC 7239) when the peer is a trusted proxy, and
+// strips the configured base path so routes match whether or not the proxy removed it.
+func newProxyMiddleware(trusted []netip.Prefix, basePath string) fiber.Handler {
+	isTrusted := func(addr netip.Addr) bool {
+		addr = addr.Unmap()
+		for _, p := range trusted {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(c *fiber.Ctx) error {
+		ip, scheme := resolveClient(c, isTrusted)
+		c.Locals(clientIPKey, ip)
+		c.Locals(schemeKey, scheme)
+
+		if basePath != "" {
+			p := c.Path()
+			switch {
+			case p == basePath:
+				// Relative links in the pages only resolve under the trailing slash
+				return c.Redirect(basePath+"/", fiber.StatusMovedPermanently)
+			case strings.HasPrefix(p, basePath+"/"):
+				c.Path(strings.TrimPrefix(p, basePath))
+			}
+		}
+		return c.Next()
+	}
+}
+
+// forwardedHop is one proxy hop as reported by Forwarded or X-Forwarded-*
+type forwardedHop struct {
+	addr  netip.Addr // invalid for "unknown" or obfuscated identifiers
+	proto string
+}
+
+// resolveClient walks the forwarding chain from the nearest hop outwards and returns the
+// first address that is not a trusted proxy. Entries left of it may be client-supplied.
+func resolveClient(c *fiber.Ctx, isTrusted func(netip.Addr) bool) (string, string) {
+	scheme := "http"
+	if c.Context().IsTLS() {
+		scheme = "https"
+	}
+
+	remote, ok := netip.AddrFromSlice(c.Context().RemoteIP())
+	if !ok || !isTrusted(remote) {
+		return c.Context().RemoteIP().String(), scheme
+	}
+
+	hops := forwardedHops(c)
+	client := remote.Unmap()
+	clientProto := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !hops[i].addr.IsValid() {
+			break
+		}
+		client = hops[i].addr.Unmap()
+		clientProto = hops[i].proto
+		if !isTrusted(client) {
+			break
+		}
+	}
+	if clientProto != "" && !c.Context().IsTLS() {
+		scheme = strings.ToLower(clientProto)
+	}
+	return client.String(), scheme
+}
+
+// forwardedHops parses the Forwarded header and X-Forwarded-For/-Proto. A proxy that sets
+// one of them passes the other on from the client, so when both are present and their nearest
+// hops disagree neither is used.
+func forwardedHops(c *fiber.Ctx) []forwardedHop {
+	fwd := parseForwarded(c.Get("Forwarded"))
+	xff := parseXForwarded(c.Get(fiber.HeaderXForwardedFor), c.Get(fiber.HeaderXForwardedProto))
+	switch {
+	case len(fwd) == 0:
+		return xff
+	case len(xff) == 0:
+		return fwd
+	case fwd[len(fwd)-1].addr.Unmap() != xff[len(xff)-1].addr.Unmap():
+		return nil
+	}
+	return fwd
+}
+
+// parseForwarded parses an RFC 7239 Forwarded header
+func parseForwarded(header string) []forwardedHop {
+	if header == "" {
+		return nil
+	}
+	var hops []forwardedHop
+	for _, elem := range strings.Split(header, ",") {
+		hop := forwardedHop{}
+		for _, pair := range strings.Split(elem, ";") {
+			k, v, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if !found {
+				continue
+			}
+			v = strings.Trim(v, `"`)
+			switch strings.ToLower(k) {
+			case "for":
+				hop.addr = parseForwardedAddr(v)
+			case "proto":
+				hop.proto = v
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// parseXForwarded parses X-Forwarded-For with the matching X-Forwarded-Proto
+func parseXForwarded(xff, xfp string) []forwardedHop {
+	if xff == "" {
+		return nil
+	}
+	var protos []string
+	if xfp != "" {
+		protos = strings.Split(xfp, ",")
+	}
+	var hops []forwardedHop
+	for i, v := range strings.Split(xff, ",") {
+		hop := forwardedHop{addr: parseForwardedAddr(strings.TrimSpace(v))}
+		// Proxies usually set a single X-Forwarded-Proto for the original request
+		if len(protos) == 1 {
+			hop.proto = strings.TrimSpace(protos[0])
+		} else if i < len(protos) {
+			hop.proto = strings.TrimSpace(protos[i])
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// parseForwardedAddr accepts "1.2.3.4", "1.2.3.4:80", "[::1]" and "[::1]:80"
+func parseForwardedAddr(v string) netip.Addr {
+	if ap, err := netip.ParseAddrPort(v); err == nil {
+		return ap.Addr()
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(v, "["), "]"))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr
+}
+
+// clientIP returns the client address resolved by newProxyMiddleware
+func clientIP(c *fiber.Ctx) string {
+	if ip, ok := c.Locals(clientIPKey).(string); ok {
+		return ip
+	}
+	return c.IP()
+}
+
+// isHTTPS reports whether the client reached us over HTTPS, directly or via a trusted proxy
+func isHTTPS(c *fiber.Ctx) bool {
+	if scheme, ok := c.Locals(schemeKey).(string); ok {
+		return scheme == "https"
+	}
+	return c.Secure()
+}
+
+// appPath prefixes an absolute app path with the configured base path
+func appPath(path string) string {
+	if config.Args == nil {
+		return path
+	}
+	return config.Args.BasePath + path
+}
+
+// redirectTo redirects to an absolute app path, honouring the base path
+func redirectTo(c *fiber.Ctx, path string) error {
+	return c.Redirect(appPath(path))
+}
+
+// rootPathRe matches quoted root-relative references to the app's own routes in pages and scripts
+var rootPathRe = regexp.MustCompile("([\"'`])/(api/|css/|js/|images/|fonts/|profile\\b|[\\w-]+\\.html\\b|[\"'`])")
+
+// rewriteBasePath prefixes root-relative references so pages work under --base-path
+// without editing the static files
+func rewriteBasePath(data []byte) []byte {
+	base := appPath("")
+	if base == "" {
+		return data
+	}
+	return rootPathRe.ReplaceAll(data, []byte("${1}"+base+"/${2}"))
+}
+
+// handleScript serves /js files with base path rewriting applied
+func handleScript(c *fiber.Ctx) error {
+	data, err := readAsset("js/" + c.Params("*"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fiber.ErrNotFound
+		}
+		return err
+	}
+	c.Type("js", "utf-8")
+	return c.Send(rewriteBasePath(data))
+}
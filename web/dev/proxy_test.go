@@ -0,0 +1,184 @@
+package dev
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/config"
+)
+
+// proxyTestApp answers with the client address and scheme newProxyMiddleware resolved.
+// app.Test connects from 0.0.0.0, so trusting it makes the peer a proxy.
+func proxyTestApp(t *testing.T, trusted, basePath string) *fiber.App {
+	t.Helper()
+	var prefixes []netip.Prefix
+	for _, p := range strings.Split(trusted, ",") {
+		if p != "" {
+			prefixes = append(prefixes, netip.MustParsePrefix(p))
+		}
+	}
+	app := fiber.New()
+	app.Use(newProxyMiddleware(prefixes, basePath))
+	app.Get("/api/who", func(c *fiber.Ctx) error {
+		return c.SendString(clientIP(c) + " " + c.Locals(schemeKey).(string))
+	})
+	return app
+}
+
+func proxyTestGet(t *testing.T, app *fiber.App, target string, headers map[string]string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest("GET", target, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestResolveClient(t *testing.T) {
+	const (
+		peer    = "0.0.0.0/32"
+		proxies = "0.0.0.0/32,10.0.0.0/8,2001:db8:ffff::/48"
+	)
+	tests := []struct {
+		name    string
+		trusted string
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted peer", "10.0.0.0/8",
+			map[string]string{"X-Forwarded-For": "203.0.113.7", "X-Forwarded-Proto": "https", "Forwarded": "for=203.0.113.7;proto=https"},
+			"0.0.0.0 http"},
+		{"no forwarding headers", peer, nil, "0.0.0.0 http"},
+		{"one proxy", peer,
+			map[string]string{"X-Forwarded-For": "203.0.113.7", "X-Forwarded-Proto": "https"},
+			"203.0.113.7 https"},
+		{"spoofed left-most X-Forwarded-For", peer,
+			map[string]string{"X-Forwarded-For": "10.0.0.1, 198.51.100.1, 203.0.113.7"},
+			"203.0.113.7 http"},
+		{"chain of trusted proxies", proxies,
+			map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.7, 10.0.0.2, 10.0.0.1"},
+			"203.0.113.7 http"},
+		{"proto of each hop", proxies,
+			map[string]string{"X-Forwarded-For": "203.0.113.7, 10.0.0.1", "X-Forwarded-Proto": "https, http"},
+			"203.0.113.7 https"},
+		{"every hop trusted", proxies,
+			map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.1"},
+			"10.0.0.3 http"},
+		{"garbage hop stops the walk", proxies,
+			map[string]string{"X-Forwarded-For": "203.0.113.7, not-an-ip, 10.0.0.1"},
+			"10.0.0.1 http"},
+		{"IPv4-mapped IPv6 hop", peer,
+			map[string]string{"X-Forwarded-For": "::ffff:203.0.113.7"},
+			"203.0.113.7 http"},
+
+		// Forwarded
+		{"Forwarded", peer,
+			map[string]string{"Forwarded": "for=203.0.113.7;proto=https;by=10.0.0.1"},
+			"203.0.113.7 https"},
+		{"Forwarded with quotes, port and case", peer,
+			map[string]string{"Forwarded": `For="203.0.113.7:4711";Proto="HTTPS"`},
+			"203.0.113.7 https"},
+		{"Forwarded IPv6", proxies,
+			map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711", for="[2001:db8:ffff::1]"`},
+			"2001:db8:cafe::17 http"},
+		{"Forwarded spoofed left-most element", peer,
+			map[string]string{"Forwarded": "for=10.0.0.9;proto=https, for=203.0.113.7"},
+			"203.0.113.7 http"},
+		{"Forwarded obfuscated client behind a trusted proxy", proxies,
+			map[string]string{"Forwarded": "for=_hidden, for=10.0.0.2"},
+			"10.0.0.2 http"},
+		{"Forwarded unknown nearest hop", peer,
+			map[string]string{"Forwarded": "for=203.0.113.7, for=unknown"},
+			"0.0.0.0 http"},
+
+		// Both headers: a proxy that sets one passes the other on from the client
+		{"mixed headers that agree", peer,
+			map[string]string{"Forwarded": "for=203.0.113.7;proto=https", "X-Forwarded-For": "203.0.113.7"},
+			"203.0.113.7 https"},
+		{"mixed headers, spoofed Forwarded", peer,
+			map[string]string{"Forwarded": "for=198.51.100.1", "X-Forwarded-For": "203.0.113.7"},
+			"0.0.0.0 http"},
+		{"mixed headers, spoofed X-Forwarded-For", peer,
+			map[string]string{"Forwarded": "for=203.0.113.7", "X-Forwarded-For": "203.0.113.7, 198.51.100.1"},
+			"0.0.0.0 http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := proxyTestGet(t, proxyTestApp(t, tt.trusted, ""), "/api/who", tt.headers)
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.want {
+				t.Errorf("got %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestBasePathRouting(t *testing.T) {
+	app := proxyTestApp(t, "", "/app")
+	tests := []struct {
+		path     string
+		status   int
+		location string
+	}{
+		{"/app/api/who", http.StatusOK, ""},
+		{"/api/who", http.StatusOK, ""}, // the proxy stripped the prefix
+		{"/app", http.StatusMovedPermanently, "/app/"},
+		{"/application/api/who", http.StatusNotFound, ""},
+		{"/app/application/api/who", http.StatusNotFound, ""},
+		{"/appapi/who", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp := proxyTestGet(t, app, tt.path, nil)
+			if resp.StatusCode != tt.status || resp.Header.Get(fiber.HeaderLocation) != tt.location {
+				t.Errorf("got %d %q, want %d %q", resp.StatusCode, resp.Header.Get(fiber.HeaderLocation), tt.status, tt.location)
+			}
+		})
+	}
+}
+
+func TestRewriteBasePath(t *testing.T) {
+	saved := config.Args.BasePath
+	t.Cleanup(func() { config.Args.BasePath = saved })
+	config.Args.BasePath = "/app"
+
+	tests := []struct{ in, want string }{
+		{`fetch('/api/profile')`, `fetch('/app/api/profile')`},
+		{`<a href="/profile">`, `<a href="/app/profile">`},
+		{`<a href="/profile/edit">`, `<a href="/app/profile/edit">`},
+		{"`/api/users/${id}`", "`/app/api/users/${id}`"},
+		{`<link href="/css/main.css">`, `<link href="/app/css/main.css">`},
+		{`<script src="/js/main.js">`, `<script src="/app/js/main.js">`},
+		{`<img src="/images/logo.png">`, `<img src="/app/images/logo.png">`},
+		{`<a href="/login.html">`, `<a href="/app/login.html">`},
+		{`<a href="/">Home</a>`, `<a href="/app/">Home</a>`},
+		{`location.href = '/'`, `location.href = '/app/'`},
+		// Already prefixed, other apps and non-root references stay as they are
+		{`<a href="/app/profile">`, `<a href="/app/profile">`},
+		{`<a href="/application/x">`, `<a href="/application/x">`},
+		{`<a href="/profiles">`, `<a href="/profiles">`},
+		{`<a href="/apiary">`, `<a href="/apiary">`},
+		{`<a href="https://example.com/api/x">`, `<a href="https://example.com/api/x">`},
+		{`<a href="api/x">`, `<a href="api/x">`},
+		{`const re = /api/;`, `const re = /api/;`},
+	}
+	for _, tt := range tests {
+		if got := string(rewriteBasePath([]byte(tt.in))); got != tt.want {
+			t.Errorf("rewriteBasePath(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+
+	config.Args.BasePath = ""
+	if got := string(rewriteBasePath([]byte(`fetch('/api/x')`))); got != `fetch('/api/x')` {
+		t.Errorf("without a base path: got %s", got)
+	}
+}
@@ -0,0 +1,55 @@
+package dev
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	// requestIDHeader carries the request ID in both directions
+	requestIDHeader = "X-Request-ID"
+
+	// requestIDKey holds the request ID in Locals, for logs and error responses
+	requestIDKey = "request_id"
+
+	maxRequestIDLength = 128
+)
+
+// newRequestIDMiddleware gives every request an ID and echoes it in X-Request-ID. An ID sent
+// by the client or a proxy in front is kept, so one ID follows the request through every
+// service; anything else gets a random UUID.
+func newRequestIDMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		c.Locals(requestIDKey, id)
+		c.Set(requestIDHeader, id)
+		return c.Next()
+	}
+}
+
+// validRequestID accepts IDs of letters, digits and a few separators. The ID ends up in logs
+// and headers, so no spaces, quotes or control characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		ch := id[i]
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '-', ch == '_', ch == '.', ch == ':', ch == '/', ch == '+', ch == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the ID of the request, set by newRequestIDMiddleware
+func requestID(c *fiber.Ctx) string {
+	id, _ := c.Locals(requestIDKey).(string)
+	return id
+}
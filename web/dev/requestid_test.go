@@ -0,0 +1,97 @@
+package dev
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestValidRequestID(t *testing.T) {
+	for _, tt := range []struct {
+		id   string
+		want bool
+	}{
+		{"", false},
+		{"abc", true},
+		{"0f8fad5b-d9cb-469f-a165-70867728950e", true},
+		{"Root=1-67891233-abcdef012345678912345678", true},
+		{"req_01/2:3.4+5", true},
+		{strings.Repeat("a", maxRequestIDLength), true},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+		{"two words", false},
+		{`quote"d`, false},
+		{"line\nbreak", false},
+		{"tab\t", false},
+		{"ünïcode", false},
+	} {
+		if got := validRequestID(tt.id); got != tt.want {
+			t.Errorf("validRequestID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var logged bytes.Buffer
+	saved := log.Writer()
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(saved) })
+
+	app := fiber.New(fiber.Config{ErrorHandler: errorHandler})
+	app.Use(newRequestIDMiddleware())
+	app.Get("/ok", func(c *fiber.Ctx) error {
+		return c.SendString(requestID(c))
+	})
+	app.Get("/fail", func(c *fiber.Ctx) error {
+		return errors.New("disk full")
+	})
+	get := func(t *testing.T, target, id string) (string, string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", target, nil)
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp.Header.Get(requestIDHeader), string(body)
+	}
+
+	// A usable ID is kept, anything else is replaced
+	if header, body := get(t, "/ok", "upstream-42"); header != "upstream-42" || body != "upstream-42" {
+		t.Errorf("sent upstream-42: got header %q, handler saw %q", header, body)
+	}
+	for _, sent := range []string{"", "not valid", strings.Repeat("x", maxRequestIDLength+1)} {
+		header, body := get(t, "/ok", sent)
+		if !uuidRegexp.MatchString(header) || body != header {
+			t.Errorf("sent %q: got header %q, handler saw %q", sent, header, body)
+		}
+	}
+	first, _ := get(t, "/ok", "")
+	second, _ := get(t, "/ok", "")
+	if first == second {
+		t.Errorf("two requests got the same ID %s", first)
+	}
+
+	// The ID ties the error a client sees to the log line
+	header, body := get(t, "/fail", "")
+	if !strings.Contains(body, `"request_id":"`+header+`"`) {
+		t.Errorf("error body %s does not carry the request ID %s", body, header)
+	}
+	if line := logged.String(); !strings.Contains(line, "disk full") || !strings.Contains(line, "request_id="+header) {
+		t.Errorf("log %q does not carry the request ID %s", line, header)
+	}
+	if strings.Contains(body, "disk full") {
+		t.Error("the internal error reached the client")
+	}
+}
@@ -0,0 +1,416 @@
+package dev
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/auth"
+	"github.com/isymbo/sachi/config"
+	"github.com/isymbo/sachi/orm"
+	"github.com/isymbo/sachi/utils"
+)
+
+const (
+	auditAdminSAMLView   = "admin.saml_view"
+	auditAdminSAMLUpdate = "admin.saml_update"
+	auditAdminSAMLDelete = "admin.saml_delete"
+)
+
+// Attribute names tried, in order, when an organization does not configure its own mapping.
+// Covers the common LDAP/eduPerson OIDs and the claim URIs used by ADFS and Entra ID.
+var (
+	samlEmailAttrs = []string{"email", "mail", "emailaddress", "urn:oid:0.9.2342.19200300.100.1.3",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress"}
+	samlNameAttrs = []string{"displayName", "name", "cn", "urn:oid:2.16.840.1.113730.3.1.241",
+		"http://schemas.microsoft.com/identity/claims/displayname"}
+	samlGivenNameAttrs = []string{"givenName", "firstName", "urn:oid:2.5.4.42",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/givenname"}
+	samlSurnameAttrs = []string{"sn", "surname", "lastName", "urn:oid:2.5.4.4",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/surname"}
+	samlCompanyAttrs = []string{"company", "organization", "o", "urn:oid:2.5.4.10",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/companyname"}
+)
+
+var (
+	samlKeyMu   sync.Mutex
+	samlKey     *rsa.PrivateKey
+	samlKeyCert *x509.Certificate
+)
+
+// samlKeyPair loads the service provider signing key from DataDir/saml, creating it on first use
+func samlKeyPair() (*rsa.PrivateKey, *x509.Certificate, error) {
+	samlKeyMu.Lock()
+	defer samlKeyMu.Unlock()
+	if samlKey != nil {
+		return samlKey, samlKeyCert, nil
+	}
+
+	dir := filepath.Join(config.Args.DataDir, "saml")
+	certPath, keyPath := filepath.Join(dir, "sp-cert.pem"), filepath.Join(dir, "sp-key.pem")
+	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+		if err := utils.GenerateSigningCert(certPath, keyPath, "sachi-saml-sp", 10*365*24*time.Hour); err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Generated SAML service provider key pair in %s", dir)
+	}
+
+	key, cert, err := auth.LoadSAMLKeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	samlKey, samlKeyCert = key, cert
+	return key, cert, nil
+}
+
+// samlServiceProvider describes this app as SP for an organization; provider may be nil
+// when only the SP metadata is needed
+func samlServiceProvider(c *fiber.Ctx, org *orm.Organization, provider *orm.SAMLProvider) (*auth.SAMLServiceProvider, error) {
+	key, cert, err := samlKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	sp := &auth.SAMLServiceProvider{
+		EntityID:    externalURL(c, "/api/sso/saml/"+org.Slug+"/metadata"),
+		ACSURL:      externalURL(c, "/api/sso/saml/"+org.Slug+"/acs"),
+		Key:         key,
+		Certificate: cert,
+	}
+	if provider != nil {
+		sp.IDPMetadata = []byte(provider.IDPMetadata)
+	}
+	return sp, nil
+}
+
+// handleSAMLMetadata serves the SP metadata an IdP administrator imports
+func handleSAMLMetadata(c *fiber.Ctx) error {
+	org, err := orm.GetOrganizationBySlug(c.UserContext(), c.Params("org"))
+	if err != nil {
+		return fiber.ErrNotFound
+	}
+	sp, err := samlServiceProvider(c, org, nil)
+	if err != nil {
+		logf(c, "Error loading SAML key pair: %v", err)
+		return fiber.ErrInternalServerError
+	}
+	metadata, err := sp.Metadata()
+	if err != nil {
+		logf(c, "Error building SAML metadata: %v", err)
+		return fiber.ErrInternalServerError
+	}
+	c.Set(fiber.HeaderContentType, "application/samlmetadata+xml")
+	return c.Send(metadata)
+}
+
+// handleSAMLLogin starts SP-initiated login with an AuthnRequest over the redirect binding
+func handleSAMLLogin(c *fiber.Ctx) error {
+	org, err := orm.GetOrganizationBySlug(c.UserContext(), c.Params("org"))
+	if err != nil {
+		return fiber.ErrNotFound
+	}
+	provider, err := orm.GetSAMLProvider(c.UserContext(), org.ID)
+	if err != nil || !provider.Enabled {
+		return fiber.ErrNotFound
+	}
+	sp, err := samlServiceProvider(c, org, provider)
+	if err != nil {
+		logf(c, "Error loading SAML key pair: %v", err)
+		return ssoFailed(c, nil, org.Slug, orm.ProviderSAML, "sp_key_unavailable")
+	}
+
+	relayState := auth.RandomToken(32)
+	target, requestID, err := sp.AuthnRequestURL(relayState)
+	if err != nil {
+		logf(c, "Error building SAML AuthnRequest for org %s: %v", org.Slug, err)
+		return ssoFailed(c, nil, org.Slug, orm.ProviderSAML, "authn_request_failed")
+	}
+
+	// The request ID is checked against InResponseTo so responses cannot be swapped between logins
+	state := &orm.SSOState{
+		State:       relayState,
+		OrgID:       org.ID,
+		Nonce:       requestID,
+		RedirectURI: sp.ACSURL,
+		NextPath:    safeNextPath(c.Query("next")),
+		ExpiresAt:   time.Now().Add(ssoStateTTL),
+	}
+	if err := orm.CreateSSOState(c.UserContext(), state); err != nil {
+		logf(c, "Error storing SSO state: %v", err)
+		return newAPIError(500, codeInternal, "Failed to start single sign-on")
+	}
+
+	// Bind the RelayState to this browser so a response cannot be posted from another one
+	setSAMLStateCookie(c, relayState, state.ExpiresAt)
+	return c.Redirect(target)
+}
+
+// setSAMLStateCookie sets (or, with an empty value, clears) the cookie binding an
+// SP-initiated login to the browser. The IdP posts back cross-site, where SameSite=Lax
+// cookies are withheld, so it is SameSite=None over HTTPS. Over plain HTTP, where None is
+// refused, it has no SameSite attribute, which browsers still send on a top-level POST
+// shortly after the cookie was set.
+func setSAMLStateCookie(c *fiber.Ctx, value string, expires time.Time) {
+	sameSite := fiber.CookieSameSiteDisabled
+	if secureCookies(c) {
+		sameSite = fiber.CookieSameSiteNoneMode
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     samlStateCookie,
+		Value:    value,
+		Path:     appPath("/api/sso/saml/"),
+		Expires:  expires,
+		Secure:   secureCookies(c),
+		HTTPOnly: true,
+		SameSite: sameSite,
+	})
+}
+
+// handleSAMLACS is the assertion consumer service for the HTTP-POST binding. Responses to
+// our own AuthnRequests are matched through RelayState; unsolicited (IdP-initiated)
+// responses are only accepted when the organization allows them.
+func handleSAMLACS(c *fiber.Ctx) error {
+	org, err := orm.GetOrganizationBySlug(c.UserContext(), c.Params("org"))
+	if err != nil {
+		return ssoFailed(c, nil, "", orm.ProviderSAML, "org_not_found")
+	}
+	provider, err := orm.GetSAMLProvider(c.UserContext(), org.ID)
+	if err != nil || !provider.Enabled {
+		return ssoFailed(c, nil, org.Slug, orm.ProviderSAML, "provider_disabled")
+	}
+
+	relayState := c.FormValue("RelayState")
+	cookieState := c.Cookies(samlStateCookie)
+	setSAMLStateCookie(c, "", time.Now().Add(-time.Hour))
+	next := "/profile"
+	var requestIDs []string
+	if relayState != "" {
+		if state, err := orm.ConsumeSSOState(c.UserContext(), relayState); err == nil && state.OrgID == org.ID {
+			// Our own requests must come back to the browser that sent them
+			if relayState != cookieState {
+				return ssoFailed(c, nil, org.Slug, orm.ProviderSAML, "state_mismatch")
+			}
+			requestIDs = []string{state.Nonce}
+			next = state.NextPath
+		}
+	}
+	if requestIDs == nil {
+		if !provider.AllowIDPInitiated {
+			return ssoFailed(c, nil, org.Slug, orm.ProviderSAML, "unsolicited_response")
+		}
+		// IdPs commonly use RelayState as the landing page for IdP-initiated logins
+		if strings.HasPrefix(relayState, "/") {
+			next = safeNextPath(relayState)
+		}
+	}
+
+	sp, err := samlServiceProvider(c, org, provider)
+	if err != nil {
+		logf(c, "Error loading SAML key pair: %v", err)
+		return ssoFailed(c, nil, org.Slug, orm.ProviderSAML, "sp_key_unavailable")
+	}
+	assertion, err := sp.ParseResponse(c.FormValue("SAMLResponse"), requestIDs)
+	if err != nil {
+		logf(c, "SAML response rejected for org %s: %v", org.Slug, err)
+		return ssoFailed(c, nil, org.Slug, orm.ProviderSAML, "invalid_response")
+	}
+	if assertion.Issuer != "" && assertion.Issuer != provider.IDPEntityID {
+		return ssoFailed(c, nil, org.Slug, orm.ProviderSAML, "issuer_mismatch")
+	}
+	// A response to one of our requests that arrives without its RelayState is not
+	// unsolicited; it was taken from the browser that asked for it
+	if len(requestIDs) == 0 && assertion.InResponseTo != "" {
+		return ssoFailed(c, nil, org.Slug, orm.ProviderSAML, "state_mismatch")
+	}
+
+	// Remember the assertion until it expires so a captured response cannot be posted again
+	expires := assertion.NotOnOrAfter
+	if minExpiry := time.Now().Add(ssoStateTTL); expires.Before(minExpiry) {
+		expires = minExpiry
+	}
+	if fresh, err := orm.MarkSAMLAssertionUsed(c.UserContext(), assertion.ID, expires); err != nil || !fresh {
+		return ssoFailed(c, nil, org.Slug, orm.ProviderSAML, "assertion_replayed")
+	}
+
+	id := samlIdentity(provider, assertion)
+	user, reason := resolveSSOUser(c, org, provider.EmailDomains, id)
+	if user == nil {
+		return ssoFailed(c, nil, org.Slug, orm.ProviderSAML, reason)
+	}
+
+	if err := startSession(c, user); err != nil {
+		logf(c, "Error creating session after SSO: %v", err)
+		return ssoFailed(c, user, org.Slug, orm.ProviderSAML, "session_failed")
+	}
+	recordAudit(c, user, auditSSOLogin, user.Email, fiber.Map{
+		"org":            org.Slug,
+		"protocol":       orm.ProviderSAML,
+		"subject":        assertion.NameID,
+		"idp_initiated":  len(requestIDs) == 0,
+		"assertion_id":   assertion.ID,
+		"name_id_format": assertion.NameIDFormat,
+	})
+	countLogin(orm.ProviderSAML, true)
+	return redirectTo(c, next)
+}
+
+// samlIdentity maps assertion attributes to user fields, preferring the organization's
+// configured attribute names over the built-in defaults
+func samlIdentity(provider *orm.SAMLProvider, a *auth.SAMLAssertion) *ssoIdentity {
+	lookup := func(configured string, defaults []string) string {
+		if configured != "" {
+			return a.Attr(configured)
+		}
+		return a.Attr(defaults...)
+	}
+
+	email := lookup(provider.AttrEmail, samlEmailAttrs)
+	if email == "" && (a.NameIDFormat == auth.SAMLEmailNameIDFormat || strings.Contains(a.NameID, "@")) {
+		email = a.NameID
+	}
+	name := lookup(provider.AttrName, samlNameAttrs)
+	if name == "" {
+		name = strings.TrimSpace(a.Attr(samlGivenNameAttrs...) + " " + a.Attr(samlSurnameAttrs...))
+	}
+
+	return &ssoIdentity{
+		Protocol: orm.ProviderSAML,
+		Issuer:   provider.IDPEntityID,
+		Subject:  a.NameID,
+		Email:    email,
+		Verified: true, // asserted by the organization's own signed IdP
+		Name:     name,
+		Company:  lookup(provider.AttrCompany, samlCompanyAttrs),
+	}
+}
+
+// handleSAMLProviderGet returns an organization's SAML configuration and the SP values to give the IdP
+func handleSAMLProviderGet(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+	org, err := loadOrg(c)
+	if err != nil {
+		return err
+	}
+	resp := fiber.Map{
+		"success":          true,
+		"sp_entity_id":     externalURL(c, "/api/sso/saml/"+org.Slug+"/metadata"),
+		"sp_metadata_url":  externalURL(c, "/api/sso/saml/"+org.Slug+"/metadata"),
+		"sp_acs_url":       externalURL(c, "/api/sso/saml/"+org.Slug+"/acs"),
+		"sp_login_url":     externalURL(c, "/api/sso/saml/"+org.Slug+"/login"),
+		"provider":         nil,
+		"provider_enabled": false,
+	}
+	if provider, err := orm.GetSAMLProvider(c.UserContext(), org.ID); err == nil {
+		resp["provider"] = provider
+		resp["provider_enabled"] = provider.Enabled
+	}
+	recordAudit(c, admin, auditAdminSAMLView, org.Slug, nil)
+	return c.JSON(resp)
+}
+
+// handleSAMLProviderPut creates or updates an organization's SAML configuration from IdP
+// metadata given inline or by URL
+func handleSAMLProviderPut(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+	org, err := loadOrg(c)
+	if err != nil {
+		return err
+	}
+
+	type SAMLProviderRequest struct {
+		MetadataURL       string `json:"metadata_url"`
+		MetadataXML       string `json:"metadata_xml"`
+		AttrEmail         string `json:"attr_email"`
+		AttrName          string `json:"attr_name"`
+		AttrCompany       string `json:"attr_company"`
+		EmailDomains      string `json:"email_domains"`
+		AllowIDPInitiated bool   `json:"allow_idp_initiated"`
+		Enabled           *bool  `json:"enabled"`
+	}
+	req := new(SAMLProviderRequest)
+	if err := c.BodyParser(req); err != nil {
+		return errInvalidBody()
+	}
+
+	metadata := []byte(req.MetadataXML)
+	if len(metadata) == 0 && req.MetadataURL != "" {
+		ctx, cancel := context.WithTimeout(c.UserContext(), 15*time.Second)
+		defer cancel()
+		if metadata, err = auth.FetchSAMLMetadata(ctx, req.MetadataURL); err != nil {
+			return newAPIError(400, codeValidationFailed, "Failed to fetch IdP metadata: "+err.Error()).
+				withField("metadata_url", fieldInvalid, "Metadata could not be fetched")
+		}
+	}
+	if len(metadata) == 0 {
+		// Allow changing the mapping without re-uploading metadata
+		existing, err := orm.GetSAMLProvider(c.UserContext(), org.ID)
+		if err != nil {
+			return newAPIError(400, codeValidationFailed, "metadata_xml or metadata_url is required").
+				withField("metadata_xml", fieldRequired, "Paste the metadata or give metadata_url")
+		}
+		metadata = []byte(existing.IDPMetadata)
+		if req.MetadataURL == "" {
+			req.MetadataURL = existing.MetadataURL
+		}
+	}
+	entity, err := auth.ParseSAMLMetadata(metadata)
+	if err != nil {
+		return newAPIError(400, codeValidationFailed, "Invalid IdP metadata: "+err.Error()).
+			withField("metadata_xml", fieldInvalid, "Not valid SAML IdP metadata")
+	}
+
+	provider := &orm.SAMLProvider{
+		OrgID:             org.ID,
+		IDPEntityID:       entity.EntityID,
+		IDPMetadata:       string(metadata),
+		MetadataURL:       req.MetadataURL,
+		AttrEmail:         strings.TrimSpace(req.AttrEmail),
+		AttrName:          strings.TrimSpace(req.AttrName),
+		AttrCompany:       strings.TrimSpace(req.AttrCompany),
+		EmailDomains:      strings.ToLower(strings.ReplaceAll(req.EmailDomains, " ", "")),
+		AllowIDPInitiated: req.AllowIDPInitiated,
+		Enabled:           req.Enabled == nil || *req.Enabled,
+	}
+	if err := orm.SaveSAMLProvider(c.UserContext(), provider); err != nil {
+		logf(c, "Error saving SAML provider: %v", err)
+		return newAPIError(500, codeInternal, "Failed to save SAML configuration")
+	}
+
+	recordAudit(c, admin, auditAdminSAMLUpdate, org.Slug, fiber.Map{
+		"idp_entity_id":       provider.IDPEntityID,
+		"metadata_url":        provider.MetadataURL,
+		"email_domains":       provider.EmailDomains,
+		"allow_idp_initiated": provider.AllowIDPInitiated,
+		"enabled":             provider.Enabled,
+	})
+	return c.JSON(fiber.Map{
+		"success":       true,
+		"message":       "SAML configuration saved",
+		"idp_entity_id": provider.IDPEntityID,
+		"sp_acs_url":    externalURL(c, "/api/sso/saml/"+org.Slug+"/acs"),
+	})
+}
+
+// handleSAMLProviderDelete removes an organization's SAML configuration
+func handleSAMLProviderDelete(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+	org, err := loadOrg(c)
+	if err != nil {
+		return err
+	}
+	if err := orm.DeleteSAMLProvider(c.UserContext(), org.ID); err != nil {
+		logf(c, "Error deleting SAML provider: %v", err)
+		return newAPIError(500, codeInternal, "Failed to delete SAML configuration")
+	}
+	recordAudit(c, admin, auditAdminSAMLDelete, org.Slug, nil)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "SAML configuration deleted",
+	})
+}
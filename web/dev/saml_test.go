@@ -0,0 +1,281 @@
+package dev
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isymbo/sachi/auth/authtest"
+	"github.com/isymbo/sachi/orm"
+)
+
+// testSAMLOrg is an organization signing in through a test SAML IdP
+type testSAMLOrg struct {
+	*orm.Organization
+	idp *authtest.SAMLIdP
+}
+
+func setupTestSAML(t *testing.T, slug, emailDomains string, allowIDPInitiated bool) *testSAMLOrg {
+	t.Helper()
+	ctx := context.Background()
+	idp := authtest.NewSAMLIdP("https://idp.example.com/" + slug + "/metadata")
+
+	orgID, err := orm.CreateOrganization(ctx, slug, "Org "+slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = orm.SaveSAMLProvider(ctx, &orm.SAMLProvider{
+		OrgID:             orgID,
+		IDPEntityID:       idp.EntityID,
+		IDPMetadata:       string(idp.Metadata()),
+		EmailDomains:      emailDomains,
+		AllowIDPInitiated: allowIDPInitiated,
+		Enabled:           true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	org, err := orm.GetOrganizationByID(ctx, orgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSAMLOrg{Organization: org, idp: idp}
+}
+
+// spEntityID and acsURL are the SP values as requests to testApp (Host example.com) see them
+func (o *testSAMLOrg) spEntityID() string {
+	return "http://example.com/api/sso/saml/" + o.Slug + "/metadata"
+}
+
+func (o *testSAMLOrg) acsURL() string {
+	return "http://example.com/api/sso/saml/" + o.Slug + "/acs"
+}
+
+// startLogin starts an SP-initiated login in b and returns the AuthnRequest ID and RelayState
+func (o *testSAMLOrg) startLogin(t *testing.T, b *testBrowser) (string, string) {
+	t.Helper()
+	resp := b.get(t, "/api/sso/saml/"+o.Slug+"/login?next=/profile")
+	if resp.StatusCode != http.StatusFound || !strings.HasPrefix(resp.Header.Get("Location"), o.idp.SSOURL()+"?") {
+		t.Fatalf("login: got %d to %s, want a redirect to the IdP", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	req, relayState, err := o.idp.ReadAuthnRequest(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.AssertionConsumerServiceURL != o.acsURL() {
+		t.Fatalf("AuthnRequest names the ACS %s, want %s", req.AssertionConsumerServiceURL, o.acsURL())
+	}
+	return req.ID, relayState
+}
+
+// login is a valid assertion for email answering requestID
+func (o *testSAMLOrg) login(requestID, email string) *authtest.SAMLLogin {
+	return &authtest.SAMLLogin{
+		SPEntityID:   o.spEntityID(),
+		ACSURL:       o.acsURL(),
+		InResponseTo: requestID,
+		NameID:       "nameid-" + email,
+		Attributes:   map[string]string{"email": email, "displayName": "User " + email},
+	}
+}
+
+// post sends a SAMLResponse to the assertion consumer service from b, as the IdP's form
+// makes the browser do
+func (o *testSAMLOrg) post(t *testing.T, b *testBrowser, samlResponse, relayState string) *http.Response {
+	t.Helper()
+	form := url.Values{"SAMLResponse": {samlResponse}, "RelayState": {relayState}}
+	req := httptest.NewRequest("POST", "/api/sso/saml/"+o.Slug+"/acs", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(t, req)
+}
+
+// assertSignedIn checks that resp signed in the account with this email and went to next
+func assertSignedIn(t *testing.T, resp *http.Response, email, next string) *orm.User {
+	t.Helper()
+	if got := redirectPath(t, resp); got != next {
+		t.Fatalf("redirected to %s, want %s", got, next)
+	}
+	token, _ := responseCookie(resp, "session_token")
+	user, err := orm.ValidateSession(context.Background(), token)
+	if err != nil {
+		t.Fatalf("no session: %v", err)
+	}
+	if user.Email != email {
+		t.Errorf("signed in %s, want %s", user.Email, email)
+	}
+	return user
+}
+
+func TestSAMLLogin(t *testing.T) {
+	org := setupTestSAML(t, "saml-login", "samllogin.example", false)
+	b := newTestBrowser("192.0.2.110")
+
+	requestID, relayState := org.startLogin(t, b)
+	resp := org.post(t, b, org.idp.Response(org.login(requestID, "ann@samllogin.example")), relayState)
+	user := assertSignedIn(t, resp, "ann@samllogin.example", "/profile")
+	if user.Name != "User ann@samllogin.example" || user.OrgID != org.ID {
+		t.Errorf("unexpected provisioned user %+v", user)
+	}
+	e := lastAuditEvent(t, auditSSOLogin, user.Email)
+	if e.Metadata["idp_initiated"] != false || e.Metadata["subject"] != "nameid-ann@samllogin.example" {
+		t.Errorf("unexpected audit event %+v", e.Metadata)
+	}
+}
+
+func TestSAMLLoginRejects(t *testing.T) {
+	org := setupTestSAML(t, "saml-reject", "samlreject.example", false)
+
+	tests := []struct {
+		name   string
+		change func(l *authtest.SAMLLogin)
+		reason string
+	}{
+		{"unsigned assertion", func(l *authtest.SAMLLogin) { l.Unsigned = true }, "invalid_response"},
+		{"wrong audience", func(l *authtest.SAMLLogin) { l.Audience = "https://other.example.com/metadata" }, "invalid_response"},
+		{"wrong recipient", func(l *authtest.SAMLLogin) { l.Recipient = "https://other.example.com/acs" }, "invalid_response"},
+		{"expired", func(l *authtest.SAMLLogin) { l.NotOnOrAfter = time.Now().Add(-10 * time.Minute) }, "invalid_response"},
+		{"answers another request", func(l *authtest.SAMLLogin) { l.InResponseTo = "id-other-request" }, "invalid_response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBrowser("192.0.2.111")
+			requestID, relayState := org.startLogin(t, b)
+			login := org.login(requestID, "bob@samlreject.example")
+			tt.change(login)
+			resp := org.post(t, b, org.idp.Response(login), relayState)
+			assertSSOFailed(t, resp, org.Slug, tt.reason)
+		})
+	}
+
+	t.Run("tampered assertion", func(t *testing.T) {
+		b := newTestBrowser("192.0.2.111")
+		requestID, relayState := org.startLogin(t, b)
+		response := org.idp.Response(org.login(requestID, "bob@samlreject.example"))
+		resp := org.post(t, b, tamperSAMLResponse(t, response, "bob@samlreject.example", "boss@samlreject.example"), relayState)
+		assertSSOFailed(t, resp, org.Slug, "invalid_response")
+		if _, err := orm.GetUserByEmail(context.Background(), "boss@samlreject.example"); err == nil {
+			t.Error("the tampered email was provisioned")
+		}
+	})
+
+	t.Run("signed by another IdP", func(t *testing.T) {
+		b := newTestBrowser("192.0.2.111")
+		requestID, relayState := org.startLogin(t, b)
+		impostor := authtest.NewSAMLIdP(org.idp.EntityID)
+		resp := org.post(t, b, impostor.Response(org.login(requestID, "bob@samlreject.example")), relayState)
+		assertSSOFailed(t, resp, org.Slug, "invalid_response")
+	})
+
+	t.Run("replayed response", func(t *testing.T) {
+		b := newTestBrowser("192.0.2.111")
+		requestID, relayState := org.startLogin(t, b)
+		response := org.idp.Response(org.login(requestID, "cy@samlreject.example"))
+		assertSignedIn(t, org.post(t, b, response, relayState), "cy@samlreject.example", "/profile")
+		// The RelayState is used up, so a replay looks unsolicited
+		assertSSOFailed(t, org.post(t, b, response, relayState), org.Slug, "unsolicited_response")
+	})
+
+	t.Run("outside the organization's domains", func(t *testing.T) {
+		b := newTestBrowser("192.0.2.111")
+		requestID, relayState := org.startLogin(t, b)
+		resp := org.post(t, b, org.idp.Response(org.login(requestID, "dee@elsewhere.example")), relayState)
+		assertSSOFailed(t, resp, org.Slug, "email_domain_not_allowed")
+	})
+}
+
+func TestSAMLLoginBoundToBrowser(t *testing.T) {
+	org := setupTestSAML(t, "saml-bound", "samlbound.example", true)
+	victim, attacker := newTestBrowser("192.0.2.113"), newTestBrowser("192.0.2.114")
+
+	// A response to the attacker's request, posted from the victim's browser
+	requestID, relayState := org.startLogin(t, attacker)
+	response := org.idp.Response(org.login(requestID, "eve@samlbound.example"))
+	resp := org.post(t, victim, response, relayState)
+	assertSSOFailed(t, resp, org.Slug, "state_mismatch")
+	if _, ok := responseCookie(resp, "session_token"); ok {
+		t.Error("the victim's browser got a session")
+	}
+	// Nor can it pass for an IdP-initiated login, which the organization allows
+	assertSSOFailed(t, org.post(t, victim, response, ""), org.Slug, "state_mismatch")
+	// The RelayState is used up either way
+	assertSSOFailed(t, org.post(t, attacker, response, relayState), org.Slug, "state_mismatch")
+}
+
+func TestSAMLStateCookie(t *testing.T) {
+	org := setupTestSAML(t, "saml-cookie", "samlcookie.example", false)
+	for _, proto := range []string{"http", "https"} {
+		req := httptest.NewRequest("GET", "/api/sso/saml/"+org.Slug+"/login", nil)
+		req.Header.Set("X-Forwarded-For", "192.0.2.115")
+		req.Header.Set("X-Forwarded-Proto", proto)
+		resp := testRequest(t, req)
+		var cookie *http.Cookie
+		for _, c := range resp.Cookies() {
+			if c.Name == samlStateCookie {
+				cookie = c
+			}
+		}
+		if cookie == nil {
+			t.Fatalf("%s: no %s cookie", proto, samlStateCookie)
+		}
+		if !cookie.HttpOnly || cookie.Path != "/api/sso/saml/" {
+			t.Errorf("%s: cookie %+v", proto, cookie)
+		}
+		// The IdP posts back cross-site, so the cookie must not be SameSite=Lax or Strict
+		var wantSameSite http.SameSite
+		wantSecure := false
+		if proto == "https" {
+			wantSameSite, wantSecure = http.SameSiteNoneMode, true
+		}
+		if cookie.SameSite != wantSameSite || cookie.Secure != wantSecure {
+			t.Errorf("%s: SameSite %v, Secure %v; want %v, %v", proto, cookie.SameSite, cookie.Secure, wantSameSite, wantSecure)
+		}
+	}
+}
+
+func TestSAMLIdPInitiated(t *testing.T) {
+	b := newTestBrowser("192.0.2.112")
+	t.Run("disabled", func(t *testing.T) {
+		org := setupTestSAML(t, "saml-idp-off", "idpoff.example", false)
+		resp := org.post(t, b, org.idp.Response(org.login("", "ann@idpoff.example")), "")
+		assertSSOFailed(t, resp, org.Slug, "unsolicited_response")
+		if _, err := orm.GetUserByEmail(context.Background(), "ann@idpoff.example"); err == nil {
+			t.Error("an unsolicited response provisioned an account")
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		org := setupTestSAML(t, "saml-idp-on", "idpon.example", true)
+		response := org.idp.Response(org.login("", "ann@idpon.example"))
+		// RelayState names the landing page of IdP-initiated logins
+		user := assertSignedIn(t, org.post(t, b, response, "/profile.html"), "ann@idpon.example", "/profile.html")
+		e := lastAuditEvent(t, auditSSOLogin, user.Email)
+		if e.Metadata["idp_initiated"] != true {
+			t.Errorf("login not recorded as IdP-initiated: %+v", e.Metadata)
+		}
+
+		// The same assertion cannot be posted again while it is valid
+		assertSSOFailed(t, org.post(t, b, response, ""), org.Slug, "assertion_replayed")
+
+		// Landing pages are local paths only
+		resp := org.post(t, b, org.idp.Response(org.login("", "ann@idpon.example")), "//evil.example/")
+		assertSignedIn(t, resp, "ann@idpon.example", "/profile")
+	})
+}
+
+// tamperSAMLResponse edits the XML of a signed base64 SAMLResponse
+func tamperSAMLResponse(t *testing.T, response, old, new string) string {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), old) {
+		t.Fatalf("response does not contain %q", old)
+	}
+	return base64.StdEncoding.EncodeToString([]byte(strings.ReplaceAll(string(raw), old, new)))
+}
@@ -0,0 +1,1050 @@
+package dev
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/auth"
+	"github.com/isymbo/sachi/orm"
+	"github.com/isymbo/sachi/scim"
+)
+
+const (
+	scimBasePath = "/scim/v2"
+
+	// scimOrgKey and scimTokenKey hold the organization and token of an authenticated SCIM request
+	scimOrgKey   = "scim_org"
+	scimTokenKey = "scim_token"
+)
+
+const (
+	auditSCIMUserCreate        = "scim.user_create"
+	auditSCIMUserUpdate        = "scim.user_update"
+	auditSCIMUserDeactivate    = "scim.user_deactivate"
+	auditSCIMUserReactivate    = "scim.user_reactivate"
+	auditSCIMUserDelete        = "scim.user_delete"
+	auditSCIMGroupCreate       = "scim.group_create"
+	auditSCIMGroupUpdate       = "scim.group_update"
+	auditSCIMGroupDelete       = "scim.group_delete"
+	auditAdminSCIMTokenList    = "admin.scim_token_list"
+	auditAdminSCIMTokenCreate  = "admin.scim_token_create"
+	auditAdminSCIMTokenDelete  = "admin.scim_token_delete"
+	auditAdminSCIMGroupList    = "admin.scim_group_list"
+	auditAdminSCIMGroupRoleSet = "admin.scim_group_role"
+)
+
+// setupSCIMRoutes sets up the SCIM 2.0 provisioning endpoints
+func setupSCIMRoutes(r fiber.Router) {
+	r.Get("/ServiceProviderConfig", handleSCIMServiceProviderConfig)
+	r.Get("/ResourceTypes", handleSCIMResourceTypes)
+	r.Get("/Schemas", handleSCIMSchemas)
+	r.Get("/Users", handleSCIMUserList)
+	r.Post("/Users", handleSCIMUserCreate)
+	r.Get("/Users/:id", handleSCIMUserGet)
+	r.Put("/Users/:id", handleSCIMUserReplace)
+	r.Patch("/Users/:id", handleSCIMUserPatch)
+	r.Delete("/Users/:id", handleSCIMUserDelete)
+	r.Get("/Groups", handleSCIMGroupList)
+	r.Post("/Groups", handleSCIMGroupCreate)
+	r.Get("/Groups/:id", handleSCIMGroupGet)
+	r.Put("/Groups/:id", handleSCIMGroupReplace)
+	r.Patch("/Groups/:id", handleSCIMGroupPatch)
+	r.Delete("/Groups/:id", handleSCIMGroupDelete)
+}
+
+// requireSCIMToken authenticates a provisioning client by its organization-scoped bearer token
+func requireSCIMToken(c *fiber.Ctx) error {
+	bearer := bearerToken(c)
+	if bearer == "" {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="scim"`)
+		return scimError(c, &scim.Error{Status: 401, Detail: "Bearer token required"})
+	}
+	tok, err := orm.GetSCIMTokenByHash(c.UserContext(), auth.HashToken(bearer))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			logf(c, "Error looking up SCIM token: %v", err)
+		}
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="scim", error="invalid_token"`)
+		return scimError(c, &scim.Error{Status: 401, Detail: "Invalid bearer token"})
+	}
+	org, err := orm.GetOrganizationByID(c.UserContext(), tok.OrgID)
+	if err != nil {
+		return scimError(c, &scim.Error{Status: 401, Detail: "Invalid bearer token"})
+	}
+	c.Locals(scimOrgKey, org)
+	c.Locals(scimTokenKey, tok)
+	return c.Next()
+}
+
+// scimJSON writes a SCIM response body
+func scimJSON(c *fiber.Ctx, status int, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, scim.ContentType+"; charset=utf-8")
+	return c.Status(status).Send(data)
+}
+
+// scimError renders protocol errors with the SCIM Error schema; anything else is logged
+// and reported as a 500 without details
+func scimError(c *fiber.Ctx, err error) error {
+	var se *scim.Error
+	if !errors.As(err, &se) {
+		logf(c, "SCIM %s %s failed: %v", c.Method(), c.Path(), err)
+		se = &scim.Error{Status: 500, Detail: "Internal server error"}
+	}
+	return scimJSON(c, se.Status, se.Body())
+}
+
+// scimPasswordError rejects a pushed password that does not meet the policy
+func scimPasswordError(violations []auth.PasswordViolation) *scim.Error {
+	msgs := make([]string, len(violations))
+	for i, v := range violations {
+		msgs[i] = v.Message
+	}
+	return scim.BadRequest(scim.ErrInvalidValue, "password does not meet the requirements: %s", strings.Join(msgs, "; "))
+}
+
+func scimNotFound(kind, id string) *scim.Error {
+	return &scim.Error{Status: 404, Detail: kind + " " + id + " not found"}
+}
+
+// scimAudit records a provisioning event; the actor is the organization's token, not a user
+func scimAudit(c *fiber.Ctx, action, target string, meta fiber.Map) {
+	if meta == nil {
+		meta = fiber.Map{}
+	}
+	meta["org"] = c.Locals(scimOrgKey).(*orm.Organization).Slug
+	meta["scim_token"] = c.Locals(scimTokenKey).(*orm.SCIMToken).ID
+	recordAudit(c, nil, action, target, meta)
+}
+
+// scimBody decodes a JSON request body into a generic resource
+func scimBody(c *fiber.Ctx) (map[string]any, error) {
+	var body map[string]any
+	if err := json.Unmarshal(c.Body(), &body); err != nil || body == nil {
+		return nil, scim.BadRequest(scim.ErrInvalidSyntax, "Request body must be a JSON object")
+	}
+	return body, nil
+}
+
+// scimPage reads startIndex (1-based) and count
+func scimPage(c *fiber.Ctx) (int, int) {
+	start := c.QueryInt("startIndex", 1)
+	if start < 1 {
+		start = 1
+	}
+	count := c.QueryInt("count", scim.MaxResults)
+	if count < 0 {
+		count = 0
+	}
+	if count > scim.MaxResults {
+		count = scim.MaxResults
+	}
+	return start, count
+}
+
+// scimList filters, paginates and projects resources into a ListResponse
+func scimList(c *fiber.Ctx, resources []map[string]any) error {
+	if f := c.Query("filter"); f != "" {
+		filter, err := scim.ParseFilter(f)
+		if err != nil {
+			return scimError(c, err)
+		}
+		matched := resources[:0]
+		for _, r := range resources {
+			if filter.Match(r) {
+				matched = append(matched, r)
+			}
+		}
+		resources = matched
+	}
+
+	start, count := scimPage(c)
+	total := len(resources)
+	page := []map[string]any{}
+	if start <= total {
+		end := start - 1 + count
+		if end > total {
+			end = total
+		}
+		page = resources[start-1 : end]
+	}
+	for i, r := range page {
+		page[i] = scim.Project(r, c.Query("attributes"), c.Query("excludedAttributes"))
+	}
+	return scimJSON(c, 200, scim.ListResponse(page, total, start))
+}
+
+func scimMeta(c *fiber.Ctx, kind, path string, created, modified time.Time) map[string]any {
+	return map[string]any{
+		"resourceType": kind,
+		"created":      created.UTC().Format(time.RFC3339),
+		"lastModified": modified.UTC().Format(time.RFC3339),
+		"location":     externalURL(c, scimBasePath+path),
+	}
+}
+
+// handleSCIMServiceProviderConfig describes the supported SCIM features
+func handleSCIMServiceProviderConfig(c *fiber.Ctx) error {
+	return scimJSON(c, 200, scim.ServiceProviderConfig(externalURL(c, "/")))
+}
+
+// handleSCIMResourceTypes lists the User and Group resource types
+func handleSCIMResourceTypes(c *fiber.Ctx) error {
+	types := scim.ResourceTypes()
+	return scimJSON(c, 200, scim.ListResponse(types, len(types), 1))
+}
+
+// handleSCIMSchemas lists the supported schemas and attributes
+func handleSCIMSchemas(c *fiber.Ctx) error {
+	schemas := scim.Schemas()
+	return scimJSON(c, 200, scim.ListResponse(schemas, len(schemas), 1))
+}
+
+// scimUserResource renders a user as a SCIM User with the enterprise extension
+func scimUserResource(c *fiber.Ctx, u *orm.User, externalID string, groups []*orm.SCIMGroup) map[string]any {
+	id := strconv.FormatInt(u.ID, 10)
+	name := map[string]any{"formatted": u.Name}
+	if given, family, ok := strings.Cut(u.Name, " "); ok {
+		name["givenName"], name["familyName"] = given, family
+	} else {
+		name["givenName"] = u.Name
+	}
+	memberOf := []any{}
+	for _, g := range groups {
+		gid := strconv.FormatInt(g.ID, 10)
+		memberOf = append(memberOf, map[string]any{
+			"value":   gid,
+			"display": g.DisplayName,
+			"$ref":    externalURL(c, scimBasePath+"/Groups/"+gid),
+		})
+	}
+
+	r := map[string]any{
+		"schemas":     []any{scim.UserSchema, scim.EnterpriseUserSchema},
+		"id":          id,
+		"userName":    u.Email,
+		"name":        name,
+		"displayName": u.Name,
+		"active":      !u.Disabled,
+		"emails":      []any{map[string]any{"value": u.Email, "type": "work", "primary": true}},
+		"groups":      memberOf,
+		"meta":        scimMeta(c, "User", "/Users/"+id, u.CreatedAt, u.UpdatedAt),
+	}
+	if externalID != "" {
+		r["externalId"] = externalID
+	}
+	if u.Company != "" {
+		r[scim.EnterpriseUserSchema] = map[string]any{"organization": u.Company}
+	}
+	return r
+}
+
+// scimUserInput is what Sachi keeps from a User resource
+type scimUserInput struct {
+	Email      string
+	Name       string
+	Company    string
+	ExternalID string
+	Password   string
+	Active     *bool // nil when the resource does not say
+}
+
+func parseSCIMUser(body map[string]any) (*scimUserInput, error) {
+	in := &scimUserInput{
+		Email:      strings.ToLower(strings.TrimSpace(scim.GetString(body, "userName"))),
+		ExternalID: strings.TrimSpace(scim.GetString(body, "externalId")),
+		Password:   scim.GetString(body, "password"),
+	}
+	if in.Email == "" {
+		// Fall back to the primary (or first) email
+		emails, _ := scim.Get(body, "emails")
+		items, _ := emails.([]any)
+		for _, item := range items {
+			m, _ := item.(map[string]any)
+			v := scim.GetString(m, "value")
+			if primary, _ := scim.GetBool(m, "primary"); primary || in.Email == "" {
+				in.Email = strings.ToLower(strings.TrimSpace(v))
+			}
+		}
+	}
+	if !strings.Contains(in.Email, "@") {
+		return nil, scim.BadRequest(scim.ErrInvalidValue, "userName must be an email address")
+	}
+
+	name := scim.GetMap(body, "name")
+	in.Name = strings.TrimSpace(scim.GetString(body, "displayName"))
+	if in.Name == "" && name != nil {
+		in.Name = strings.TrimSpace(scim.GetString(name, "formatted"))
+		if in.Name == "" {
+			in.Name = strings.TrimSpace(scim.GetString(name, "givenName") + " " + scim.GetString(name, "familyName"))
+		}
+	}
+	if in.Name == "" {
+		in.Name = in.Email[:strings.Index(in.Email, "@")]
+	}
+
+	if ext := scim.GetMap(body, scim.EnterpriseUserSchema); ext != nil {
+		in.Company = strings.TrimSpace(scim.GetString(ext, "organization"))
+	}
+	if _, present := scim.Get(body, "active"); present {
+		active, ok := scim.GetBool(body, "active")
+		if !ok {
+			return nil, scim.BadRequest(scim.ErrInvalidValue, "active must be a boolean")
+		}
+		in.Active = &active
+	}
+	return in, nil
+}
+
+// scimOrgUsers returns the organization's users with their externalIds and groups
+func scimOrgUsers(ctx context.Context, org *orm.Organization) ([]*orm.User, map[int64]string, map[int64][]*orm.SCIMGroup, error) {
+	users, err := orm.ListOrganizationUsers(ctx, org.ID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	externalIDs, err := orm.SCIMExternalIDs(ctx, org.Slug)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	groups, err := orm.ListSCIMGroups(ctx, org.ID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	memberOf := map[int64][]*orm.SCIMGroup{}
+	for _, g := range groups {
+		for _, userID := range g.Members {
+			memberOf[userID] = append(memberOf[userID], g)
+		}
+	}
+	return users, externalIDs, memberOf, nil
+}
+
+// scimLoadUser resolves the :id parameter to a member of the token's organization
+func scimLoadUser(c *fiber.Ctx) (*orm.User, error) {
+	org := c.Locals(scimOrgKey).(*orm.Organization)
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return nil, scimNotFound("User", c.Params("id"))
+	}
+	user, err := orm.GetUserByID(c.UserContext(), id)
+	if err != nil || user.OrgID != org.ID {
+		return nil, scimNotFound("User", c.Params("id"))
+	}
+	return user, nil
+}
+
+// renderSCIMUser reloads a user and writes it as a User resource
+func renderSCIMUser(c *fiber.Ctx, status int, userID int64) error {
+	org := c.Locals(scimOrgKey).(*orm.Organization)
+	users, externalIDs, memberOf, err := scimOrgUsers(c.UserContext(), org)
+	if err != nil {
+		return scimError(c, err)
+	}
+	for _, u := range users {
+		if u.ID == userID {
+			r := scimUserResource(c, u, externalIDs[u.ID], memberOf[u.ID])
+			if status == 201 {
+				c.Set(fiber.HeaderLocation, r["meta"].(map[string]any)["location"].(string))
+			}
+			return scimJSON(c, status, scim.Project(r, c.Query("attributes"), c.Query("excludedAttributes")))
+		}
+	}
+	return scimError(c, scimNotFound("User", strconv.FormatInt(userID, 10)))
+}
+
+// handleSCIMUserList lists the organization's users, optionally filtered
+func handleSCIMUserList(c *fiber.Ctx) error {
+	org := c.Locals(scimOrgKey).(*orm.Organization)
+	users, externalIDs, memberOf, err := scimOrgUsers(c.UserContext(), org)
+	if err != nil {
+		return scimError(c, err)
+	}
+	resources := make([]map[string]any, 0, len(users))
+	for _, u := range users {
+		resources = append(resources, scimUserResource(c, u, externalIDs[u.ID], memberOf[u.ID]))
+	}
+	return scimList(c, resources)
+}
+
+// handleSCIMUserGet returns one user
+func handleSCIMUserGet(c *fiber.Ctx) error {
+	user, err := scimLoadUser(c)
+	if err != nil {
+		return scimError(c, err)
+	}
+	return renderSCIMUser(c, 200, user.ID)
+}
+
+// handleSCIMUserCreate provisions a user into the organization
+func handleSCIMUserCreate(c *fiber.Ctx) error {
+	org := c.Locals(scimOrgKey).(*orm.Organization)
+	body, err := scimBody(c)
+	if err != nil {
+		return scimError(c, err)
+	}
+	in, err := parseSCIMUser(body)
+	if err != nil {
+		return scimError(c, err)
+	}
+	if _, err := orm.GetUserByEmail(c.UserContext(), in.Email); err == nil {
+		return scimError(c, &scim.Error{Status: 409, ScimType: scim.ErrUniqueness, Detail: "userName is already in use"})
+	}
+
+	// Without a password the account can only sign in through the organization's SSO
+	var hash string
+	if in.Password != "" {
+		if violations := checkNewPassword(c.UserContext(), nil, in.Password, in.Name, in.Email); len(violations) > 0 {
+			return scimError(c, scimPasswordError(violations))
+		}
+		h, err := hashPassword(c.UserContext(), in.Password)
+		if err != nil {
+			return scimError(c, err)
+		}
+		hash = h
+	}
+	userID, err := orm.CreateUser(c.UserContext(), in.Name, in.Email, in.Company, hash)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return scimError(c, &scim.Error{Status: 409, ScimType: scim.ErrUniqueness, Detail: "userName is already in use"})
+		}
+		return scimError(c, err)
+	}
+	if err := orm.SetUserOrganization(c.UserContext(), userID, org.ID); err != nil {
+		return scimError(c, err)
+	}
+	if in.ExternalID != "" {
+		if err := orm.SetSCIMExternalID(c.UserContext(), userID, org.Slug, in.ExternalID); err != nil {
+			return scimError(c, err)
+		}
+	}
+	if in.Active != nil && !*in.Active {
+		if err := orm.SetUserDisabled(c.UserContext(), userID, true); err != nil {
+			return scimError(c, err)
+		}
+	}
+
+	scimAudit(c, auditSCIMUserCreate, in.Email, fiber.Map{"external_id": in.ExternalID, "active": in.Active == nil || *in.Active})
+	signups.Inc("scim")
+	return renderSCIMUser(c, 201, userID)
+}
+
+// updateSCIMUser stores a replaced or patched User resource. Deactivation signs the user
+// out of every session and revokes their OAuth grants immediately.
+func updateSCIMUser(c *fiber.Ctx, user *orm.User, in *scimUserInput) error {
+	org := c.Locals(scimOrgKey).(*orm.Organization)
+
+	if in.Email != user.Email {
+		if other, err := orm.GetUserByEmail(c.UserContext(), in.Email); err == nil && other.ID != user.ID {
+			return &scim.Error{Status: 409, ScimType: scim.ErrUniqueness, Detail: "userName is already in use"}
+		}
+	}
+	if in.Password != "" {
+		if violations := checkNewPassword(c.UserContext(), user, in.Password, in.Name, in.Email); len(violations) > 0 {
+			return scimPasswordError(violations)
+		}
+	}
+	if err := orm.UpdateUser(c.UserContext(), user.ID, in.Name, in.Email, in.Company); err != nil {
+		return err
+	}
+	if in.Password != "" {
+		h, err := hashPassword(c.UserContext(), in.Password)
+		if err != nil {
+			return err
+		}
+		if err := orm.UpdateUserPassword(c.UserContext(), user.ID, h, passwordPolicy.History); err != nil {
+			return err
+		}
+	}
+	externalIDs, err := orm.SCIMExternalIDs(c.UserContext(), org.Slug)
+	if err != nil {
+		return err
+	}
+	if externalIDs[user.ID] != in.ExternalID {
+		if err := orm.SetSCIMExternalID(c.UserContext(), user.ID, org.Slug, in.ExternalID); err != nil {
+			return err
+		}
+	}
+	scimAudit(c, auditSCIMUserUpdate, in.Email, fiber.Map{"previous_email": user.Email})
+
+	if in.Active != nil && *in.Active == user.Disabled {
+		if err := orm.SetUserDisabled(c.UserContext(), user.ID, !*in.Active); err != nil {
+			return err
+		}
+		action := auditSCIMUserReactivate
+		if !*in.Active {
+			action = auditSCIMUserDeactivate
+		}
+		scimAudit(c, action, in.Email, nil)
+	}
+	return nil
+}
+
+// handleSCIMUserReplace replaces a user (PUT)
+func handleSCIMUserReplace(c *fiber.Ctx) error {
+	user, err := scimLoadUser(c)
+	if err != nil {
+		return scimError(c, err)
+	}
+	body, err := scimBody(c)
+	if err != nil {
+		return scimError(c, err)
+	}
+	in, err := parseSCIMUser(body)
+	if err != nil {
+		return scimError(c, err)
+	}
+	if err := updateSCIMUser(c, user, in); err != nil {
+		return scimError(c, err)
+	}
+	return renderSCIMUser(c, 200, user.ID)
+}
+
+// handleSCIMUserPatch applies PATCH operations to the current User resource
+func handleSCIMUserPatch(c *fiber.Ctx) error {
+	org := c.Locals(scimOrgKey).(*orm.Organization)
+	user, err := scimLoadUser(c)
+	if err != nil {
+		return scimError(c, err)
+	}
+	req := new(scim.PatchRequest)
+	if err := json.Unmarshal(c.Body(), req); err != nil {
+		return scimError(c, scim.BadRequest(scim.ErrInvalidSyntax, "Invalid PATCH request body"))
+	}
+
+	externalIDs, err := orm.SCIMExternalIDs(c.UserContext(), org.Slug)
+	if err != nil {
+		return scimError(c, err)
+	}
+	resource := scimUserResource(c, user, externalIDs[user.ID], nil)
+	if err := scim.ApplyPatch(resource, req.Operations); err != nil {
+		return scimError(c, err)
+	}
+	reconcileSCIMUserPatch(resource, user)
+	in, err := parseSCIMUser(resource)
+	if err != nil {
+		return scimError(c, err)
+	}
+	if err := updateSCIMUser(c, user, in); err != nil {
+		return scimError(c, err)
+	}
+	return renderSCIMUser(c, 200, user.ID)
+}
+
+// reconcileSCIMUserPatch copies changes made through redundant attributes onto the ones
+// parseSCIMUser reads first: name parts onto displayName and the primary email onto userName
+func reconcileSCIMUserPatch(resource map[string]any, user *orm.User) {
+	if scim.GetString(resource, "displayName") == user.Name {
+		name := scim.GetMap(resource, "name")
+		formatted := strings.TrimSpace(scim.GetString(name, "formatted"))
+		given, family := scim.GetString(name, "givenName"), scim.GetString(name, "familyName")
+		oldGiven, oldFamily, _ := strings.Cut(user.Name, " ")
+		switch {
+		case formatted != "" && formatted != user.Name:
+			resource["displayName"] = formatted
+		case given != oldGiven || family != oldFamily:
+			resource["displayName"] = strings.TrimSpace(given + " " + family)
+		}
+	}
+
+	if strings.EqualFold(scim.GetString(resource, "userName"), user.Email) {
+		emails, _ := scim.Get(resource, "emails")
+		items, _ := emails.([]any)
+		for _, item := range items {
+			m, _ := item.(map[string]any)
+			if primary, _ := scim.GetBool(m, "primary"); primary || len(items) == 1 {
+				if v := strings.TrimSpace(scim.GetString(m, "value")); v != "" {
+					resource["userName"] = v
+				}
+				break
+			}
+		}
+	}
+}
+
+// handleSCIMUserDelete deprovisions a user by deleting the account
+func handleSCIMUserDelete(c *fiber.Ctx) error {
+	user, err := scimLoadUser(c)
+	if err != nil {
+		return scimError(c, err)
+	}
+	if err := orm.DeleteUser(c.UserContext(), user.ID); err != nil {
+		return scimError(c, err)
+	}
+	deleteBlob(user.AvatarKey)
+	scimAudit(c, auditSCIMUserDelete, user.Email, nil)
+	return c.SendStatus(204)
+}
+
+// scimGroupResource renders a group; users maps member ids to their accounts for display names
+func scimGroupResource(c *fiber.Ctx, g *orm.SCIMGroup, users map[int64]*orm.User) map[string]any {
+	id := strconv.FormatInt(g.ID, 10)
+	members := []any{}
+	for _, userID := range g.Members {
+		uid := strconv.FormatInt(userID, 10)
+		m := map[string]any{
+			"value": uid,
+			"type":  "User",
+			"$ref":  externalURL(c, scimBasePath+"/Users/"+uid),
+		}
+		if u := users[userID]; u != nil {
+			m["display"] = u.Name
+		}
+		members = append(members, m)
+	}
+	r := map[string]any{
+		"schemas":     []any{scim.GroupSchema},
+		"id":          id,
+		"displayName": g.DisplayName,
+		"members":     members,
+		"meta":        scimMeta(c, "Group", "/Groups/"+id, g.CreatedAt, g.UpdatedAt),
+	}
+	if g.ExternalID != "" {
+		r["externalId"] = g.ExternalID
+	}
+	return r
+}
+
+// scimUsersByID indexes the organization's users
+func scimUsersByID(ctx context.Context, org *orm.Organization) (map[int64]*orm.User, error) {
+	users, err := orm.ListOrganizationUsers(ctx, org.ID)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]*orm.User, len(users))
+	for _, u := range users {
+		byID[u.ID] = u
+	}
+	return byID, nil
+}
+
+// parseSCIMGroup reads displayName, externalId and members into g; members must belong
+// to the organization
+func parseSCIMGroup(body map[string]any, g *orm.SCIMGroup, users map[int64]*orm.User) error {
+	g.DisplayName = strings.TrimSpace(scim.GetString(body, "displayName"))
+	if g.DisplayName == "" {
+		return scim.BadRequest(scim.ErrInvalidValue, "displayName is required")
+	}
+	g.ExternalID = strings.TrimSpace(scim.GetString(body, "externalId"))
+
+	g.Members = []int64{}
+	raw, _ := scim.Get(body, "members")
+	items, _ := raw.([]any)
+	seen := map[int64]bool{}
+	for _, item := range items {
+		m, _ := item.(map[string]any)
+		value := scim.GetString(m, "value")
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || users[id] == nil {
+			return scim.BadRequest(scim.ErrInvalidValue, "member %q is not a user of this organization", value)
+		}
+		if !seen[id] {
+			seen[id] = true
+			g.Members = append(g.Members, id)
+		}
+	}
+	return nil
+}
+
+// scimGroupNameTaken reports whether another group of the organization already uses the name
+func scimGroupNameTaken(ctx context.Context, orgID, groupID int64, name string) (bool, error) {
+	groups, err := orm.ListSCIMGroups(ctx, orgID)
+	if err != nil {
+		return false, err
+	}
+	for _, g := range groups {
+		if g.ID != groupID && strings.EqualFold(g.DisplayName, name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// scimLoadGroup resolves the :id parameter to a group of the token's organization
+func scimLoadGroup(c *fiber.Ctx) (*orm.SCIMGroup, error) {
+	org := c.Locals(scimOrgKey).(*orm.Organization)
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return nil, scimNotFound("Group", c.Params("id"))
+	}
+	g, err := orm.GetSCIMGroup(c.UserContext(), org.ID, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, scimNotFound("Group", c.Params("id"))
+		}
+		return nil, err
+	}
+	return g, nil
+}
+
+// renderSCIMGroup reloads a group and writes it as a Group resource
+func renderSCIMGroup(c *fiber.Ctx, status int, groupID int64) error {
+	org := c.Locals(scimOrgKey).(*orm.Organization)
+	g, err := orm.GetSCIMGroup(c.UserContext(), org.ID, groupID)
+	if err != nil {
+		return scimError(c, err)
+	}
+	users, err := scimUsersByID(c.UserContext(), org)
+	if err != nil {
+		return scimError(c, err)
+	}
+	r := scimGroupResource(c, g, users)
+	if status == 201 {
+		c.Set(fiber.HeaderLocation, r["meta"].(map[string]any)["location"].(string))
+	}
+	return scimJSON(c, status, scim.Project(r, c.Query("attributes"), c.Query("excludedAttributes")))
+}
+
+// handleSCIMGroupList lists the organization's groups, optionally filtered
+func handleSCIMGroupList(c *fiber.Ctx) error {
+	org := c.Locals(scimOrgKey).(*orm.Organization)
+	groups, err := orm.ListSCIMGroups(c.UserContext(), org.ID)
+	if err != nil {
+		return scimError(c, err)
+	}
+	users, err := scimUsersByID(c.UserContext(), org)
+	if err != nil {
+		return scimError(c, err)
+	}
+	resources := make([]map[string]any, 0, len(groups))
+	for _, g := range groups {
+		resources = append(resources, scimGroupResource(c, g, users))
+	}
+	return scimList(c, resources)
+}
+
+// handleSCIMGroupGet returns one group
+func handleSCIMGroupGet(c *fiber.Ctx) error {
+	g, err := scimLoadGroup(c)
+	if err != nil {
+		return scimError(c, err)
+	}
+	return renderSCIMGroup(c, 200, g.ID)
+}
+
+// handleSCIMGroupCreate creates a group
+func handleSCIMGroupCreate(c *fiber.Ctx) error {
+	org := c.Locals(scimOrgKey).(*orm.Organization)
+	body, err := scimBody(c)
+	if err != nil {
+		return scimError(c, err)
+	}
+	users, err := scimUsersByID(c.UserContext(), org)
+	if err != nil {
+		return scimError(c, err)
+	}
+	g := &orm.SCIMGroup{OrgID: org.ID}
+	if err := parseSCIMGroup(body, g, users); err != nil {
+		return scimError(c, err)
+	}
+	if taken, err := scimGroupNameTaken(c.UserContext(), org.ID, 0, g.DisplayName); err != nil || taken {
+		if err != nil {
+			return scimError(c, err)
+		}
+		return scimError(c, &scim.Error{Status: 409, ScimType: scim.ErrUniqueness, Detail: "displayName is already in use"})
+	}
+	if err := orm.SaveSCIMGroup(c.UserContext(), g); err != nil {
+		return scimError(c, err)
+	}
+	scimAudit(c, auditSCIMGroupCreate, g.DisplayName, fiber.Map{"members": len(g.Members)})
+	return renderSCIMGroup(c, 201, g.ID)
+}
+
+// updateSCIMGroup stores a replaced or patched group. Membership changes of a role-mapped
+// group are applied to the affected users' roles.
+func updateSCIMGroup(c *fiber.Ctx, old *orm.SCIMGroup, body map[string]any) error {
+	org := c.Locals(scimOrgKey).(*orm.Organization)
+	users, err := scimUsersByID(c.UserContext(), org)
+	if err != nil {
+		return err
+	}
+	g := &orm.SCIMGroup{ID: old.ID, OrgID: org.ID, Role: old.Role}
+	if err := parseSCIMGroup(body, g, users); err != nil {
+		return err
+	}
+	if taken, err := scimGroupNameTaken(c.UserContext(), org.ID, g.ID, g.DisplayName); err != nil || taken {
+		if err != nil {
+			return err
+		}
+		return &scim.Error{Status: 409, ScimType: scim.ErrUniqueness, Detail: "displayName is already in use"}
+	}
+	if err := orm.SaveSCIMGroup(c.UserContext(), g); err != nil {
+		return err
+	}
+
+	added, removed := diffMembers(old.Members, g.Members)
+	meta := fiber.Map{
+		"previous_name": old.DisplayName,
+		"added":         added,
+		"removed":       removed,
+	}
+	if g.Role != "" && len(added)+len(removed) > 0 {
+		kept, err := orm.SyncSCIMGroupRoles(c.UserContext(), append(added, removed...))
+		if err != nil {
+			return err
+		}
+		if len(kept) > 0 {
+			meta["kept_last_admin"] = kept
+		}
+	}
+	scimAudit(c, auditSCIMGroupUpdate, g.DisplayName, meta)
+	return nil
+}
+
+// diffMembers returns the ids present only in after (added) and only in before (removed)
+func diffMembers(before, after []int64) ([]int64, []int64) {
+	in := func(list []int64, id int64) bool {
+		for _, v := range list {
+			if v == id {
+				return true
+			}
+		}
+		return false
+	}
+	added, removed := []int64{}, []int64{}
+	for _, id := range after {
+		if !in(before, id) {
+			added = append(added, id)
+		}
+	}
+	for _, id := range before {
+		if !in(after, id) {
+			removed = append(removed, id)
+		}
+	}
+	return added, removed
+}
+
+// handleSCIMGroupReplace replaces a group (PUT)
+func handleSCIMGroupReplace(c *fiber.Ctx) error {
+	g, err := scimLoadGroup(c)
+	if err != nil {
+		return scimError(c, err)
+	}
+	body, err := scimBody(c)
+	if err != nil {
+		return scimError(c, err)
+	}
+	if err := updateSCIMGroup(c, g, body); err != nil {
+		return scimError(c, err)
+	}
+	return renderSCIMGroup(c, 200, g.ID)
+}
+
+// handleSCIMGroupPatch applies PATCH operations, typically member adds and removes
+func handleSCIMGroupPatch(c *fiber.Ctx) error {
+	org := c.Locals(scimOrgKey).(*orm.Organization)
+	g, err := scimLoadGroup(c)
+	if err != nil {
+		return scimError(c, err)
+	}
+	req := new(scim.PatchRequest)
+	if err := json.Unmarshal(c.Body(), req); err != nil {
+		return scimError(c, scim.BadRequest(scim.ErrInvalidSyntax, "Invalid PATCH request body"))
+	}
+	users, err := scimUsersByID(c.UserContext(), org)
+	if err != nil {
+		return scimError(c, err)
+	}
+	resource := scimGroupResource(c, g, users)
+	if err := scim.ApplyPatch(resource, req.Operations); err != nil {
+		return scimError(c, err)
+	}
+	if err := updateSCIMGroup(c, g, resource); err != nil {
+		return scimError(c, err)
+	}
+	return renderSCIMGroup(c, 200, g.ID)
+}
+
+// handleSCIMGroupDelete deletes a group; members of a role-mapped group lose that role
+func handleSCIMGroupDelete(c *fiber.Ctx) error {
+	org := c.Locals(scimOrgKey).(*orm.Organization)
+	g, err := scimLoadGroup(c)
+	if err != nil {
+		return scimError(c, err)
+	}
+	if err := orm.DeleteSCIMGroup(c.UserContext(), org.ID, g.ID); err != nil {
+		return scimError(c, err)
+	}
+	meta := fiber.Map{"members": len(g.Members)}
+	if g.Role != "" {
+		kept, err := orm.SyncSCIMGroupRoles(c.UserContext(), g.Members)
+		if err != nil {
+			return scimError(c, err)
+		}
+		if len(kept) > 0 {
+			meta["kept_last_admin"] = kept
+		}
+	}
+	scimAudit(c, auditSCIMGroupDelete, g.DisplayName, meta)
+	return c.SendStatus(204)
+}
+
+// handleSCIMTokenList lists an organization's provisioning tokens (never the secrets)
+func handleSCIMTokenList(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+	org, err := loadOrg(c)
+	if err != nil {
+		return err
+	}
+	tokens, err := orm.ListSCIMTokens(c.UserContext(), org.ID)
+	if err != nil {
+		logf(c, "Error listing SCIM tokens: %v", err)
+		return newAPIError(500, codeInternal, "Failed to load SCIM tokens")
+	}
+	recordAudit(c, admin, auditAdminSCIMTokenList, org.Slug, nil)
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"tokens":   tokens,
+		"base_url": externalURL(c, scimBasePath),
+	})
+}
+
+// handleSCIMTokenCreate issues a provisioning token. The token is only returned here.
+func handleSCIMTokenCreate(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+	org, err := loadOrg(c)
+	if err != nil {
+		return err
+	}
+
+	type CreateTokenRequest struct {
+		Description string `json:"description"`
+	}
+	req := new(CreateTokenRequest)
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(req); err != nil {
+			return errInvalidBody()
+		}
+	}
+
+	secret := auth.RandomToken(32)
+	tok := &orm.SCIMToken{
+		OrgID:       org.ID,
+		TokenHash:   auth.HashToken(secret),
+		Description: strings.TrimSpace(req.Description),
+		CreatedBy:   admin.ID,
+	}
+	if err := orm.CreateSCIMToken(c.UserContext(), tok); err != nil {
+		logf(c, "Error creating SCIM token: %v", err)
+		return newAPIError(500, codeInternal, "Failed to create SCIM token")
+	}
+
+	recordAudit(c, admin, auditAdminSCIMTokenCreate, org.Slug, fiber.Map{"token_id": tok.ID, "description": tok.Description})
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"id":       tok.ID,
+		"token":    secret,
+		"base_url": externalURL(c, scimBasePath),
+	})
+}
+
+// handleSCIMTokenDelete revokes a provisioning token
+func handleSCIMTokenDelete(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+	org, err := loadOrg(c)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return newAPIError(404, codeNotFound, "SCIM token not found")
+	}
+	deleted, err := orm.DeleteSCIMToken(c.UserContext(), org.ID, id)
+	if err != nil {
+		logf(c, "Error deleting SCIM token: %v", err)
+		return newAPIError(500, codeInternal, "Failed to delete SCIM token")
+	}
+	if !deleted {
+		return newAPIError(404, codeNotFound, "SCIM token not found")
+	}
+	recordAudit(c, admin, auditAdminSCIMTokenDelete, org.Slug, fiber.Map{"token_id": id})
+	return c.JSON(fiber.Map{
+		"success": true,
+	})
+}
+
+// handleSCIMGroupAdminList lists provisioned groups with their role mappings
+func handleSCIMGroupAdminList(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+	org, err := loadOrg(c)
+	if err != nil {
+		return err
+	}
+	groups, err := orm.ListSCIMGroups(c.UserContext(), org.ID)
+	if err != nil {
+		logf(c, "Error listing SCIM groups: %v", err)
+		return newAPIError(500, codeInternal, "Failed to load groups")
+	}
+	recordAudit(c, admin, auditAdminSCIMGroupList, org.Slug, nil)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"groups":  groups,
+	})
+}
+
+// handleSCIMGroupRoleSet maps a provisioned group to a role granted to its members.
+// Mappings are an administrator decision; identity providers cannot set them.
+func handleSCIMGroupRoleSet(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+	org, err := loadOrg(c)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return newAPIError(404, codeNotFound, "Group not found")
+	}
+	g, err := orm.GetSCIMGroup(c.UserContext(), org.ID, id)
+	if err != nil {
+		return newAPIError(404, codeNotFound, "Group not found")
+	}
+
+	type RoleRequest struct {
+		Role string `json:"role"`
+	}
+	req := new(RoleRequest)
+	if err := c.BodyParser(req); err != nil {
+		return errInvalidBody()
+	}
+	if req.Role != "" && req.Role != orm.RoleUser && req.Role != orm.RoleAdmin {
+		return newAPIError(400, codeValidationFailed, "Role must be \"user\", \"admin\" or empty to remove the mapping").
+			withField("role", fieldInvalid, "Must be user, admin or empty")
+	}
+
+	if req.Role == g.Role {
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	}
+	if err := orm.SetSCIMGroupRole(c.UserContext(), org.ID, g.ID, req.Role); err != nil {
+		logf(c, "Error setting SCIM group role: %v", err)
+		return newAPIError(500, codeInternal, "Failed to update group")
+	}
+	kept, err := orm.SyncSCIMGroupRoles(c.UserContext(), g.Members)
+	if err != nil {
+		logf(c, "Error applying SCIM group roles: %v", err)
+		return newAPIError(500, codeInternal, "Failed to apply the role to group members")
+	}
+	meta := fiber.Map{
+		"group":         g.DisplayName,
+		"role":          req.Role,
+		"previous_role": g.Role,
+		"members":       len(g.Members),
+	}
+	if len(kept) > 0 {
+		meta["kept_last_admin"] = kept
+	}
+	recordAudit(c, admin, auditAdminSCIMGroupRoleSet, org.Slug, meta)
+	return c.JSON(fiber.Map{
+		"success": true,
+	})
+}
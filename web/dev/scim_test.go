@@ -0,0 +1,244 @@
+package dev
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/auth"
+	"github.com/isymbo/sachi/orm"
+	"github.com/isymbo/sachi/scim"
+)
+
+// testSCIMClient provisions one organization through its SCIM token
+type testSCIMClient struct {
+	org   *orm.Organization
+	token string
+}
+
+func newTestSCIMClient(t *testing.T, slug string) *testSCIMClient {
+	t.Helper()
+	ctx := context.Background()
+	orgID, err := orm.CreateOrganization(ctx, slug, "Org "+slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	org, err := orm.GetOrganizationByID(ctx, orgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := auth.RandomToken(32)
+	if err := orm.CreateSCIMToken(ctx, &orm.SCIMToken{OrgID: orgID, TokenHash: auth.HashToken(token)}); err != nil {
+		t.Fatal(err)
+	}
+	return &testSCIMClient{org: org, token: token}
+}
+
+// do sends a SCIM request and decodes the response resource, if any
+func (s *testSCIMClient) do(t *testing.T, method, path string, body any) (int, map[string]any) {
+	t.Helper()
+	var req *http.Request
+	if body != nil {
+		data, _ := json.Marshal(body)
+		req = httptest.NewRequest(method, scimBasePath+path, strings.NewReader(string(data)))
+		req.Header.Set(fiber.HeaderContentType, scim.ContentType)
+	} else {
+		req = httptest.NewRequest(method, scimBasePath+path, nil)
+	}
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+s.token)
+	resp := testRequest(t, req)
+	out := map[string]any{}
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+// createUser provisions a user and returns its id
+func (s *testSCIMClient) createUser(t *testing.T, email string) int64 {
+	t.Helper()
+	status, out := s.do(t, "POST", "/Users", map[string]any{
+		"schemas":  []string{scim.UserSchema},
+		"userName": email,
+		"name":     map[string]any{"formatted": email},
+	})
+	id, _ := strconv.ParseInt(fmt.Sprint(out["id"]), 10, 64)
+	if status != http.StatusCreated || id == 0 {
+		t.Fatalf("creating %s: got %d %v", email, status, out)
+	}
+	return id
+}
+
+// createGroup provisions a group with members and returns its id
+func (s *testSCIMClient) createGroup(t *testing.T, name string, members ...int64) int64 {
+	t.Helper()
+	list := []map[string]any{}
+	for _, id := range members {
+		list = append(list, map[string]any{"value": strconv.FormatInt(id, 10)})
+	}
+	status, out := s.do(t, "POST", "/Groups", map[string]any{
+		"schemas":     []string{scim.GroupSchema},
+		"displayName": name,
+		"members":     list,
+	})
+	id, _ := strconv.ParseInt(fmt.Sprint(out["id"]), 10, 64)
+	if status != http.StatusCreated || id == 0 {
+		t.Fatalf("creating group %s: got %d %v", name, status, out)
+	}
+	return id
+}
+
+// patchMembers adds or removes one member of a group, as identity providers do
+func (s *testSCIMClient) patchMembers(t *testing.T, groupID int64, op string, userID int64) {
+	t.Helper()
+	status, out := s.do(t, "PATCH", fmt.Sprintf("/Groups/%d", groupID), map[string]any{
+		"schemas":    []string{scim.PatchOpSchema},
+		"Operations": []map[string]any{{"op": op, "path": "members", "value": []map[string]any{{"value": strconv.FormatInt(userID, 10)}}}},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("%s member %d: got %d %v", op, userID, status, out)
+	}
+}
+
+// assertRole checks a user's role
+func assertRole(t *testing.T, userID int64, want, when string) {
+	t.Helper()
+	user, err := orm.GetUserByID(context.Background(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != want {
+		t.Errorf("%s: user %d is %s, want %s", when, userID, user.Role, want)
+	}
+}
+
+// mapGroupRole maps a provisioned group to a role through the admin API
+func mapGroupRole(t *testing.T, admin *testBrowser, org *orm.Organization, groupID int64, role string) {
+	t.Helper()
+	req := httptest.NewRequest("PUT", fmt.Sprintf("/api/admin/orgs/%s/scim/groups/%d", org.Slug, groupID), strings.NewReader(`{"role": "`+role+`"}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(csrfHeaderName, admin.csrfToken(t))
+	if resp := admin.do(t, req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("mapping group %d to %q: got status %d", groupID, role, resp.StatusCode)
+	}
+}
+
+func TestSCIMGroupRoles(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSCIMClient(t, "scim-roles")
+	admin := signInAdmin(t, "Ada", "ada@scim.example", "192.0.2.70")
+
+	mapped := s.createUser(t, "mapped@scim-roles.example")
+	local := s.createUser(t, "local@scim-roles.example")
+	if err := orm.SetUserRole(ctx, local, orm.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	group := s.createGroup(t, "Admins", mapped, local)
+	assertRole(t, mapped, orm.RoleUser, "groups grant nothing until mapped")
+
+	mapGroupRole(t, admin, s.org, group, orm.RoleAdmin)
+	assertRole(t, mapped, orm.RoleAdmin, "group mapped to admin")
+	assertRole(t, local, orm.RoleAdmin, "group mapped to admin")
+
+	// Membership changes take away only the role the mapping granted
+	s.patchMembers(t, group, "remove", local)
+	assertRole(t, local, orm.RoleAdmin, "locally promoted admin left the group")
+	s.patchMembers(t, group, "remove", mapped)
+	assertRole(t, mapped, orm.RoleUser, "mapped admin left the group")
+	s.patchMembers(t, group, "add", mapped)
+	assertRole(t, mapped, orm.RoleAdmin, "mapped admin rejoined the group")
+
+	// A second mapped group keeps the role when the first stops granting it
+	other := s.createGroup(t, "Ops", mapped, local)
+	mapGroupRole(t, admin, s.org, other, orm.RoleAdmin)
+	mapGroupRole(t, admin, s.org, group, "")
+	assertRole(t, mapped, orm.RoleAdmin, "still in another admin group")
+
+	// Removing the mapping, or deleting the group, demotes
+	mapGroupRole(t, admin, s.org, other, "")
+	assertRole(t, mapped, orm.RoleUser, "mapping removed")
+	mapGroupRole(t, admin, s.org, other, orm.RoleAdmin)
+	assertRole(t, mapped, orm.RoleAdmin, "mapping restored")
+	if status, out := s.do(t, "DELETE", fmt.Sprintf("/Groups/%d", other), nil); status != http.StatusNoContent {
+		t.Fatalf("deleting the group: got %d %v", status, out)
+	}
+	assertRole(t, mapped, orm.RoleUser, "group deleted")
+	assertRole(t, local, orm.RoleAdmin, "group deleted")
+
+	// An admin's own decision is not undone by the mapping
+	mapGroupRole(t, admin, s.org, group, orm.RoleAdmin)
+	if err := orm.SetUserRole(ctx, mapped, orm.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	s.patchMembers(t, group, "remove", mapped)
+	assertRole(t, mapped, orm.RoleAdmin, "promoted by an admin after the mapping")
+}
+
+// onlyAdmin makes userID the only enabled admin until the test ends
+func onlyAdmin(t *testing.T, userID int64) {
+	t.Helper()
+	ctx := context.Background()
+	admins, _, err := orm.ListUsers(ctx, orm.UserFilter{Role: orm.RoleAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range admins {
+		if a.ID == userID || a.Disabled {
+			continue
+		}
+		if err := orm.SetUserRole(ctx, a.ID, orm.RoleUser); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { orm.SetUserRole(ctx, a.ID, orm.RoleAdmin) })
+	}
+}
+
+func TestSCIMCannotDemoteLastAdmin(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSCIMClient(t, "scim-last-admin")
+	user := s.createUser(t, "last@scim-last-admin.example")
+	group := s.createGroup(t, "Admins", user)
+	if err := orm.SetSCIMGroupRole(ctx, s.org.ID, group, orm.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := orm.SyncSCIMGroupRoles(ctx, []int64{user}); err != nil {
+		t.Fatal(err)
+	}
+	assertRole(t, user, orm.RoleAdmin, "group mapped to admin")
+	onlyAdmin(t, user)
+
+	s.patchMembers(t, group, "remove", user)
+	assertRole(t, user, orm.RoleAdmin, "last admin removed from the group")
+	event := lastAuditEvent(t, auditSCIMGroupUpdate, "Admins")
+	if kept, _ := event.Metadata["kept_last_admin"].([]any); len(kept) != 1 || kept[0] != float64(user) {
+		t.Errorf("audit event does not record the skipped demotion: %v", event.Metadata)
+	}
+
+	s.patchMembers(t, group, "add", user)
+	if status, _ := s.do(t, "DELETE", fmt.Sprintf("/Groups/%d", group), nil); status != http.StatusNoContent {
+		t.Fatalf("deleting the group: got status %d", status)
+	}
+	assertRole(t, user, orm.RoleAdmin, "group of the last admin deleted")
+}
+
+func TestSCIMCannotReachUnaffiliatedAccounts(t *testing.T) {
+	s := newTestSCIMClient(t, "scim-reach")
+	outsider := createTestUser(t, "Out", "out@scim-reach.example", "a long enough passphrase")
+
+	if status, _ := s.do(t, "GET", fmt.Sprintf("/Users/%d", outsider.ID), nil); status != http.StatusNotFound {
+		t.Errorf("GET of an account outside the organization: got status %d, want 404", status)
+	}
+	if status, _ := s.do(t, "DELETE", fmt.Sprintf("/Users/%d", outsider.ID), nil); status != http.StatusNotFound {
+		t.Errorf("DELETE of an account outside the organization: got status %d, want 404", status)
+	}
+	if status, _ := s.do(t, "POST", "/Users", map[string]any{"schemas": []string{scim.UserSchema}, "userName": outsider.Email}); status != http.StatusConflict {
+		t.Errorf("provisioning an existing email: got status %d, want 409", status)
+	}
+	if _, err := orm.GetUserByID(context.Background(), outsider.ID); err != nil {
+		t.Errorf("account is gone: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package dev
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/config"
+)
+
+const (
+	cspNonceKey       = "cspNonce"
+	securityPolicyKey = "securityPolicy"
+	cspReportPath     = "/api/csp-report"
+	cspNoncePattern   = "{nonce}"
+)
+
+// securityPolicy describes the security headers sent with a response.
+// Routes can adjust it with withSecurityHeaders.
+type securityPolicy struct {
+	CSP               map[string]string // directive -> sources; "{nonce}" is replaced per request
+	CSPReportOnly     bool
+	FrameOptions      string
+	ReferrerPolicy    string
+	PermissionsPolicy string
+	HSTS              string // only sent over HTTPS
+}
+
+func (p *securityPolicy) clone() *securityPolicy {
+	cp := *p
+	cp.CSP = make(map[string]string, len(p.CSP))
+	for k, v := range p.CSP {
+		cp.CSP[k] = v
+	}
+	return &cp
+}
+
+// cspHeader renders the CSP directives with the request nonce
+func (p *securityPolicy) cspHeader(nonce string) string {
+	names := make([]string, 0, len(p.CSP))
+	for name := range p.CSP {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.ReplaceAll(p.CSP[name], cspNoncePattern, nonce)
+		if value == "" {
+			parts = append(parts, name)
+		} else {
+			parts = append(parts, name+" "+value)
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// defaultSecurityPolicy covers the static pages and the CDNs they load from
+func defaultSecurityPolicy(args *config.CmdArgs) *securityPolicy {
+	return &securityPolicy{
+		CSP: map[string]string{
+			"default-src":     "'self'",
+			"script-src":      "'self' 'nonce-" + cspNoncePattern + "' https://cdn.jsdelivr.net https://unpkg.com",
+			"style-src":       "'self' 'unsafe-inline' https://cdn.jsdelivr.net https://cdnjs.cloudflare.com https://fonts.googleapis.com",
+			"font-src":        "'self' data: https://fonts.gstatic.com https://cdnjs.cloudflare.com",
+			"img-src":         "'self' data:",
+			"connect-src":     "'self'",
+			"object-src":      "'none'",
+			"base-uri":        "'self'",
+			"form-action":     "'self'",
+			"frame-ancestors": "'none'",
+			"report-uri":      appPath(cspReportPath),
+			"report-to":       "csp-endpoint",
+		},
+		CSPReportOnly:     args.CSPReportOnly,
+		FrameOptions:      "DENY",
+		ReferrerPolicy:    "strict-origin-when-cross-origin",
+		PermissionsPolicy: "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+		HSTS:              "max-age=31536000; includeSubDomains",
+	}
+}
+
+// apiSecurityPolicy locks JSON responses down further: they never load subresources
+func apiSecurityPolicy(p *securityPolicy) {
+	p.CSP = map[string]string{
+		"default-src":     "'none'",
+		"frame-ancestors": "'none'",
+		"report-uri":      appPath(cspReportPath),
+		"report-to":       "csp-endpoint",
+	}
+}
+
+// newSecurityHeaders sets security headers on every response. A fresh CSP nonce is
+// generated per request and exposed via c.Locals(cspNonceKey) for inline scripts.
+func newSecurityHeaders(base *securityPolicy) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		nonce, err := newNonce()
+		if err != nil {
+			return err
+		}
+		c.Locals(cspNonceKey, nonce)
+		c.Locals(securityPolicyKey, base)
+
+		err = c.Next()
+
+		p, _ := c.Locals(securityPolicyKey).(*securityPolicy)
+		if p == nil {
+			p = base
+		}
+		if len(p.CSP) > 0 {
+			header := fiber.HeaderContentSecurityPolicy
+			if p.CSPReportOnly {
+				header = fiber.HeaderContentSecurityPolicyReportOnly
+			}
+			c.Set(header, p.cspHeader(nonce))
+			c.Set("Reporting-Endpoints", `csp-endpoint="`+appPath(cspReportPath)+`"`)
+		}
+		if p.FrameOptions != "" {
+			c.Set(fiber.HeaderXFrameOptions, p.FrameOptions)
+		}
+		if p.ReferrerPolicy != "" {
+			c.Set(fiber.HeaderReferrerPolicy, p.ReferrerPolicy)
+		}
+		if p.PermissionsPolicy != "" {
+			c.Set(fiber.HeaderPermissionsPolicy, p.PermissionsPolicy)
+		}
+		if p.HSTS != "" && isHTTPS(c) {
+			c.Set(fiber.HeaderStrictTransportSecurity, p.HSTS)
+		}
+		c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+		return err
+	}
+}
+
+// withSecurityHeaders overrides the security policy for the routes it is attached to
+func withSecurityHeaders(modify func(p *securityPolicy)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if p, ok := c.Locals(securityPolicyKey).(*securityPolicy); ok {
+			cp := p.clone()
+			modify(cp)
+			c.Locals(securityPolicyKey, cp)
+		}
+		return c.Next()
+	}
+}
+
+// cspNonce returns the nonce generated for the current request
+func cspNonce(c *fiber.Ctx) string {
+	nonce, _ := c.Locals(cspNonceKey).(string)
+	return nonce
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// handleCSPReport receives violation reports sent by browsers (report-uri and Reporting API formats)
+func handleCSPReport(c *fiber.Ctx) error {
+	body := c.Body()
+	if len(body) > 0 {
+		if len(body) > 8192 {
+			body = body[:8192]
+		}
+		logf(c, "CSP violation from %s: %s", clientIP(c), strings.TrimSpace(string(body)))
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,247 @@
+package dev
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/isymbo/sachi/auth"
+	"github.com/isymbo/sachi/auth/authtest"
+	"github.com/isymbo/sachi/orm"
+)
+
+// setupTestOIDC creates an organization whose OIDC provider is a local test IdP
+func setupTestOIDC(t *testing.T, slug, emailDomains string) (*authtest.OIDCProvider, *orm.Organization) {
+	t.Helper()
+	ctx := context.Background()
+	idp := authtest.NewOIDCProvider("sachi-" + slug)
+	t.Cleanup(idp.Close)
+
+	orgID, err := orm.CreateOrganization(ctx, slug, "Org "+slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = orm.SaveOIDCProvider(ctx, &orm.OIDCProvider{
+		OrgID:        orgID,
+		Issuer:       idp.Issuer(),
+		ClientID:     idp.ClientID,
+		ClientSecret: "secret",
+		Scopes:       "openid email profile",
+		EmailDomains: emailDomains,
+		Enabled:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	org, err := orm.GetOrganizationByID(ctx, orgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idp, org
+}
+
+// oidcLogin is a sign-in started at /api/sso/oidc/:org/login, as the IdP sees it
+type oidcLogin struct {
+	state, nonce, challenge string
+	cookie                  string // the sso_state cookie binding the state to the browser
+}
+
+func startOIDCLogin(t *testing.T, idp *authtest.OIDCProvider, slug string) *oidcLogin {
+	t.Helper()
+	resp := testRequest(t, httptest.NewRequest("GET", "/api/sso/oidc/"+slug+"/login?next=/profile", nil))
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("login: got status %d, want a redirect to the IdP", resp.StatusCode)
+	}
+	u, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || u.Scheme+"://"+u.Host != idp.URL || u.Path != "/authorize" {
+		t.Fatalf("login redirected to %s", resp.Header.Get("Location"))
+	}
+	q := u.Query()
+	if q.Get("client_id") != idp.ClientID || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization request %s", u)
+	}
+	cookie, _ := responseCookie(resp, ssoStateCookie)
+	return &oidcLogin{state: q.Get("state"), nonce: q.Get("nonce"), challenge: q.Get("code_challenge"), cookie: cookie}
+}
+
+// callback returns to the app from the IdP with code and state
+func (l *oidcLogin) callback(t *testing.T, code, state string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/sso/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	req.AddCookie(&http.Cookie{Name: ssoStateCookie, Value: l.cookie})
+	return testRequest(t, req)
+}
+
+// finish has the IdP issue idToken and completes the login
+func (l *oidcLogin) finish(t *testing.T, idp *authtest.OIDCProvider, idToken string) *http.Response {
+	t.Helper()
+	return l.callback(t, idp.IssueCode(l.challenge, idToken), l.state)
+}
+
+// assertSSOFailed checks that the login was refused for reason
+func assertSSOFailed(t *testing.T, resp *http.Response, target, reason string) {
+	t.Helper()
+	if got := redirectPath(t, resp); got != "/login.html?error=sso_failed" {
+		t.Errorf("redirected to %s, want the login page", got)
+	}
+	if _, ok := responseCookie(resp, "session_token"); ok {
+		t.Error("a session cookie was set")
+	}
+	e := lastAuditEvent(t, auditSSOLoginFailed, target)
+	if e.Metadata["reason"] != reason {
+		t.Errorf("failure reason %v, want %s", e.Metadata["reason"], reason)
+	}
+}
+
+func TestOIDCLoginProvisionsUser(t *testing.T) {
+	idp, org := setupTestOIDC(t, "oidc-jit", "jit.example")
+	ctx := context.Background()
+
+	login := startOIDCLogin(t, idp, org.Slug)
+	resp := login.finish(t, idp, idp.IDToken(map[string]any{
+		"sub":            "ann-1",
+		"nonce":          login.nonce,
+		"email":          "Ann@jit.example",
+		"email_verified": true,
+		"name":           "Ann Example",
+	}))
+	if got := redirectPath(t, resp); got != "/profile" {
+		t.Fatalf("redirected to %s, want /profile", got)
+	}
+	token, ok := responseCookie(resp, "session_token")
+	if !ok || token == "" {
+		t.Fatal("no session cookie")
+	}
+
+	user, err := orm.ValidateSession(ctx, token)
+	if err != nil {
+		t.Fatalf("session: %v", err)
+	}
+	if user.Email != "ann@jit.example" || user.Name != "Ann Example" || user.OrgID != org.ID || user.PasswordHash != "" {
+		t.Errorf("unexpected provisioned user %+v", user)
+	}
+	if linked, err := orm.GetUserByIdentity(ctx, orm.ProviderOIDC, idp.Issuer(), "ann-1"); err != nil || linked.ID != user.ID {
+		t.Errorf("identity not linked: %v", err)
+	}
+	lastAuditEvent(t, auditSSOProvision, user.Email)
+
+	// The next login finds the account by its linked identity, even with another email
+	login = startOIDCLogin(t, idp, org.Slug)
+	resp = login.finish(t, idp, idp.IDToken(map[string]any{"sub": "ann-1", "nonce": login.nonce, "email": "ann.renamed@jit.example"}))
+	token, _ = responseCookie(resp, "session_token")
+	if again, err := orm.ValidateSession(ctx, token); err != nil || again.ID != user.ID {
+		t.Errorf("second login did not sign in the same account: %v", err)
+	}
+}
+
+func TestOIDCLoginLinksExistingAccount(t *testing.T) {
+	idp, org := setupTestOIDC(t, "oidc-link", "link.example")
+	existing := createTestUser(t, "Bea", "bea@link.example", "a long enough passphrase")
+
+	login := startOIDCLogin(t, idp, org.Slug)
+	resp := login.finish(t, idp, idp.IDToken(map[string]any{
+		"sub": "bea-1", "nonce": login.nonce, "email": "bea@link.example", "email_verified": true,
+	}))
+	token, _ := responseCookie(resp, "session_token")
+	user, err := orm.ValidateSession(context.Background(), token)
+	if err != nil || user.ID != existing.ID {
+		t.Fatalf("existing account not signed in: %v %+v", err, user)
+	}
+	// Out of reach of the organization's SCIM token
+	if user.OrgID != 0 {
+		t.Errorf("existing account was moved into organization %d", user.OrgID)
+	}
+	if linked, err := orm.GetUserByIdentity(context.Background(), orm.ProviderOIDC, idp.Issuer(), "bea-1"); err != nil || linked.ID != existing.ID {
+		t.Errorf("identity not linked: %v", err)
+	}
+}
+
+func TestOIDCLoginRejects(t *testing.T) {
+	idp, org := setupTestOIDC(t, "oidc-reject", "reject.example")
+	claims := func(nonce, email string, verified bool) map[string]any {
+		return map[string]any{"sub": "sub-" + email, "nonce": nonce, "email": email, "email_verified": verified}
+	}
+
+	t.Run("state not bound to this browser", func(t *testing.T) {
+		login := startOIDCLogin(t, idp, org.Slug)
+		login.cookie = auth.RandomToken(32)
+		resp := login.finish(t, idp, idp.IDToken(claims(login.nonce, "cy@reject.example", true)))
+		assertSSOFailed(t, resp, "", "state_mismatch")
+	})
+
+	t.Run("state used twice", func(t *testing.T) {
+		login := startOIDCLogin(t, idp, org.Slug)
+		token := idp.IDToken(claims(login.nonce, "dee@reject.example", true))
+		if resp := login.finish(t, idp, token); redirectPath(t, resp) != "/profile" {
+			t.Fatal("first callback failed")
+		}
+		resp := login.finish(t, idp, token)
+		assertSSOFailed(t, resp, "", "state_expired")
+	})
+
+	t.Run("wrong nonce", func(t *testing.T) {
+		login := startOIDCLogin(t, idp, org.Slug)
+		resp := login.finish(t, idp, idp.IDToken(claims(auth.RandomToken(32), "eve@reject.example", true)))
+		assertSSOFailed(t, resp, org.Slug, "invalid_id_token")
+	})
+
+	t.Run("bad signature", func(t *testing.T) {
+		login := startOIDCLogin(t, idp, org.Slug)
+		full := claims(login.nonce, "fay@reject.example", true)
+		full["iss"], full["aud"], full["exp"] = idp.Issuer(), idp.ClientID, 9999999999
+		resp := login.finish(t, idp, authtest.SignJWT(authtest.NewKey(), idp.KeyID, full))
+		assertSSOFailed(t, resp, org.Slug, "invalid_id_token")
+	})
+
+	t.Run("code issued for another PKCE challenge", func(t *testing.T) {
+		login := startOIDCLogin(t, idp, org.Slug)
+		_, challenge := auth.NewPKCE()
+		code := idp.IssueCode(challenge, idp.IDToken(claims(login.nonce, "gus@reject.example", true)))
+		resp := login.callback(t, code, login.state)
+		assertSSOFailed(t, resp, org.Slug, "code_exchange_failed")
+	})
+
+	t.Run("unverified email", func(t *testing.T) {
+		login := startOIDCLogin(t, idp, org.Slug)
+		resp := login.finish(t, idp, idp.IDToken(claims(login.nonce, "hal@reject.example", false)))
+		assertSSOFailed(t, resp, org.Slug, "email_not_verified")
+		if _, err := orm.GetUserByEmail(context.Background(), "hal@reject.example"); err == nil {
+			t.Error("an account was provisioned for an unverified email")
+		}
+	})
+
+	t.Run("new account outside the organization's domains", func(t *testing.T) {
+		login := startOIDCLogin(t, idp, org.Slug)
+		resp := login.finish(t, idp, idp.IDToken(claims(login.nonce, "ivy@elsewhere.example", true)))
+		assertSSOFailed(t, resp, org.Slug, "email_domain_not_allowed")
+		if _, err := orm.GetUserByEmail(context.Background(), "ivy@elsewhere.example"); err == nil {
+			t.Error("an account was provisioned outside the organization's domains")
+		}
+	})
+
+	t.Run("existing account outside the organization's domains", func(t *testing.T) {
+		createTestUser(t, "Jo", "jo@elsewhere.example", "a long enough passphrase")
+		login := startOIDCLogin(t, idp, org.Slug)
+		resp := login.finish(t, idp, idp.IDToken(claims(login.nonce, "jo@elsewhere.example", true)))
+		assertSSOFailed(t, resp, org.Slug, "email_domain_not_allowed")
+	})
+}
+
+func TestOIDCLoginOrganizationMemberOutsideDomains(t *testing.T) {
+	idp, org := setupTestOIDC(t, "oidc-member", "member.example")
+	member := createTestUser(t, "Kim", "kim@contractor.example", "a long enough passphrase")
+	if err := orm.SetUserOrganization(context.Background(), member.ID, org.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Members of the organization may sign in through its IdP with any email domain
+	login := startOIDCLogin(t, idp, org.Slug)
+	resp := login.finish(t, idp, idp.IDToken(map[string]any{
+		"sub": "kim-1", "nonce": login.nonce, "email": "kim@contractor.example", "email_verified": true,
+	}))
+	if got := redirectPath(t, resp); got != "/profile" {
+		t.Errorf("redirected to %s, want /profile", got)
+	}
+}
@@ -0,0 +1,193 @@
+package dev
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/orm"
+)
+
+// Pages are html/template files at the root of the frontend. Each one starts with
+// {{template "site-layout" .}} or {{template "app-layout" .}} and defines "title" and
+// "content"; the layouts and the partials they share (head, navigation, scripts) live in
+// templates/.
+const layoutGlob = "templates/*.html"
+
+// pageTemplates holds the parsed pages by file name. It is filled once at startup for the
+// embedded frontend and stays nil with --assets-dir, where pages are parsed on every request.
+var pageTemplates map[string]*template.Template
+
+var templateFuncs = template.FuncMap{
+	"asset": assetURL,
+}
+
+// pageData is what page templates are rendered with
+type pageData struct {
+	Page  string  // file name without .html; marks the active navigation link
+	Nonce string  // CSP nonce for <script> tags
+	User  *meUser // signed-in user, nil for guests
+	Data  any     // values only this page uses
+}
+
+// meUser is the signed-in user as returned by /api/me and rendered into pages
+type meUser struct {
+	ID                 int64           `json:"id"`
+	Name               string          `json:"name"`
+	Email              string          `json:"email"`
+	Company            string          `json:"company"`
+	HasPassword        bool            `json:"has_password"`
+	Role               string          `json:"role"`
+	DeleteAt           *time.Time      `json:"delete_at,omitempty"`
+	MustChangePassword bool            `json:"must_change_password,omitempty"`
+	Impersonator       *meImpersonator `json:"impersonator,omitempty"`
+	AvatarURL          string          `json:"avatar_url,omitempty"`
+}
+
+// meImpersonator is the administrator acting as the user
+type meImpersonator struct {
+	ID    int64  `json:"id"`
+	Email string `json:"email"`
+}
+
+func newMeUser(c *fiber.Ctx, user *orm.User) *meUser {
+	me := &meUser{
+		ID:                 user.ID,
+		Name:               user.Name,
+		Email:              user.Email,
+		Company:            user.Company,
+		HasPassword:        user.PasswordHash != "",
+		Role:               user.Role,
+		MustChangePassword: user.MustChangePassword,
+	}
+	if !user.DeleteAt.IsZero() {
+		deleteAt := user.DeleteAt.UTC()
+		me.DeleteAt = &deleteAt
+	}
+	if imp, ok := c.Locals(impersonationKey).(*orm.Impersonation); ok {
+		me.Impersonator = &meImpersonator{ID: imp.AdminID, Email: imp.AdminEmail}
+	}
+	if url := avatarURL(user); url != "" {
+		me.AvatarURL = appPath(url)
+	}
+	return me
+}
+
+// IsAdmin reports whether the navigation should offer the admin console
+func (u *meUser) IsAdmin() bool {
+	return u.Role == orm.RoleAdmin
+}
+
+// Initials stands in for a missing profile picture
+func (u *meUser) Initials() string {
+	var initials string
+	for _, word := range strings.Fields(u.Name) {
+		initials += strings.ToUpper(string([]rune(word)[:1]))
+	}
+	if r := []rune(initials); len(r) > 2 {
+		initials = string(r[:2])
+	}
+	return initials
+}
+
+// pageUser returns the user a page is rendered for: the one requireAuth found, or on public
+// pages the owner of the session cookie. Guests get nil.
+func pageUser(c *fiber.Ctx) *meUser {
+	if user, ok := c.Locals("user").(*orm.User); ok {
+		return newMeUser(c, user)
+	}
+	token := c.Cookies("session_token")
+	if token == "" {
+		return nil
+	}
+	user, err := orm.ValidateSession(c.UserContext(), token)
+	if err != nil {
+		return nil
+	}
+	return newMeUser(c, user)
+}
+
+// assetURL is the template function for stylesheet and script links: the fingerprinted
+// path of an embedded asset, or the path itself with --assets-dir
+func assetURL(name string) string {
+	if a, ok := precomputedAssets["/"+name]; ok {
+		return a.hashedPath[1:]
+	}
+	return name
+}
+
+// loadPageTemplates parses every page of the frontend
+func loadPageTemplates(fsys fs.FS) (map[string]*template.Template, error) {
+	names, err := fs.Glob(fsys, "*.html")
+	if err != nil {
+		return nil, err
+	}
+	pages := map[string]*template.Template{}
+	for _, name := range names {
+		if pages[name], err = parsePage(fsys, name); err != nil {
+			return nil, err
+		}
+	}
+	return pages, nil
+}
+
+// parsePage parses a page together with the layouts and partials
+func parsePage(fsys fs.FS, name string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(templateFuncs).ParseFS(fsys, layoutGlob, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse page %s: %v", name, err)
+	}
+	return t, nil
+}
+
+// pageTemplate returns a parsed page, or fiber.ErrNotFound for names that are not pages
+func pageTemplate(name string) (*template.Template, error) {
+	if pageTemplates != nil {
+		t, ok := pageTemplates[name]
+		if !ok {
+			return nil, fiber.ErrNotFound
+		}
+		return t, nil
+	}
+	if _, err := fs.Stat(assetFS, name); err != nil || path.Ext(name) != ".html" {
+		return nil, fiber.ErrNotFound
+	}
+	return parsePage(assetFS, name)
+}
+
+// renderPage renders a page for the request with the signed-in user, the CSP nonce and the
+// page's own data, prefixing root-relative links with the base path
+func renderPage(c *fiber.Ctx, name string, data any) error {
+	name = path.Clean("/" + name)[1:]
+	if strings.Contains(name, "/") {
+		return fiber.ErrNotFound
+	}
+	t, err := pageTemplate(name)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, pageData{
+		Page:  strings.TrimSuffix(name, ".html"),
+		Nonce: cspNonce(c),
+		User:  pageUser(c),
+		Data:  data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to render page %s: %v", name, err)
+	}
+
+	c.Type("html", "utf-8")
+	return c.Send(rewriteBasePath(buf.Bytes()))
+}
+
+// sendPage renders a page that needs no data of its own
+func sendPage(c *fiber.Ctx, name string) error {
+	return renderPage(c, name, nil)
+}
@@ -0,0 +1,206 @@
+package dev
+
+import (
+	"context"
+	"encoding/json"
+	"html"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isymbo/sachi/orm"
+	"github.com/isymbo/sachi/web/static"
+)
+
+var (
+	cspNonceRegexp    = regexp.MustCompile(`'nonce-([^']+)'`)
+	scriptTagRegexp   = regexp.MustCompile(`<script[^>]*>`)
+	scriptNonceRegexp = regexp.MustCompile(`nonce="([^"]*)"`)
+	currentUserRegexp = regexp.MustCompile(`(?s)<script type="application/json" id="current-user">(.*?)</script>`)
+)
+
+// getPage fetches a page and returns its body
+func getPage(t *testing.T, b *testBrowser, target string) (*http.Response, string) {
+	t.Helper()
+	resp := b.get(t, target)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: got status %d", target, resp.StatusCode)
+	}
+	return resp, string(body)
+}
+
+// pageCurrentUser decodes the user a page was rendered for, nil for guests
+func pageCurrentUser(t *testing.T, body string) map[string]any {
+	t.Helper()
+	m := currentUserRegexp.FindStringSubmatch(body)
+	if m == nil {
+		t.Fatal("page has no current-user script")
+	}
+	var user map[string]any
+	if err := json.Unmarshal([]byte(m[1]), &user); err != nil {
+		t.Fatalf("current-user is not JSON: %v\n%s", err, m[1])
+	}
+	return user
+}
+
+func TestPageTemplates(t *testing.T) {
+	pages, err := loadPageTemplates(static.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != len(pageNames()) {
+		t.Errorf("parsed %d pages, the frontend has %d", len(pages), len(pageNames()))
+	}
+
+	b := newTestBrowser("192.0.2.90")
+	for _, target := range []string{"/", "/about.html", "/pricing.html", "/product.html", "/login.html", "/register.html", "/consent.html", "/docs"} {
+		t.Run(target, func(t *testing.T) {
+			resp, body := getPage(t, b, target)
+			if got := resp.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+				t.Errorf("Content-Type = %q", got)
+			}
+			if !strings.HasPrefix(body, "<!DOCTYPE html>") || !strings.Contains(body, `<nav class="navbar">`) || strings.Contains(body, "{{") {
+				t.Error("page is not rendered inside a layout")
+			}
+			if regexp.MustCompile(`<title>\s*</title>`).MatchString(body) {
+				t.Error("page has no title")
+			}
+			if user := pageCurrentUser(t, body); user != nil {
+				t.Errorf("guest page rendered for %v", user)
+			}
+
+			// Every script carries this response's CSP nonce
+			m := cspNonceRegexp.FindStringSubmatch(resp.Header.Get("Content-Security-Policy"))
+			if m == nil {
+				t.Fatal("no nonce in the Content-Security-Policy")
+			}
+			for _, tag := range scriptTagRegexp.FindAllString(body, -1) {
+				if strings.Contains(tag, `type="application/json"`) {
+					continue
+				}
+				if n := scriptNonceRegexp.FindStringSubmatch(tag); n == nil || html.UnescapeString(n[1]) != m[1] {
+					t.Errorf("%s does not carry the nonce %s", tag, m[1])
+				}
+			}
+		})
+	}
+
+	// Nonces are not reused between responses
+	first, _ := getPage(t, b, "/about.html")
+	second, _ := getPage(t, b, "/about.html")
+	if first.Header.Get("Content-Security-Policy") == second.Header.Get("Content-Security-Policy") {
+		t.Error("two responses share a nonce")
+	}
+
+	// Per-page data
+	_, body := getPage(t, b, "/login.html")
+	if !strings.Contains(body, `id="magic-link-form"`) {
+		t.Error("login page does not offer sign-in links")
+	}
+	magicLinksEnabled = false
+	_, body = getPage(t, b, "/login.html")
+	magicLinksEnabled = true
+	if strings.Contains(body, `id="magic-link-form"`) {
+		t.Error("login page offers sign-in links when they are off")
+	}
+
+	// Only pages are rendered
+	for _, target := range []string{"/templates/layout.html", "/missing.html", "/%2e%2e/static.html"} {
+		if resp := b.get(t, target); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: got status %d, want 404", target, resp.StatusCode)
+		}
+	}
+}
+
+func TestPageUser(t *testing.T) {
+	user, b := signInForOAuth(t, "Eve <b>Okafor</b>", "eve@pages.example", "192.0.2.91")
+
+	_, body := getPage(t, b, "/profile")
+	if strings.Contains(body, "<b>Okafor</b>") {
+		t.Error("the user's name is not escaped")
+	}
+	if !strings.Contains(body, `<h1 id="user-name">Eve &lt;b&gt;Okafor&lt;/b&gt;</h1>`) || !strings.Contains(body, "eve@pages.example") {
+		t.Error("profile page is not rendered for the user")
+	}
+	if strings.Contains(body, `href="admin.html"`) {
+		t.Error("the admin console is offered to a user")
+	}
+
+	// The page carries what /api/me returns, so scripts need not fetch it
+	var me struct {
+		User map[string]any `json:"user"`
+	}
+	if err := json.NewDecoder(b.get(t, "/api/me").Body).Decode(&me); err != nil {
+		t.Fatal(err)
+	}
+	if got := pageCurrentUser(t, body); !reflect.DeepEqual(got, me.User) {
+		t.Errorf("page user %v, /api/me %v", got, me.User)
+	}
+	if me.User["id"] != float64(user.ID) {
+		t.Errorf("/api/me returned %v", me.User)
+	}
+
+	// Public pages know the session too
+	_, body = getPage(t, b, "/pricing.html")
+	if !strings.Contains(body, `href="profile.html" class="btn">Profile`) || strings.Contains(body, `href="login.html"`) {
+		t.Error("public page does not show the signed-in navigation")
+	}
+	if got := pageCurrentUser(t, body); got == nil || got["email"] != "eve@pages.example" {
+		t.Errorf("public page rendered for %v", got)
+	}
+
+	// A session that is not valid is a guest
+	guest := newTestBrowser("192.0.2.92")
+	guest.jar.SetCookies(testAppURL, []*http.Cookie{{Name: "session_token", Value: "not-a-session"}})
+	if _, body = getPage(t, guest, "/pricing.html"); pageCurrentUser(t, body) != nil || !strings.Contains(body, `href="login.html"`) {
+		t.Error("an invalid session cookie signs the page in")
+	}
+
+	admin := signInAdmin(t, "Ann Lee", "ann@pages.example", "192.0.2.93")
+	if _, body = getPage(t, admin, "/profile"); !strings.Contains(body, `href="admin.html"`) {
+		t.Error("the admin console is not offered to an admin")
+	}
+}
+
+func TestPageUserImpersonation(t *testing.T) {
+	ctx := context.Background()
+	admin := createTestUser(t, "Ida", "ida@pages.example", "a long enough passphrase")
+	if err := orm.SetUserRole(ctx, admin.ID, orm.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	user := createTestUser(t, "Jon", "jon@pages.example", "a long enough passphrase")
+	token, err := orm.CreateImpersonation(ctx, admin.ID, user.ID, "support ticket", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBrowser("192.0.2.94")
+	b.jar.SetCookies(testAppURL, []*http.Cookie{{Name: "session_token", Value: token}})
+
+	_, body := getPage(t, b, "/profile")
+	got := pageCurrentUser(t, body)
+	imp, _ := got["impersonator"].(map[string]any)
+	if got["email"] != user.Email || imp["email"] != admin.Email {
+		t.Errorf("page rendered for %v", got)
+	}
+}
+
+func TestInitials(t *testing.T) {
+	for name, want := range map[string]string{
+		"Ada Lovelace":           "AL",
+		"grace":                  "G",
+		"Jean Baptiste Lamarck":  "JB",
+		"  Émile   Zola ":        "ÉZ",
+		"":                       "",
+		"李 小龙":                   "李小",
+		"mary-jane o'neil smith": "MO",
+	} {
+		if got := (&meUser{Name: name}).Initials(); got != want {
+			t.Errorf("Initials(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
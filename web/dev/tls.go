@@ -0,0 +1,204 @@
+package dev
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/config"
+	"github.com/isymbo/sachi/core"
+)
+
+// certReloadInterval is how often the certificate files are checked for changes
+const certReloadInterval = 30 * time.Second
+
+// certReloader serves the current certificate and reloads it when the files change on disk,
+// so renewed certificates are picked up without a restart.
+type certReloader struct {
+	certPath, keyPath string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	r := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// latestModTime returns the newest modification time of the cert and key files
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, p := range []string{r.certPath, r.keyPath} {
+		info, err := os.Stat(p)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// watch polls the files and reloads on change. A broken pair keeps the previous certificate.
+func (r *certReloader) watch() {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-core.Ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.reloadIfChanged()
+			if err != nil {
+				log.Printf("tls: certificate reload failed, keeping previous certificate: %v", err)
+			} else if reloaded {
+				log.Printf("tls: reloaded certificate from %s", r.certPath)
+			}
+		}
+	}
+}
+
+// reloadIfChanged reloads the pair when either file is newer than the loaded certificate
+func (r *certReloader) reloadIfChanged() (bool, error) {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return false, err
+	}
+	r.mu.RLock()
+	changed := modTime.After(r.modTime)
+	r.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	return true, r.reload()
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// listenTLS serves the app over HTTPS with hot certificate reload, plus the optional
+// plain-HTTP listener that redirects to HTTPS.
+func listenTLS(app *fiber.App, args *config.CmdArgs, addr string) error {
+	reloader, err := newCertReloader(args.TLSCert, args.TLSKey)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	go reloader.watch()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	tlsLn := tls.NewListener(ln, tlsConfig(reloader))
+
+	if args.HTTPRedirectPort > 0 {
+		go runHTTPRedirect(args)
+	}
+
+	log.Printf("Sachi web server starting at https://%s", addr)
+	return app.Listener(tlsLn)
+}
+
+// tlsConfig serves the reloader's current certificate over HTTP/1.1, which is all fasthttp speaks
+func tlsConfig(reloader *certReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{"http/1.1"},
+	}
+}
+
+// runHTTPRedirect answers plain HTTP requests with a permanent redirect to the HTTPS listener
+func runHTTPRedirect(args *config.CmdArgs) {
+	redirect := fiber.New(fiber.Config{
+		AppName:               "Sachi HTTP redirect",
+		DisableStartupMessage: true,
+	})
+	redirect.Use(httpsRedirect(args.Port))
+
+	core.AddExitCallback(func() {
+		if err := redirect.Shutdown(); err != nil {
+			log.Printf("Error shutting down HTTP redirect server: %v", err)
+		}
+	})
+
+	addr := fmt.Sprintf("%s:%d", args.Host, args.HTTPRedirectPort)
+	log.Printf("HTTP to HTTPS redirect listening at http://%s", addr)
+	if err := redirect.Listen(addr); err != nil {
+		log.Printf("HTTP redirect server error: %v", err)
+	}
+}
+
+// httpsRedirect sends a request to the same host and URL on the HTTPS port. The path is kept
+// as it came, base path included.
+func httpsRedirect(httpsPort int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		host := c.Hostname()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		if host == "" {
+			return fiber.ErrBadRequest
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		return c.Redirect("https://"+host+c.OriginalURL(), fiber.StatusMovedPermanently)
+	}
+}
+
+// secureCookies reports whether cookies for this request should carry the Secure flag:
+// the connection is TLS, a trusted proxy reports the original scheme as https, or
+// --secure-cookies says the site is only reached over HTTPS
+func secureCookies(c *fiber.Ctx) bool {
+	return isHTTPS(c) || (config.Args != nil && config.Args.SecureCookies)
+}
+
+// setSessionCookie sets (or, with an empty value, clears) the site-wide session cookie
+func setSessionCookie(c *fiber.Ctx, value string, expires time.Time) {
+	c.Cookie(&fiber.Cookie{
+		Name:     "session_token",
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   secureCookies(c),
+		HTTPOnly: true,
+		SameSite: "Lax",
+	})
+}
@@ -0,0 +1,227 @@
+package dev
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/config"
+	"github.com/isymbo/sachi/utils"
+)
+
+// writeTestCert replaces the pair with a new self-signed certificate dated mod, and returns
+// its serial number
+func writeTestCert(t *testing.T, certPath, keyPath string, mod time.Time) string {
+	t.Helper()
+	if err := utils.GenerateSelfSignedCert(certPath, keyPath, []string{"127.0.0.1"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{certPath, keyPath} {
+		if err := os.Chtimes(p, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certSerial(t, &pair)
+}
+
+func certSerial(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.SerialNumber.String()
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := newCertReloader(certPath, keyPath); err == nil {
+		t.Fatal("loaded a missing certificate")
+	}
+
+	start := time.Now().Add(-time.Hour)
+	first := writeTestCert(t, certPath, keyPath, start)
+	r, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() string {
+		t.Helper()
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return certSerial(t, cert)
+	}
+	if served() != first {
+		t.Fatal("not serving the loaded certificate")
+	}
+	if reloaded, err := r.reloadIfChanged(); reloaded || err != nil {
+		t.Errorf("unchanged files: reloaded = %v, %v", reloaded, err)
+	}
+
+	// A renewed pair is picked up
+	second := writeTestCert(t, certPath, keyPath, start.Add(time.Minute))
+	if reloaded, err := r.reloadIfChanged(); !reloaded || err != nil {
+		t.Fatalf("renewed pair: reloaded = %v, %v", reloaded, err)
+	}
+	if served() != second {
+		t.Error("still serving the old certificate")
+	}
+
+	// A half-written or missing pair keeps the previous certificate
+	if err := os.WriteFile(certPath, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certPath, start.Add(2*time.Minute), start.Add(2*time.Minute))
+	if _, err := r.reloadIfChanged(); err == nil {
+		t.Error("a broken certificate was loaded")
+	}
+	os.Remove(keyPath)
+	if _, err := r.reloadIfChanged(); err == nil {
+		t.Error("a missing key went unnoticed")
+	}
+	if served() != second {
+		t.Error("a failed reload dropped the certificate")
+	}
+
+	// New connections get the reloaded certificate and cookies are marked Secure
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/", func(c *fiber.Ctx) error {
+		setSessionCookie(c, "token", time.Now().Add(time.Hour))
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+	go app.Listener(tls.NewListener(ln, tlsConfig(r)))
+	t.Cleanup(func() { app.Shutdown() })
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}},
+		DisableKeepAlives: true,
+	}}
+	get := func() *http.Response {
+		t.Helper()
+		resp, err := client.Get("https://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	resp := get()
+	if got := resp.TLS.PeerCertificates[0].SerialNumber.String(); got != second {
+		t.Errorf("served serial %s, want %s", got, second)
+	}
+	if resp.TLS.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("negotiated %q", resp.TLS.NegotiatedProtocol)
+	}
+	if cookies := resp.Cookies(); len(cookies) != 1 || !cookies[0].Secure {
+		t.Errorf("cookies over TLS: %v", cookies)
+	}
+
+	third := writeTestCert(t, certPath, keyPath, start.Add(3*time.Minute))
+	if _, err := r.reloadIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	if got := get().TLS.PeerCertificates[0].SerialNumber.String(); got != third {
+		t.Errorf("after reload served serial %s, want %s", got, third)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		name string
+		host string
+		port int
+		url  string
+		want string
+	}{
+		{"default port", "example.com", 443, "/login?next=%2Fprofile", "https://example.com/login?next=%2Fprofile"},
+		{"HTTP port dropped", "example.com:8080", 443, "/", "https://example.com/"},
+		{"other HTTPS port", "example.com:8080", 8443, "/a/b", "https://example.com:8443/a/b"},
+		{"other HTTPS port, no port in Host", "example.com", 8443, "/", "https://example.com:8443/"},
+		{"IPv4", "192.0.2.1:80", 8443, "/", "https://192.0.2.1:8443/"},
+		{"IPv6 with port", "[2001:db8::1]:8080", 443, "/", "https://[2001:db8::1]/"},
+		{"IPv6 without port", "[2001:db8::1]", 443, "/", "https://[2001:db8::1]/"},
+		{"IPv6 to other HTTPS port", "[2001:db8::1]", 8443, "/x", "https://[2001:db8::1]:8443/x"},
+		{"base path kept", "example.com", 443, "/app/profile?tab=security", "https://example.com/app/profile?tab=security"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Use(httpsRedirect(tt.port))
+			req := httptest.NewRequest("POST", tt.url, nil)
+			req.Host = tt.host
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get(fiber.HeaderLocation) != tt.want {
+				t.Errorf("got %d %s, want 301 %s", resp.StatusCode, resp.Header.Get(fiber.HeaderLocation), tt.want)
+			}
+		})
+	}
+}
+
+func TestSecureCookies(t *testing.T) {
+	saved := config.Args
+	t.Cleanup(func() { config.Args = saved })
+
+	tests := []struct {
+		name    string
+		trusted string
+		proto   string
+		flag    bool
+		want    bool
+	}{
+		{"plain HTTP", "0.0.0.0/32", "", false, false},
+		{"trusted proxy reports https", "0.0.0.0/32", "https", false, true},
+		{"trusted proxy reports http", "0.0.0.0/32", "http", false, false},
+		{"scheme without a client address", "0.0.0.0/32", "https only", false, false},
+		{"untrusted peer claims https", "10.0.0.0/8", "https", false, false},
+		{"--secure-cookies", "10.0.0.0/8", "", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Args = &config.CmdArgs{SecureCookies: tt.flag}
+			app := fiber.New()
+			app.Use(newProxyMiddleware([]netip.Prefix{netip.MustParsePrefix(tt.trusted)}, ""))
+			app.Get("/", func(c *fiber.Ctx) error {
+				setSessionCookie(c, "token", time.Now().Add(time.Hour))
+				return c.SendStatus(fiber.StatusNoContent)
+			})
+			req := httptest.NewRequest("GET", "/", nil)
+			// Proxies report the scheme along with the client address
+			if proto, ok := strings.CutSuffix(tt.proto, " only"); ok {
+				req.Header.Set("X-Forwarded-Proto", proto)
+			} else if tt.proto != "" {
+				req.Header.Set("X-Forwarded-For", "203.0.113.9")
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cookies := resp.Cookies()
+			if len(cookies) != 1 || cookies[0].Secure != tt.want || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode {
+				t.Errorf("got %v, want Secure = %v", cookies, tt.want)
+			}
+		})
+	}
+}
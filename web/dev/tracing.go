@@ -0,0 +1,87 @@
+package dev
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/tracing"
+)
+
+// traceIDKey holds the request's trace ID in Locals, for the access log and error responses
+const traceIDKey = "trace_id"
+
+// newTracingMiddleware starts the server span of every request, continuing the caller's trace
+// when a traceparent header is sent. Handlers pass c.UserContext() on, so queries, password
+// hashing and calls to identity providers become child spans. Like the metrics middleware it
+// renders errors itself, so the span records the status the client gets.
+func newTracingMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !tracing.Enabled() {
+			return c.Next()
+		}
+		ctx := tracing.Extract(c.UserContext(), c.Get(tracing.TraceparentHeader), c.Get(tracing.TracestateHeader))
+		ctx, span := tracing.Start(ctx, c.Method(), tracing.KindServer)
+		defer span.End()
+		c.SetUserContext(ctx)
+		c.Locals(traceIDKey, span.TraceID())
+		// Lets a client without tracing of its own quote the trace of a failed request
+		c.Set("traceresponse", span.SpanContext().Traceparent())
+
+		if err := c.Next(); err != nil {
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		status := c.Response().StatusCode()
+		route := metricsRoute(c)
+		span.SetName(c.Method() + " " + route)
+		span.SetAttributes(
+			tracing.String("http.request.method", c.Method()),
+			tracing.String("http.route", route),
+			tracing.String("url.path", c.Path()),
+			tracing.Int("http.response.status_code", status),
+			tracing.String("client.address", clientIP(c)),
+			tracing.String("user_agent.original", c.Get(fiber.HeaderUserAgent)),
+			tracing.String("http.request.id", requestID(c)),
+		)
+		if status >= 500 {
+			span.SetError(fmt.Sprintf("HTTP %d", status))
+		}
+		return nil
+	}
+}
+
+// traced runs a middleware inside a span of its own. The span also covers the rest of the
+// chain, which the middleware wraps with c.Next().
+func traced(name string, h fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx, span := tracing.Start(c.UserContext(), "middleware "+name, tracing.KindInternal)
+		if span == nil {
+			return h(c)
+		}
+		defer span.End()
+		c.SetUserContext(ctx)
+		err := h(c)
+		if err != nil && errorStatus(err) >= 500 {
+			span.RecordError(err)
+		}
+		return err
+	}
+}
+
+// logf logs like log.Printf, followed by the request ID and, when it is traced, the trace ID
+func logf(c *fiber.Ctx, format string, args ...any) {
+	log.Print(fmt.Sprintf(format, args...) + logSuffix(c))
+}
+
+// logSuffix is what logf appends to a message. Code that logs after the handler returns, such
+// as a goroutine, takes it beforehand: Fiber reuses c for the next request.
+func logSuffix(c *fiber.Ctx) string {
+	suffix := tracing.LogSuffix(c.UserContext())
+	if id := requestID(c); id != "" {
+		suffix = " request_id=" + id + suffix
+	}
+	return suffix
+}
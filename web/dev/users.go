@@ -0,0 +1,323 @@
+package dev
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/isymbo/sachi/auth"
+	"github.com/isymbo/sachi/orm"
+	"github.com/isymbo/sachi/tracing"
+)
+
+// Audit actions
+const (
+	auditAdminUserList          = "admin.user_list"
+	auditAdminUserView          = "admin.user_view"
+	auditAdminUserDisable       = "admin.user_disable"
+	auditAdminUserEnable        = "admin.user_enable"
+	auditAdminUserLogout        = "admin.user_logout"
+	auditAdminUserPasswordReset = "admin.user_password_reset"
+	auditAdminUserRoleChange    = "admin.user_role_change"
+)
+
+const (
+	usersDefaultPageSize = 25
+	usersMaxPageSize     = 200
+)
+
+// handleAdminPage serves the admin console to admins and sends everyone else to their profile
+func handleAdminPage(c *fiber.Ctx) error {
+	user := c.Locals("user").(*orm.User)
+	if user.Role != orm.RoleAdmin {
+		return redirectTo(c, "/profile")
+	}
+	c.Set("Cache-Control", "no-store")
+	c.Set("Pragma", "no-cache")
+	c.Set("Expires", "0")
+	return sendPage(c, "admin.html")
+}
+
+// adminUserJSON is the admin view of an account
+func adminUserJSON(u *orm.User) fiber.Map {
+	m := fiber.Map{
+		"id":                   u.ID,
+		"name":                 u.Name,
+		"email":                u.Email,
+		"company":              u.Company,
+		"role":                 u.Role,
+		"org_id":               u.OrgID,
+		"disabled":             u.Disabled,
+		"has_password":         u.PasswordHash != "",
+		"must_change_password": u.MustChangePassword,
+		"created_at":           u.CreatedAt,
+		"updated_at":           u.UpdatedAt,
+	}
+	if !u.DeleteAt.IsZero() {
+		m["delete_at"] = u.DeleteAt.UTC()
+	}
+	if url := avatarURL(u); url != "" {
+		m["avatar_url"] = appPath(url)
+	}
+	return m
+}
+
+// adminTargetUser loads the account named by the :id route parameter
+func adminTargetUser(c *fiber.Ctx) (*orm.User, error) {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return nil, newAPIError(400, codeInvalidRequest, "Invalid user id")
+	}
+	user, err := orm.GetUserByID(c.UserContext(), int64(id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, newAPIError(404, codeNotFound, "User not found")
+	}
+	if err != nil {
+		logf(c, "Error loading user %d: %v", id, err)
+		return nil, newAPIError(500, codeInternal, "Failed to load user")
+	}
+	return user, nil
+}
+
+// lastAdminConflict refuses changes that would leave no enabled admin
+func lastAdminConflict(ctx context.Context, target *orm.User) error {
+	if target.Role != orm.RoleAdmin || target.Disabled {
+		return nil
+	}
+	admins, err := orm.CountAdmins(ctx)
+	if err != nil {
+		log.Printf("Error counting admins: %v%s", err, tracing.LogSuffix(ctx))
+		return newAPIError(500, codeInternal, "Failed to update user")
+	}
+	if admins <= 1 {
+		return newAPIError(409, codeConflict, "This is the only administrator. Make someone else an administrator first.")
+	}
+	return nil
+}
+
+// handleAdminUserList lists users with search (q on name and email), role, status
+// (active, disabled, deleting) and org filters, sorted by sort (name, email, newest)
+func handleAdminUserList(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+
+	f := orm.UserFilter{
+		Query:  c.Query("q"),
+		Role:   c.Query("role"),
+		Status: c.Query("status"),
+		Sort:   c.Query("sort"),
+	}
+	if slug := c.Query("org"); slug != "" {
+		org, err := orm.GetOrganizationBySlug(c.UserContext(), slug)
+		if err != nil {
+			return newAPIError(400, codeValidationFailed, "Unknown organization").
+				withField("org", fieldInvalid, "No organization has this slug")
+		}
+		f.OrgID = org.ID
+	}
+	page := c.QueryInt("page", 1)
+	if page < 1 {
+		page = 1
+	}
+	perPage := c.QueryInt("per_page", usersDefaultPageSize)
+	if perPage < 1 || perPage > usersMaxPageSize {
+		perPage = usersDefaultPageSize
+	}
+	f.Limit = perPage
+	f.Offset = (page - 1) * perPage
+
+	users, total, err := orm.ListUsers(c.UserContext(), f)
+	if err != nil {
+		logf(c, "Error listing users: %v", err)
+		return newAPIError(500, codeInternal, "Failed to load users")
+	}
+	recordAudit(c, admin, auditAdminUserList, "", fiber.Map{"query": c.Context().QueryArgs().String()})
+
+	list := make([]fiber.Map, 0, len(users))
+	for _, u := range users {
+		list = append(list, adminUserJSON(u))
+	}
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"users":    list,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
+
+// handleAdminUserGet shows one account with its organization, linked identities, active
+// sessions and latest activity
+func handleAdminUserGet(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+	user, err := adminTargetUser(c)
+	if err != nil {
+		return err
+	}
+
+	detail := adminUserJSON(user)
+	if user.OrgID != 0 {
+		if org, err := orm.GetOrganizationByID(c.UserContext(), user.OrgID); err == nil {
+			detail["org"] = org
+		}
+	}
+	identities, err := orm.ListUserIdentities(c.UserContext(), user.ID)
+	if err != nil {
+		logf(c, "Error listing identities of user %d: %v", user.ID, err)
+		return newAPIError(500, codeInternal, "Failed to load user")
+	}
+	sessions, err := orm.CountUserSessions(c.UserContext(), user.ID)
+	if err != nil {
+		logf(c, "Error counting sessions of user %d: %v", user.ID, err)
+		return newAPIError(500, codeInternal, "Failed to load user")
+	}
+	events, _, err := orm.ListAuditEvents(c.UserContext(), orm.AuditFilter{ActorID: user.ID, Limit: 20})
+	if err != nil {
+		logf(c, "Error listing audit events of user %d: %v", user.ID, err)
+		return newAPIError(500, codeInternal, "Failed to load user")
+	}
+	detail["identities"] = identities
+	detail["active_sessions"] = sessions
+	detail["recent_events"] = events
+
+	recordAudit(c, admin, auditAdminUserView, user.Email, fiber.Map{"user_id": user.ID})
+	return c.JSON(fiber.Map{
+		"success": true,
+		"user":    detail,
+	})
+}
+
+// handleAdminUserDisable disables an account and signs it out everywhere
+func handleAdminUserDisable(c *fiber.Ctx) error {
+	return setUserDisabled(c, true)
+}
+
+// handleAdminUserEnable re-enables a disabled account
+func handleAdminUserEnable(c *fiber.Ctx) error {
+	return setUserDisabled(c, false)
+}
+
+func setUserDisabled(c *fiber.Ctx, disabled bool) error {
+	admin := c.Locals("user").(*orm.User)
+	user, err := adminTargetUser(c)
+	if err != nil {
+		return err
+	}
+	if disabled {
+		if user.ID == admin.ID {
+			return newAPIError(400, codeInvalidRequest, "You cannot disable your own account")
+		}
+		if err := lastAdminConflict(c.UserContext(), user); err != nil {
+			return err
+		}
+	}
+
+	if err := orm.SetUserDisabled(c.UserContext(), user.ID, disabled); err != nil {
+		logf(c, "Error updating user %d: %v", user.ID, err)
+		return newAPIError(500, codeInternal, "Failed to update user")
+	}
+	action, message := auditAdminUserEnable, "Account enabled"
+	if disabled {
+		action, message = auditAdminUserDisable, "Account disabled"
+	}
+	recordAudit(c, admin, action, user.Email, fiber.Map{"user_id": user.ID})
+
+	user.Disabled = disabled
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": message,
+		"user":    adminUserJSON(user),
+	})
+}
+
+// handleAdminUserLogout ends all of a user's sessions and revokes their OAuth tokens
+func handleAdminUserLogout(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+	user, err := adminTargetUser(c)
+	if err != nil {
+		return err
+	}
+	if err := orm.SignOutUser(c.UserContext(), user.ID); err != nil {
+		logf(c, "Error signing out user %d: %v", user.ID, err)
+		return newAPIError(500, codeInternal, "Failed to sign out user")
+	}
+	recordAudit(c, admin, auditAdminUserLogout, user.Email, fiber.Map{"user_id": user.ID})
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Signed out everywhere",
+	})
+}
+
+// handleAdminUserPasswordReset replaces the user's password with a temporary one, shown
+// once to the admin; the user has to choose a new password after signing in with it
+func handleAdminUserPasswordReset(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+	user, err := adminTargetUser(c)
+	if err != nil {
+		return err
+	}
+	if user.ID == admin.ID {
+		return newAPIError(400, codeInvalidRequest, "Change your own password from your profile")
+	}
+
+	password := auth.TemporaryPassword(passwordPolicy.MinLength)
+	hash, err := hashPassword(c.UserContext(), password)
+	if err != nil {
+		return newAPIError(500, codeInternal, "Failed to hash password")
+	}
+	if err := orm.ResetUserPassword(c.UserContext(), user.ID, hash, passwordPolicy.History); err != nil {
+		logf(c, "Error resetting password of user %d: %v", user.ID, err)
+		return newAPIError(500, codeInternal, "Failed to reset password")
+	}
+	recordAudit(c, admin, auditAdminUserPasswordReset, user.Email, fiber.Map{"user_id": user.ID})
+
+	return c.JSON(fiber.Map{
+		"success":            true,
+		"message":            "Give this password to the user; they must change it when they next sign in",
+		"temporary_password": password,
+	})
+}
+
+// handleAdminUserRole changes a user's role with {"role": "admin"|"user"}
+func handleAdminUserRole(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*orm.User)
+	user, err := adminTargetUser(c)
+	if err != nil {
+		return err
+	}
+
+	type RoleRequest struct {
+		Role string `json:"role"`
+	}
+	req := new(RoleRequest)
+	if err := c.BodyParser(req); err != nil || (req.Role != orm.RoleAdmin && req.Role != orm.RoleUser) {
+		return newAPIError(400, codeValidationFailed, "Role must be admin or user").
+			withField("role", fieldInvalid, "Must be admin or user")
+	}
+	if req.Role == user.Role {
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "Role unchanged",
+			"user":    adminUserJSON(user),
+		})
+	}
+	if req.Role != orm.RoleAdmin {
+		if err := lastAdminConflict(c.UserContext(), user); err != nil {
+			return err
+		}
+	}
+
+	if err := orm.SetUserRole(c.UserContext(), user.ID, req.Role); err != nil {
+		logf(c, "Error changing role of user %d: %v", user.ID, err)
+		return newAPIError(500, codeInternal, "Failed to change role")
+	}
+	recordAudit(c, admin, auditAdminUserRoleChange, user.Email, fiber.Map{"user_id": user.ID, "from": user.Role, "to": req.Role})
+
+	user.Role = req.Role
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Role changed",
+		"user":    adminUserJSON(user),
+	})
+}
@@ -9,3 +9,18 @@ import (
 func RunDev(args *config.CmdArgs) error {
 	return dev.Run(args)
 }
+
+// RunServe starts the web server in production mode
+func RunServe(args *config.CmdArgs) error {
+	return dev.Run(args)
+}
+
+// OpenAPISpec returns the OpenAPI document of the API
+func OpenAPISpec() []byte {
+	return dev.OpenAPISpec()
+}
+
+// CheckOpenAPI compares the server's routes with the OpenAPI document and returns the differences
+func CheckOpenAPI() ([]string, error) {
+	return dev.CheckOpenAPI()
+}
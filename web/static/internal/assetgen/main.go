@@ -0,0 +1,138 @@
+// Command assetgen precomputes what the server sends for the frontend's static files: a
+// fingerprinted path and an ETag for each, and gzip and brotli variants of the text ones. It
+// writes them to the precomputed directory, which is embedded along with the files, so the
+// server does no compression at startup. Run it from web/static with go generate after
+// changing anything under the directories it is given.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// outDir matches static.PrecomputedDir
+const outDir = "precomputed"
+
+// minCompressionGain is the share of bytes a compressed variant must save to be kept
+const minCompressionGain = 0.1
+
+// asset matches static.Asset
+type asset struct {
+	Path        string `json:"path"`
+	HashedPath  string `json:"hashedPath"`
+	ContentType string `json:"contentType"`
+	ETag        string `json:"etag"`
+	Gzip        bool   `json:"gzip,omitempty"`
+	Brotli      bool   `json:"brotli,omitempty"`
+}
+
+func main() {
+	log.SetFlags(0)
+	if err := os.RemoveAll(outDir); err != nil {
+		log.Fatal(err)
+	}
+	assets := []asset{}
+	for _, dir := range os.Args[1:] {
+		err := fs.WalkDir(os.DirFS("."), dir, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			a, err := precompute(name)
+			if err == nil {
+				assets = append(assets, a)
+			}
+			return err
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Fatal(err)
+		}
+	}
+	manifest, err := json.MarshalIndent(assets, "", "\t")
+	if err == nil {
+		err = write("manifest.json", append(manifest, '\n'))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// precompute describes one file and writes its compressed variants
+func precompute(name string) (asset, error) {
+	data, err := os.ReadFile(filepath.FromSlash(name))
+	if err != nil {
+		return asset{}, err
+	}
+	sum := sha256.Sum256(data)
+	ext := path.Ext(name)
+	a := asset{
+		Path:        "/" + name,
+		HashedPath:  "/" + strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:6]) + ext,
+		ContentType: mime.TypeByExtension(ext),
+		ETag:        `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`,
+	}
+	if a.ContentType == "" {
+		a.ContentType = "application/octet-stream"
+	}
+	if !compressible(a.ContentType) {
+		return a, nil
+	}
+	if gz := gzipBytes(data); worthIt(data, gz) {
+		a.Gzip = true
+		err = write(name+".gz", gz)
+	}
+	if br := brotliBytes(data); err == nil && worthIt(data, br) {
+		a.Brotli = true
+		err = write(name+".br", br)
+	}
+	return a, err
+}
+
+func write(name string, data []byte) error {
+	name = filepath.Join(outDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0o644)
+}
+
+func compressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.Contains(contentType, "javascript") ||
+		strings.Contains(contentType, "json") ||
+		strings.Contains(contentType, "svg")
+}
+
+// gzipBytes leaves the header's name and time empty, so the output only depends on data
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func brotliBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	w := brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func worthIt(data, compressed []byte) bool {
+	return float64(len(compressed)) <= float64(len(data))*(1-minCompressionGain)
+}
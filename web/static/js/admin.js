@@ -0,0 +1,266 @@
+// Admin console: user management
+
+const adminState = {
+    page: 1,
+    perPage: 25,
+    total: 0,
+    filters: {},
+    selected: null
+};
+
+document.addEventListener('DOMContentLoaded', function() {
+    document.getElementById('user-search').addEventListener('submit', function(e) {
+        e.preventDefault();
+        const formData = new FormData(this);
+        adminState.filters = {};
+        for (const [key, value] of formData.entries()) {
+            if (value) adminState.filters[key] = value;
+        }
+        adminState.page = 1;
+        loadUsers();
+    });
+    document.getElementById('prev-page').addEventListener('click', function() {
+        if (adminState.page > 1) {
+            adminState.page--;
+            loadUsers();
+        }
+    });
+    document.getElementById('next-page').addEventListener('click', function() {
+        if (adminState.page * adminState.perPage < adminState.total) {
+            adminState.page++;
+            loadUsers();
+        }
+    });
+
+    document.getElementById('action-disable').addEventListener('click', () => userAction('disable', 'Disable this account and sign it out everywhere?'));
+    document.getElementById('action-enable').addEventListener('click', () => userAction('enable'));
+    document.getElementById('action-logout').addEventListener('click', () => userAction('logout', 'Sign this user out of every session and application?'));
+    document.getElementById('action-reset').addEventListener('click', handlePasswordReset);
+    document.getElementById('action-role').addEventListener('click', handleRoleChange);
+    document.getElementById('action-impersonate').addEventListener('click', handleImpersonate);
+
+    loadUsers();
+});
+
+function notify(message, type) {
+    if (window.SachiApp && window.SachiApp.showNotification) {
+        window.SachiApp.showNotification(message, type);
+    }
+}
+
+// Fetch and render the current page of users
+async function loadUsers() {
+    const params = new URLSearchParams(adminState.filters);
+    params.set('page', adminState.page);
+    params.set('per_page', adminState.perPage);
+
+    try {
+        const response = await fetch('/api/admin/users?' + params, { credentials: 'include' });
+        if (response.status === 401) {
+            window.location.href = '/login.html';
+            return;
+        }
+        const data = await response.json();
+        if (!response.ok || !data.success) {
+            notify(data.message || 'Failed to load users', 'error');
+            return;
+        }
+        adminState.total = data.total;
+        renderUsers(data.users);
+    } catch (error) {
+        console.error('Loading users failed:', error);
+        notify('Failed to load users', 'error');
+    }
+}
+
+function userStatus(user) {
+    if (user.disabled) return 'Disabled';
+    if (user.delete_at) return 'Deleting';
+    if (user.must_change_password) return 'Password reset';
+    return 'Active';
+}
+
+function renderUsers(users) {
+    const rows = document.getElementById('user-rows');
+    rows.replaceChildren();
+    for (const user of users) {
+        const tr = document.createElement('tr');
+        for (const text of [user.name, user.email, user.role, userStatus(user)]) {
+            const td = document.createElement('td');
+            td.textContent = text;
+            tr.appendChild(td);
+        }
+        if (adminState.selected && adminState.selected.id === user.id) {
+            tr.classList.add('selected');
+        }
+        tr.addEventListener('click', () => loadUser(user.id));
+        rows.appendChild(tr);
+    }
+    if (users.length === 0) {
+        const tr = document.createElement('tr');
+        const td = document.createElement('td');
+        td.colSpan = 4;
+        td.textContent = 'No users match.';
+        tr.appendChild(td);
+        rows.appendChild(tr);
+    }
+
+    const first = adminState.total === 0 ? 0 : (adminState.page - 1) * adminState.perPage + 1;
+    const last = Math.min(adminState.page * adminState.perPage, adminState.total);
+    document.getElementById('page-info').textContent = `${first}–${last} of ${adminState.total}`;
+    document.getElementById('prev-page').disabled = adminState.page <= 1;
+    document.getElementById('next-page').disabled = last >= adminState.total;
+}
+
+// Fetch and show one user's details
+async function loadUser(id) {
+    try {
+        const response = await fetch('/api/admin/users/' + id, { credentials: 'include' });
+        const data = await response.json();
+        if (!response.ok || !data.success) {
+            notify(data.message || 'Failed to load user', 'error');
+            return;
+        }
+        document.getElementById('temporary-password-box').style.display = 'none';
+        renderUser(data.user);
+        loadUsers();
+    } catch (error) {
+        console.error('Loading user failed:', error);
+        notify('Failed to load user', 'error');
+    }
+}
+
+function renderUser(user) {
+    adminState.selected = user;
+    document.getElementById('user-detail').style.display = 'block';
+    document.getElementById('detail-name').textContent = user.name;
+    document.getElementById('detail-email').textContent = user.email;
+
+    const fields = [
+        ['Company', user.company || '—'],
+        ['Organization', user.org ? user.org.name : '—'],
+        ['Role', user.role],
+        ['Status', userStatus(user)],
+        ['Password', user.has_password ? 'Set' : 'None (single sign-on only)'],
+        ['Active sessions', user.active_sessions],
+        ['Created', new Date(user.created_at).toLocaleString()]
+    ];
+    if (user.delete_at) {
+        fields.push(['Deletion on', new Date(user.delete_at).toLocaleDateString()]);
+    }
+    const dl = document.getElementById('detail-fields');
+    dl.replaceChildren();
+    for (const [label, value] of fields) {
+        const dt = document.createElement('dt');
+        dt.textContent = label;
+        const dd = document.createElement('dd');
+        dd.textContent = value;
+        dl.append(dt, dd);
+    }
+
+    renderList('detail-identities', user.identities, id =>
+        `${id.provider} · ${id.issuer}${id.email ? ' · ' + id.email : ''}`, 'No linked identities');
+    renderList('detail-events', user.recent_events, e =>
+        `${new Date(e.created_at).toLocaleString()} · ${e.action}${e.target ? ' · ' + e.target : ''}`, 'No recorded activity');
+
+    document.getElementById('action-disable').style.display = user.disabled ? 'none' : 'inline-flex';
+    document.getElementById('action-enable').style.display = user.disabled ? 'inline-flex' : 'none';
+    document.getElementById('action-reset').style.display = user.has_password ? 'inline-flex' : 'none';
+    document.getElementById('action-role').textContent = user.role === 'admin' ? 'Make user' : 'Make admin';
+    document.getElementById('action-impersonate').style.display = user.role === 'admin' || user.disabled ? 'none' : 'inline-flex';
+}
+
+function renderList(id, items, format, empty) {
+    const ul = document.getElementById(id);
+    ul.replaceChildren();
+    for (const item of items.length ? items : [null]) {
+        const li = document.createElement('li');
+        li.textContent = item ? format(item) : empty;
+        ul.appendChild(li);
+    }
+}
+
+// POST to a user action endpoint and refresh the view
+async function postUserAction(action, options) {
+    const user = adminState.selected;
+    const response = await window.SachiApp.apiFetch(`/api/admin/users/${user.id}/${action}`, Object.assign({ method: 'POST' }, options));
+    const data = await response.json();
+    if (!response.ok || !data.success) {
+        notify(data.message || 'Action failed', 'error');
+        return null;
+    }
+    return data;
+}
+
+async function userAction(action, confirmText) {
+    if (confirmText && !window.confirm(confirmText)) return;
+    try {
+        const data = await postUserAction(action);
+        if (data) {
+            notify(data.message, 'success');
+            loadUser(adminState.selected.id);
+        }
+    } catch (error) {
+        console.error('User action failed:', error);
+        notify('Action failed', 'error');
+    }
+}
+
+async function handlePasswordReset() {
+    if (!window.confirm('Replace this user\'s password with a temporary one and sign them out everywhere?')) return;
+    try {
+        const data = await postUserAction('reset-password');
+        if (data) {
+            await loadUser(adminState.selected.id);
+            document.getElementById('temporary-password').textContent = data.temporary_password;
+            document.getElementById('temporary-password-box').style.display = 'block';
+        }
+    } catch (error) {
+        console.error('Password reset failed:', error);
+        notify('Failed to reset password', 'error');
+    }
+}
+
+async function handleRoleChange() {
+    const user = adminState.selected;
+    const role = user.role === 'admin' ? 'user' : 'admin';
+    if (!window.confirm(role === 'admin' ? `Make ${user.email} an administrator?` : `Remove administrator rights from ${user.email}?`)) return;
+    try {
+        const response = await window.SachiApp.apiFetch(`/api/admin/users/${user.id}/role`, {
+            method: 'PUT',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ role })
+        });
+        const data = await response.json();
+        if (response.ok && data.success) {
+            notify(data.message, 'success');
+            loadUser(user.id);
+        } else {
+            notify(data.message || 'Failed to change role', 'error');
+        }
+    } catch (error) {
+        console.error('Role change failed:', error);
+        notify('Failed to change role', 'error');
+    }
+}
+
+async function handleImpersonate() {
+    const reason = window.prompt(`Why do you need to sign in as ${adminState.selected.email}? This is recorded in the audit log.`);
+    if (!reason) return;
+    try {
+        const data = await postUserAction('impersonate', {
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ reason })
+        });
+        if (data) {
+            window.location.href = data.redirect;
+        }
+    } catch (error) {
+        console.error('Impersonation failed:', error);
+        notify('Failed to impersonate user', 'error');
+    }
+}
@@ -0,0 +1,232 @@
+// API reference: renders /api/openapi.json grouped by tag, with a form to try each operation
+// from the browser with the signed-in session
+
+const docsMethods = ['get', 'put', 'post', 'patch', 'delete'];
+
+document.addEventListener('DOMContentLoaded', async function() {
+    const description = document.getElementById('docs-description');
+    let spec;
+    try {
+        const response = await fetch('/api/openapi.json', { credentials: 'include' });
+        spec = await response.json();
+        if (!response.ok) {
+            description.textContent = spec.message || 'The OpenAPI document could not be loaded.';
+            return;
+        }
+    } catch (error) {
+        description.textContent = 'The OpenAPI document could not be loaded.';
+        return;
+    }
+
+    description.textContent = spec.info.description || '';
+    // The server URL carries the base path when the app is mounted under a prefix
+    const server = (spec.servers || [])[0];
+    const basePath = server ? new URL(server.url, window.location.href).pathname.replace(/\/$/, '') : '';
+    const byTag = groupOperations(spec);
+    const nav = document.getElementById('docs-nav');
+    const container = document.getElementById('docs-operations');
+    (spec.tags || []).forEach(tag => {
+        const operations = byTag[tag.name];
+        if (!operations) return;
+
+        const heading = el('h3', null, tag.name);
+        nav.appendChild(heading);
+        const list = el('ul');
+        nav.appendChild(list);
+
+        const section = el('section', 'docs-tag');
+        section.appendChild(el('h2', null, tag.name));
+        if (tag.description) section.appendChild(el('p', 'text-muted-foreground', tag.description));
+        operations.forEach(op => {
+            const link = el('a', null, op.method.toUpperCase() + ' ' + op.path);
+            link.href = '#' + op.operation.operationId;
+            list.appendChild(el('li')).appendChild(link);
+            section.appendChild(renderOperation(spec, basePath, op));
+        });
+        container.appendChild(section);
+    });
+
+    if (window.location.hash) {
+        const target = document.getElementById(window.location.hash.slice(1));
+        if (target) target.scrollIntoView();
+    }
+});
+
+function el(tag, className, text) {
+    const node = document.createElement(tag);
+    if (className) node.className = className;
+    if (text !== undefined) node.textContent = text;
+    return node;
+}
+
+function groupOperations(spec) {
+    const byTag = {};
+    Object.keys(spec.paths).forEach(path => {
+        docsMethods.forEach(method => {
+            const operation = spec.paths[path][method];
+            if (!operation) return;
+            const tag = (operation.tags || ['Other'])[0];
+            (byTag[tag] = byTag[tag] || []).push({ path, method, operation });
+        });
+    });
+    return byTag;
+}
+
+// resolve follows a local $ref such as #/components/schemas/Error
+function resolve(spec, node) {
+    while (node && node.$ref) {
+        node = node.$ref.replace(/^#\//, '').split('/').reduce((n, key) => n && n[key], spec);
+    }
+    return node || {};
+}
+
+// exampleFor builds a sample value from a schema, for request bodies and responses
+function exampleFor(spec, schema, depth = 0) {
+    schema = resolve(spec, schema);
+    if (schema.example !== undefined) return schema.example;
+    if (depth > 6) return null;
+    if (schema.enum) return schema.enum[0];
+    if (schema.default !== undefined) return schema.default;
+    switch (schema.type) {
+    case 'object': {
+        const value = {};
+        Object.entries(schema.properties || {}).forEach(([name, prop]) => {
+            value[name] = exampleFor(spec, prop, depth + 1);
+        });
+        if (!schema.properties && schema.additionalProperties && schema.additionalProperties !== true) {
+            value.key = exampleFor(spec, schema.additionalProperties, depth + 1);
+        }
+        return value;
+    }
+    case 'array':
+        return [exampleFor(spec, schema.items, depth + 1)];
+    case 'integer':
+    case 'number':
+        return 0;
+    case 'boolean':
+        return true;
+    case 'string':
+        return { 'date-time': '2025-01-01T00:00:00Z', email: 'user@example.com', uri: 'https://example.com', binary: '<file>', password: '********' }[schema.format] || 'string';
+    }
+    return null;
+}
+
+function renderOperation(spec, basePath, { path, method, operation }) {
+    const card = el('article', 'profile-section docs-operation');
+    card.id = operation.operationId;
+
+    const title = el('h3', 'docs-operation-title');
+    title.appendChild(el('span', 'docs-method docs-method-' + method, method.toUpperCase()));
+    title.appendChild(el('code', null, path));
+    card.appendChild(title);
+    card.appendChild(el('p', 'font-medium', operation.summary || ''));
+    if (operation.description) card.appendChild(el('p', 'text-sm text-muted-foreground', operation.description));
+    const security = operation.security || spec.security || [];
+    card.appendChild(el('p', 'text-sm text-muted-foreground',
+        security.length && Object.keys(security[0]).length ? 'Authentication: ' + security.map(s => Object.keys(s).join(' + ')).join(' or ') : 'No authentication'));
+
+    const params = operation.parameters || [];
+    if (params.length) {
+        card.appendChild(el('h4', null, 'Parameters'));
+        const table = el('table', 'admin-table docs-table');
+        params.forEach(p => {
+            const row = table.appendChild(el('tr'));
+            row.appendChild(el('td')).appendChild(el('code', null, p.name));
+            row.appendChild(el('td', 'text-muted-foreground', p.in + (p.required ? ', required' : '')));
+            row.appendChild(el('td', null, (resolve(spec, p.schema).type || '') + (p.description ? ' - ' + p.description : '')));
+        });
+        card.appendChild(table);
+    }
+
+    let bodyType = null;
+    if (operation.requestBody) {
+        bodyType = Object.keys(operation.requestBody.content)[0];
+        card.appendChild(el('h4', null, 'Request body (' + bodyType + ')'));
+        card.appendChild(el('pre', 'docs-code', JSON.stringify(exampleFor(spec, operation.requestBody.content[bodyType].schema), null, 2)));
+    }
+
+    card.appendChild(el('h4', null, 'Responses'));
+    const responses = el('dl', 'docs-responses');
+    Object.entries(operation.responses).forEach(([code, response]) => {
+        response = resolve(spec, response);
+        responses.appendChild(el('dt', null, code));
+        const dd = responses.appendChild(el('dd', null, response.description || ''));
+        const content = response.content && Object.values(response.content)[0];
+        if (content && content.schema) {
+            const details = dd.appendChild(el('details'));
+            details.appendChild(el('summary', 'text-sm', 'Example'));
+            details.appendChild(el('pre', 'docs-code', JSON.stringify(content.example || exampleFor(spec, content.schema), null, 2)));
+        }
+    });
+    card.appendChild(responses);
+
+    card.appendChild(renderTryIt(spec, basePath + path, method, params, operation, bodyType));
+    return card;
+}
+
+// renderTryIt sends the request with the browser's session; state-changing requests get the
+// CSRF token through SachiApp.apiFetch
+function renderTryIt(spec, path, method, params, operation, bodyType) {
+    const details = el('details', 'docs-try');
+    details.appendChild(el('summary', 'text-sm font-medium', 'Try it'));
+    const form = details.appendChild(el('form', 'space-y-2'));
+    const inputs = {};
+    params.filter(p => p.in === 'path' || p.in === 'query').forEach(p => {
+        const input = el('input', 'input');
+        input.name = p.name;
+        input.placeholder = p.name + (p.required ? ' (required)' : '');
+        input.required = p.in === 'path';
+        inputs[p.name] = p;
+        form.appendChild(input);
+    });
+    let body = null;
+    if (bodyType === 'application/json') {
+        body = form.appendChild(el('textarea', 'input docs-code'));
+        body.rows = 6;
+        body.value = JSON.stringify(exampleFor(spec, operation.requestBody.content[bodyType].schema), null, 2);
+    }
+    const send = form.appendChild(el('button', 'btn btn-sm', 'Send'));
+    send.type = 'submit';
+    const output = details.appendChild(el('pre', 'docs-code'));
+    output.hidden = true;
+
+    form.addEventListener('submit', async function(e) {
+        e.preventDefault();
+        let url = path;
+        const query = new URLSearchParams();
+        Object.values(inputs).forEach(p => {
+            const value = form.elements[p.name].value;
+            if (p.in === 'path') {
+                url = url.replace('{' + p.name + '}', encodeURIComponent(value));
+            } else if (value) {
+                query.set(p.name, value);
+            }
+        });
+        if (query.toString()) url += '?' + query.toString();
+
+        const options = { method: method.toUpperCase(), headers: {} };
+        if (body) {
+            options.headers['Content-Type'] = 'application/json';
+            options.body = body.value;
+        }
+        send.disabled = true;
+        output.hidden = false;
+        try {
+            const response = await window.SachiApp.apiFetch(url, options);
+            const text = await response.text();
+            let shown = text;
+            try {
+                shown = JSON.stringify(JSON.parse(text), null, 2);
+            } catch (error) {
+                // not JSON; show as it is
+            }
+            output.textContent = response.status + ' ' + response.statusText +
+                '\nX-Request-ID: ' + (response.headers.get('X-Request-ID') || '') + '\n\n' + shown;
+        } catch (error) {
+            output.textContent = 'Request failed: ' + error.message;
+        } finally {
+            send.disabled = false;
+        }
+    });
+    return details;
+}
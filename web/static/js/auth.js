@@ -3,6 +3,7 @@
 document.addEventListener('DOMContentLoaded', function() {
     initializePasswordToggle();
     initializePasswordValidation();
+    initializePasswordPolicyHints();
     initializeForgotPassword();
     initializeSocialAuth();
 });
@@ -82,6 +83,68 @@ function initializePasswordValidation() {
     });
 }
 
+// Show the server's password requirements under every new-password field
+async function initializePasswordPolicyHints() {
+    const hints = document.querySelectorAll('[data-password-hint]');
+    if (!hints.length) return;
+
+    try {
+        const response = await fetch('/api/password-policy', { credentials: 'include' });
+        if (!response.ok) return;
+        const policy = await response.json();
+
+        const parts = [`At least ${policy.min_length} characters`];
+        if (policy.min_classes > 0) {
+            parts.push(`${policy.min_classes} of lowercase, uppercase, digits and symbols`);
+        }
+        parts.push('not your name or email');
+        if (policy.breached_check) {
+            parts.push('not a commonly used password');
+        }
+        hints.forEach(hint => {
+            hint.textContent = parts.join(', ') + '.';
+        });
+    } catch (error) {
+        // Hints are informational; the server enforces the policy either way
+    }
+}
+
+// The field-level details of an API error for one field, e.g. the unmet rules of a password
+function fieldErrors(data, field) {
+    return (data && data.fields || []).filter(f => f.field === field);
+}
+
+// Render the per-rule violations of a rejected password below its input. They are
+// cleared as soon as the user edits the field.
+function showPasswordViolations(input, violations) {
+    clearPasswordViolations(input);
+    if (!input || !violations || !violations.length) return;
+
+    const list = document.createElement('ul');
+    list.className = 'password-violations';
+    violations.forEach(v => {
+        const item = document.createElement('li');
+        item.dataset.rule = v.code;
+        item.textContent = v.message;
+        list.appendChild(item);
+    });
+    input.insertAdjacentElement('afterend', list);
+    input.classList.add('invalid');
+    input.setAttribute('aria-invalid', 'true');
+    input.addEventListener('input', () => clearPasswordViolations(input), { once: true });
+    input.focus();
+}
+
+function clearPasswordViolations(input) {
+    if (!input) return;
+    const next = input.nextElementSibling;
+    if (next && next.classList.contains('password-violations')) {
+        next.remove();
+    }
+    input.classList.remove('invalid');
+    input.removeAttribute('aria-invalid');
+}
+
 function initializeForgotPassword() {
     const forgotPasswordLink = document.querySelector('.forgot-password');
     const modal = document.getElementById('forgot-password-modal');
@@ -178,6 +241,15 @@ function initializeSocialAuth() {
     });
 }
 
+// Where to go after signing in: a same-site ?next= path (e.g. an OAuth authorization request) or the profile
+function postLoginPath() {
+    const next = new URLSearchParams(window.location.search).get('next');
+    if (next && next.startsWith('/') && !next.startsWith('//') && !next.startsWith('/\\')) {
+        return next;
+    }
+    return '/profile';
+}
+
 // Login form handling
 const loginForm = document.getElementById('login-form');
 if (loginForm) {
@@ -204,12 +276,11 @@ if (loginForm) {
         submitButton.disabled = true;
         
         try {
-            const response = await fetch('/api/login', {
+            const response = await window.SachiApp.apiFetch('/api/login', {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json'
                 },
-                credentials: 'include',
                 body: JSON.stringify({ email, password })
             });
 
@@ -219,8 +290,10 @@ if (loginForm) {
                 if (window.SachiApp && window.SachiApp.showNotification) {
                     window.SachiApp.showNotification('Login successful! Redirecting...', 'success');
                 }
+                // An admin-issued temporary password has to be replaced first
+                const target = data.user && data.user.must_change_password ? '/profile' : postLoginPath();
                 setTimeout(() => {
-                    window.location.href = '/profile';
+                    window.location.href = target;
                 }, 500);
             } else {
                 if (window.SachiApp && window.SachiApp.showNotification) {
@@ -238,6 +311,107 @@ if (loginForm) {
     });
 }
 
+// Single sign-on: route the user to their organization's identity provider by email domain
+const ssoButton = document.getElementById('sso-login');
+if (ssoButton) {
+    ssoButton.addEventListener('click', async function() {
+        const emailInput = document.querySelector('input[name="email"]');
+        const email = emailInput ? emailInput.value.trim() : '';
+
+        if (!email) {
+            if (window.SachiApp && window.SachiApp.showNotification) {
+                window.SachiApp.showNotification('Enter your work email to sign in with SSO.', 'error');
+            }
+            if (emailInput) emailInput.focus();
+            return;
+        }
+
+        try {
+            const response = await fetch('/api/sso/discover?email=' + encodeURIComponent(email) + '&next=' + encodeURIComponent(postLoginPath()), {
+                credentials: 'include'
+            });
+            const data = await response.json();
+
+            if (response.ok && data.success) {
+                window.location.href = data.login_url;
+            } else if (window.SachiApp && window.SachiApp.showNotification) {
+                window.SachiApp.showNotification(data.message || 'Single sign-on is not available for this email.', 'error');
+            }
+        } catch (error) {
+            if (window.SachiApp && window.SachiApp.showNotification) {
+                window.SachiApp.showNotification('Something went wrong. Please try again.', 'error');
+            }
+        }
+    });
+}
+
+// Passwordless sign-in: swap the password form for the sign-in link form
+const magicLinkForm = document.getElementById('magic-link-form');
+const magicLinkToggle = document.getElementById('magic-link-toggle');
+if (magicLinkForm && magicLinkToggle) {
+    const passwordViews = [document.getElementById('login-form'), document.getElementById('sso-login')];
+
+    function showMagicLinkForm(show) {
+        passwordViews.forEach(el => {
+            if (el) el.style.display = show ? 'none' : '';
+        });
+        magicLinkForm.style.display = show ? 'flex' : 'none';
+        magicLinkToggle.querySelector('span').textContent = show ? 'Sign in with a password instead' : 'Email me a sign-in link instead';
+        if (show) {
+            const passwordEmail = document.getElementById('email');
+            const magicEmail = document.getElementById('magic-email');
+            if (passwordEmail && passwordEmail.value && !magicEmail.value) {
+                magicEmail.value = passwordEmail.value;
+            }
+            magicEmail.focus();
+        }
+    }
+
+    magicLinkToggle.addEventListener('click', function() {
+        showMagicLinkForm(magicLinkForm.style.display === 'none');
+    });
+    if (new URLSearchParams(window.location.search).get('method') === 'link') {
+        showMagicLinkForm(true);
+    }
+
+    magicLinkForm.addEventListener('submit', async function(e) {
+        e.preventDefault();
+
+        const email = new FormData(this).get('email');
+        const submitButton = this.querySelector('.btn');
+        const originalHTML = submitButton.innerHTML;
+        submitButton.innerHTML = '<span class="spinner"></span> Sending...';
+        submitButton.disabled = true;
+
+        try {
+            const response = await window.SachiApp.apiFetch('/api/login/magic', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json'
+                },
+                body: JSON.stringify({ email, next: postLoginPath() })
+            });
+            const data = await response.json();
+
+            if (response.ok && data.success) {
+                document.getElementById('magic-link-sent').hidden = false;
+                if (window.SachiApp && window.SachiApp.showNotification) {
+                    window.SachiApp.showNotification(data.message, 'success');
+                }
+            } else if (window.SachiApp && window.SachiApp.showNotification) {
+                window.SachiApp.showNotification(data.message || 'Could not send a sign-in link. Please try again.', 'error');
+            }
+        } catch (error) {
+            if (window.SachiApp && window.SachiApp.showNotification) {
+                window.SachiApp.showNotification('Something went wrong. Please try again.', 'error');
+            }
+        } finally {
+            submitButton.innerHTML = originalHTML;
+            submitButton.disabled = false;
+        }
+    });
+}
+
 // Register form handling
 const registerForm = document.getElementById('register-form');
 if (registerForm) {
@@ -266,12 +440,11 @@ if (registerForm) {
         submitButton.disabled = true;
         
         try {
-            const response = await fetch('/api/register', {
+            const response = await window.SachiApp.apiFetch('/api/register', {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json'
                 },
-                credentials: 'include',
                 body: JSON.stringify({ name, email, company, password })
             });
 
@@ -285,6 +458,7 @@ if (registerForm) {
                     window.location.href = '/login.html';
                 }, 1500);
             } else {
+                showPasswordViolations(this.querySelector('input[name="password"]'), fieldErrors(data, 'password'));
                 if (window.SachiApp && window.SachiApp.showNotification) {
                     window.SachiApp.showNotification(data.message || 'Something went wrong. Please try again.', 'error');
                 }
@@ -317,4 +491,14 @@ document.addEventListener('DOMContentLoaded', function() {
         // Store selected plan for later use
         sessionStorage.setItem('selectedPlan', plan);
     }
+
+    const errorMessages = {
+        sso_failed: 'Single sign-on failed. Please try again or contact your administrator.',
+        magic_link_invalid: 'This sign-in link is invalid, expired or already used. Please request a new one.',
+        magic_link_browser: 'Open the sign-in link in the same browser you requested it from, or request a new one here.'
+    };
+    const errorMessage = errorMessages[urlParams.get('error')];
+    if (errorMessage && window.SachiApp && window.SachiApp.showNotification) {
+        window.SachiApp.showNotification(errorMessage, 'error');
+    }
 });
@@ -0,0 +1,83 @@
+// OAuth consent screen: shows what a third-party application asks for and posts the user's decision
+
+document.addEventListener('DOMContentLoaded', async function() {
+    const params = new URLSearchParams(window.location.search);
+    const description = document.getElementById('consent-description');
+
+    function showError(message) {
+        description.textContent = message;
+        if (window.SachiApp && window.SachiApp.showNotification) {
+            window.SachiApp.showNotification(message, 'error');
+        }
+    }
+
+    let info;
+    try {
+        const response = await fetch('/api/oauth/consent?' + params.toString(), {
+            credentials: 'include'
+        });
+        if (response.status === 401) {
+            window.location.href = '/login.html?next=' + encodeURIComponent(window.location.pathname + window.location.search);
+            return;
+        }
+        info = await response.json();
+        if (!response.ok || !info.success) {
+            showError(info.message || 'This authorization request is invalid.');
+            return;
+        }
+    } catch (error) {
+        showError('Something went wrong. Please try again.');
+        return;
+    }
+
+    document.getElementById('client-name').textContent = info.client.name;
+    document.getElementById('redirect-host').textContent = info.redirect_host;
+    document.getElementById('user-email').textContent = info.user.email;
+    description.textContent = info.client.name + ' is requesting access to your Sachi account.';
+
+    const list = document.getElementById('consent-scopes');
+    info.scopes.forEach(scope => {
+        const item = document.createElement('li');
+        item.textContent = scope.description;
+        list.appendChild(item);
+    });
+    document.getElementById('consent-body').style.display = 'flex';
+
+    async function decide(approve, button) {
+        button.disabled = true;
+        try {
+            const response = await window.SachiApp.apiFetch('/api/oauth/consent', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json'
+                },
+                body: JSON.stringify({
+                    client_id: params.get('client_id') || '',
+                    redirect_uri: params.get('redirect_uri') || '',
+                    response_type: params.get('response_type') || '',
+                    scope: params.get('scope') || '',
+                    state: params.get('state') || '',
+                    code_challenge: params.get('code_challenge') || '',
+                    code_challenge_method: params.get('code_challenge_method') || '',
+                    approve: approve
+                })
+            });
+            const data = await response.json();
+            if (response.ok && data.success) {
+                window.location.href = data.redirect_url;
+                return;
+            }
+            showError(data.message || 'Something went wrong. Please try again.');
+        } catch (error) {
+            showError('Something went wrong. Please try again.');
+        }
+        button.disabled = false;
+    }
+
+    document.getElementById('consent-allow').addEventListener('click', function() {
+        decide(true, this);
+    });
+    document.getElementById('consent-deny').addEventListener('click', function() {
+        decide(false, this);
+    });
+});
@@ -49,11 +49,78 @@ window.SachiApp = {
                 };
 
                 setTimeout(hide, 4000);
+        },
+
+        // CSRF token cache; fetched lazily from /api/csrf
+        csrfToken: null,
+
+        getCsrfToken: async function(refresh = false) {
+                if (this.csrfToken && !refresh) {
+                        return this.csrfToken;
+                }
+                const response = await fetch('/api/csrf', { credentials: 'include' });
+                const data = await response.json();
+                this.csrfToken = data.csrf_token;
+                return this.csrfToken;
+        },
+
+        // fetch wrapper for API calls: sends cookies and attaches the CSRF header
+        // to state-changing requests, retrying once with a fresh token on 403
+        apiFetch: async function(url, options = {}) {
+                const method = (options.method || 'GET').toUpperCase();
+                const send = async (refresh) => {
+                        const headers = Object.assign({}, options.headers);
+                        if (!['GET', 'HEAD', 'OPTIONS'].includes(method)) {
+                                headers['X-CSRF-Token'] = await this.getCsrfToken(refresh);
+                        }
+                        return fetch(url, Object.assign({ credentials: 'include' }, options, { headers }));
+                };
+
+                let response = await send(false);
+                if (response.status === 403 && !['GET', 'HEAD', 'OPTIONS'].includes(method)) {
+                        response = await send(true);
+                }
+                return response;
         }
 };
 
+// The signed-in user the server rendered into the page (as /api/me returns it), null for guests
+window.SachiApp.currentUser = (function() {
+    const el = document.getElementById('current-user');
+    return el ? JSON.parse(el.textContent) : null;
+})();
+
+// Logout button in the navigation of signed-in pages
+async function handleLogout(e) {
+    e.preventDefault();
+
+    try {
+        const response = await window.SachiApp.apiFetch('/api/logout', {
+            method: 'POST'
+        });
+
+        if (response.ok) {
+            window.SachiApp.showNotification('Logged out successfully', 'success');
+            setTimeout(() => {
+                window.location.href = '/';
+            }, 1000);
+        } else {
+            // Even if logout fails on server, clear local state
+            window.location.href = '/';
+        }
+    } catch (error) {
+        console.error('Logout failed:', error);
+        window.location.href = '/';
+    }
+}
+
 // Mobile navigation toggle
 document.addEventListener('DOMContentLoaded', function() {
+    const logoutBtn = document.getElementById('logout-btn');
+    if (logoutBtn) {
+        logoutBtn.addEventListener('click', handleLogout);
+    }
+
     const navToggle = document.getElementById('nav-toggle');
     const navMenu = document.getElementById('nav-menu');
     
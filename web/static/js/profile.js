@@ -9,38 +9,21 @@ document.addEventListener('DOMContentLoaded', function() {
     })();
 });
 
-// Check if user is authenticated
+// The server renders the signed-in user into the page; without one, sign in first
 async function checkAuthentication() {
-    try {
-        const response = await fetch('/api/me', { credentials: 'include' });
-        if (!response.ok) {
-            // User not authenticated, redirect to login
-            window.location.href = '/login.html';
-            return false;
-        }
-        // Ensure JSON response
-        const contentType = response.headers.get('content-type') || '';
-        if (!contentType.includes('application/json')) {
-            window.location.href = '/login.html';
-            return false;
-        }
-        // Cache user info to avoid a second request
-        const data = await response.json();
-        window.__ME = data.user;
-        return true;
-    } catch (error) {
-        console.error('Authentication check failed:', error);
+    if (!window.SachiApp.currentUser) {
         window.location.href = '/login.html';
         return false;
     }
+    window.__ME = window.SachiApp.currentUser;
+    return true;
 }
 
-// Load user profile data
-async function loadUserProfile() {
+// Show the user's profile data, fetching it again after a change when refresh is set
+async function loadUserProfile(refresh = false) {
     try {
-        // Use cached user from checkAuthentication if available
         let user = window.__ME;
-        if (!user) {
+        if (!user || refresh) {
             const response = await fetch('/api/me', { credentials: 'include' });
             if (response.status === 401) {
                 window.location.href = '/login.html';
@@ -54,7 +37,7 @@ async function loadUserProfile() {
                 throw new Error('Unexpected response');
             }
             const data = await response.json();
-            user = data.user;
+            user = window.__ME = data.user;
         }
 
         // Update profile display
@@ -67,15 +50,53 @@ async function loadUserProfile() {
         document.getElementById('display-email').textContent = user.email;
         document.getElementById('display-company').textContent = user.company || 'No company specified';
 
-        // Generate avatar initials
-        const initials = user.name.split(' ').map(n => n[0]).join('').toUpperCase().substring(0, 2);
-        document.getElementById('avatar').textContent = initials;
+        // Show the picture, or initials when there is none
+        const avatar = document.getElementById('avatar');
+        if (user.avatar_url) {
+            const img = document.createElement('img');
+            img.src = user.avatar_url;
+            img.alt = user.name;
+            avatar.replaceChildren(img);
+        } else {
+            avatar.textContent = user.name.split(' ').map(n => n[0]).join('').toUpperCase().substring(0, 2);
+        }
+        document.getElementById('avatar-remove-btn').style.display = user.avatar_url ? 'inline-flex' : 'none';
 
         // Populate edit form
         document.getElementById('edit-name').value = user.name;
         document.getElementById('edit-email').value = user.email;
         document.getElementById('edit-company').value = user.company || '';
 
+        // Deletion re-confirms with the password, or the email for accounts without one
+        document.getElementById('delete-password-group').style.display = user.has_password ? 'block' : 'none';
+        document.getElementById('delete-confirm-group').style.display = user.has_password ? 'none' : 'block';
+
+        // Scheduled deletion notice
+        const banner = document.getElementById('deletion-banner');
+        if (user.delete_at) {
+            const when = new Date(user.delete_at).toLocaleDateString(undefined, { dateStyle: 'long' });
+            document.getElementById('deletion-banner-text').textContent = `Your account is scheduled for deletion on ${when}.`;
+            banner.style.display = 'flex';
+            document.getElementById('delete-account-display').style.display = 'none';
+        } else {
+            banner.style.display = 'none';
+            document.getElementById('delete-account-display').style.display = 'block';
+        }
+
+        // An administrator acting as this user
+        document.getElementById('impersonation-banner').style.display = user.impersonator ? 'flex' : 'none';
+        if (user.impersonator) {
+            document.getElementById('impersonation-banner-text').textContent =
+                `You are signed in as ${user.email} on behalf of ${user.impersonator.email || 'a deleted administrator'}.`;
+        }
+
+        // A temporary password has to be replaced before anything else works
+        if (user.must_change_password) {
+            document.getElementById('password-required').style.display = 'block';
+            document.getElementById('password-display').style.display = 'none';
+            document.getElementById('change-password-form').style.display = 'block';
+        }
+
     } catch (error) {
         console.error('Failed to load profile:', error);
         if (window.SachiApp && window.SachiApp.showNotification) {
@@ -114,6 +135,7 @@ function initializeProfileHandlers() {
         document.getElementById('change-password-form').style.display = 'none';
         document.getElementById('password-display').style.display = 'block';
         document.getElementById('password-form').reset();
+        clearPasswordViolations(document.getElementById('new-password'));
     });
 
     // Profile form submission
@@ -122,8 +144,34 @@ function initializeProfileHandlers() {
     // Password form submission
     document.getElementById('password-form').addEventListener('submit', handlePasswordChange);
 
-    // Logout button
-    document.getElementById('logout-btn').addEventListener('click', handleLogout);
+    // Profile picture
+    document.getElementById('avatar-upload-btn').addEventListener('click', function() {
+        document.getElementById('avatar-input').click();
+    });
+    document.getElementById('avatar-input').addEventListener('change', handleAvatarUpload);
+    document.getElementById('avatar-remove-btn').addEventListener('click', handleAvatarRemove);
+
+    // Delete account button
+    document.getElementById('delete-account-btn').addEventListener('click', function() {
+        document.getElementById('delete-account-display').style.display = 'none';
+        document.getElementById('delete-account-form').style.display = 'block';
+    });
+
+    // Cancel delete account
+    document.getElementById('cancel-delete-btn').addEventListener('click', function() {
+        document.getElementById('delete-account-form').style.display = 'none';
+        document.getElementById('delete-account-display').style.display = 'block';
+        document.getElementById('delete-form').reset();
+    });
+
+    // Delete account form submission
+    document.getElementById('delete-form').addEventListener('submit', handleAccountDelete);
+
+    // Keep an account scheduled for deletion
+    document.getElementById('cancel-deletion-btn').addEventListener('click', handleCancelDeletion);
+
+    // Return to the administrator's own session
+    document.getElementById('stop-impersonation-btn').addEventListener('click', handleStopImpersonation);
 }
 
 // Handle profile update
@@ -149,12 +197,11 @@ async function handleProfileUpdate(e) {
         submitButton.innerHTML = '<span class="spinner"></span> Saving...';
         submitButton.disabled = true;
 
-        const response = await fetch('/api/profile', {
+        const response = await window.SachiApp.apiFetch('/api/profile', {
             method: 'PUT',
             headers: {
                 'Content-Type': 'application/json'
             },
-            credentials: 'include',
             body: JSON.stringify({ name, email, company })
         });
 
@@ -166,7 +213,7 @@ async function handleProfileUpdate(e) {
             }
             document.getElementById('edit-profile-form').style.display = 'none';
             document.getElementById('profile-display').style.display = 'block';
-            loadUserProfile(); // Reload updated data
+            loadUserProfile(true); // Reload updated data
         } else {
             if (window.SachiApp && window.SachiApp.showNotification) {
                 window.SachiApp.showNotification(data.message || 'Failed to update profile', 'error');
@@ -206,13 +253,6 @@ async function handlePasswordChange(e) {
         return;
     }
 
-    if (newPassword.length < 6) {
-        if (window.SachiApp && window.SachiApp.showNotification) {
-            window.SachiApp.showNotification('New password must be at least 6 characters long', 'error');
-        }
-        return;
-    }
-
     const submitButton = e.target.querySelector('button[type="submit"]');
     const originalText = submitButton.textContent;
 
@@ -220,12 +260,11 @@ async function handlePasswordChange(e) {
         submitButton.innerHTML = '<span class="spinner"></span> Changing...';
         submitButton.disabled = true;
 
-        const response = await fetch('/api/change-password', {
+        const response = await window.SachiApp.apiFetch('/api/change-password', {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json'
             },
-            credentials: 'include',
             body: JSON.stringify({ currentPassword, newPassword })
         });
 
@@ -237,8 +276,11 @@ async function handlePasswordChange(e) {
             }
             document.getElementById('change-password-form').style.display = 'none';
             document.getElementById('password-display').style.display = 'block';
+            document.getElementById('password-required').style.display = 'none';
             document.getElementById('password-form').reset();
+            window.__ME.must_change_password = false;
         } else {
+            showPasswordViolations(e.target.querySelector('input[name="newPassword"]'), fieldErrors(data, 'newPassword'));
             if (window.SachiApp && window.SachiApp.showNotification) {
                 window.SachiApp.showNotification(data.message || 'Failed to change password', 'error');
             }
@@ -254,29 +296,178 @@ async function handlePasswordChange(e) {
     }
 }
 
-// Handle logout
-async function handleLogout(e) {
+// Handle profile picture upload
+async function handleAvatarUpload(e) {
+    const file = e.target.files[0];
+    e.target.value = '';
+    if (!file) return;
+
+    if (file.size > 2 * 1024 * 1024) {
+        if (window.SachiApp && window.SachiApp.showNotification) {
+            window.SachiApp.showNotification('Pictures can be at most 2 MB', 'error');
+        }
+        return;
+    }
+
+    const button = document.getElementById('avatar-upload-btn');
+    const originalText = button.textContent;
+
+    try {
+        button.innerHTML = '<span class="spinner"></span> Uploading...';
+        button.disabled = true;
+
+        const body = new FormData();
+        body.append('avatar', file);
+        const response = await window.SachiApp.apiFetch('/api/account/avatar', {
+            method: 'POST',
+            body
+        });
+
+        const data = await response.json();
+
+        if (response.ok && data.success) {
+            window.__ME.avatar_url = data.avatar_url;
+            loadUserProfile();
+        } else if (window.SachiApp && window.SachiApp.showNotification) {
+            window.SachiApp.showNotification(data.message || 'Failed to upload picture', 'error');
+        }
+    } catch (error) {
+        console.error('Picture upload failed:', error);
+        if (window.SachiApp && window.SachiApp.showNotification) {
+            window.SachiApp.showNotification('Failed to upload picture', 'error');
+        }
+    } finally {
+        button.textContent = originalText;
+        button.disabled = false;
+    }
+}
+
+// Handle profile picture removal
+async function handleAvatarRemove(e) {
     e.preventDefault();
 
     try {
-    const response = await fetch('/api/logout', {
-            method: 'POST'
+        const response = await window.SachiApp.apiFetch('/api/account/avatar', {
+            method: 'DELETE'
         });
 
-        if (response.ok) {
+        const data = await response.json();
+
+        if (response.ok && data.success) {
+            window.__ME.avatar_url = null;
+            loadUserProfile();
+        } else if (window.SachiApp && window.SachiApp.showNotification) {
+            window.SachiApp.showNotification(data.message || 'Failed to remove picture', 'error');
+        }
+    } catch (error) {
+        console.error('Picture removal failed:', error);
+        if (window.SachiApp && window.SachiApp.showNotification) {
+            window.SachiApp.showNotification('Failed to remove picture', 'error');
+        }
+    }
+}
+
+// Handle account deletion
+async function handleAccountDelete(e) {
+    e.preventDefault();
+
+    const formData = new FormData(e.target);
+    const password = formData.get('password') || '';
+    const confirm = formData.get('confirm') || '';
+
+    if (!window.confirm('Delete your account? You will be signed out everywhere.')) {
+        return;
+    }
+
+    const submitButton = e.target.querySelector('button[type="submit"]');
+    const originalText = submitButton.textContent;
+
+    try {
+        submitButton.innerHTML = '<span class="spinner"></span> Deleting...';
+        submitButton.disabled = true;
+
+        const response = await window.SachiApp.apiFetch('/api/account/delete', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ password, confirm })
+        });
+
+        const data = await response.json();
+
+        if (response.ok && data.success) {
             if (window.SachiApp && window.SachiApp.showNotification) {
-                window.SachiApp.showNotification('Logged out successfully', 'success');
+                window.SachiApp.showNotification(data.message, 'success');
             }
             setTimeout(() => {
                 window.location.href = '/';
-            }, 1000);
+            }, 3000);
         } else {
-            // Even if logout fails on server, clear local state
-            window.location.href = '/';
+            if (window.SachiApp && window.SachiApp.showNotification) {
+                window.SachiApp.showNotification(data.message || 'Failed to delete account', 'error');
+            }
+            submitButton.textContent = originalText;
+            submitButton.disabled = false;
         }
     } catch (error) {
-        console.error('Logout failed:', error);
-        // Even if logout fails, redirect to login
-        window.location.href = '/';
+        console.error('Account deletion failed:', error);
+        if (window.SachiApp && window.SachiApp.showNotification) {
+            window.SachiApp.showNotification('Failed to delete account', 'error');
+        }
+        submitButton.textContent = originalText;
+        submitButton.disabled = false;
+    }
+}
+
+// Handle cancelling a scheduled deletion
+async function handleCancelDeletion(e) {
+    e.preventDefault();
+
+    try {
+        const response = await window.SachiApp.apiFetch('/api/account/delete/cancel', {
+            method: 'POST'
+        });
+
+        const data = await response.json();
+
+        if (response.ok && data.success) {
+            if (window.SachiApp && window.SachiApp.showNotification) {
+                window.SachiApp.showNotification('Your account will not be deleted', 'success');
+            }
+            window.__ME.delete_at = null;
+            loadUserProfile();
+        } else if (window.SachiApp && window.SachiApp.showNotification) {
+            window.SachiApp.showNotification(data.message || 'Failed to cancel account deletion', 'error');
+        }
+    } catch (error) {
+        console.error('Cancelling account deletion failed:', error);
+        if (window.SachiApp && window.SachiApp.showNotification) {
+            window.SachiApp.showNotification('Failed to cancel account deletion', 'error');
+        }
+    }
+}
+
+// Handle ending an impersonation
+async function handleStopImpersonation(e) {
+    e.preventDefault();
+
+    try {
+        const response = await window.SachiApp.apiFetch('/api/impersonation/stop', {
+            method: 'POST'
+        });
+
+        const data = await response.json();
+
+        if (response.ok && data.success) {
+            window.location.href = data.redirect;
+        } else if (window.SachiApp && window.SachiApp.showNotification) {
+            window.SachiApp.showNotification(data.message || 'Failed to stop impersonating', 'error');
+        }
+    } catch (error) {
+        console.error('Stopping impersonation failed:', error);
+        if (window.SachiApp && window.SachiApp.showNotification) {
+            window.SachiApp.showNotification('Failed to stop impersonating', 'error');
+        }
     }
 }
@@ -0,0 +1,63 @@
+// Package static embeds the frontend (pages, stylesheets and scripts) so the binary can be
+// run from any directory.
+package static
+
+//go:generate go run ./internal/assetgen css js images fonts
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+)
+
+// FS holds the page templates at its root, their layouts and partials in templates, the css
+// and js directories, and what go generate precomputed for them in precomputed
+//
+//go:embed *.html css js templates precomputed
+var FS embed.FS
+
+// AssetDirs are the directories served as files; pages are rendered from templates. Keep the
+// list in step with the go:generate line above.
+var AssetDirs = []string{"css", "js", "images", "fonts"}
+
+// PrecomputedDir holds manifest.json and the compressed variants, e.g. css/ui.css.br
+const PrecomputedDir = "precomputed"
+
+// Asset is a file under AssetDirs as described by the manifest go generate writes
+type Asset struct {
+	Path        string `json:"path"`       // request path, e.g. /css/ui.css
+	HashedPath  string `json:"hashedPath"` // path with a content hash before the extension
+	ContentType string `json:"contentType"`
+	ETag        string `json:"etag"`             // strong ETag of the uncompressed content, quoted
+	Gzip        bool   `json:"gzip,omitempty"`   // PrecomputedDir holds the file with .gz added
+	Brotli      bool   `json:"brotli,omitempty"` // and with .br added
+}
+
+// ETag returns the strong ETag go generate gives a file with this content
+func ETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+}
+
+// Manifest reads the embedded manifest. It fails when a file was changed after go generate
+// last ran, since its ETag and compressed variants would describe the old content.
+func Manifest() ([]Asset, error) {
+	data, err := fs.ReadFile(FS, PrecomputedDir+"/manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	var assets []Asset
+	if err := json.Unmarshal(data, &assets); err != nil {
+		return nil, fmt.Errorf("invalid asset manifest: %v", err)
+	}
+	for _, a := range assets {
+		data, err := fs.ReadFile(FS, a.Path[1:])
+		if err != nil || ETag(data) != a.ETag {
+			return nil, fmt.Errorf("asset manifest is out of date at %s; run go generate ./web/static", a.Path)
+		}
+	}
+	return assets, nil
+}
@@ -0,0 +1,87 @@
+package static
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// TestManifestUpToDate fails when a file under AssetDirs changed, appeared or went away
+// without go generate being run again
+func TestManifestUpToDate(t *testing.T) {
+	assets, err := Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := map[string]Asset{}
+	for _, a := range assets {
+		listed[a.Path] = a
+	}
+
+	disk := os.DirFS(".")
+	for _, dir := range AssetDirs {
+		err := fs.WalkDir(disk, dir, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			a, ok := listed["/"+name]
+			if !ok {
+				t.Errorf("%s is not in the manifest; run go generate", name)
+				return nil
+			}
+			delete(listed, a.Path)
+			data, err := fs.ReadFile(disk, name)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(data)
+			if ETag(data) != a.ETag || !strings.Contains(a.HashedPath, "."+hex.EncodeToString(sum[:6])+".") {
+				t.Errorf("%s: manifest has %s %s; run go generate", name, a.ETag, a.HashedPath)
+			}
+			checkVariant(t, a.Gzip, name+".gz", data, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) })
+			checkVariant(t, a.Brotli, name+".br", data, func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil })
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+	}
+	for p := range listed {
+		t.Errorf("%s is in the manifest but not on disk; run go generate", p)
+	}
+}
+
+// checkVariant checks that a compressed variant exists when the manifest says so and
+// decompresses to the current content
+func checkVariant(t *testing.T, listed bool, name string, want []byte, decompress func(io.Reader) (io.Reader, error)) {
+	t.Helper()
+	compressed, err := fs.ReadFile(FS, PrecomputedDir+"/"+name)
+	if !listed {
+		if err == nil {
+			t.Errorf("%s is embedded but not in the manifest", name)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	r, err := decompress(bytes.NewReader(compressed))
+	if err == nil {
+		var got []byte
+		if got, err = io.ReadAll(r); err == nil && !bytes.Equal(got, want) {
+			t.Errorf("%s does not decompress to the current file; run go generate", name)
+		}
+	}
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+	}
+}